@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"event_sourcing_golang/eventstore/archive"
+)
+
+// archiveEvents moves the events covered by old snapshots to the -archive directory
+func archiveEvents(ctx context.Context, app *app, args []string) error {
+	fs := flag.NewFlagSet("archive", flag.ContinueOnError)
+	retention := fs.Duration("retention", 30*24*time.Hour, "age of the latest snapshot before the events it covers are archived")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if app.archive == nil {
+		return errors.New("archive needs -archive to write the segments")
+	}
+
+	n, err := archive.NewArchiver(app.store, app.archive, archive.WithRetention(*retention)).Run(ctx)
+	fmt.Fprintf(os.Stderr, "archived %d events\n", n)
+	return err
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// pageSize is the number of aggregates read at once when listing them
+const pageSize = 500
+
+type aggregateLine struct {
+	ID      string `json:"id"`
+	Type    string `json:"type"`
+	Version int    `json:"version"`
+}
+
+// snapshotLine is a snapshot, a stale one has no state as it can't be decoded
+type snapshotLine struct {
+	AggregateID string                  `json:"aggregate_id"`
+	Version     int                     `json:"version"`
+	CreatedAt   int64                   `json:"created_at"`
+	Schema      string                  `json:"schema"`
+	Stale       bool                    `json:"stale,omitempty"`
+	State       eventsourcing.Aggregate `json:"state,omitempty"`
+}
+
+type stateLine struct {
+	AggregateID   string                  `json:"aggregate_id"`
+	AggregateType string                  `json:"aggregate_type"`
+	Version       int                     `json:"version"`
+	State         eventsourcing.Aggregate `json:"state"`
+}
+
+func listAggregates(ctx context.Context, app *app, args []string) error {
+	fs := flag.NewFlagSet("aggregates", flag.ContinueOnError)
+	aggType := fs.String("type", "", "only list aggregates of this type")
+	after := fs.String("after", "", "only list aggregates with a greater id")
+	limit := fs.Int("limit", 0, "maximum number of aggregates, 0 lists all of them")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	return eachAggregate(ctx, app.store, *aggType, *after, *limit, func(info repos.AggregateInfo) error {
+		return app.out.Encode(aggregateLine{ID: info.ID, Type: info.Type, Version: info.Version})
+	})
+}
+
+func dumpEvents(ctx context.Context, app *app, args []string) error {
+	fs := flag.NewFlagSet("events", flag.ContinueOnError)
+	from := fs.Int("from", 0, "only dump events with a greater version")
+	id, err := singleArg(fs, args, "aggregate id")
+	if err != nil {
+		return err
+	}
+	if _, err := app.store.AggregateVersion(ctx, id); err != nil {
+		return err
+	}
+
+	for e, err := range app.store.Events(ctx, id, *from) {
+		if err != nil {
+			return err
+		}
+		if err := app.out.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dumpSnapshots(ctx context.Context, app *app, args []string) error {
+	fs := flag.NewFlagSet("snapshots", flag.ContinueOnError)
+	id, err := singleArg(fs, args, "aggregate id")
+	if err != nil {
+		return err
+	}
+	aggType, err := aggregateType(ctx, app.store, id)
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := app.store.Snapshots(ctx, id)
+	if err != nil {
+		return err
+	}
+	for _, meta := range snapshots {
+		agg, err := newAggregate(aggType)
+		if err != nil {
+			return err
+		}
+		line := snapshotLine{AggregateID: id, Version: meta.Version, CreatedAt: meta.CreatedAt.Unix(), Schema: meta.Schema}
+		switch err := app.store.ReadSnapshotAt(ctx, id, meta.Version, agg); {
+		case errors.Is(err, repos.ErrSnapshotStale):
+			line.Stale = true
+		case err != nil:
+			return err
+		default:
+			line.State = agg
+		}
+
+		if err := app.out.Encode(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func printState(ctx context.Context, app *app, args []string) error {
+	fs := flag.NewFlagSet("state", flag.ContinueOnError)
+	version := fs.Int("version", 0, "version to rehydrate, 0 is the current version")
+	id, err := singleArg(fs, args, "aggregate id")
+	if err != nil {
+		return err
+	}
+	aggType, err := aggregateType(ctx, app.store, id)
+	if err != nil {
+		return err
+	}
+	agg, err := newAggregate(aggType)
+	if err != nil {
+		return err
+	}
+
+	as := eventstore.NewAggregateStore(app.repos)
+	if *version > 0 {
+		err = as.GetAtVersion(ctx, id, *version, agg)
+	} else {
+		err = as.Get(ctx, id, agg)
+	}
+	if err != nil {
+		return err
+	}
+
+	return app.out.Encode(stateLine{AggregateID: id, AggregateType: aggType, Version: agg.Root().Version(), State: agg})
+}
+
+// eachAggregate calls fn with up to limit aggregates of aggType after the given id, all of them when limit is 0
+func eachAggregate(ctx context.Context, store repos.EventStore, aggType, after string, limit int,
+	fn func(repos.AggregateInfo) error) error {
+	for n := 0; limit == 0 || n < limit; {
+		size := pageSize
+		if limit > 0 {
+			size = min(size, limit-n)
+		}
+		page, err := store.Aggregates(ctx, aggType, after, size)
+		if err != nil {
+			return err
+		}
+
+		for _, info := range page {
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+		if len(page) < size {
+			return nil
+		}
+		n += len(page)
+		after = page[len(page)-1].ID
+	}
+	return nil
+}
+
+// aggregateType returns the type of a stored aggregate, read from its first event
+func aggregateType(ctx context.Context, store repos.EventStore, id string) (string, error) {
+	if _, err := store.AggregateVersion(ctx, id); err != nil {
+		return "", err
+	}
+	for e, err := range store.Events(ctx, id, 0) {
+		if err != nil {
+			return "", err
+		}
+		return e.AggregateType, nil
+	}
+	return "", fmt.Errorf("aggregate id=%s has no event", id)
+}
@@ -0,0 +1,210 @@
+// Command esctl inspects, verifies, exports and imports an event store and regenerates its stale snapshots.
+// Output is NDJSON, one object per line:
+//
+//	esctl -driver sqlite -dsn es.db aggregates [-type BankAccount] [-after id] [-limit n]
+//	esctl -driver sqlite -dsn es.db events [-from version] <aggregate-id>
+//	esctl -driver sqlite -dsn es.db snapshots <aggregate-id>
+//	esctl -driver sqlite -dsn es.db state [-version v] <aggregate-id>
+//	esctl -driver sqlite -dsn es.db verify [-type BankAccount] [aggregate-id ...]
+//	esctl -driver sqlite -dsn es.db export [-from position] > events.ndjson
+//	esctl -driver sqlite -dsn es.db -keys keys import [-name checkpoint] events.ndjson
+//	esctl -driver sqlite -dsn es.db -keys keys regenerate [-type BankAccount]
+//	esctl -driver sqlite -dsn es.db -archive segments archive [-retention 720h]
+//
+// Personal data is printed as redacted unless -keys points to the directory of the file key store.
+// With -archive, the events moved to the archive directory are read back like the events still stored.
+// verify exits with status 1 when it finds an issue.
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+
+	"event_sourcing_golang/eventstore/archive"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/example/bank"
+	"event_sourcing_golang/pkg/eventsourcing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// aggregateTypes are the aggregates esctl can decode, register the aggregates of new domains here
+var aggregateTypes = []eventsourcing.Aggregate{
+	&bank.BankAccount{},
+	&bank.Transfer{},
+}
+
+// errIssues makes esctl exit with status 1 after printing the issues found
+var errIssues = errors.New("issues found")
+
+type command struct {
+	usage string
+	run   func(ctx context.Context, app *app, args []string) error
+}
+
+var commands = map[string]command{
+	"aggregates": {"aggregates [-type T] [-after id] [-limit n]", listAggregates},
+	"events":     {"events [-from version] <aggregate-id>", dumpEvents},
+	"snapshots":  {"snapshots <aggregate-id>", dumpSnapshots},
+	"state":      {"state [-version v] <aggregate-id>", printState},
+	"verify":     {"verify [-type T] [aggregate-id ...]", verify},
+	"export":     {"export [-from position]", exportEvents},
+	"import":     {"import [-name checkpoint] <file>", importEvents},
+	"regenerate": {"regenerate [-type T]", regenerateSnapshots},
+	"archive":    {"archive [-retention d]", archiveEvents},
+}
+
+type app struct {
+	db    *gorm.DB
+	repos repos.Repos
+	store repos.EventStore
+	w     io.Writer
+	out   *json.Encoder
+	// redacted is set without -keys, the personal data read is redacted
+	redacted bool
+	// archive is the archive of the -archive directory, nil without it
+	archive *archive.Store
+}
+
+func main() {
+	driver := flag.String("driver", "sqlite", "database driver: sqlite, mysql or postgres")
+	dsn := flag.String("dsn", "", "database DSN")
+	keys := flag.String("keys", "", "directory of the file key store, personal data is redacted without it")
+	archiveDir := flag.String("archive", "", "directory of the archived event segments")
+	flag.Usage = usage
+	flag.Parse()
+
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok || *dsn == "" {
+		usage()
+		os.Exit(2)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	app, err := newApp(*driver, *dsn, *keys, *archiveDir, out)
+	if err == nil {
+		err = cmd.run(context.Background(), app, flag.Args()[1:])
+	}
+	if ferr := out.Flush(); err == nil {
+		err = ferr
+	}
+
+	switch {
+	case errors.Is(err, errIssues):
+		os.Exit(1)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "esctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: esctl -driver sqlite|mysql|postgres -dsn DSN [-keys dir] <command>")
+	for _, name := range []string{"aggregates", "events", "snapshots", "state", "verify", "export", "import", "regenerate", "archive"} {
+		fmt.Fprintf(os.Stderr, "  %s\n", commands[name].usage)
+	}
+	flag.PrintDefaults()
+}
+
+func newApp(driver, dsn, keysDir, archiveDir string, out *bufio.Writer) (*app, error) {
+	db, err := openDB(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	s := eventsourcing.NewSerializer()
+	for _, agg := range aggregateTypes {
+		if err := s.RegisterAggregate(agg); err != nil {
+			return nil, fmt.Errorf("register aggregate err=%w", err)
+		}
+	}
+	for _, c := range []eventsourcing.Codec{eventsourcing.MsgpackCodec(), eventsourcing.ProtobufCodec()} {
+		if err := s.RegisterCodec(c); err != nil {
+			return nil, fmt.Errorf("register codec err=%w", err)
+		}
+	}
+
+	// an empty key store redacts the personal data instead of printing its ciphertext
+	ks := eventsourcing.NewInMemoryKeyStore()
+	if keysDir != "" {
+		if ks, err = eventsourcing.NewFileKeyStore(keysDir); err != nil {
+			return nil, err
+		}
+	}
+	s.UseKeyStore(ks)
+
+	var opts []repos.Option
+	var store *archive.Store
+	if archiveDir != "" {
+		blobs, err := archive.NewFileBlobStore(archiveDir)
+		if err != nil {
+			return nil, err
+		}
+		store = archive.NewStore(blobs)
+		opts = append(opts, repos.WithArchive(store))
+	}
+
+	r := repos.New(db, s, opts...)
+	return &app{
+		db:       db,
+		repos:    r,
+		store:    r.EventStore(),
+		w:        out,
+		out:      json.NewEncoder(out),
+		redacted: keysDir == "",
+		archive:  store,
+	}, nil
+}
+
+func openDB(driver, dsn string) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch driver {
+	case "sqlite":
+		dialector = sqlite.Open(dsn)
+	case "mysql":
+		dialector = mysql.Open(dsn)
+	case "postgres":
+		dialector = postgres.Open(dsn)
+	default:
+		return nil, fmt.Errorf("unknown driver %q", driver)
+	}
+
+	db, err := gorm.Open(dialector, &gorm.Config{Logger: logger.Default.LogMode(logger.Silent)})
+	if err != nil {
+		return nil, fmt.Errorf("open database err=%w", err)
+	}
+	return db, nil
+}
+
+// newAggregate returns a new instance of the registered aggregate type
+func newAggregate(aggType string) (eventsourcing.Aggregate, error) {
+	for _, agg := range aggregateTypes {
+		t := reflect.TypeOf(agg).Elem()
+		if t.Name() == aggType {
+			return reflect.New(t).Interface().(eventsourcing.Aggregate), nil
+		}
+	}
+	return nil, fmt.Errorf("aggregate type %q is not registered in esctl", aggType)
+}
+
+// singleArg parses the flags of a command taking a single argument, such as an aggregate ID
+func singleArg(fs *flag.FlagSet, args []string, name string) (string, error) {
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() != 1 {
+		return "", fmt.Errorf("%s takes one %s", fs.Name(), name)
+	}
+	return fs.Arg(0), nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+
+	"event_sourcing_golang/eventstore"
+)
+
+// regenerateSnapshots replaces the stale snapshots of the registered aggregate types
+func regenerateSnapshots(ctx context.Context, app *app, args []string) error {
+	fs := flag.NewFlagSet("regenerate", flag.ContinueOnError)
+	aggType := fs.String("type", "", "only regenerate the snapshots of this aggregate type")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	// the snapshots would be written with the redacted personal data
+	if app.redacted {
+		return errors.New("regenerate needs -keys to read the personal data")
+	}
+
+	for _, agg := range aggregateTypes {
+		name := reflect.TypeOf(agg).Elem().Name()
+		if *aggType != "" && name != *aggType {
+			continue
+		}
+
+		n, err := eventstore.NewSnapshotRegenerator(app.repos, agg).Run(ctx)
+		fmt.Fprintf(os.Stderr, "regenerated %d %s snapshots\n", n, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"event_sourcing_golang/eventstore/migration"
+	"event_sourcing_golang/eventstore/projection"
+	"event_sourcing_golang/eventstore/repos"
+)
+
+func exportEvents(ctx context.Context, app *app, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	from := fs.Int64("from", 0, "only export events with a greater position")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	position, err := migration.Export(ctx, app.store, app.w, *from)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "exported up to position %d\n", position)
+	return nil
+}
+
+// importEvents migrates the database and copies an export into it, the checkpoint makes an interrupted import resume.
+// The key store of -keys must hold the keys the exported personal data was encrypted with.
+func importEvents(ctx context.Context, app *app, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	name := fs.String("name", "esctl-import", "name of the import checkpoint")
+	file, err := singleArg(fs, args, "file")
+	if err != nil {
+		return err
+	}
+	// the personal data of the export is encrypted, without its keys it would be imported redacted
+	if app.redacted {
+		return errors.New("import needs -keys to read the personal data")
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := repos.Migrate(ctx, app.db); err != nil {
+		return err
+	}
+	copier := migration.NewCopier(*name, app.store, projection.NewStore(app.db))
+	position, err := copier.Import(ctx, f, app.repos.Serializer())
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "imported up to position %d\n", position)
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// Checks reported by verify
+const (
+	// checkUnreadable is an aggregate whose events can't be read, the checks of its remaining events are skipped
+	checkUnreadable = "unreadable"
+	// checkVersionGap is an event whose version does not follow the previous one
+	checkVersionGap = "version_gap"
+	// checkVersionMismatch is an es_aggregate.version different from the version of the last event
+	checkVersionMismatch = "version_mismatch"
+	// checkSnapshotOrphan is a snapshot at a version without event
+	checkSnapshotOrphan = "snapshot_orphan"
+	// checkSnapshotMismatch is a snapshot whose state differs from the replay of the events up to its version
+	checkSnapshotMismatch = "snapshot_mismatch"
+	// checkSnapshotStale is a snapshot written with another schema than the aggregate's, regenerate replaces it
+	checkSnapshotStale = "snapshot_stale"
+)
+
+type issue struct {
+	AggregateID string `json:"aggregate_id"`
+	Check       string `json:"check"`
+	Detail      string `json:"detail"`
+}
+
+type verifier struct {
+	app    *app
+	issues int
+}
+
+func verify(ctx context.Context, app *app, args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	aggType := fs.String("type", "", "only verify aggregates of this type")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	v := &verifier{app: app}
+	verified := 0
+	check := func(info repos.AggregateInfo) error {
+		verified++
+		return v.aggregate(ctx, info)
+	}
+
+	if fs.NArg() == 0 {
+		if err := eachAggregate(ctx, app.store, *aggType, "", 0, check); err != nil {
+			return err
+		}
+	}
+	for _, id := range fs.Args() {
+		version, err := app.store.AggregateVersion(ctx, id)
+		if err != nil {
+			return err
+		}
+		typ, err := aggregateType(ctx, app.store, id)
+		if err != nil {
+			return err
+		}
+		if err := check(repos.AggregateInfo{ID: id, Type: typ, Version: version}); err != nil {
+			return err
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "verified %d aggregates, %d issues\n", verified, v.issues)
+	if v.issues > 0 {
+		return errIssues
+	}
+	return nil
+}
+
+func (v *verifier) report(aggregateID, check, format string, args ...interface{}) error {
+	v.issues++
+	return v.app.out.Encode(issue{AggregateID: aggregateID, Check: check, Detail: fmt.Sprintf(format, args...)})
+}
+
+// aggregate replays the events of the aggregate once, checking their versions and comparing the replayed state
+// with every snapshot as the replay reaches its version
+func (v *verifier) aggregate(ctx context.Context, info repos.AggregateInfo) error {
+	replay, err := newAggregate(info.Type)
+	if err != nil {
+		return v.report(info.ID, checkUnreadable, "%v", err)
+	}
+	snapshots, err := v.app.store.Snapshots(ctx, info.ID)
+	if err != nil {
+		return err
+	}
+
+	last, next := 0, 0
+	for e, err := range v.app.store.Events(ctx, info.ID, 0) {
+		if err != nil {
+			return v.report(info.ID, checkUnreadable, "read events after version %d: %v", last, err)
+		}
+		if e.Version != last+1 {
+			if err := v.report(info.ID, checkVersionGap, "version %d follows version %d", e.Version, last); err != nil {
+				return err
+			}
+		}
+		last = e.Version
+		replay.Root().LoadFromHistory(replay, []eventsourcing.Event{e})
+
+		for ; next < len(snapshots) && snapshots[next].Version <= last; next++ {
+			if err := v.snapshot(ctx, info, snapshots[next], last, replay); err != nil {
+				return err
+			}
+		}
+	}
+
+	if last != info.Version {
+		err := v.report(info.ID, checkVersionMismatch, "es_aggregate.version is %d, the last event version is %d",
+			info.Version, last)
+		if err != nil {
+			return err
+		}
+	}
+	for ; next < len(snapshots); next++ {
+		err := v.report(info.ID, checkSnapshotOrphan, "snapshot version %d is after the last event version %d",
+			snapshots[next].Version, last)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// snapshot compares the snapshot with the replay, which is at the version of the last event read
+func (v *verifier) snapshot(ctx context.Context, info repos.AggregateInfo, meta repos.SnapshotMeta, replayed int,
+	replay eventsourcing.Aggregate) error {
+	version := meta.Version
+	if version != replayed {
+		return v.report(info.ID, checkSnapshotOrphan, "snapshot version %d has no event", version)
+	}
+
+	snap, err := newAggregate(info.Type)
+	if err != nil {
+		return err
+	}
+	err = v.app.store.ReadSnapshotAt(ctx, info.ID, version, snap)
+	if errors.Is(err, repos.ErrSnapshotStale) {
+		return v.report(info.ID, checkSnapshotStale, "snapshot version %d has schema %q, the aggregate has %q",
+			version, meta.Schema, eventsourcing.SnapshotSchema(snap))
+	}
+	if err != nil {
+		return v.report(info.ID, checkUnreadable, "read snapshot version %d: %v", version, err)
+	}
+
+	want, err := json.Marshal(replay)
+	if err != nil {
+		return fmt.Errorf("encode replayed state err=%w", err)
+	}
+	got, err := json.Marshal(snap)
+	if err != nil {
+		return fmt.Errorf("encode snapshot state err=%w", err)
+	}
+	if !bytes.Equal(want, got) {
+		return v.report(info.ID, checkSnapshotMismatch, "snapshot version %d is %s, the replay is %s", version, got, want)
+	}
+	return nil
+}
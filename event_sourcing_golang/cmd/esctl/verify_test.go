@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/example/bank"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// newTestApp returns an app on an in-memory store and the buffer it writes to
+func newTestApp(t *testing.T) (*app, *bytes.Buffer) {
+	t.Helper()
+	s := eventsourcing.NewSerializer()
+	for _, agg := range aggregateTypes {
+		if err := s.RegisterAggregate(agg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := repos.NewInMemory(s)
+	out := &bytes.Buffer{}
+	return &app{repos: r, store: r.EventStore(), w: out, out: json.NewEncoder(out)}, out
+}
+
+// openAccount saves an account opened with two deposits and returns it at version 3
+func openAccount(t *testing.T, accounts *eventstore.Repository[*bank.BankAccount], id string) *bank.BankAccount {
+	t.Helper()
+	acc, err := accounts.Create(context.Background(), id, func(a *bank.BankAccount) error {
+		for _, e := range []interface{}{&bank.AccountOpened{Owner: "Ada"}, &bank.MoneyDeposited{Amount: 10},
+			&bank.MoneyDeposited{Amount: 5}} {
+			if err := a.ApplyChange(a, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acc
+}
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	app, out := newTestApp(t)
+	accounts := eventstore.NewRepository[*bank.BankAccount](
+		eventstore.NewAggregateStore(app.repos, eventstore.WithDefaultSnapshotPolicy(eventstore.Never())))
+
+	// a consistent account with a snapshot of its state
+	ok := openAccount(t, accounts, "acc-ok")
+	if err := app.store.CreateSnapshot(ctx, ok); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first event is gone
+	openAccount(t, accounts, "acc-gap")
+	if _, err := app.store.DeleteEvents(ctx, "acc-gap", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// the aggregate version moved without its event
+	moved := openAccount(t, accounts, "acc-moved")
+	if err := moved.ApplyChange(moved, &bank.MoneyDeposited{Amount: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := app.store.CheckAndUpdateVersion(ctx, moved); err != nil {
+		t.Fatal(err)
+	}
+
+	// the snapshot holds another balance than the events lead to
+	wrong := openAccount(t, accounts, "acc-snapshot")
+	wrong.Balance = 1000
+	if err := app.store.CreateSnapshot(ctx, wrong); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := verify(ctx, app, nil); !errors.Is(err, errIssues) {
+		t.Fatalf("verify err=%v, want errIssues", err)
+	}
+
+	var got []issue
+	dec := json.NewDecoder(out)
+	for dec.More() {
+		var i issue
+		if err := dec.Decode(&i); err != nil {
+			t.Fatal(err)
+		}
+		i.Detail = ""
+		got = append(got, i)
+	}
+	want := []issue{
+		{AggregateID: "acc-gap", Check: checkVersionGap},
+		{AggregateID: "acc-moved", Check: checkVersionMismatch},
+		{AggregateID: "acc-snapshot", Check: checkSnapshotMismatch},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("issues=%+v, want %+v", got, want)
+	}
+
+	// verifying a single aggregate only checks it
+	out.Reset()
+	if err := verify(ctx, app, []string{"acc-ok"}); err != nil {
+		t.Fatalf("verify of a consistent aggregate err=%v, issues %s", err, out)
+	}
+}
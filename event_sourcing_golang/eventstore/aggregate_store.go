@@ -6,6 +6,7 @@ import (
 	"event_sourcing_golang/eventstore/repos"
 	"fmt"
 	"reflect"
+	"time"
 
 	"event_sourcing_golang/pkg/eventsourcing"
 )
@@ -13,31 +14,86 @@ import (
 var _ AggregateStore = (*aggregateStore)(nil)
 
 type AggregateStore interface {
+	// Get builds the latest state of the aggregate, ErrAggregateNotFound if it has no event
 	Get(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) error
+	// GetAtVersion builds the aggregate as it was at version, ErrVersionNotFound if it never reached it
+	GetAtVersion(ctx context.Context, aggregateID string, version int, agg eventsourcing.Aggregate) error
+	// GetAsOf builds the aggregate as it was at the given time, ErrAggregateNotFound if it did not exist yet
+	GetAsOf(ctx context.Context, aggregateID string, at time.Time, agg eventsourcing.Aggregate) error
+	// CacheStats returns the statistics of the aggregate cache enabled by WithCache
+	CacheStats() CacheStats
 	Save(ctx context.Context, agg eventsourcing.Aggregate) error
+	// SaveAll saves several aggregates atomically, see UnitOfWork
+	SaveAll(ctx context.Context, aggs ...eventsourcing.Aggregate) error
+	// Serializer returns the serializer the aggregates are stored with, it names the events they apply
+	Serializer() eventsourcing.Serializer
 }
 
 type aggregateStore struct {
-	repo repos.EventStore
+	repo       repos.EventStore
+	serializer eventsourcing.Serializer
+
+	// snapshotPolicies keeps the snapshot policy per aggregate type
+	snapshotPolicies      map[string]SnapshotPolicy
+	defaultSnapshotPolicy SnapshotPolicy
+	onSnapshotError       func(error)
+
+	// purgeStaleSnapshots makes loads delete the snapshots written with another schema
+	purgeStaleSnapshots bool
+
+	// outbox makes Save record its events in the outbox for the relay to publish
+	outbox bool
+	// cache keeps hydrated aggregates, nil when disabled
+	cache *aggregateCache
 }
 
-func NewAggregateStore(repos repos.Repos) AggregateStore {
-	return &aggregateStore{
-		repo: repos.EventStore(),
+func NewAggregateStore(repos repos.Repos, opts ...Option) AggregateStore {
+	as := &aggregateStore{
+		repo:                  repos.EventStore(),
+		serializer:            repos.Serializer(),
+		snapshotPolicies:      make(map[string]SnapshotPolicy),
+		defaultSnapshotPolicy: EveryNEvents(20),
+		onSnapshotError:       defaultSnapshotErrorHandler,
 	}
+	for _, opt := range opts {
+		opt(as)
+	}
+
+	return as
 }
 
 // Get fetches the events and build up the aggregate
 func (as *aggregateStore) Get(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) error {
-	if reflect.ValueOf(agg).Kind() != reflect.Ptr {
-		return errors.New("aggregate must to be a pointer")
+	aggType, err := as.register(agg)
+	if err != nil {
+		return err
 	}
 
-	aggType := reflect.TypeOf(agg).Elem().Name()
-	agg.Root().SetAggregateType(aggType)
+	if as.cache != nil {
+		err = as.getCached(ctx, aggregateID, aggType, agg)
+	} else {
+		err = as.load(ctx, aggregateID, aggType, agg)
+	}
+	if err != nil {
+		return err
+	}
+	if agg.Root().Version() == 0 {
+		return fmt.Errorf("%w id=%s", ErrAggregateNotFound, aggregateID)
+	}
+
+	return nil
+}
 
-	// FIXME: getFromSnapshot should be configurable base on aggregate
-	has := as.getFromSnapshot(ctx, aggregateID, agg)
+// load builds the aggregate from its latest snapshot and the events after it
+func (as *aggregateStore) load(ctx context.Context, aggregateID, aggType string, agg eventsourcing.Aggregate) error {
+	if _, never := as.snapshotPolicy(aggType).(neverPolicy); never {
+		return as.getFromEvents(ctx, aggregateID, agg)
+	}
+
+	has, err := as.getFromSnapshot(ctx, aggregateID, agg)
+	if err != nil {
+		return err
+	}
 	if !has {
 		return as.getFromEvents(ctx, aggregateID, agg)
 	}
@@ -45,68 +101,399 @@ func (as *aggregateStore) Get(ctx context.Context, aggregateID string, agg event
 	return nil
 }
 
-func (as *aggregateStore) Save(ctx context.Context, agg eventsourcing.Aggregate) error {
+// getCached restores the aggregate from the cache and replays the events stored since it was cached,
+// the stored aggregate version tells whether there are any. On a miss the aggregate is loaded and cached.
+func (as *aggregateStore) getCached(ctx context.Context, aggregateID, aggType string, agg eventsourcing.Aggregate) error {
+	current, err := as.repo.AggregateVersion(ctx, aggregateID)
+	if err != nil {
+		return err
+	}
+	if current == 0 {
+		return fmt.Errorf("%w id=%s", ErrAggregateNotFound, aggregateID)
+	}
+
+	entry, hit := as.cache.get(aggregateID, current)
+	if hit {
+		if err := as.serializer.DecodeSnapshot(aggregateID, entry.codec, entry.state, agg); err != nil {
+			return fmt.Errorf("restore cached aggregate id=%s err=%w", aggregateID, err)
+		}
+		agg.Root().SetInternal(aggregateID, entry.version, entry.version)
+
+		if entry.version == current {
+			return nil
+		}
+		if err := as.repo.Get(ctx, aggregateID, entry.version, current, agg); err != nil {
+			return err
+		}
+	} else if err := as.load(ctx, aggregateID, aggType, agg); err != nil {
+		return err
+	}
+
+	codec, state, err := as.serializer.EncodeSnapshot(agg)
+	if err != nil {
+		return fmt.Errorf("cache aggregate id=%s err=%w", aggregateID, err)
+	}
+	as.cache.put(aggregateID, agg.Root().Version(), codec, state)
+
+	return nil
+}
+
+func (as *aggregateStore) Serializer() eventsourcing.Serializer {
+	return as.serializer
+}
+
+func (as *aggregateStore) CacheStats() CacheStats {
+	if as.cache == nil {
+		return CacheStats{}
+	}
+	return as.cache.Stats()
+}
+
+// GetAtVersion starts from the latest snapshot at or below version and replays the events up to it
+func (as *aggregateStore) GetAtVersion(ctx context.Context, aggregateID string, version int, agg eventsourcing.Aggregate) error {
+	if version < 1 {
+		return fmt.Errorf("version must be positive, got=%d", version)
+	}
+	aggType, err := as.register(agg)
+	if err != nil {
+		return err
+	}
+
+	if _, never := as.snapshotPolicy(aggType).(neverPolicy); !never {
+		err := as.repo.ReadSnapshotAt(ctx, aggregateID, version, agg)
+		if err != nil && !errors.Is(err, repos.ErrSnapshotNotFound) {
+			return err
+		}
+	}
+
 	root := agg.Root()
-	aggType := reflect.TypeOf(agg).Elem().Name()
-	root.SetAggregateType(aggType)
+	if root.Version() < version {
+		err := as.repo.Get(ctx, aggregateID, root.Version(), version, agg)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case root.Version() == 0:
+		return fmt.Errorf("%w id=%s", ErrAggregateNotFound, aggregateID)
+	case root.Version() < version:
+		return fmt.Errorf("%w id=%s version=%d latest=%d", ErrVersionNotFound, aggregateID, version, root.Version())
+	}
 
-	err := as.repo.CreateIfNotExist(ctx, root.AggregateID(), aggType)
+	return nil
+}
+
+// GetAsOf builds the aggregate at the version of its last event created at or before at
+func (as *aggregateStore) GetAsOf(ctx context.Context, aggregateID string, at time.Time, agg eventsourcing.Aggregate) error {
+	version, err := as.repo.VersionAt(ctx, aggregateID, at)
 	if err != nil {
 		return err
 	}
+	if version == 0 {
+		return fmt.Errorf("%w id=%s at=%s", ErrAggregateNotFound, aggregateID, at.Format(time.RFC3339))
+	}
 
-	err = as.repo.WithTransaction(ctx, func(txn repos.EventStore) error {
-		if !txn.CheckAndUpdateVersion(ctx, agg) {
-			return fmt.Errorf("optimistic concurrency control failed id=%s, expectedVersion=%d, newversion=%d",
-				root.AggregateID(), root.BaseVersion(), root.Version())
+	return as.GetAtVersion(ctx, aggregateID, version, agg)
+}
+
+func (as *aggregateStore) Save(ctx context.Context, agg eventsourcing.Aggregate) error {
+	return as.SaveAll(ctx, agg)
+}
+
+// aggregateChange is an aggregate being saved with the events it appends
+type aggregateChange struct {
+	agg      eventsourcing.Aggregate
+	aggType  string
+	policy   SnapshotPolicy
+	events   []eventsourcing.Event
+	snapshot bool
+}
+
+// SaveAll saves the changes of every aggregate in one transaction. If the version of any of them changed since
+// it was loaded, or any write fails, nothing is saved.
+// With a command ID in ctx, see eventsourcing.WithCommandID, a command that was already saved is not saved again:
+// the aggregates are set to the state the original save left them in and SaveAll succeeds.
+func (as *aggregateStore) SaveAll(ctx context.Context, aggs ...eventsourcing.Aggregate) error {
+	commandID := eventsourcing.MetadataFromContext(ctx).CommandID
+	if commandID != "" {
+		replayed, err := as.replayCommand(ctx, commandID, aggs)
+		if err != nil || replayed {
+			return err
 		}
+	}
 
-		for _, event := range root.Events() {
-			err := txn.Append(ctx, event)
-			if err != nil {
-				return err
-			}
+	changes := make([]*aggregateChange, 0, len(aggs))
+	var events []eventsourcing.Event
+	for _, agg := range aggs {
+		aggType, err := as.register(agg)
+		if err != nil {
+			return err
+		}
+		root := agg.Root()
+
+		err = as.repo.CreateIfNotExist(ctx, root.AggregateID(), aggType)
+		if err != nil {
+			return err
+		}
 
-			// FIXME: createSnapshot should be configurable
-			nthEvent := 20
-			version := root.Version()
-			if version%nthEvent == 0 {
+		c := &aggregateChange{agg: agg, aggType: aggType, policy: as.snapshotPolicy(aggType)}
+		c.events = root.CloneEvents()
+		changes = append(changes, c)
+		events = append(events, c.events...)
+	}
 
-				err = txn.CreateSnapshot(ctx, agg)
-				if err != nil {
+	// the events of all aggregates are stamped together so they share the same correlation ID
+	eventsourcing.StampMetadata(ctx, events)
+	for _, c := range changes {
+		c.events, events = events[:len(c.events)], events[len(c.events):]
+	}
 
-					return err
-				}
+	err := as.repo.WithTransaction(ctx, func(txn repos.EventStore) error {
+		for _, c := range changes {
+			if err := as.saveChange(ctx, txn, c); err != nil {
+				return err
 			}
-			root.Update()
 		}
 
+		if commandID != "" {
+			records := make([]repos.CommandRecord, 0, len(changes))
+			for _, c := range changes {
+				records = append(records, repos.CommandRecord{AggregateID: c.agg.Root().AggregateID(), Version: c.agg.Root().Version()})
+			}
+			if err := txn.RecordCommand(ctx, commandID, records...); err != nil {
+				return err
+			}
+		}
+
+		for _, c := range changes {
+			c.agg.Root().Update()
+		}
 		return nil
 	})
+	if as.cache != nil {
+		for _, c := range changes {
+			as.cache.remove(c.agg.Root().AggregateID())
+		}
+	}
+	if errors.Is(err, repos.ErrDuplicateCommand) {
+		// the same command was saved concurrently
+		_, err = as.replayCommand(ctx, commandID, aggs)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, c := range changes {
+		if _, async := c.policy.(asyncPolicy); async && c.snapshot {
+			as.createSnapshotAsync(ctx, c.agg)
+		}
+	}
+
+	return nil
+}
+
+// replayCommand sets aggs to the versions recorded for commandID, it returns false when the command was never saved
+func (as *aggregateStore) replayCommand(ctx context.Context, commandID string, aggs []eventsourcing.Aggregate) (bool, error) {
+	records, err := as.repo.LookupCommand(ctx, commandID)
+	if errors.Is(err, repos.ErrCommandNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	versions := make(map[string]int, len(records))
+	for _, r := range records {
+		versions[r.AggregateID] = r.Version
+	}
+	for _, agg := range aggs {
+		id := agg.Root().AggregateID()
+		version, ok := versions[id]
+		if !ok {
+			return true, fmt.Errorf("%w id=%s was saved without aggregate id=%s", repos.ErrDuplicateCommand, commandID, id)
+		}
+
+		// the original state is loaded into a new instance, agg holds the changes of the replayed command
+		original, ok := reflect.New(reflect.TypeOf(agg).Elem()).Interface().(eventsourcing.Aggregate)
+		if !ok {
+			return true, errors.New("aggregate type does not implement Aggregate")
+		}
+		if err := as.GetAtVersion(ctx, id, version, original); err != nil {
+			return true, err
+		}
+		reflect.ValueOf(agg).Elem().Set(reflect.ValueOf(original).Elem())
+	}
+
+	return true, nil
+}
+
+// saveChange checks the expected version of the aggregate and writes its events, outbox messages and snapshot
+func (as *aggregateStore) saveChange(ctx context.Context, txn repos.EventStore, c *aggregateChange) error {
+	err := txn.CheckAndUpdateVersion(ctx, c.agg)
 	if err != nil {
+		return err
+	}
 
+	for i := range c.events {
+		c.events[i].AggregateType = c.aggType
+		c.events[i].EventType = as.serializer.EventTypeName(c.events[i].Data)
+		err := txn.Append(ctx, c.events[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	if as.outbox {
+		err := txn.AppendOutbox(ctx, c.events...)
+		if err != nil {
+			return err
+		}
+	}
+
+	c.snapshot, err = as.shouldSnapshot(ctx, txn, c.policy, c.agg, c.events)
+	if err != nil {
 		return err
 	}
+	if c.snapshot {
+		if _, async := c.policy.(asyncPolicy); !async {
+			err := txn.CreateSnapshot(ctx, c.agg)
+			if err != nil {
+				return err
+			}
+		}
+	}
 
 	return nil
 }
 
-func (as *aggregateStore) getFromSnapshot(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) bool {
-	has := as.repo.ReadSnapshot(ctx, aggregateID, agg.Root().Version(), agg)
-	if !has {
-		return false
+func (as *aggregateStore) snapshotPolicy(aggType string) SnapshotPolicy {
+	p, ok := as.snapshotPolicies[aggType]
+	if !ok {
+		p = as.defaultSnapshotPolicy
+	}
+	if a, ok := p.(asyncPolicy); ok {
+		if _, never := a.SnapshotPolicy.(neverPolicy); never {
+			return a.SnapshotPolicy
+		}
+	}
+
+	return p
+}
+
+func (as *aggregateStore) shouldSnapshot(ctx context.Context, txn repos.EventStore, policy SnapshotPolicy, agg eventsourcing.Aggregate, events []eventsourcing.Event) (bool, error) {
+	if _, never := policy.(neverPolicy); never || len(events) == 0 {
+		return false, nil
+	}
+
+	root := agg.Root()
+	info := SnapshotInfo{
+		AggregateType: root.AggregateType(),
+		Version:       root.Version(),
+		Events:        events,
+	}
+	last, err := txn.LastSnapshot(ctx, root.AggregateID())
+	switch {
+	// a stale snapshot is never read, the aggregate is as if it had none
+	case err == nil && last.Schema == eventsourcing.SnapshotSchema(agg):
+		info.SnapshotVersion = last.Version
+		info.SnapshotAt = last.CreatedAt
+	case !errors.Is(err, repos.ErrSnapshotNotFound):
+		return false, err
+	}
+
+	return policy.ShouldSnapshot(info), nil
+}
+
+// createSnapshotAsync writes the snapshot of a copy of agg in the background, so the caller can keep using agg
+func (as *aggregateStore) createSnapshotAsync(ctx context.Context, agg eventsourcing.Aggregate) {
+	clone, err := as.clone(agg)
+	if err != nil {
+		as.onSnapshotError(fmt.Errorf("clone aggregate id=%s err=%w", agg.Root().AggregateID(), err))
+		return
+	}
+
+	ctx = context.WithoutCancel(ctx)
+	go func() {
+		err := as.repo.WithTransaction(ctx, func(txn repos.EventStore) error {
+			return txn.CreateSnapshot(ctx, clone)
+		})
+		if err != nil {
+			as.onSnapshotError(fmt.Errorf("create snapshot id=%s err=%w", clone.Root().AggregateID(), err))
+		}
+	}()
+}
+
+// clone deep copies agg through the serializer, including its root state
+func (as *aggregateStore) clone(agg eventsourcing.Aggregate) (eventsourcing.Aggregate, error) {
+	data, err := as.serializer.Marshal(agg)
+	if err != nil {
+		return nil, err
+	}
+
+	clone, ok := reflect.New(reflect.TypeOf(agg).Elem()).Interface().(eventsourcing.Aggregate)
+	if !ok {
+		return nil, errors.New("aggregate type does not implement Aggregate")
+	}
+	if err := as.serializer.Unmarshal(data, clone); err != nil {
+		return nil, err
+	}
+
+	root := agg.Root()
+	clone.Root().SetAggregateType(root.AggregateType())
+	clone.Root().SetInternal(root.AggregateID(), root.BaseVersion(), root.Version())
+
+	return clone, nil
+}
+
+// getFromSnapshot loads the latest snapshot and the events after it, it returns false when there is no snapshot
+// of agg's schema
+func (as *aggregateStore) getFromSnapshot(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) (bool, error) {
+	err := as.repo.ReadSnapshot(ctx, aggregateID, agg.Root().Version(), agg)
+	if errors.Is(err, repos.ErrSnapshotStale) && as.purgeStaleSnapshots {
+		// the load itself does not depend on the purge, its failure is only reported
+		if _, err := as.repo.PurgeStaleSnapshots(ctx, aggregateID, agg); err != nil {
+			as.onSnapshotError(fmt.Errorf("purge stale snapshots id=%s err=%w", aggregateID, err))
+		}
+	}
+	if errors.Is(err, repos.ErrSnapshotNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
 	}
 
 	root := agg.Root()
 	if root.BaseVersion() < root.Version() {
 		err := as.repo.Get(ctx, aggregateID, root.BaseVersion(), root.Version(), agg)
 		if err != nil {
-
-			return false
+			return false, err
 		}
 	}
 
-	return true
+	return true, nil
+}
+
+// register sets the aggregate type of agg and makes the events it applies named by the serializer of the store
+func (as *aggregateStore) register(agg eventsourcing.Aggregate) (string, error) {
+	aggType, err := setAggregateType(agg)
+	if err != nil {
+		return "", err
+	}
+	agg.Root().SetEventNamer(as.serializer)
+	return aggType, nil
+}
+
+// setAggregateType sets the aggregate type of agg from its struct name and returns it
+func setAggregateType(agg eventsourcing.Aggregate) (string, error) {
+	if reflect.ValueOf(agg).Kind() != reflect.Ptr {
+		return "", errors.New("aggregate must to be a pointer")
+	}
+
+	aggType := reflect.TypeOf(agg).Elem().Name()
+	agg.Root().SetAggregateType(aggType)
+	return aggType, nil
 }
 
 func (as *aggregateStore) getFromEvents(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) error {
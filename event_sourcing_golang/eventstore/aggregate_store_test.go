@@ -0,0 +1,184 @@
+package eventstore_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/archive"
+	"event_sourcing_golang/eventstore/repos"
+)
+
+func TestGetMissingAggregate(t *testing.T) {
+	ctx := context.Background()
+	for name, opts := range map[string][]eventstore.Option{
+		"Uncached": nil,
+		"Cached":   {eventstore.WithCache(10)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			store := eventstore.NewAggregateStore(newRepos(t), opts...)
+			if err := store.Get(ctx, "acc-1", &Account{}); !errors.Is(err, eventstore.ErrAggregateNotFound) {
+				t.Fatalf("get of a missing aggregate err=%v, want ErrAggregateNotFound", err)
+			}
+			uow := eventstore.NewUnitOfWork(store)
+			if err := uow.Get(ctx, "acc-1", &Account{}); !errors.Is(err, eventstore.ErrAggregateNotFound) {
+				t.Fatalf("unit of work get err=%v, want ErrAggregateNotFound", err)
+			}
+
+			accounts := eventstore.NewRepository[*Account](store)
+			if _, err := accounts.Create(ctx, "acc-1", deposit(3)); err != nil {
+				t.Fatal(err)
+			}
+			acc := &Account{}
+			if err := store.Get(ctx, "acc-1", acc); err != nil {
+				t.Fatal(err)
+			}
+			if acc.Balance != 3 {
+				t.Fatalf("balance=%d, want 3", acc.Balance)
+			}
+		})
+	}
+}
+
+// saveDeposits saves a deposit of 1, 2, 3... to acc-1 for every time in at, each event created at its time
+func saveDeposits(t *testing.T, store eventstore.AggregateStore, at ...time.Time) {
+	t.Helper()
+	accounts := eventstore.NewRepository[*Account](store)
+	for i, created := range at {
+		apply := func(a *Account) error {
+			if err := deposit(i + 1)(a); err != nil {
+				return err
+			}
+			events := a.Root().Events()
+			events[len(events)-1].CreatedAt = created.Unix()
+			return nil
+		}
+		var err error
+		if i == 0 {
+			_, err = accounts.Create(context.Background(), "acc-1", apply)
+		} else {
+			_, err = accounts.Update(context.Background(), "acc-1", apply)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// times returns n times 10 seconds apart
+func times(n int) []time.Time {
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := make([]time.Time, n)
+	for i := range at {
+		at[i] = start.Add(time.Duration(i) * 10 * time.Second)
+	}
+	return at
+}
+
+func TestGetAtVersion(t *testing.T) {
+	ctx := context.Background()
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			r := open(t)
+			store := eventstore.NewAggregateStore(r, eventstore.WithSnapshotPolicy(&Account{}, eventstore.EveryNEvents(2)))
+			saveDeposits(t, store, times(5)...)
+
+			// only the snapshot at version 2 holds the first deposits, version 3 is replayed from it
+			if _, err := r.EventStore().DeleteEvents(ctx, "acc-1", 2); err != nil {
+				t.Fatal(err)
+			}
+			acc := &Account{}
+			if err := store.GetAtVersion(ctx, "acc-1", 3, acc); err != nil {
+				t.Fatal(err)
+			}
+			if acc.Root().Version() != 3 || acc.Balance != 6 {
+				t.Fatalf("version=%d balance=%d, want version 3 balance 6", acc.Root().Version(), acc.Balance)
+			}
+
+			err := store.GetAtVersion(ctx, "acc-1", 6, &Account{})
+			if !errors.Is(err, eventstore.ErrVersionNotFound) {
+				t.Fatalf("get above the latest version err=%v, want ErrVersionNotFound", err)
+			}
+		})
+	}
+}
+
+func TestGetAsOf(t *testing.T) {
+	ctx := context.Background()
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			store := eventstore.NewAggregateStore(open(t))
+			at := times(3)
+			saveDeposits(t, store, at...)
+
+			err := store.GetAsOf(ctx, "acc-1", at[0].Add(-time.Second), &Account{})
+			if !errors.Is(err, eventstore.ErrAggregateNotFound) {
+				t.Fatalf("get before the first event err=%v, want ErrAggregateNotFound", err)
+			}
+
+			for _, tc := range []struct {
+				at      time.Time
+				version int
+				balance int
+			}{
+				{at[1], 2, 3},
+				{at[1].Add(5 * time.Second), 2, 3},
+				{at[2].Add(time.Hour), 3, 6},
+			} {
+				acc := &Account{}
+				if err := store.GetAsOf(ctx, "acc-1", tc.at, acc); err != nil {
+					t.Fatal(err)
+				}
+				if acc.Root().Version() != tc.version || acc.Balance != tc.balance {
+					t.Fatalf("at %s version=%d balance=%d, want version %d balance %d", tc.at.Format(time.RFC3339),
+						acc.Root().Version(), acc.Balance, tc.version, tc.balance)
+				}
+			}
+		})
+	}
+}
+
+func TestPointInTimeLoadsReadArchivedEvents(t *testing.T) {
+	ctx := context.Background()
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			blobs, err := archive.NewFileBlobStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			segments := archive.NewStore(blobs)
+			r := open(t, repos.WithArchive(segments))
+			store := eventstore.NewAggregateStore(r, eventstore.WithSnapshotPolicy(&Account{}, eventstore.EveryNEvents(4)))
+			at := times(5)
+			saveDeposits(t, store, at...)
+
+			// the events up to the snapshot at version 4 leave the event store
+			n, err := archive.NewArchiver(r.EventStore(), segments, archive.WithRetention(-time.Hour)).Run(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 4 {
+				t.Fatalf("%d events archived, want 4", n)
+			}
+
+			acc := &Account{}
+			if err := store.GetAtVersion(ctx, "acc-1", 2, acc); err != nil {
+				t.Fatal(err)
+			}
+			if acc.Root().Version() != 2 || acc.Balance != 3 {
+				t.Fatalf("version=%d balance=%d, want version 2 balance 3", acc.Root().Version(), acc.Balance)
+			}
+
+			acc = &Account{}
+			if err := store.GetAsOf(ctx, "acc-1", at[2], acc); err != nil {
+				t.Fatal(err)
+			}
+			if acc.Root().Version() != 3 || acc.Balance != 6 {
+				t.Fatalf("version=%d balance=%d as of the third event, want version 3 balance 6",
+					acc.Root().Version(), acc.Balance)
+			}
+		})
+	}
+}
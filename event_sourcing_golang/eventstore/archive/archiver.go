@@ -0,0 +1,124 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"event_sourcing_golang/eventstore/repos"
+)
+
+const (
+	defaultRetention = 30 * 24 * time.Hour
+	defaultBatchSize = 100
+)
+
+// Archiver moves the events covered by a snapshot older than the retention window into segments of a Store.
+// Loads start from the snapshot and don't read them anymore. The last event of an aggregate stays in the event
+// store as appends check their version against it, as do the events the outbox has not delivered yet.
+type Archiver struct {
+	es    repos.EventStore
+	store *Store
+
+	retention time.Duration
+	batchSize int
+}
+
+type ArchiverOption func(*Archiver)
+
+// WithRetention sets how old the latest snapshot of an aggregate must be before its events are archived
+func WithRetention(d time.Duration) ArchiverOption {
+	return func(a *Archiver) {
+		a.retention = d
+	}
+}
+
+// WithBatchSize sets how many aggregates are listed at a time
+func WithBatchSize(n int) ArchiverOption {
+	return func(a *Archiver) {
+		if n > 0 {
+			a.batchSize = n
+		}
+	}
+}
+
+func NewArchiver(es repos.EventStore, store *Store, opts ...ArchiverOption) *Archiver {
+	a := &Archiver{
+		es:        es,
+		store:     store,
+		retention: defaultRetention,
+		batchSize: defaultBatchSize,
+	}
+	for _, opt := range opts {
+		opt(a)
+	}
+
+	return a
+}
+
+// Run archives the events of every aggregate with a snapshot older than the retention window and returns how many
+// events it archived. It stops at the first error, running it again resumes where it stopped.
+func (a *Archiver) Run(ctx context.Context) (int, error) {
+	before := time.Now().Add(-a.retention)
+	archived := 0
+	afterID := ""
+	for {
+		infos, err := a.es.Aggregates(ctx, "", afterID, a.batchSize)
+		if err != nil {
+			return archived, err
+		}
+
+		for _, info := range infos {
+			if err := ctx.Err(); err != nil {
+				return archived, err
+			}
+			n, err := a.archive(ctx, info, before)
+			archived += n
+			if err != nil {
+				return archived, fmt.Errorf("archive events id=%s err=%w", info.ID, err)
+			}
+		}
+
+		if len(infos) < a.batchSize {
+			return archived, nil
+		}
+		afterID = infos[len(infos)-1].ID
+	}
+}
+
+// archive moves the events of the aggregate up to its latest snapshot when it was taken before before
+func (a *Archiver) archive(ctx context.Context, info repos.AggregateInfo, before time.Time) (int, error) {
+	snap, err := a.es.LastSnapshot(ctx, info.ID)
+	if errors.Is(err, repos.ErrSnapshotNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if snap.CreatedAt.After(before) {
+		return 0, nil
+	}
+
+	upTo := min(snap.Version, info.Version-1)
+	undelivered, err := a.es.UndeliveredOutboxVersion(ctx, info.ID)
+	if err != nil {
+		return 0, err
+	}
+	if undelivered > 0 {
+		upTo = min(upTo, undelivered-1)
+	}
+	if upTo < 1 {
+		return 0, nil
+	}
+	events, err := a.es.StoredEvents(ctx, info.ID, 0, upTo)
+	if err != nil || len(events) == 0 {
+		return 0, err
+	}
+
+	// the segment is written first, a failure before the delete leaves the events in both places
+	if err := a.store.write(ctx, events); err != nil {
+		return 0, err
+	}
+	return a.es.DeleteEvents(ctx, info.ID, upTo)
+}
@@ -0,0 +1,171 @@
+package archive_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/archive"
+	"event_sourcing_golang/eventstore/migration"
+	"event_sourcing_golang/eventstore/outbox"
+	"event_sourcing_golang/eventstore/projection"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type Deposited struct{ Amount int }
+
+type Account struct {
+	eventsourcing.AggregateRoot
+	Balance int
+}
+
+func (a *Account) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&Deposited{})
+}
+
+func (a *Account) Transition(e eventsourcing.Event) error {
+	if v, ok := e.Data.(*Deposited); ok {
+		a.Balance += v.Amount
+	}
+	return nil
+}
+
+// brokenAfter publishes the events of every aggregate up to version, the later ones fail
+type brokenAfter struct {
+	version int
+}
+
+func (p brokenAfter) Publish(ctx context.Context, e eventsourcing.Event) error {
+	if e.Version > p.version {
+		return errors.New("broker unavailable")
+	}
+	return nil
+}
+
+type openFunc func(t *testing.T, s eventsourcing.Serializer, opts ...repos.Option) repos.Repos
+
+var stores = map[string]openFunc{
+	"InMemory": func(t *testing.T, s eventsourcing.Serializer, opts ...repos.Option) repos.Repos {
+		return repos.NewInMemory(s, opts...)
+	},
+	"SQLite": func(t *testing.T, s eventsourcing.Serializer, opts ...repos.Option) repos.Repos {
+		db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "es.db")), &gorm.Config{Logger: logger.Discard})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repos.Migrate(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+		return repos.New(db, s, opts...)
+	},
+}
+
+// setup saves acc-1 with 4 deposits and a snapshot through the outbox, and delivers its events up to delivered
+func setup(t *testing.T, open openFunc, delivered int) (repos.Repos, *archive.Archiver) {
+	t.Helper()
+	ctx := context.Background()
+	s := eventsourcing.NewSerializer()
+	if err := s.RegisterAggregate(&Account{}); err != nil {
+		t.Fatal(err)
+	}
+	blobs, err := archive.NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := archive.NewStore(blobs)
+	r := open(t, s, repos.WithArchive(store))
+
+	as := eventstore.NewAggregateStore(r, eventstore.WithOutbox(),
+		eventstore.WithSnapshotPolicy(&Account{}, eventstore.EveryNEvents(4)))
+	_, err = eventstore.NewRepository[*Account](as).Create(ctx, "acc-1", func(a *Account) error {
+		for i := 0; i < 4; i++ {
+			if err := a.ApplyChange(a, &Deposited{Amount: 10}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	relay := outbox.NewRelay(r.EventStore(), brokenAfter{delivered}, outbox.WithBackoff(func(int) time.Duration {
+		return time.Hour
+	}))
+	for i := 0; ; i++ {
+		n, err := relay.RelayOnce(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			break
+		}
+		if i == 10 {
+			t.Fatal("outbox never drained")
+		}
+	}
+
+	// the snapshot is already past the retention window
+	return r, archive.NewArchiver(r.EventStore(), store, archive.WithRetention(-time.Hour))
+}
+
+func TestArchiverKeepsUndeliveredEvents(t *testing.T) {
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			r, archiver := setup(t, open, 0)
+			if n, err := archiver.Run(ctx); err != nil || n != 0 {
+				t.Fatalf("archived n=%d err=%v with nothing delivered, want 0", n, err)
+			}
+
+			r, archiver = setup(t, open, 2)
+			if n, err := archiver.Run(ctx); err != nil || n != 2 {
+				t.Fatalf("archived n=%d err=%v with versions 1 and 2 delivered, want 2", n, err)
+			}
+			left, err := r.EventStore().StoredEvents(ctx, "acc-1", 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(left) != 2 || left[0].Version != 3 {
+				t.Fatalf("stored events=%+v, want the undelivered versions 3 and 4", left)
+			}
+
+			events, err := r.EventStore().List(ctx, "acc-1", &Account{})
+			if err != nil || len(events) != 4 {
+				t.Fatalf("listed %d events err=%v, want 4 with the archived ones", len(events), err)
+			}
+		})
+	}
+}
+
+func TestFullReplaysRefusedAfterArchiving(t *testing.T) {
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			r, archiver := setup(t, open, 4)
+			if n, err := archiver.Run(ctx); err != nil || n != 3 {
+				t.Fatalf("archived n=%d err=%v, want 3", n, err)
+			}
+
+			p := projection.New("balances", "balances")
+			runner := projection.NewRunner(r.EventStore(), projection.NewInMemoryStore(), p)
+			if err := runner.Rebuild(ctx, "balances"); !errors.Is(err, repos.ErrEventsArchived) {
+				t.Fatalf("rebuild err=%v, want %v", err, repos.ErrEventsArchived)
+			}
+
+			target := repos.NewInMemory(r.Serializer())
+			copier := migration.NewCopier("copy", target.EventStore(), projection.NewInMemoryStore())
+			if _, err := copier.Copy(ctx, r.EventStore()); !errors.Is(err, repos.ErrEventsArchived) {
+				t.Fatalf("copy err=%v, want %v", err, repos.ErrEventsArchived)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package archive
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrBlobNotFound is returned when no blob is stored under the key
+var ErrBlobNotFound = errors.New("blob not found")
+
+// BlobStore keeps the archived segments, keys are slash separated paths such as <aggregate>/<segment>
+type BlobStore interface {
+	// Put stores data under key, replacing the blob already stored under it
+	Put(ctx context.Context, key string, data []byte) error
+	// Get returns the blob stored under key, ErrBlobNotFound if there is none
+	Get(ctx context.Context, key string) ([]byte, error)
+	// List returns the keys in the directory of prefix starting with prefix, in lexical order
+	List(ctx context.Context, prefix string) ([]string, error)
+}
+
+var _ BlobStore = (*FileBlobStore)(nil)
+
+// FileBlobStore is a BlobStore keeping every blob in a file under its root directory
+type FileBlobStore struct {
+	root string
+}
+
+// NewFileBlobStore returns a FileBlobStore under root, creating the directory when needed
+func NewFileBlobStore(root string) (*FileBlobStore, error) {
+	if err := os.MkdirAll(root, 0o700); err != nil {
+		return nil, fmt.Errorf("create blob dir=%s err=%w", root, err)
+	}
+	return &FileBlobStore{root: root}, nil
+}
+
+// Put writes the blob to a temporary file renamed over the key, so a crash never leaves a partial blob
+func (s *FileBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	file, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(file), 0o700); err != nil {
+		return fmt.Errorf("create blob dir key=%s err=%w", key, err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("create blob key=%s err=%w", key, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("write blob key=%s err=%w", key, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("sync blob key=%s err=%w", key, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close blob key=%s err=%w", key, err)
+	}
+	if err := os.Rename(tmp.Name(), file); err != nil {
+		return fmt.Errorf("rename blob key=%s err=%w", key, err)
+	}
+	return nil
+}
+
+func (s *FileBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	file, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w key=%s", ErrBlobNotFound, key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read blob key=%s err=%w", key, err)
+	}
+	return data, nil
+}
+
+func (s *FileBlobStore) List(ctx context.Context, prefix string) ([]string, error) {
+	// the directory of a prefix ending with a slash is the prefix itself
+	dir := path.Dir(prefix + "_")
+	file := s.root
+	if dir != "." {
+		var err error
+		if file, err = s.path(dir); err != nil {
+			return nil, err
+		}
+	}
+
+	entries, err := os.ReadDir(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("list blobs prefix=%s err=%w", prefix, err)
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			continue
+		}
+		if key := path.Join(dir, entry.Name()); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+// path returns the file of key, keys can't leave the root directory
+func (s *FileBlobStore) path(key string) (string, error) {
+	clean := path.Clean("/" + key)
+	if clean == "/" || clean != "/"+strings.TrimSuffix(key, "/") {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(clean)), nil
+}
@@ -0,0 +1,182 @@
+// Package archive moves old events out of the event store into compressed segments of a blob store, and reads
+// them back when a historical read needs them.
+//
+// The Archiver moves the events covered by a snapshot older than a retention window, the Store is given to
+// repos.WithArchive so List, Events and point-in-time loads keep seeing every event:
+//
+//	blobs, _ := archive.NewFileBlobStore("/var/lib/es-archive")
+//	store := archive.NewStore(blobs)
+//	r := repos.New(db, s, repos.WithArchive(store))
+//	archived, err := archive.NewArchiver(r.EventStore(), store).Run(ctx)
+//
+// ReadAll, Subscribe and the exports only read the events still in the event store, projections and copies must
+// have processed the events before they are archived: their full replays fail with repos.ErrEventsArchived.
+// Events still waiting in the outbox are not archived.
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"iter"
+	"path"
+	"slices"
+	"time"
+
+	"event_sourcing_golang/eventstore/repos"
+)
+
+var _ repos.Archive = (*Store)(nil)
+
+const segmentExt = ".ndjson.gz"
+
+// Store keeps the archived events of every aggregate in segments, gzip compressed NDJSON of repos.StoredEvent
+// named after the versions they hold. The segments of an aggregate share a directory named after its ID.
+type Store struct {
+	blobs BlobStore
+}
+
+func NewStore(blobs BlobStore) *Store {
+	return &Store{blobs: blobs}
+}
+
+// segment is a blob holding the events of an aggregate in (from, to]
+type segment struct {
+	key      string
+	from, to int
+}
+
+// segmentDir returns the directory of the segments of an aggregate, the ID is encoded as it may hold any character
+func segmentDir(aggregateID string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(aggregateID)) + "/"
+}
+
+// segments returns the segments of the aggregate ordered by version
+func (s *Store) segments(ctx context.Context, aggregateID string) ([]segment, error) {
+	keys, err := s.blobs.List(ctx, segmentDir(aggregateID))
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]segment, 0, len(keys))
+	for _, key := range keys {
+		seg := segment{key: key}
+		if _, err := fmt.Sscanf(path.Base(key), "%d-%d"+segmentExt, &seg.from, &seg.to); err != nil {
+			return nil, fmt.Errorf("invalid segment key=%s err=%w", key, err)
+		}
+		result = append(result, seg)
+	}
+	slices.SortFunc(result, func(a, b segment) int {
+		if a.from != b.from {
+			return a.from - b.from
+		}
+		return a.to - b.to
+	})
+	return result, nil
+}
+
+// write stores events, consecutive events of one aggregate, in a new segment. A segment of the same versions
+// is replaced, so writing again after a failure is safe.
+func (s *Store) write(ctx context.Context, events []repos.StoredEvent) error {
+	first, last := events[0], events[len(events)-1]
+	key := fmt.Sprintf("%s%010d-%010d%s", segmentDir(first.AggregateID), first.Version-1, last.Version, segmentExt)
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	enc := json.NewEncoder(zw)
+	for _, se := range events {
+		if err := enc.Encode(se); err != nil {
+			return fmt.Errorf("encode archived event id=%s version=%d err=%w", se.AggregateID, se.Version, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return fmt.Errorf("compress segment key=%s err=%w", key, err)
+	}
+
+	return s.blobs.Put(ctx, key, buf.Bytes())
+}
+
+func (s *Store) read(ctx context.Context, seg segment) ([]repos.StoredEvent, error) {
+	data, err := s.blobs.Get(ctx, seg.key)
+	if err != nil {
+		return nil, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decompress segment key=%s err=%w", seg.key, err)
+	}
+	defer zr.Close()
+
+	var result []repos.StoredEvent
+	dec := json.NewDecoder(bufio.NewReader(zr))
+	for {
+		var se repos.StoredEvent
+		err := dec.Decode(&se)
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode segment key=%s err=%w", seg.key, err)
+		}
+		result = append(result, se)
+	}
+}
+
+// ArchivedEvents streams the segments holding versions in (fromVersion, toVersion], toVersion 0 meaning the latest.
+// One segment is read at a time. Segments may overlap when an archiving failed halfway, each version is yielded once.
+func (s *Store) ArchivedEvents(ctx context.Context, aggregateID string, fromVersion, toVersion int) iter.Seq2[repos.StoredEvent, error] {
+	return func(yield func(repos.StoredEvent, error) bool) {
+		segments, err := s.segments(ctx, aggregateID)
+		if err != nil {
+			yield(repos.StoredEvent{}, err)
+			return
+		}
+
+		last := fromVersion
+		for _, seg := range segments {
+			if seg.to <= last || (toVersion > 0 && seg.from >= toVersion) {
+				continue
+			}
+			events, err := s.read(ctx, seg)
+			if err != nil {
+				yield(repos.StoredEvent{}, err)
+				return
+			}
+			for _, se := range events {
+				if se.Version <= last || (toVersion > 0 && se.Version > toVersion) {
+					continue
+				}
+				if !yield(se, nil) {
+					return
+				}
+				last = se.Version
+			}
+		}
+	}
+}
+
+// ArchivedVersionAt reads the segments from the latest one until it finds an event created at or before at
+func (s *Store) ArchivedVersionAt(ctx context.Context, aggregateID string, at time.Time) (int, error) {
+	segments, err := s.segments(ctx, aggregateID)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := len(segments) - 1; i >= 0; i-- {
+		events, err := s.read(ctx, segments[i])
+		if err != nil {
+			return 0, err
+		}
+		for j := len(events) - 1; j >= 0; j-- {
+			if events[j].CreatedAt <= at.Unix() {
+				return events[j].Version, nil
+			}
+		}
+	}
+	return 0, nil
+}
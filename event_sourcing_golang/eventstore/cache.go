@@ -0,0 +1,106 @@
+package eventstore
+
+import (
+	"container/list"
+	"sync"
+)
+
+// CacheStats reports the activity of the aggregate cache, it is zero when the cache is disabled
+type CacheStats struct {
+	Hits   int64
+	Misses int64
+	// Evictions counts the aggregates dropped to make room for others
+	Evictions int64
+	Size      int
+}
+
+// aggregateCache is a LRU cache of hydrated aggregates. It keeps each aggregate encoded like a snapshot,
+// so every Get decodes its own copy, the cached state is never mutated and forgotten personal data stays redacted.
+type aggregateCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+	stats    CacheStats
+}
+
+type cacheEntry struct {
+	id      string
+	version int
+	codec   string
+	state   []byte
+}
+
+func newAggregateCache(capacity int) *aggregateCache {
+	return &aggregateCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached entry of id when it is not newer than maxVersion, counting a hit or a miss.
+// An entry newer than maxVersion comes from a save that was rolled back and is dropped.
+func (c *aggregateCache) get(id string, maxVersion int) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[id]
+	if ok && el.Value.(*cacheEntry).version > maxVersion {
+		c.order.Remove(el)
+		delete(c.entries, id)
+		ok = false
+	}
+	if !ok {
+		c.stats.Misses++
+		return cacheEntry{}, false
+	}
+
+	c.stats.Hits++
+	c.order.MoveToFront(el)
+	return *el.Value.(*cacheEntry), true
+}
+
+// put caches state as the version of id, unless a newer version is already cached
+func (c *aggregateCache) put(id string, version int, codec string, state []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[id]; ok {
+		e := el.Value.(*cacheEntry)
+		if e.version <= version {
+			e.version = version
+			e.codec = codec
+			e.state = state
+		}
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[id] = c.order.PushFront(&cacheEntry{id: id, version: version, codec: codec, state: state})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).id)
+		c.stats.Evictions++
+	}
+}
+
+func (c *aggregateCache) remove(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[id]; ok {
+		c.order.Remove(el)
+		delete(c.entries, id)
+	}
+}
+
+func (c *aggregateCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Size = c.order.Len()
+	return stats
+}
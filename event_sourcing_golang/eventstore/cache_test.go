@@ -0,0 +1,118 @@
+package eventstore_test
+
+import (
+	"context"
+	"testing"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/repos"
+)
+
+func get(t *testing.T, store eventstore.AggregateStore, id string) *Account {
+	t.Helper()
+	acc := &Account{}
+	if err := store.Get(context.Background(), id, acc); err != nil {
+		t.Fatal(err)
+	}
+	return acc
+}
+
+func TestCacheReplaysEventsSavedElsewhere(t *testing.T) {
+	ctx := context.Background()
+	r := newRepos(t)
+	cached := eventstore.NewAggregateStore(r, eventstore.WithCache(10))
+	// other saves to the same events without going through the cache of cached
+	other := eventstore.NewRepository[*Account](eventstore.NewAggregateStore(r))
+	if _, err := other.Create(ctx, "acc-1", deposit(10)); err != nil {
+		t.Fatal(err)
+	}
+
+	if acc := get(t, cached, "acc-1"); acc.Balance != 10 {
+		t.Fatalf("balance=%d, want 10", acc.Balance)
+	}
+	for _, amount := range []int{5, 1} {
+		if _, err := other.Update(ctx, "acc-1", deposit(amount)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the cached state at version 1 is completed with the two events after it
+	acc := get(t, cached, "acc-1")
+	if acc.Balance != 16 || acc.Version() != 3 || acc.BaseVersion() != 3 {
+		t.Fatalf("balance=%d version=%d base=%d, want 16 at 3", acc.Balance, acc.Version(), acc.BaseVersion())
+	}
+	if acc := get(t, cached, "acc-1"); acc.Balance != 16 {
+		t.Fatalf("balance=%d on the next hit, want 16", acc.Balance)
+	}
+	stats := cached.CacheStats()
+	if stats.Hits != 2 || stats.Misses != 1 || stats.Size != 1 {
+		t.Fatalf("stats=%+v, want 2 hits and 1 miss", stats)
+	}
+}
+
+func TestCacheDroppedOnRolledBackSave(t *testing.T) {
+	ctx := context.Background()
+	r := newRepos(t)
+	store := eventstore.NewAggregateStore(r, eventstore.WithCache(10))
+	accounts := eventstore.NewRepository[*Account](store)
+	for _, id := range []string{"acc-1", "acc-2"} {
+		if _, err := accounts.Create(ctx, id, deposit(10)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	acc1 := get(t, store, "acc-1")
+	acc2 := get(t, store, "acc-2")
+	// acc-2 changes after it was loaded, saving both fails and nothing is saved
+	if _, err := accounts.Update(ctx, "acc-2", deposit(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := deposit(100)(acc1); err != nil {
+		t.Fatal(err)
+	}
+	if err := deposit(100)(acc2); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.SaveAll(ctx, acc1, acc2); !repos.IsConcurrencyConflict(err) {
+		t.Fatalf("err=%v, want a concurrency conflict", err)
+	}
+
+	before := store.CacheStats()
+	acc := get(t, store, "acc-1")
+	if acc.Balance != 10 || acc.Version() != 1 {
+		t.Fatalf("balance=%d version=%d after the rollback, want 10 at 1", acc.Balance, acc.Version())
+	}
+	if misses := store.CacheStats().Misses - before.Misses; misses != 1 {
+		t.Fatalf("%d misses after the rollback, want the entry dropped", misses)
+	}
+	if acc := get(t, store, "acc-2"); acc.Balance != 11 {
+		t.Fatalf("acc-2 balance=%d, want 11", acc.Balance)
+	}
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	ctx := context.Background()
+	store := eventstore.NewAggregateStore(newRepos(t), eventstore.WithCache(2))
+	accounts := eventstore.NewRepository[*Account](store)
+	for _, id := range []string{"acc-1", "acc-2", "acc-3"} {
+		if _, err := accounts.Create(ctx, id, deposit(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	get(t, store, "acc-1")
+	get(t, store, "acc-2")
+	get(t, store, "acc-1")
+	get(t, store, "acc-3")
+	stats := store.CacheStats()
+	if stats.Evictions != 1 || stats.Size != 2 {
+		t.Fatalf("stats=%+v, want 1 eviction", stats)
+	}
+
+	// acc-2 was the least recently used
+	get(t, store, "acc-1")
+	get(t, store, "acc-2")
+	if got := store.CacheStats(); got.Hits != stats.Hits+1 || got.Misses != stats.Misses+1 {
+		t.Fatalf("stats=%+v after %+v, want acc-1 hit and acc-2 missed", got, stats)
+	}
+}
@@ -0,0 +1,104 @@
+package eventstore_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// lateLookup misses the first command lookup, as when a concurrent save of the command commits right after it
+type lateLookup struct {
+	repos.EventStore
+	missed bool
+}
+
+func (l *lateLookup) LookupCommand(ctx context.Context, commandID string) ([]repos.CommandRecord, error) {
+	if !l.missed {
+		l.missed = true
+		return nil, fmt.Errorf("%w id=%s", repos.ErrCommandNotFound, commandID)
+	}
+	return l.EventStore.LookupCommand(ctx, commandID)
+}
+
+type lateRepos struct {
+	repos.Repos
+	es *lateLookup
+}
+
+func (r *lateRepos) EventStore() repos.EventStore { return r.es }
+
+func TestDuplicateCommandSavedConcurrently(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			r := open(t)
+			accounts := eventstore.NewRepository[*Account](eventstore.NewAggregateStore(r))
+			if _, err := accounts.Create(ctx, "acc-1", deposit(10)); err != nil {
+				t.Fatal(err)
+			}
+			cmd := eventsourcing.WithCommandID(ctx, "cmd-1")
+			if _, err := accounts.Update(cmd, "acc-1", deposit(5)); err != nil {
+				t.Fatal(err)
+			}
+
+			// the duplicate passes the lookup and the version check, recording the command fails and it is replayed
+			late := eventstore.NewAggregateStore(&lateRepos{Repos: r, es: &lateLookup{EventStore: r.EventStore()}})
+			acc := get(t, late, "acc-1")
+			_ = deposit(5)(acc)
+			if err := late.Save(cmd, acc); err != nil {
+				t.Fatal(err)
+			}
+			if acc.Balance != 15 || acc.Version() != 2 || acc.IsUnsaved() {
+				t.Fatalf("replayed balance=%d version=%d unsaved=%t, want 15 at 2", acc.Balance, acc.Version(), acc.IsUnsaved())
+			}
+			if got := get(t, late, "acc-1"); got.Balance != 15 || got.Version() != 2 {
+				t.Fatalf("stored balance=%d version=%d, want 15 at 2", got.Balance, got.Version())
+			}
+		})
+	}
+}
+
+func TestCommandRetriedInParallel(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			r := open(t)
+			accounts := eventstore.NewRepository[*Account](eventstore.NewAggregateStore(r),
+				eventstore.WithRetryPolicy(eventstore.RetryPolicy{MaxAttempts: 10, Backoff: noWait}))
+			if _, err := accounts.Create(ctx, "acc-1", deposit(10)); err != nil {
+				t.Fatal(err)
+			}
+
+			// every copy of the command succeeds and sees the state left by the one that was saved
+			cmd := eventsourcing.WithCommandID(ctx, "cmd-1")
+			var wg sync.WaitGroup
+			results := make(chan error, 8)
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					acc, err := accounts.Update(cmd, "acc-1", deposit(5))
+					if err == nil && (acc.Balance != 15 || acc.Version() != 2) {
+						err = fmt.Errorf("balance=%d version=%d, want 15 at 2", acc.Balance, acc.Version())
+					}
+					results <- err
+				}()
+			}
+			wg.Wait()
+			close(results)
+			for err := range results {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := get(t, eventstore.NewAggregateStore(r), "acc-1"); got.Balance != 15 {
+				t.Fatalf("stored balance=%d, want 15", got.Balance)
+			}
+		})
+	}
+}
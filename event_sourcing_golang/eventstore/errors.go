@@ -0,0 +1,19 @@
+package eventstore
+
+import (
+	"errors"
+
+	"event_sourcing_golang/eventstore/repos"
+)
+
+// The errors of the repos layer are re-exported so callers of AggregateStore don't need to import repos
+type ErrConcurrencyConflict = repos.ErrConcurrencyConflict
+
+var (
+	ErrAggregateNotFound = repos.ErrAggregateNotFound
+	ErrUnknownEventType  = repos.ErrUnknownEventType
+	ErrDuplicateCommand  = repos.ErrDuplicateCommand
+)
+
+// ErrVersionNotFound is returned when loading an aggregate at a version it has not reached
+var ErrVersionNotFound = errors.New("aggregate version not found")
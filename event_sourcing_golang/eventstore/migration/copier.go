@@ -0,0 +1,220 @@
+// Package migration copies event histories between event stores, such as from MySQL to Postgres
+// or into the in-memory store for load tests.
+package migration
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+const defaultBatchSize = 500
+
+// CheckpointStore keeps the last copied position of every copy, projection stores implement it
+type CheckpointStore interface {
+	// LoadCheckpoint returns the last copied source position, 0 if the copy never ran
+	LoadCheckpoint(ctx context.Context, name string) (int64, error)
+	SaveCheckpoint(ctx context.Context, name string, position int64) error
+}
+
+// Copier copies the events of a source stream to a target store in position order.
+// Each batch is written in one target transaction and then checkpointed under the copier name, so a stopped copy
+// resumes where it was. Events keep their aggregate version, those the target already has are skipped,
+// which makes re-running a copy safe even when it stopped between a batch and its checkpoint.
+// Snapshots and outbox messages are not copied, the target takes new snapshots as aggregates are saved.
+type Copier struct {
+	name        string
+	target      repos.EventStore
+	checkpoints CheckpointStore
+
+	batchSize int
+	filter    func(eventsourcing.Event) bool
+	transform func(context.Context, eventsourcing.Event) (eventsourcing.Event, error)
+}
+
+type CopierOption func(*Copier)
+
+// WithBatchSize sets how many events are written per target transaction, n must be positive
+func WithBatchSize(n int) CopierOption {
+	return func(c *Copier) {
+		if n > 0 {
+			c.batchSize = n
+		}
+	}
+}
+
+// WithFilter only copies the events fn returns true for. Dropping events in the middle of a copied aggregate
+// would leave a version gap and fails the copy, so filters should keep or drop whole aggregates.
+func WithFilter(fn func(eventsourcing.Event) bool) CopierOption {
+	return func(c *Copier) {
+		c.filter = fn
+	}
+}
+
+// WithTransform rewrites every copied event before it is written to the target, for example to
+// rename an event type. Positions are assigned by the target, the version of the event must be kept.
+func WithTransform(fn func(context.Context, eventsourcing.Event) (eventsourcing.Event, error)) CopierOption {
+	return func(c *Copier) {
+		c.transform = fn
+	}
+}
+
+// NewCopier creates a Copier writing to target and keeping its checkpoint as name in checkpoints
+func NewCopier(name string, target repos.EventStore, checkpoints CheckpointStore, opts ...CopierOption) *Copier {
+	c := &Copier{
+		name:        name,
+		target:      target,
+		checkpoints: checkpoints,
+		batchSize:   defaultBatchSize,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Copy copies the events of source appended after the checkpoint until it is caught up,
+// and returns the source position reached. It fails with repos.ErrEventsArchived when events after the checkpoint
+// were archived.
+func (c *Copier) Copy(ctx context.Context, source repos.EventStore) (int64, error) {
+	position, err := c.checkpoints.LoadCheckpoint(ctx, c.name)
+	if err != nil {
+		return 0, err
+	}
+	if err := repos.CheckUnarchived(ctx, source, position); err != nil {
+		return position, err
+	}
+
+	for {
+		events, err := source.ReadAll(ctx, position, c.batchSize)
+		if err != nil {
+			return position, err
+		}
+		if len(events) == 0 {
+			return position, nil
+		}
+
+		if err := c.write(ctx, events); err != nil {
+			return position, err
+		}
+		position = events[len(events)-1].Position
+		if len(events) < c.batchSize {
+			return position, nil
+		}
+	}
+}
+
+// Follow copies like Copy and then keeps copying the events appended to source until ctx is done,
+// so the target stays in sync while writers are moved to it
+func (c *Copier) Follow(ctx context.Context, source repos.EventStore) error {
+	position, err := c.Copy(ctx, source)
+	if err != nil {
+		return err
+	}
+
+	sub := source.Subscribe(ctx, position)
+	for e := range sub.Events() {
+		if err := c.write(ctx, []eventsourcing.Event{e}); err != nil {
+			return err
+		}
+	}
+
+	// a subscription stopped by ctx is a normal shutdown
+	if err := sub.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+	return nil
+}
+
+// write copies events in one target transaction and checkpoints the position of the last one
+func (c *Copier) write(ctx context.Context, events []eventsourcing.Event) error {
+	position := events[len(events)-1].Position
+
+	err := c.target.WithTransaction(ctx, func(tx repos.EventStore) error {
+		// versions holds the target version of the aggregates of the batch, as stored and as copied
+		stored := make(map[string]int)
+		versions := make(map[string]int)
+		var order []string
+
+		for _, e := range events {
+			if c.filter != nil && !c.filter(e) {
+				continue
+			}
+			if c.transform != nil {
+				transformed, err := c.transform(ctx, e)
+				if err != nil {
+					return fmt.Errorf("transform event position=%d err=%w", e.Position, err)
+				}
+				e = transformed
+			}
+
+			version, ok := versions[e.AggregateID]
+			if !ok {
+				var err error
+				if version, err = targetVersion(ctx, tx, e); err != nil {
+					return err
+				}
+				stored[e.AggregateID] = version
+				versions[e.AggregateID] = version
+				order = append(order, e.AggregateID)
+			}
+
+			// copied by a run stopped before its checkpoint
+			if e.Version <= version {
+				continue
+			}
+			if e.Version != version+1 {
+				return fmt.Errorf("event version=%d of aggregate id=%s does not follow the copied version=%d",
+					e.Version, e.AggregateID, version)
+			}
+
+			if err := tx.Append(ctx, e); err != nil {
+				return err
+			}
+			versions[e.AggregateID] = e.Version
+		}
+
+		for _, id := range order {
+			if versions[id] == stored[id] {
+				continue
+			}
+			agg := &copiedAggregate{}
+			agg.SetInternal(id, stored[id], versions[id])
+			if err := tx.CheckAndUpdateVersion(ctx, agg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("copy events up to position=%d err=%w", position, err)
+	}
+
+	return c.checkpoints.SaveCheckpoint(ctx, c.name, position)
+}
+
+// targetVersion returns the version of the aggregate of e in the target, creating the aggregate if needed
+func targetVersion(ctx context.Context, tx repos.EventStore, e eventsourcing.Event) (int, error) {
+	version, err := tx.AggregateVersion(ctx, e.AggregateID)
+	if errors.Is(err, repos.ErrAggregateNotFound) {
+		return 0, tx.CreateIfNotExist(ctx, e.AggregateID, e.AggregateType)
+	}
+	return version, err
+}
+
+// copiedAggregate carries the versions of a copied aggregate to CheckAndUpdateVersion, which reads them from its root
+type copiedAggregate struct {
+	eventsourcing.AggregateRoot
+}
+
+func (a *copiedAggregate) RegisterEvents(eventsourcing.RegisterEventsFunc) error {
+	return nil
+}
+
+func (a *copiedAggregate) Transition(eventsourcing.Event) error {
+	return nil
+}
@@ -0,0 +1,59 @@
+package migration_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"event_sourcing_golang/eventstore/migration"
+	"event_sourcing_golang/eventstore/projection"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFollowCopiesEventsAppendedMeanwhile(t *testing.T) {
+	keys := eventsourcing.NewInMemoryKeyStore()
+	source := newRepos(t, keys)
+	target := newRepos(t, keys)
+	open(t, source, "acc-1", "owner-a")
+	open(t, source, "acc-2", "owner-b")
+
+	checkpoints := projection.NewInMemoryStore()
+	copier := migration.NewCopier("follow", target.EventStore(), checkpoints)
+	checkpoint := func(want int64) func() bool {
+		return func() bool {
+			position, err := checkpoints.LoadCheckpoint(context.Background(), "follow")
+			return err == nil && position == want
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- copier.Follow(ctx, source.EventStore()) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Fatalf("follow stopped with err=%v", err)
+		}
+	}()
+
+	eventually(t, "the copy of the existing events", checkpoint(2))
+	open(t, source, "acc-3", "owner-c")
+	open(t, source, "acc-4", "owner-d")
+	eventually(t, "the copy of the appended events", checkpoint(4))
+
+	for id, want := range map[string]string{"acc-1": "owner-a", "acc-3": "owner-c", "acc-4": "owner-d"} {
+		if got := owner(t, target, id); got != want {
+			t.Fatalf("copied owner of %s=%s, want %s", id, got, want)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package migration
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// record is an exported event. Its payload is kept as stored with its codec, exports written before the payload
+// was kept hold the data as JSON instead.
+type record struct {
+	eventsourcing.Event
+	Data    json.RawMessage `json:"data,omitempty"`
+	Codec   string          `json:"codec,omitempty"`
+	Payload []byte          `json:"payload,omitempty"`
+}
+
+// Export writes the events of source after fromPosition to w as NDJSON, one event per line in position order,
+// and returns the last position written so a later export can continue from it.
+// Event payloads are written as stored, so personal data stays encrypted and importing it needs the key store
+// of the source. It fails with repos.ErrEventsArchived when events after fromPosition were archived.
+func Export(ctx context.Context, source repos.EventStore, w io.Writer, fromPosition int64) (int64, error) {
+	if err := repos.CheckUnarchived(ctx, source, fromPosition); err != nil {
+		return fromPosition, err
+	}
+	enc := json.NewEncoder(w)
+	position := fromPosition
+	for {
+		events, err := source.ReadAll(ctx, position, defaultBatchSize)
+		if err != nil {
+			return position, err
+		}
+		stored, err := storedEvents(ctx, source, events)
+		if err != nil {
+			return position, err
+		}
+
+		for _, e := range events {
+			se, ok := stored[eventKey{e.AggregateID, e.Version}]
+			if !ok {
+				return position, fmt.Errorf("export event position=%d err=stored event not found", e.Position)
+			}
+			se.Event.Data = nil
+			if err := enc.Encode(record{Event: se.Event, Codec: se.Codec, Payload: se.Payload}); err != nil {
+				return position, fmt.Errorf("export event position=%d err=%w", e.Position, err)
+			}
+			position = e.Position
+		}
+		if len(events) < defaultBatchSize {
+			return position, nil
+		}
+	}
+}
+
+type eventKey struct {
+	aggregateID string
+	version     int
+}
+
+// storedEvents reads the stored payloads of events, with one read per aggregate
+func storedEvents(ctx context.Context, source repos.EventStore, events []eventsourcing.Event) (map[eventKey]repos.StoredEvent, error) {
+	type versionRange struct{ from, to int }
+	ranges := make(map[string]*versionRange)
+	var order []string
+	for _, e := range events {
+		r, ok := ranges[e.AggregateID]
+		if !ok {
+			ranges[e.AggregateID] = &versionRange{from: e.Version - 1, to: e.Version}
+			order = append(order, e.AggregateID)
+			continue
+		}
+		r.from = min(r.from, e.Version-1)
+		r.to = max(r.to, e.Version)
+	}
+
+	result := make(map[eventKey]repos.StoredEvent, len(events))
+	for _, id := range order {
+		stored, err := source.StoredEvents(ctx, id, ranges[id].from, ranges[id].to)
+		if err != nil {
+			return nil, err
+		}
+		for _, se := range stored {
+			result[eventKey{se.AggregateID, se.Version}] = se
+		}
+	}
+	return result, nil
+}
+
+// Import copies the events of an NDJSON file written by Export like Copy, decoding their data with the types
+// registered in s. The personal data is decrypted with the key store of s, which must hold the keys of the export.
+// Lines at or below the checkpoint are skipped, so an interrupted import can be run again.
+func (c *Copier) Import(ctx context.Context, r io.Reader, s eventsourcing.Serializer) (int64, error) {
+	position, err := c.checkpoints.LoadCheckpoint(ctx, c.name)
+	if err != nil {
+		return 0, err
+	}
+
+	dec := json.NewDecoder(r)
+	batch := make([]eventsourcing.Event, 0, c.batchSize)
+	for {
+		var rec record
+		err := dec.Decode(&rec)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return position, fmt.Errorf("read event after position=%d err=%w", position, err)
+		}
+		if rec.Position <= position {
+			continue
+		}
+
+		e := rec.Event
+		codec, payload := rec.Codec, rec.Payload
+		if payload == nil {
+			codec, payload = eventsourcing.CodecJSON, rec.Data
+		}
+		if err := s.UnmarshalEvent(e.AggregateType, &e, codec, payload); err != nil {
+			return position, fmt.Errorf("decode event position=%d err=%w", rec.Position, err)
+		}
+
+		batch = append(batch, e)
+		if len(batch) == c.batchSize {
+			if err := c.write(ctx, batch); err != nil {
+				return position, err
+			}
+			position = batch[len(batch)-1].Position
+			batch = batch[:0]
+		}
+	}
+
+	if len(batch) > 0 {
+		if err := c.write(ctx, batch); err != nil {
+			return position, err
+		}
+		position = batch[len(batch)-1].Position
+	}
+	return position, nil
+}
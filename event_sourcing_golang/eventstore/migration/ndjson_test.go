@@ -0,0 +1,136 @@
+package migration_test
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/migration"
+	"event_sourcing_golang/eventstore/projection"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+type Opened struct {
+	Owner string `pii:"data"`
+}
+
+type Account struct {
+	eventsourcing.AggregateRoot
+	Owner string `pii:"data"`
+}
+
+func (a *Account) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&Opened{})
+}
+
+func (a *Account) Transition(e eventsourcing.Event) error {
+	if v, ok := e.Data.(*Opened); ok {
+		a.Owner = v.Owner
+	}
+	return nil
+}
+
+func newRepos(t *testing.T, keys eventsourcing.KeyStore) repos.Repos {
+	t.Helper()
+	s := eventsourcing.NewSerializer()
+	if err := s.RegisterAggregate(&Account{}); err != nil {
+		t.Fatal(err)
+	}
+	s.UseKeyStore(keys)
+	return repos.NewInMemory(s)
+}
+
+func open(t *testing.T, r repos.Repos, id, owner string) {
+	t.Helper()
+	accounts := eventstore.NewRepository[*Account](eventstore.NewAggregateStore(r))
+	_, err := accounts.Create(context.Background(), id, func(a *Account) error {
+		return a.ApplyChange(a, &Opened{Owner: owner})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func owner(t *testing.T, r repos.Repos, id string) string {
+	t.Helper()
+	acc, err := eventstore.NewRepository[*Account](eventstore.NewAggregateStore(r)).Load(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return acc.Owner
+}
+
+func TestExportKeepsPersonalDataEncrypted(t *testing.T) {
+	ctx := context.Background()
+	keys := eventsourcing.NewInMemoryKeyStore()
+	source := newRepos(t, keys)
+	for i, id := range []string{"acc-1", "acc-2", "acc-3"} {
+		open(t, source, id, "owner-"+string(rune('a'+i)))
+	}
+
+	var buf bytes.Buffer
+	position, err := migration.Export(ctx, source.EventStore(), &buf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if position != 3 {
+		t.Fatalf("exported up to position=%d, want 3", position)
+	}
+	if strings.Contains(buf.String(), "owner-") {
+		t.Fatalf("export holds personal data in clear:\n%s", buf.String())
+	}
+
+	// the target shares the keys of the source, the imported events are read back in clear
+	target := newRepos(t, keys)
+	copier := migration.NewCopier("import", target.EventStore(), projection.NewInMemoryStore(), migration.WithBatchSize(2))
+	if position, err := copier.Import(ctx, bytes.NewReader(buf.Bytes()), target.Serializer()); err != nil || position != 3 {
+		t.Fatalf("imported up to position=%d err=%v, want 3", position, err)
+	}
+	if got := owner(t, target, "acc-2"); got != "owner-b" {
+		t.Fatalf("imported owner=%s, want owner-b", got)
+	}
+
+	// the subject is forgotten in the source after the export, the imported copy can't be read either
+	if err := keys.Forget("acc-2"); err != nil {
+		t.Fatal(err)
+	}
+	if got := owner(t, target, "acc-2"); got != eventsourcing.Redacted {
+		t.Fatalf("imported owner=%s after forget, want %s", got, eventsourcing.Redacted)
+	}
+}
+
+func TestImportDataWrittenAsJSON(t *testing.T) {
+	ctx := context.Background()
+	target := newRepos(t, eventsourcing.NewInMemoryKeyStore())
+	export := `{"aggregate_id":"acc-1","aggregate_type":"Account","version":1,"event_type":"Opened","schema_version":1,` +
+		`"data":{"Owner":"owner-a"},"position":1}` + "\n"
+
+	copier := migration.NewCopier("import", target.EventStore(), projection.NewInMemoryStore())
+	if _, err := copier.Import(ctx, strings.NewReader(export), target.Serializer()); err != nil {
+		t.Fatal(err)
+	}
+	if got := owner(t, target, "acc-1"); got != "owner-a" {
+		t.Fatalf("imported owner=%s, want owner-a", got)
+	}
+}
+
+func TestCopyIgnoresInvalidBatchSize(t *testing.T) {
+	ctx := context.Background()
+	keys := eventsourcing.NewInMemoryKeyStore()
+	source := newRepos(t, keys)
+	open(t, source, "acc-1", "owner-a")
+
+	target := newRepos(t, keys)
+	for _, n := range []int{0, -1} {
+		copier := migration.NewCopier("copy", target.EventStore(), projection.NewInMemoryStore(), migration.WithBatchSize(n))
+		if position, err := copier.Copy(ctx, source.EventStore()); err != nil || position != 1 {
+			t.Fatalf("batch size=%d copied up to position=%d err=%v, want 1", n, position, err)
+		}
+	}
+	if got := owner(t, target, "acc-1"); got != "owner-a" {
+		t.Fatalf("copied owner=%s, want owner-a", got)
+	}
+}
@@ -0,0 +1,62 @@
+package eventstore
+
+import (
+	"log"
+	"reflect"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+type Option func(*aggregateStore)
+
+// WithSnapshotPolicy sets the snapshot policy used for aggregates of the same type as agg
+func WithSnapshotPolicy(agg eventsourcing.Aggregate, p SnapshotPolicy) Option {
+	return func(as *aggregateStore) {
+		as.snapshotPolicies[reflect.TypeOf(agg).Elem().Name()] = p
+	}
+}
+
+// WithDefaultSnapshotPolicy sets the snapshot policy for aggregate types without their own policy
+func WithDefaultSnapshotPolicy(p SnapshotPolicy) Option {
+	return func(as *aggregateStore) {
+		as.defaultSnapshotPolicy = p
+	}
+}
+
+// WithSnapshotErrorHandler sets the handler receiving errors of asynchronous snapshots and stale snapshot purges,
+// they are logged by default
+func WithSnapshotErrorHandler(fn func(error)) Option {
+	return func(as *aggregateStore) {
+		as.onSnapshotError = fn
+	}
+}
+
+// WithStaleSnapshotPurge makes loads delete the snapshots of the aggregate written with another schema, they are
+// otherwise ignored and left for a SnapshotRegenerator to replace
+func WithStaleSnapshotPurge() Option {
+	return func(as *aggregateStore) {
+		as.purgeStaleSnapshots = true
+	}
+}
+
+// WithOutbox makes Save write its events to the outbox in the same transaction,
+// an outbox.Relay then publishes them once committed
+func WithOutbox() Option {
+	return func(as *aggregateStore) {
+		as.outbox = true
+	}
+}
+
+// WithCache keeps up to size hydrated aggregates in a LRU cache. A cached aggregate only gets the events stored
+// after it replayed, and Save drops it from the cache. Aggregates are cached encoded like their snapshots.
+func WithCache(size int) Option {
+	return func(as *aggregateStore) {
+		if size > 0 {
+			as.cache = newAggregateCache(size)
+		}
+	}
+}
+
+func defaultSnapshotErrorHandler(err error) {
+	log.Printf("eventstore: snapshot failed err=%v", err)
+}
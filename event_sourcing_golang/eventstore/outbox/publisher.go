@@ -0,0 +1,40 @@
+package outbox
+
+import (
+	"context"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// Publisher delivers an event to the outside world, an error makes the relay retry it later
+type Publisher interface {
+	Publish(ctx context.Context, e eventsourcing.Event) error
+}
+
+var _ Publisher = (*ChannelPublisher)(nil)
+
+// ChannelPublisher hands events to in-process consumers through a channel
+type ChannelPublisher struct {
+	ch chan eventsourcing.Event
+}
+
+func NewChannelPublisher(buffer int) *ChannelPublisher {
+	return &ChannelPublisher{
+		ch: make(chan eventsourcing.Event, buffer),
+	}
+}
+
+// Events returns the channel consumers read published events from
+func (p *ChannelPublisher) Events() <-chan eventsourcing.Event {
+	return p.ch
+}
+
+// Publish blocks until a consumer takes the event or ctx is done
+func (p *ChannelPublisher) Publish(ctx context.Context, e eventsourcing.Event) error {
+	select {
+	case p.ch <- e:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,128 @@
+package outbox
+
+import (
+	"context"
+	"time"
+
+	"event_sourcing_golang/eventstore/repos"
+)
+
+const (
+	defaultBatchSize    = 100
+	defaultPollInterval = time.Second
+	defaultMinBackoff   = time.Second
+	defaultMaxBackoff   = 5 * time.Minute
+)
+
+// Relay publishes the events recorded in the outbox and marks them delivered.
+// Failed messages are retried with exponential backoff, later events of the same aggregate wait for them.
+// Delivery is at least once: a crash between Publish and marking the message delivered publishes it again.
+// A single relay should run per store.
+type Relay struct {
+	es        repos.EventStore
+	publisher Publisher
+
+	batchSize    int
+	pollInterval time.Duration
+	backoff      func(attempts int) time.Duration
+}
+
+type RelayOption func(*Relay)
+
+// WithBatchSize sets how many messages are published per poll, n must be positive
+func WithBatchSize(n int) RelayOption {
+	return func(r *Relay) {
+		if n > 0 {
+			r.batchSize = n
+		}
+	}
+}
+
+// WithPollInterval sets how long the relay waits when the outbox has nothing due
+func WithPollInterval(d time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.pollInterval = d
+	}
+}
+
+// WithBackoff sets the delay before retrying a message that already failed attempts times
+func WithBackoff(fn func(attempts int) time.Duration) RelayOption {
+	return func(r *Relay) {
+		r.backoff = fn
+	}
+}
+
+func NewRelay(es repos.EventStore, publisher Publisher, opts ...RelayOption) *Relay {
+	r := &Relay{
+		es:           es,
+		publisher:    publisher,
+		batchSize:    defaultBatchSize,
+		pollInterval: defaultPollInterval,
+		backoff:      ExponentialBackoff(defaultMinBackoff, defaultMaxBackoff),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	return r
+}
+
+// ExponentialBackoff doubles the delay from minDelay on every failed attempt, up to maxDelay
+func ExponentialBackoff(minDelay, maxDelay time.Duration) func(attempts int) time.Duration {
+	return func(attempts int) time.Duration {
+		d := minDelay
+		for i := 1; i < attempts && d < maxDelay; i++ {
+			d *= 2
+		}
+		if d > maxDelay {
+			d = maxDelay
+		}
+		return d
+	}
+}
+
+// Run relays outbox messages until ctx is done or the store fails
+func (r *Relay) Run(ctx context.Context) error {
+	for {
+		n, err := r.RelayOnce(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if n == r.batchSize {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(r.pollInterval):
+		}
+	}
+}
+
+// RelayOnce publishes one batch of due messages and returns how many were fetched
+func (r *Relay) RelayOnce(ctx context.Context) (int, error) {
+	msgs, err := r.es.PendingOutbox(ctx, time.Now(), r.batchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, msg := range msgs {
+		if err := r.publisher.Publish(ctx, msg.Event); err != nil {
+			next := time.Now().Add(r.backoff(msg.Attempts + 1))
+			if err := r.es.MarkOutboxFailed(ctx, msg.ID, next, err.Error()); err != nil {
+				return len(msgs), err
+			}
+			continue
+		}
+
+		if err := r.es.MarkOutboxDelivered(ctx, msg.ID); err != nil {
+			return len(msgs), err
+		}
+	}
+
+	return len(msgs), nil
+}
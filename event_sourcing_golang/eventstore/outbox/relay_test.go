@@ -0,0 +1,276 @@
+package outbox_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/outbox"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type Deposited struct{ Amount int }
+
+type Account struct {
+	eventsourcing.AggregateRoot
+	Balance int
+}
+
+func (a *Account) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&Deposited{})
+}
+
+func (a *Account) Transition(e eventsourcing.Event) error {
+	if v, ok := e.Data.(*Deposited); ok {
+		a.Balance += v.Amount
+	}
+	return nil
+}
+
+// recorder publishes every event but the ones failing lists, each of those fails once
+type recorder struct {
+	mu        sync.Mutex
+	published []string
+	failing   map[string]bool
+}
+
+func newRecorder(failing ...string) *recorder {
+	r := &recorder{failing: make(map[string]bool)}
+	for _, id := range failing {
+		r.failing[id] = true
+	}
+	return r
+}
+
+func (r *recorder) Publish(ctx context.Context, e eventsourcing.Event) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id := fmt.Sprintf("%s:%d", e.AggregateID, e.Version)
+	if r.failing[id] {
+		delete(r.failing, id)
+		return errors.New("broker unavailable")
+	}
+	r.published = append(r.published, id)
+	return nil
+}
+
+func (r *recorder) events() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.published...)
+}
+
+type store struct {
+	name string
+	open func(t *testing.T, s eventsourcing.Serializer) repos.Repos
+}
+
+var stores = []store{
+	{"InMemory", func(t *testing.T, s eventsourcing.Serializer) repos.Repos {
+		return repos.NewInMemory(s)
+	}},
+	{"SQLite", func(t *testing.T, s eventsourcing.Serializer) repos.Repos {
+		db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "es.db")), &gorm.Config{Logger: logger.Discard})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repos.Migrate(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+		return repos.New(db, s)
+	}},
+}
+
+// setup returns the event store of a new store and a function saving deposits through the outbox
+func setup(t *testing.T, st store) (repos.EventStore, func(id string, amounts ...int)) {
+	t.Helper()
+	s := eventsourcing.NewSerializer()
+	if err := s.RegisterAggregate(&Account{}); err != nil {
+		t.Fatal(err)
+	}
+	r := st.open(t, s)
+	accounts := eventstore.NewRepository[*Account](eventstore.NewAggregateStore(r, eventstore.WithOutbox()))
+
+	deposit := func(id string, amounts ...int) {
+		t.Helper()
+		ctx := context.Background()
+		for _, amount := range amounts {
+			apply := func(a *Account) error {
+				return a.ApplyChange(a, &Deposited{Amount: amount})
+			}
+			_, err := accounts.Update(ctx, id, apply)
+			if errors.Is(err, eventstore.ErrAggregateNotFound) {
+				_, err = accounts.Create(ctx, id, apply)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return r.EventStore(), deposit
+}
+
+// drain relays until the outbox has nothing due and returns how many rounds fetched messages
+func drain(t *testing.T, relay *outbox.Relay) int {
+	t.Helper()
+	rounds := 0
+	for ; rounds < 100; rounds++ {
+		n, err := relay.RelayOnce(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n == 0 {
+			return rounds
+		}
+	}
+	t.Fatal("outbox never drained")
+	return rounds
+}
+
+func equal(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestRelayRetriesInOrder(t *testing.T) {
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			es, deposit := setup(t, st)
+			deposit("acc-1", 1, 2, 3)
+			deposit("acc-2", 10)
+
+			var attempts []int
+			pub := newRecorder("acc-1:1")
+			relay := outbox.NewRelay(es, pub, outbox.WithBackoff(func(n int) time.Duration {
+				attempts = append(attempts, n)
+				return 0
+			}))
+
+			// the failure of acc-1 does not hold back acc-2
+			n, err := relay.RelayOnce(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 2 {
+				t.Fatalf("%d messages fetched, want the oldest of each aggregate", n)
+			}
+			if got := pub.events(); !equal(got, []string{"acc-2:1"}) {
+				t.Fatalf("published=%v after the failure, want [acc-2:1]", got)
+			}
+			if len(attempts) != 1 || attempts[0] != 1 {
+				t.Fatalf("backoff called with %v, want [1]", attempts)
+			}
+
+			drain(t, relay)
+			want := []string{"acc-2:1", "acc-1:1", "acc-1:2", "acc-1:3"}
+			if got := pub.events(); !equal(got, want) {
+				t.Fatalf("published=%v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRelayWaitsForBackoff(t *testing.T) {
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			es, deposit := setup(t, st)
+			deposit("acc-1", 1, 2)
+
+			pub := newRecorder("acc-1:1")
+			relay := outbox.NewRelay(es, pub, outbox.WithBackoff(func(int) time.Duration {
+				return time.Hour
+			}))
+			if rounds := drain(t, relay); rounds != 1 {
+				t.Fatalf("%d rounds fetched messages, want 1", rounds)
+			}
+			// the failed event is not due yet and the later one waits for it
+			if got := pub.events(); len(got) != 0 {
+				t.Fatalf("published=%v before the backoff elapsed, want nothing", got)
+			}
+
+			msgs, err := es.PendingOutbox(context.Background(), time.Now().Add(2*time.Hour), 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msgs) != 1 || msgs[0].Event.Version != 1 || msgs[0].Attempts != 1 {
+				t.Fatalf("pending after the backoff=%+v, want v1 after 1 attempt", msgs)
+			}
+		})
+	}
+}
+
+func TestRelayRunPublishesToChannel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	es, deposit := setup(t, stores[0])
+	deposit("acc-1", 1, 2, 3)
+
+	pub := outbox.NewChannelPublisher(0)
+	relay := outbox.NewRelay(es, pub, outbox.WithPollInterval(time.Millisecond))
+	done := make(chan error, 1)
+	go func() { done <- relay.Run(ctx) }()
+
+	for want := 1; want <= 3; want++ {
+		select {
+		case e := <-pub.Events():
+			if e.Version != want || e.Data.(*Deposited).Amount != want {
+				t.Fatalf("received v%d amount=%d, want v%d", e.Version, e.Data.(*Deposited).Amount, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("v%d never published", want)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRelayIgnoresInvalidBatchSize(t *testing.T) {
+	for _, st := range stores {
+		for _, n := range []int{0, -1} {
+			t.Run(fmt.Sprintf("%s/%d", st.name, n), func(t *testing.T) {
+				es, deposit := setup(t, st)
+				for _, id := range []string{"acc-1", "acc-2", "acc-3"} {
+					deposit(id, 1)
+				}
+
+				pub := newRecorder()
+				relay := outbox.NewRelay(es, pub, outbox.WithBatchSize(n))
+				if got, err := relay.RelayOnce(context.Background()); err != nil || got != 3 {
+					t.Fatalf("relayed %d messages err=%v, want 3", got, err)
+				}
+				if got, want := pub.events(), []string{"acc-1:1", "acc-2:1", "acc-3:1"}; !equal(got, want) {
+					t.Fatalf("published %v, want %v", got, want)
+				}
+			})
+		}
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	backoff := outbox.ExponentialBackoff(time.Second, 5*time.Second)
+	for attempts, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 30: 5 * time.Second} {
+		if got := backoff(attempts); got != want {
+			t.Fatalf("backoff(%d)=%s, want %s", attempts, got, want)
+		}
+	}
+}
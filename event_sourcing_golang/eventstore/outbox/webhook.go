@@ -0,0 +1,61 @@
+package outbox
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+var _ Publisher = (*WebhookPublisher)(nil)
+
+// WebhookPublisher POSTs every event as JSON to an HTTP endpoint, any non 2xx response is a failure.
+// The X-Event-ID header is stable across retries so receivers can deduplicate.
+type WebhookPublisher struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookPublisher(url string, client *http.Client) *WebhookPublisher {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &WebhookPublisher{
+		url:    url,
+		client: client,
+	}
+}
+
+func (p *WebhookPublisher) Publish(ctx context.Context, e eventsourcing.Event) error {
+	body, err := json.Marshal(e)
+	if err != nil {
+		return fmt.Errorf("marshal event err=%w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", e.AggregateID+":"+strconv.Itoa(e.Version))
+	req.Header.Set("X-Event-Type", e.AggregateType+"_"+e.EventType)
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("post webhook err=%w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with status=%d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package process
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// ErrCommandRejected is wrapped by the error of a Dispatcher rejecting a command for good
+var ErrCommandRejected = errors.New("command rejected")
+
+// Command is a command issued by a process
+type Command struct {
+	// ID is the idempotency ID of the command, the same for every delivery of it
+	ID   string
+	Name string
+	Data json.RawMessage
+	// CorrelationID and CausationID are given to the events the command saves
+	CorrelationID string
+	CausationID   string
+}
+
+// Decode decodes the data of the command into v
+func (c Command) Decode(v interface{}) error {
+	if err := json.Unmarshal(c.Data, v); err != nil {
+		return fmt.Errorf("decode command id=%s name=%s err=%w", c.ID, c.Name, err)
+	}
+	return nil
+}
+
+// Dispatcher delivers the commands of processes. A command is delivered again until Dispatch succeeds, even after
+// it was handled when the manager stopped before recording it, so the ctx carries the ID of the command, see
+// eventsourcing.WithCommandID: saving its changes with ctx saves them only once.
+// The commands of a process are delivered in order, a command the dispatcher rejects for good must return an error
+// wrapping ErrCommandRejected rather than hold up the following ones: the process records it as CommandRejected
+// and the handler registered with Manager.OnRejected reacts to it.
+type Dispatcher interface {
+	Dispatch(ctx context.Context, cmd Command) error
+}
+
+type DispatcherFunc func(ctx context.Context, cmd Command) error
+
+func (f DispatcherFunc) Dispatch(ctx context.Context, cmd Command) error {
+	return f(ctx, cmd)
+}
+
+// commandContext returns the context cmd is dispatched with
+func commandContext(ctx context.Context, cmd Command) context.Context {
+	ctx = eventsourcing.WithCommandID(ctx, cmd.ID)
+	ctx = eventsourcing.WithCorrelationID(ctx, cmd.CorrelationID)
+	return eventsourcing.WithCausationID(ctx, cmd.CausationID)
+}
@@ -0,0 +1,464 @@
+// Package process runs process managers, also known as sagas: long-running processes reacting to the events of
+// some aggregates by sending commands to others, such as crediting the target account of a transfer once its
+// source account is debited.
+//
+// A process is an aggregate embedding Saga, saved through an AggregateStore like any other aggregate. The Manager
+// follows the global stream and hands each event it has a handler for to the process it correlates with, by
+// default the process of the correlation ID of the event. The process records the commands it sends and the
+// deadlines it sets as its own events, the Manager then delivers the commands and fires the deadlines when due:
+//
+//	m := process.NewManager[*Transfer]("transfer", r.EventStore(), as, checkpoints, dispatcher).
+//		On(&bank.MoneyWithdrawn{}, func(ctx context.Context, t *Transfer, e eventsourcing.Event) error {
+//			return t.Send("CreditAccount", ...)
+//		}).
+//		OnDeadline("timeout", func(ctx context.Context, t *Transfer, d process.Deadline) error {
+//			return t.Complete()
+//		})
+//	err := m.Run(ctx)
+//
+// A command the Dispatcher rejects is recorded and handed to the handler registered with OnRejected.
+// A single manager should run per process type.
+package process
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"slices"
+	"time"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+const (
+	defaultRetryDelay = 5 * time.Second
+	defaultBatchSize  = 100
+)
+
+// HandlerFunc reacts to an event by changing the process p, it must not have other side effects as an event is
+// handled again when saving the process fails
+type HandlerFunc[P Process] func(ctx context.Context, p P, e eventsourcing.Event) error
+
+// DeadlineFunc reacts to the deadline d of the process p firing
+type DeadlineFunc[P Process] func(ctx context.Context, p P, d Deadline) error
+
+// RejectionFunc reacts to the Dispatcher rejecting the command cmd of the process p with err
+type RejectionFunc[P Process] func(ctx context.Context, p P, cmd Command, err error) error
+
+// CheckpointStore keeps the last handled position of every manager, projection stores implement it
+type CheckpointStore interface {
+	// LoadCheckpoint returns the last handled position, 0 if the manager never ran
+	LoadCheckpoint(ctx context.Context, name string) (int64, error)
+	SaveCheckpoint(ctx context.Context, name string, position int64) error
+}
+
+type managerOptions struct {
+	correlate  func(eventsourcing.Event) string
+	retryDelay time.Duration
+	batchSize  int
+	onError    func(error)
+}
+
+type ManagerOption func(*managerOptions)
+
+// WithCorrelation sets how the key of the process an event belongs to is taken from the event, events with an
+// empty key are skipped. Events are correlated by their correlation ID by default.
+func WithCorrelation(fn func(eventsourcing.Event) string) ManagerOption {
+	return func(o *managerOptions) {
+		o.correlate = fn
+	}
+}
+
+// ByExtra correlates events by the string stored under key in their metadata, see ApplyChangeWithMetadata
+func ByExtra(key string) func(eventsourcing.Event) string {
+	return func(e eventsourcing.Event) string {
+		v, _ := e.Metadata.Extra[key].(string)
+		return v
+	}
+}
+
+func byCorrelationID(e eventsourcing.Event) string {
+	return e.Metadata.CorrelationID
+}
+
+// WithRetryDelay sets how long the commands of a process wait after a failed delivery before they are sent again
+func WithRetryDelay(d time.Duration) ManagerOption {
+	return func(o *managerOptions) {
+		o.retryDelay = d
+	}
+}
+
+// WithErrorHandler sets the function failed deliveries are reported to, they are logged by default
+func WithErrorHandler(fn func(error)) ManagerOption {
+	return func(o *managerOptions) {
+		o.onError = fn
+	}
+}
+
+// WithBatchSize sets how many processes are listed at a time when the manager starts
+func WithBatchSize(n int) ManagerOption {
+	return func(o *managerOptions) {
+		if n > 0 {
+			o.batchSize = n
+		}
+	}
+}
+
+func defaultErrorHandler(err error) {
+	log.Printf("process: command delivery failed err=%v", err)
+}
+
+// Manager runs the processes of type P, a pointer to a struct embedding Saga. The process correlated by key is
+// saved under the ID <name>:<key>.
+type Manager[P Process] struct {
+	name        string
+	es          repos.EventStore
+	store       eventstore.AggregateStore
+	checkpoints CheckpointStore
+	dispatcher  Dispatcher
+	opts        managerOptions
+
+	aggType    string
+	handlers   map[reflect.Type]HandlerFunc[P]
+	deadlines  map[string]DeadlineFunc[P]
+	rejections map[string]RejectionFunc[P]
+
+	// wake keeps when each process with commands to deliver or deadlines must be handled, it is only used by Run
+	wake map[string]time.Time
+}
+
+// NewManager creates a manager, name is its checkpoint key and the prefix of the IDs of its processes
+func NewManager[P Process](name string, es repos.EventStore, store eventstore.AggregateStore,
+	checkpoints CheckpointStore, dispatcher Dispatcher, opts ...ManagerOption) *Manager[P] {
+	o := managerOptions{
+		correlate:  byCorrelationID,
+		retryDelay: defaultRetryDelay,
+		batchSize:  defaultBatchSize,
+		onError:    defaultErrorHandler,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	var zero P
+	return &Manager[P]{
+		name:        name,
+		es:          es,
+		store:       store,
+		checkpoints: checkpoints,
+		dispatcher:  dispatcher,
+		opts:        o,
+		aggType:     reflect.TypeOf(zero).Elem().Name(),
+		handlers:    make(map[reflect.Type]HandlerFunc[P]),
+		deadlines:   make(map[string]DeadlineFunc[P]),
+		rejections:  make(map[string]RejectionFunc[P]),
+	}
+}
+
+// On registers h for the events of the same type as event, event must be a pointer to struct.
+// The process of an event that was never saved has version 0, h starts it by recording a change.
+func (m *Manager[P]) On(event interface{}, h HandlerFunc[P]) *Manager[P] {
+	m.handlers[reflect.TypeOf(event)] = h
+	return m
+}
+
+// OnDeadline registers h for the deadlines named name, a deadline without handler just fires
+func (m *Manager[P]) OnDeadline(name string, h DeadlineFunc[P]) *Manager[P] {
+	m.deadlines[name] = h
+	return m
+}
+
+// OnRejected registers h for the rejections of the commands named name, a rejection without handler just drops
+// the command
+func (m *Manager[P]) OnRejected(name string, h RejectionFunc[P]) *Manager[P] {
+	m.rejections[name] = h
+	return m
+}
+
+// Run schedules the processes left with commands to deliver or deadlines, then handles the events from the
+// checkpoint of the manager until ctx is done or a handler fails. Events are delivered at least once but an event
+// already saved by its process is not handled again.
+// Starting loads every process of the type to find the scheduled ones.
+func (m *Manager[P]) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	if err := m.recover(ctx); err != nil {
+		return fmt.Errorf("process %s recover err=%w", m.name, err)
+	}
+	position, err := m.checkpoints.LoadCheckpoint(ctx, m.name)
+	if err != nil {
+		return err
+	}
+
+	sub := m.es.Subscribe(ctx, position)
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	for {
+		var due <-chan time.Time
+		if at, ok := m.nextWake(); ok {
+			timer.Reset(time.Until(at))
+			due = timer.C
+		}
+
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				// a subscription stopped by ctx is a normal shutdown
+				if err := sub.Err(); err != nil && ctx.Err() == nil {
+					return err
+				}
+				return nil
+			}
+			if err := m.handle(ctx, e); err != nil {
+				return fmt.Errorf("process %s position=%d err=%w", m.name, e.Position, err)
+			}
+			if err := m.checkpoints.SaveCheckpoint(ctx, m.name, e.Position); err != nil {
+				return err
+			}
+		case <-due:
+			if err := m.wakeDue(ctx); err != nil {
+				return fmt.Errorf("process %s err=%w", m.name, err)
+			}
+		}
+	}
+}
+
+// recover schedules the processes left with commands to deliver or deadlines when the manager stopped
+func (m *Manager[P]) recover(ctx context.Context) error {
+	m.wake = make(map[string]time.Time)
+	afterID := ""
+	for {
+		infos, err := m.es.Aggregates(ctx, m.aggType, afterID, m.opts.batchSize)
+		if err != nil {
+			return err
+		}
+
+		for _, info := range infos {
+			p, err := m.load(ctx, info.ID)
+			if err != nil {
+				return err
+			}
+			if at, ok := p.saga().wakeAt(); ok {
+				m.wake[info.ID] = at
+			}
+		}
+
+		if len(infos) < m.opts.batchSize {
+			return nil
+		}
+		afterID = infos[len(infos)-1].ID
+	}
+}
+
+func (m *Manager[P]) nextWake() (time.Time, bool) {
+	var next time.Time
+	for _, at := range m.wake {
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// wakeDue handles every process whose wake up time has come
+func (m *Manager[P]) wakeDue(ctx context.Context) error {
+	now := time.Now()
+	for id, at := range m.wake {
+		if at.After(now) {
+			continue
+		}
+		p, err := m.load(ctx, id)
+		if err != nil {
+			return err
+		}
+		if err := m.settle(ctx, p); err != nil {
+			return fmt.Errorf("id=%s err=%w", id, err)
+		}
+	}
+	return nil
+}
+
+// handle hands e to the process it correlates with and saves the process with e as its command
+func (m *Manager[P]) handle(ctx context.Context, e eventsourcing.Event) error {
+	h, ok := m.handlers[reflect.TypeOf(e.Data)]
+	if !ok || e.AggregateType == m.aggType {
+		return nil
+	}
+	key := m.opts.correlate(e)
+	if key == "" {
+		return nil
+	}
+
+	p, err := m.load(ctx, m.name+":"+key)
+	if err != nil {
+		return err
+	}
+	if p.saga().Completed {
+		return nil
+	}
+
+	commandID := p.Root().AggregateID() + "/event/" + eventKey(e)
+	_, err = m.es.LookupCommand(ctx, commandID)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, repos.ErrCommandNotFound) {
+		return err
+	}
+
+	ctx = eventsourcing.CausedBy(ctx, e)
+	p.saga().bind(p, e.Metadata)
+	if err := h(ctx, p, e); err != nil {
+		return fmt.Errorf("handle event type=%s id=%s err=%w", e.EventType, e.AggregateID, err)
+	}
+	if !p.Root().IsUnsaved() {
+		return nil
+	}
+	if err := m.store.Save(eventsourcing.WithCommandID(ctx, commandID), p); err != nil {
+		return err
+	}
+
+	return m.settle(ctx, p)
+}
+
+// eventKey identifies e, events stored before event IDs by their aggregate and version
+func eventKey(e eventsourcing.Event) string {
+	if e.Metadata.EventID != "" {
+		return e.Metadata.EventID
+	}
+	return fmt.Sprintf("%s@%d", e.AggregateID, e.Version)
+}
+
+// settle fires the due deadlines of p and delivers its commands, then sets when p must be woken up next
+func (m *Manager[P]) settle(ctx context.Context, p P) error {
+	s := p.saga()
+	id := p.Root().AggregateID()
+	now := time.Now()
+
+	// the due deadlines fire in the order of their time whatever the order they were scheduled in
+	due := slices.DeleteFunc(slices.Clone(s.Deadlines), func(d Deadline) bool { return d.At.After(now) })
+	slices.SortStableFunc(due, func(a, b Deadline) int { return a.At.Compare(b.At) })
+	for _, d := range due {
+		// an earlier deadline may have cancelled it
+		if _, ok := s.deadline(d.ID); !ok {
+			continue
+		}
+		if err := m.fire(ctx, p, d); err != nil {
+			return err
+		}
+	}
+
+	delivered, err := m.deliver(ctx, p)
+	if err != nil {
+		return err
+	}
+
+	if !delivered {
+		m.wake[id] = now.Add(m.opts.retryDelay)
+	} else if at, ok := s.wakeAt(); ok {
+		m.wake[id] = at
+	} else {
+		delete(m.wake, id)
+	}
+	return nil
+}
+
+// fire runs the handler of the deadline d and saves p with the deadline fired
+func (m *Manager[P]) fire(ctx context.Context, p P, d Deadline) error {
+	ctx = eventsourcing.WithCorrelationID(ctx, d.CorrelationID)
+	ctx = eventsourcing.WithCausationID(ctx, d.ID)
+	s := p.saga()
+	s.bind(p, eventsourcing.Metadata{EventID: d.ID, CorrelationID: d.CorrelationID})
+
+	if h, ok := m.deadlines[d.Name]; ok {
+		if err := h(ctx, p, d); err != nil {
+			return fmt.Errorf("deadline id=%s name=%s err=%w", d.ID, d.Name, err)
+		}
+	}
+	// the handler may have scheduled it again or completed the process
+	if _, ok := s.deadline(d.ID); ok {
+		if err := s.apply(&DeadlineFired{ID: d.ID}); err != nil {
+			return err
+		}
+	}
+
+	return m.save(ctx, p)
+}
+
+// deliver dispatches the commands of p in order and saves each delivered or rejected one, it returns false when a
+// dispatch failed and the commands from it wait for a retry
+func (m *Manager[P]) deliver(ctx context.Context, p P) (bool, error) {
+	s := p.saga()
+	s.bind(p, s.trigger)
+
+	// a rejection handler may issue more commands, they are delivered too
+	for len(s.Commands) > 0 {
+		cmd := s.Commands[0]
+		cmdCtx := commandContext(ctx, cmd)
+		err := m.dispatcher.Dispatch(cmdCtx, cmd)
+		if errors.Is(err, ErrCommandRejected) {
+			if err := m.reject(cmdCtx, p, cmd, err); err != nil {
+				return false, err
+			}
+			continue
+		}
+		if err != nil {
+			m.opts.onError(fmt.Errorf("process %s command id=%s name=%s err=%w", m.name, cmd.ID, cmd.Name, err))
+			return false, nil
+		}
+
+		if err := s.apply(&CommandDelivered{ID: cmd.ID}); err != nil {
+			return false, err
+		}
+		// the delivery is caused by the command, not saved as the command
+		if err := m.save(eventsourcing.WithCausationID(eventsourcing.WithCommandID(cmdCtx, ""), cmd.ID), p); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// reject records the rejection of cmd, runs its handler and saves p
+func (m *Manager[P]) reject(ctx context.Context, p P, cmd Command, reason error) error {
+	s := p.saga()
+	s.bind(p, eventsourcing.Metadata{EventID: cmd.ID, CorrelationID: cmd.CorrelationID})
+	if err := s.apply(&CommandRejected{ID: cmd.ID, Reason: reason.Error()}); err != nil {
+		return err
+	}
+	if h, ok := m.rejections[cmd.Name]; ok {
+		if err := h(ctx, p, cmd, reason); err != nil {
+			return fmt.Errorf("rejected command id=%s name=%s err=%w", cmd.ID, cmd.Name, err)
+		}
+	}
+
+	// like a delivery the rejection is caused by the command
+	return m.save(eventsourcing.WithCausationID(eventsourcing.WithCommandID(ctx, ""), cmd.ID), p)
+}
+
+func (m *Manager[P]) save(ctx context.Context, p P) error {
+	if !p.Root().IsUnsaved() {
+		return nil
+	}
+	return m.store.Save(ctx, p)
+}
+
+// load returns the process with id, a new process with the ID when it was never saved
+func (m *Manager[P]) load(ctx context.Context, id string) (P, error) {
+	var zero P
+	p := reflect.New(reflect.TypeOf(zero).Elem()).Interface().(P)
+	err := m.store.Get(ctx, id, p)
+	if errors.Is(err, eventstore.ErrAggregateNotFound) {
+		err = p.Root().SetID(id)
+	}
+	if err != nil {
+		return p, err
+	}
+
+	p.saga().bind(p, eventsourcing.Metadata{})
+	return p, nil
+}
@@ -0,0 +1,269 @@
+package process_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/process"
+	"event_sourcing_golang/eventstore/projection"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+type Deposited struct{ Amount int }
+
+type Account struct {
+	eventsourcing.AggregateRoot
+}
+
+func (a *Account) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&Deposited{})
+}
+
+func (a *Account) Transition(e eventsourcing.Event) error {
+	return nil
+}
+
+// Events of the payout process
+type DepositSeen struct{}
+type DeadlineNoted struct{ Name string }
+
+// Payout is the process of the tests, it records what it reacted to
+type Payout struct {
+	process.Saga
+	Seen  int
+	Fired []string
+}
+
+func (p *Payout) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(append(process.SagaEvents(), &DepositSeen{}, &DeadlineNoted{})...)
+}
+
+func (p *Payout) Transition(e eventsourcing.Event) error {
+	if p.Saga.Transition(e) {
+		return nil
+	}
+	switch v := e.Data.(type) {
+	case *DepositSeen:
+		p.Seen++
+	case *DeadlineNoted:
+		p.Fired = append(p.Fired, v.Name)
+	}
+	return nil
+}
+
+// dispatcher records the commands it is given, the ones named in failing fail once and the ones named in
+// rejecting are rejected
+type dispatcher struct {
+	mu        sync.Mutex
+	calls     []process.Command
+	failing   map[string]bool
+	rejecting map[string]bool
+}
+
+func (d *dispatcher) Dispatch(ctx context.Context, cmd process.Command) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.calls = append(d.calls, cmd)
+	if d.failing[cmd.Name] {
+		delete(d.failing, cmd.Name)
+		return errors.New("unavailable")
+	}
+	if d.rejecting[cmd.Name] {
+		return process.ErrCommandRejected
+	}
+	return nil
+}
+
+// names returns the names of the commands given so far
+func (d *dispatcher) names() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var result []string
+	for _, cmd := range d.calls {
+		result = append(result, cmd.Name)
+	}
+	return result
+}
+
+type fixture struct {
+	r           repos.Repos
+	as          eventstore.AggregateStore
+	checkpoints *projection.MemoryStore
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	s := eventsourcing.NewSerializer()
+	for _, agg := range []eventsourcing.Aggregate{&Account{}, &Payout{}} {
+		if err := s.RegisterAggregate(agg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := repos.NewInMemory(s)
+	return &fixture{r: r, as: eventstore.NewAggregateStore(r), checkpoints: projection.NewInMemoryStore()}
+}
+
+// manager returns a manager of payouts sending Pay for every deposit
+func (f *fixture) manager(d process.Dispatcher, opts ...process.ManagerOption) *process.Manager[*Payout] {
+	return process.NewManager[*Payout]("payout", f.r.EventStore(), f.as, f.checkpoints, d, opts...).
+		On(&Deposited{}, func(ctx context.Context, p *Payout, e eventsourcing.Event) error {
+			if err := p.ApplyChange(p, &DepositSeen{}); err != nil {
+				return err
+			}
+			return p.Send("Pay", e.Data.(*Deposited).Amount)
+		})
+}
+
+// deposit saves a deposit on a new account, correlated with the payout key
+func (f *fixture) deposit(t *testing.T, id, key string) {
+	t.Helper()
+	ctx := eventsourcing.WithCorrelationID(context.Background(), key)
+	_, err := eventstore.NewRepository[*Account](f.as).Create(ctx, id, func(a *Account) error {
+		return a.ApplyChange(a, &Deposited{Amount: 10})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (f *fixture) payout(t *testing.T, key string) *Payout {
+	t.Helper()
+	p := &Payout{}
+	err := f.as.Get(context.Background(), "payout:"+key, p)
+	if err != nil && !errors.Is(err, eventstore.ErrAggregateNotFound) {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// run runs m until the returned function is called
+func run(t *testing.T, m *process.Manager[*Payout]) func() {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- m.Run(ctx) }()
+	return func() {
+		t.Helper()
+		cancel()
+		if err := <-stopped; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestEventHandledOnceWhenReplayed(t *testing.T) {
+	f := newFixture(t)
+	d := &dispatcher{}
+	stop := run(t, f.manager(d))
+	f.deposit(t, "acc-1", "pay-1")
+	eventually(t, "the first payout", func() bool { return len(f.payout(t, "pay-1").Commands) == 0 && len(d.names()) == 1 })
+	stop()
+
+	// the manager stopped before saving its checkpoint, the deposit is handled again
+	if err := f.checkpoints.SaveCheckpoint(context.Background(), "payout", 0); err != nil {
+		t.Fatal(err)
+	}
+	stop = run(t, f.manager(d))
+	f.deposit(t, "acc-2", "pay-2")
+	eventually(t, "the second payout", func() bool { return f.payout(t, "pay-2").Seen == 1 && len(d.names()) == 2 })
+	stop()
+
+	if got := f.payout(t, "pay-1"); got.Seen != 1 {
+		t.Fatalf("first deposit seen %d times, want once", got.Seen)
+	}
+	if got := d.names(); len(got) != 2 {
+		t.Fatalf("dispatched %v, want one Pay per deposit", got)
+	}
+}
+
+func TestCommandRedeliveredAfterFailedDispatch(t *testing.T) {
+	f := newFixture(t)
+	d := &dispatcher{failing: map[string]bool{"Pay": true}}
+	var mu sync.Mutex
+	var failures []error
+	onError := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		failures = append(failures, err)
+	}
+	stop := run(t, f.manager(d, process.WithRetryDelay(10*time.Millisecond), process.WithErrorHandler(onError)))
+	f.deposit(t, "acc-1", "pay-1")
+	eventually(t, "the payout", func() bool { return len(d.names()) == 2 && len(f.payout(t, "pay-1").Commands) == 0 })
+	stop()
+
+	if d.calls[0].ID != d.calls[1].ID {
+		t.Fatalf("redelivered command id=%s, want the id=%s of the failed one", d.calls[1].ID, d.calls[0].ID)
+	}
+	if len(failures) != 1 {
+		t.Fatalf("%d failures reported, want 1", len(failures))
+	}
+}
+
+func TestRejectedCommandHandled(t *testing.T) {
+	f := newFixture(t)
+	d := &dispatcher{rejecting: map[string]bool{"Pay": true}}
+	m := f.manager(d).OnRejected("Pay", func(ctx context.Context, p *Payout, cmd process.Command, err error) error {
+		if !errors.Is(err, process.ErrCommandRejected) {
+			t.Errorf("rejection err=%v, want %v", err, process.ErrCommandRejected)
+		}
+		return p.Send("Refund", cmd.Data)
+	})
+	stop := run(t, m)
+	f.deposit(t, "acc-1", "pay-1")
+	eventually(t, "the refund", func() bool { return len(d.names()) == 2 && len(f.payout(t, "pay-1").Commands) == 0 })
+	stop()
+
+	if got := d.names(); !slices.Equal(got, []string{"Pay", "Refund"}) {
+		t.Fatalf("dispatched %v, want the rejected Pay once then Refund", got)
+	}
+}
+
+func TestDeadlinesFireInTimeOrder(t *testing.T) {
+	f := newFixture(t)
+	note := func(ctx context.Context, p *Payout, d process.Deadline) error {
+		return p.ApplyChange(p, &DeadlineNoted{Name: d.Name})
+	}
+	m := process.NewManager[*Payout]("payout", f.r.EventStore(), f.as, f.checkpoints, &dispatcher{}).
+		On(&Deposited{}, func(ctx context.Context, p *Payout, e eventsourcing.Event) error {
+			// both are due once saved, the later one is scheduled first
+			now := time.Now()
+			if err := p.Schedule("late", now.Add(-time.Millisecond)); err != nil {
+				return err
+			}
+			return p.Schedule("early", now.Add(-2*time.Millisecond))
+		}).
+		OnDeadline("early", func(ctx context.Context, p *Payout, d process.Deadline) error {
+			if err := note(ctx, p, d); err != nil {
+				return err
+			}
+			return p.Cancel("late")
+		}).
+		OnDeadline("late", note)
+	stop := run(t, m)
+	f.deposit(t, "acc-1", "pay-1")
+	eventually(t, "the deadlines", func() bool {
+		p := f.payout(t, "pay-1")
+		return p.Version() > 0 && len(p.Deadlines) == 0
+	})
+	stop()
+
+	if got := f.payout(t, "pay-1").Fired; !slices.Equal(got, []string{"early"}) {
+		t.Fatalf("fired %v, want early only as it cancels late", got)
+	}
+}
@@ -0,0 +1,213 @@
+package process
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// Events of the saga, recorded in the stream of the process next to its own events
+type CommandIssued struct {
+	Command Command
+}
+type CommandDelivered struct {
+	ID string
+}
+type CommandRejected struct {
+	ID     string
+	Reason string
+}
+type DeadlineScheduled struct {
+	Deadline Deadline
+}
+type DeadlineCancelled struct {
+	Name string
+}
+type DeadlineFired struct {
+	ID string
+}
+type ProcessCompleted struct{}
+
+// SagaEvents returns the events of the saga, a process registers them with its own events
+func SagaEvents() []interface{} {
+	return []interface{}{
+		&CommandIssued{}, &CommandDelivered{}, &CommandRejected{}, &DeadlineScheduled{}, &DeadlineCancelled{}, &DeadlineFired{},
+		&ProcessCompleted{},
+	}
+}
+
+// Deadline wakes up a process at a given time unless it is cancelled or the process completes first
+type Deadline struct {
+	// ID identifies the deadline within every process, it is the cause of what the process does when it fires
+	ID            string
+	Name          string
+	At            time.Time
+	CorrelationID string
+}
+
+// Process is the state of a running process: an aggregate embedding Saga
+type Process interface {
+	eventsourcing.Aggregate
+	saga() *Saga
+}
+
+// Saga is embedded in a process aggregate and keeps the commands it still has to deliver, its deadlines and
+// whether it completed. Its changes are events of the process, so the Transition of the process passes every
+// event to Saga.Transition first and its RegisterEvents registers SagaEvents:
+//
+//	func (t *Transfer) Transition(e eventsourcing.Event) error {
+//		if t.Saga.Transition(e) {
+//			return nil
+//		}
+//		switch v := e.Data.(type) {
+//		...
+//	}
+type Saga struct {
+	eventsourcing.AggregateRoot
+	// Commands are the commands issued and not delivered yet, in the order they were issued
+	Commands  []Command
+	Deadlines []Deadline
+	Completed bool
+
+	// self is the process embedding the saga and trigger the metadata of what it reacts to, set by the Manager
+	self    eventsourcing.Aggregate
+	trigger eventsourcing.Metadata
+}
+
+func (s *Saga) saga() *Saga {
+	return s
+}
+
+// bind makes the changes of the saga apply to p in reaction to the event or deadline with metadata trigger
+func (s *Saga) bind(p eventsourcing.Aggregate, trigger eventsourcing.Metadata) {
+	s.self = p
+	s.trigger = trigger
+}
+
+func (s *Saga) apply(data interface{}) error {
+	if s.self == nil {
+		return errors.New("saga is not handled by a process manager")
+	}
+	return s.ApplyChange(s.self, data)
+}
+
+// nextID returns the ID of what the next change of the process issues, unique across processes and stable
+func (s *Saga) nextID() string {
+	return fmt.Sprintf("%s/%d", s.AggregateID(), s.Version()+1)
+}
+
+func (s *Saga) correlationID() string {
+	if s.trigger.CorrelationID != "" {
+		return s.trigger.CorrelationID
+	}
+	return s.trigger.EventID
+}
+
+// Send issues a command with data, JSON encoded. It is delivered once the process is saved, until the
+// Dispatcher accepts it.
+func (s *Saga) Send(name string, data interface{}) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("encode command name=%s err=%w", name, err)
+	}
+
+	return s.apply(&CommandIssued{Command: Command{
+		ID:            s.nextID(),
+		Name:          name,
+		Data:          payload,
+		CorrelationID: s.correlationID(),
+		CausationID:   s.trigger.EventID,
+	}})
+}
+
+// Schedule sets the deadline name to fire at, replacing the deadline of the same name
+func (s *Saga) Schedule(name string, at time.Time) error {
+	return s.apply(&DeadlineScheduled{Deadline: Deadline{
+		ID:            s.nextID(),
+		Name:          name,
+		At:            at.UTC(),
+		CorrelationID: s.correlationID(),
+	}})
+}
+
+// Cancel removes the deadline name, if it is scheduled
+func (s *Saga) Cancel(name string) error {
+	for _, d := range s.Deadlines {
+		if d.Name == name {
+			return s.apply(&DeadlineCancelled{Name: name})
+		}
+	}
+	return nil
+}
+
+// Complete ends the process: its deadlines are cancelled and it ignores the events it still receives.
+// The commands it already issued are still delivered.
+func (s *Saga) Complete() error {
+	if s.Completed {
+		return nil
+	}
+	return s.apply(&ProcessCompleted{})
+}
+
+// Transition applies e when it is an event of the saga and reports whether it was
+func (s *Saga) Transition(e eventsourcing.Event) bool {
+	switch v := e.Data.(type) {
+	case *CommandIssued:
+		s.Commands = append(s.Commands, v.Command)
+	case *CommandDelivered:
+		s.Commands = without(s.Commands, func(c Command) bool { return c.ID == v.ID })
+	case *CommandRejected:
+		s.Commands = without(s.Commands, func(c Command) bool { return c.ID == v.ID })
+	case *DeadlineScheduled:
+		s.Deadlines = append(without(s.Deadlines, func(d Deadline) bool { return d.Name == v.Deadline.Name }), v.Deadline)
+	case *DeadlineCancelled:
+		s.Deadlines = without(s.Deadlines, func(d Deadline) bool { return d.Name == v.Name })
+	case *DeadlineFired:
+		s.Deadlines = without(s.Deadlines, func(d Deadline) bool { return d.ID == v.ID })
+	case *ProcessCompleted:
+		s.Completed = true
+		s.Deadlines = nil
+	default:
+		return false
+	}
+	return true
+}
+
+// deadline returns the scheduled deadline with id
+func (s *Saga) deadline(id string) (Deadline, bool) {
+	for _, d := range s.Deadlines {
+		if d.ID == id {
+			return d, true
+		}
+	}
+	return Deadline{}, false
+}
+
+// wakeAt returns when the process has something to do, false if it has nothing left
+func (s *Saga) wakeAt() (time.Time, bool) {
+	if len(s.Commands) > 0 {
+		return time.Now(), true
+	}
+
+	var at time.Time
+	for _, d := range s.Deadlines {
+		if at.IsZero() || d.At.Before(at) {
+			at = d.At
+		}
+	}
+	return at, !at.IsZero()
+}
+
+// without returns a new slice of the items drop returns false for, the slice of a loaded aggregate is not modified
+func without[T any](items []T, drop func(T) bool) []T {
+	result := make([]T, 0, len(items))
+	for _, item := range items {
+		if !drop(item) {
+			result = append(result, item)
+		}
+	}
+	return result
+}
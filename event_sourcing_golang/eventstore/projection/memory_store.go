@@ -0,0 +1,119 @@
+package projection
+
+import (
+	"context"
+	"sync"
+)
+
+var _ Store = (*MemoryStore)(nil)
+
+// MemoryStore is an in-memory Store for testing/demo purposes.
+// It also holds the in-memory read model tables so handlers have somewhere to write to.
+type MemoryStore struct {
+	mu          sync.RWMutex
+	checkpoints map[string]int64
+	tables      map[string]*Table
+}
+
+func NewInMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		checkpoints: make(map[string]int64),
+		tables:      make(map[string]*Table),
+	}
+}
+
+// Table returns the read model table with the given name, creating it if needed
+func (m *MemoryStore) Table(name string) *Table {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tables[name]
+	if !ok {
+		t = newTable()
+		m.tables[name] = t
+	}
+
+	return t
+}
+
+func (m *MemoryStore) LoadCheckpoint(ctx context.Context, name string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.checkpoints[name], nil
+}
+
+func (m *MemoryStore) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.checkpoints[name] = position
+	return nil
+}
+
+func (m *MemoryStore) CreateShadow(ctx context.Context, table string) (string, error) {
+	shadow := table + "_shadow"
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tables[shadow] = newTable()
+
+	return shadow, nil
+}
+
+func (m *MemoryStore) Swap(ctx context.Context, table, shadow string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.tables[shadow]
+	if !ok {
+		t = newTable()
+	}
+	m.tables[table] = t
+	delete(m.tables, shadow)
+
+	return nil
+}
+
+// Table is a concurrency safe key/value read model
+type Table struct {
+	mu   sync.RWMutex
+	rows map[string]interface{}
+}
+
+func newTable() *Table {
+	return &Table{
+		rows: make(map[string]interface{}),
+	}
+}
+
+func (t *Table) Get(key string) (interface{}, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	v, ok := t.rows[key]
+	return v, ok
+}
+
+func (t *Table) Put(key string, v interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rows[key] = v
+}
+
+func (t *Table) Delete(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.rows, key)
+}
+
+// Update replaces the row under key with fn's result, atomically
+func (t *Table) Update(key string, fn func(v interface{}, ok bool) interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v, ok := t.rows[key]
+	t.rows[key] = fn(v, ok)
+}
+
+func (t *Table) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return len(t.rows)
+}
@@ -0,0 +1,54 @@
+package projection
+
+import (
+	"context"
+	"reflect"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// HandlerFunc applies an event to the read model stored under table.
+// table is the live table while running and the shadow table while rebuilding.
+type HandlerFunc = func(ctx context.Context, table string, e eventsourcing.Event) error
+
+// Projection builds a read model from the global event stream.
+// Handlers are registered per event type, events without a handler are skipped.
+type Projection struct {
+	name  string
+	table string
+	// handlers are keyed by the type of the event data, whatever name the serializer stores the events under
+	handlers map[reflect.Type]HandlerFunc
+}
+
+// New creates a projection, name is the checkpoint key and table is the live read model it writes to
+func New(name, table string) *Projection {
+	return &Projection{
+		name:     name,
+		table:    table,
+		handlers: make(map[reflect.Type]HandlerFunc),
+	}
+}
+
+func (p *Projection) Name() string {
+	return p.name
+}
+
+func (p *Projection) Table() string {
+	return p.table
+}
+
+// On registers h for the events of the same type as event, event must be a pointer to struct
+func (p *Projection) On(event interface{}, h HandlerFunc) *Projection {
+	p.handlers[reflect.TypeOf(event)] = h
+	return p
+}
+
+// handle applies e to table if the projection has a handler for it
+func (p *Projection) handle(ctx context.Context, table string, e eventsourcing.Event) error {
+	h, ok := p.handlers[reflect.TypeOf(e.Data)]
+	if !ok {
+		return nil
+	}
+
+	return h(ctx, table, e)
+}
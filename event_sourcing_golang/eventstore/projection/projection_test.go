@@ -0,0 +1,43 @@
+package projection_test
+
+import (
+	"context"
+	"testing"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/projection"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+func TestHandlerRegisteredBeforeEventName(t *testing.T) {
+	ctx := context.Background()
+	var handled []string
+	p := projection.New("balances", "balances").On(&Deposited{}, func(ctx context.Context, table string, e eventsourcing.Event) error {
+		handled = append(handled, e.EventType)
+		return nil
+	})
+
+	// the name is given after the handler was registered
+	s := eventsourcing.NewSerializer()
+	if err := eventsourcing.Register[Deposited](s, "account.deposited.v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterAggregate(&Account{}); err != nil {
+		t.Fatal(err)
+	}
+	r := repos.NewInMemory(s)
+	_, err := eventstore.NewRepository[*Account](eventstore.NewAggregateStore(r)).Create(ctx, "acc-1", func(a *Account) error {
+		return a.ApplyChange(a, &Deposited{Amount: 10})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := projection.NewRunner(r.EventStore(), projection.NewInMemoryStore(), p).Rebuild(ctx, "balances"); err != nil {
+		t.Fatal(err)
+	}
+	if len(handled) != 1 || handled[0] != "account.deposited.v1" {
+		t.Fatalf("handled %v, want the deposit stored under its name", handled)
+	}
+}
@@ -0,0 +1,184 @@
+package projection
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"event_sourcing_golang/eventstore/repos"
+)
+
+const rebuildBatchSize = 500
+
+// Runner feeds the global event stream to projections and keeps their checkpoints.
+// Events are delivered at least once, so handlers must be idempotent for the events around a crash.
+type Runner struct {
+	es      repos.EventStore
+	store   Store
+	workers map[string]*worker
+}
+
+// worker runs a single projection, mu serialises live processing with the swap step of a rebuild
+type worker struct {
+	mu         sync.Mutex
+	projection *Projection
+	position   int64
+}
+
+func NewRunner(es repos.EventStore, store Store, projections ...*Projection) *Runner {
+	workers := make(map[string]*worker, len(projections))
+	for _, p := range projections {
+		workers[p.Name()] = &worker{projection: p}
+	}
+
+	return &Runner{
+		es:      es,
+		store:   store,
+		workers: workers,
+	}
+}
+
+// Run processes events for every projection from its checkpoint until ctx is done or a handler fails
+func (r *Runner) Run(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(r.workers))
+	for _, w := range r.workers {
+		wg.Add(1)
+		go func(w *worker) {
+			defer wg.Done()
+			if err := r.run(ctx, w); err != nil {
+				errs <- fmt.Errorf("projection %s err=%w", w.projection.Name(), err)
+				cancel()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+func (r *Runner) run(ctx context.Context, w *worker) error {
+	// the checkpoint is loaded under mu so a rebuild swapped meanwhile is not overwritten by an older position
+	w.mu.Lock()
+	checkpoint, err := r.store.LoadCheckpoint(ctx, w.projection.Name())
+	if err != nil {
+		w.mu.Unlock()
+		return err
+	}
+	w.position = max(w.position, checkpoint)
+	position := w.position
+	w.mu.Unlock()
+
+	if err := repos.CheckUnarchived(ctx, r.es, position); err != nil {
+		return fmt.Errorf("run projection %s err=%w", w.projection.Name(), err)
+	}
+
+	sub := r.es.Subscribe(ctx, position)
+	for e := range sub.Events() {
+		w.mu.Lock()
+		err := r.apply(ctx, w, e.Position, func() error {
+			return w.projection.handle(ctx, w.projection.Table(), e)
+		})
+		w.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+
+	// a subscription stopped by ctx is a normal shutdown
+	if err := sub.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	return nil
+}
+
+// apply runs fn for the event at position unless a rebuild already covered it, then moves the checkpoint
+func (r *Runner) apply(ctx context.Context, w *worker, position int64, fn func() error) error {
+	if position <= w.position {
+		return nil
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	if err := r.store.SaveCheckpoint(ctx, w.projection.Name(), position); err != nil {
+		return err
+	}
+	w.position = position
+
+	return nil
+}
+
+// Rebuild replays the whole stream from position zero into a shadow table and swaps it in.
+// Live processing keeps going on the old table and is only paused while the shadow catches up and is swapped.
+// It fails with repos.ErrEventsArchived once events were archived, they can't be replayed anymore.
+func (r *Runner) Rebuild(ctx context.Context, name string) error {
+	w, ok := r.workers[name]
+	if !ok {
+		return fmt.Errorf("projection %s is not registered", name)
+	}
+	p := w.projection
+	if err := repos.CheckUnarchived(ctx, r.es, 0); err != nil {
+		return fmt.Errorf("rebuild projection %s err=%w", name, err)
+	}
+
+	shadow, err := r.store.CreateShadow(ctx, p.Table())
+	if err != nil {
+		return err
+	}
+
+	position, err := r.replay(ctx, p, shadow, 0)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// catch up with events appended during the replay, nothing new is processed live meanwhile
+	position, err = r.replay(ctx, p, shadow, position)
+	if err != nil {
+		return err
+	}
+
+	if err := r.store.Swap(ctx, p.Table(), shadow); err != nil {
+		return err
+	}
+
+	// the live table now contains everything up to the latest position, which may be ahead of the live run
+	if position > w.position {
+		if err := r.store.SaveCheckpoint(ctx, name, position); err != nil {
+			return err
+		}
+		w.position = position
+	}
+
+	return nil
+}
+
+// replay applies every event after position to table and returns the last position applied
+func (r *Runner) replay(ctx context.Context, p *Projection, table string, position int64) (int64, error) {
+	for {
+		events, err := r.es.ReadAll(ctx, position, rebuildBatchSize)
+		if err != nil {
+			return position, err
+		}
+
+		for _, e := range events {
+			if err := p.handle(ctx, table, e); err != nil {
+				return position, err
+			}
+			position = e.Position
+		}
+
+		if len(events) < rebuildBatchSize {
+			return position, nil
+		}
+	}
+}
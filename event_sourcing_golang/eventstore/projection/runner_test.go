@@ -0,0 +1,381 @@
+package projection_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/projection"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type Deposited struct{ Amount int }
+
+type Account struct {
+	eventsourcing.AggregateRoot
+	Balance int
+}
+
+func (a *Account) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&Deposited{})
+}
+
+func (a *Account) Transition(e eventsourcing.Event) error {
+	if v, ok := e.Data.(*Deposited); ok {
+		a.Balance += v.Amount
+	}
+	return nil
+}
+
+type fixture struct {
+	es       repos.EventStore
+	accounts *eventstore.Repository[*Account]
+	store    *projection.MemoryStore
+
+	mu      sync.Mutex
+	handled int
+}
+
+func newFixture(t *testing.T) *fixture {
+	t.Helper()
+	s := eventsourcing.NewSerializer()
+	if err := s.RegisterAggregate(&Account{}); err != nil {
+		t.Fatal(err)
+	}
+	r := repos.NewInMemory(s)
+	return &fixture{
+		es:       r.EventStore(),
+		accounts: eventstore.NewRepository[*Account](eventstore.NewAggregateStore(r)),
+		store:    projection.NewInMemoryStore(),
+	}
+}
+
+// deposit saves a deposit of amount to the account id
+func (f *fixture) deposit(t *testing.T, id string, amount int) {
+	t.Helper()
+	if err := f.save(id, amount); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (f *fixture) save(id string, amount int) error {
+	ctx := context.Background()
+	apply := func(a *Account) error {
+		return a.ApplyChange(a, &Deposited{Amount: amount})
+	}
+	_, err := f.accounts.Update(ctx, id, apply)
+	if errors.Is(err, eventstore.ErrAggregateNotFound) {
+		_, err = f.accounts.Create(ctx, id, apply)
+	}
+	return err
+}
+
+// balances sums the deposits per account into its table
+func (f *fixture) balances() *projection.Projection {
+	return projection.New("balances", "balances").
+		On(&Deposited{}, func(ctx context.Context, table string, e eventsourcing.Event) error {
+			f.mu.Lock()
+			f.handled++
+			f.mu.Unlock()
+			f.store.Table(table).Update(e.AggregateID, func(v interface{}, ok bool) interface{} {
+				if !ok {
+					return e.Data.(*Deposited).Amount
+				}
+				return v.(int) + e.Data.(*Deposited).Amount
+			})
+			return nil
+		})
+}
+
+func (f *fixture) handledCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.handled
+}
+
+func (f *fixture) lastPosition(t *testing.T) int64 {
+	t.Helper()
+	var last int64
+	for {
+		events, err := f.es.ReadAll(context.Background(), last, 100)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) == 0 {
+			return last
+		}
+		last = events[len(events)-1].Position
+	}
+}
+
+// run runs r until the checkpoint of the balances projection reaches the last position, then stops it
+func (f *fixture) run(t *testing.T, r *projection.Runner) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- r.Run(ctx) }()
+	f.waitCheckpoint(t, f.lastPosition(t), done)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (f *fixture) waitCheckpoint(t *testing.T, position int64, done <-chan error) {
+	t.Helper()
+	deadline := time.After(5 * time.Second)
+	for {
+		checkpoint, err := f.store.LoadCheckpoint(context.Background(), "balances")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checkpoint >= position {
+			return
+		}
+		select {
+		case err := <-done:
+			t.Fatalf("runner stopped err=%v", err)
+		case <-deadline:
+			t.Fatalf("checkpoint=%d, want %d", checkpoint, position)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
+
+func balance(t *testing.T, store *projection.MemoryStore, id string) int {
+	t.Helper()
+	v, ok := store.Table("balances").Get(id)
+	if !ok {
+		t.Fatalf("no balance for %s", id)
+	}
+	return v.(int)
+}
+
+func TestRunnerResumesFromCheckpoint(t *testing.T) {
+	f := newFixture(t)
+	f.deposit(t, "acc-1", 10)
+	f.deposit(t, "acc-1", 5)
+	f.deposit(t, "acc-2", 1)
+
+	f.run(t, projection.NewRunner(f.es, f.store, f.balances()))
+	if got := balance(t, f.store, "acc-1"); got != 15 {
+		t.Fatalf("acc-1 balance=%d, want 15", got)
+	}
+	if got := f.handledCount(); got != 3 {
+		t.Fatalf("%d events handled, want 3", got)
+	}
+
+	// a new runner starts after the checkpoint, the handled events are not handled again
+	f.deposit(t, "acc-2", 2)
+	f.run(t, projection.NewRunner(f.es, f.store, f.balances()))
+	if got := f.handledCount(); got != 4 {
+		t.Fatalf("%d events handled after the restart, want 4", got)
+	}
+	if got := balance(t, f.store, "acc-2"); got != 3 {
+		t.Fatalf("acc-2 balance=%d, want 3", got)
+	}
+}
+
+func TestRebuildSwapsShadowTable(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	f.deposit(t, "acc-1", 10)
+	f.deposit(t, "acc-2", 7)
+
+	// the live table is wrong, as after a bug fixed in the handlers
+	f.store.Table("balances").Put("acc-1", 1000)
+	f.store.Table("balances").Put("acc-gone", 1)
+
+	r := projection.NewRunner(f.es, f.store, f.balances())
+	if err := r.Rebuild(ctx, "balances"); err != nil {
+		t.Fatal(err)
+	}
+	if got := balance(t, f.store, "acc-1"); got != 10 {
+		t.Fatalf("acc-1 balance=%d after the rebuild, want 10", got)
+	}
+	if _, ok := f.store.Table("balances").Get("acc-gone"); ok {
+		t.Fatal("the rows of the old table are kept after the rebuild")
+	}
+	if n := f.store.Table("balances_shadow").Len(); n != 0 {
+		t.Fatalf("shadow table has %d rows after the swap, want 0", n)
+	}
+	checkpoint, err := f.store.LoadCheckpoint(ctx, "balances")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint != f.lastPosition(t) {
+		t.Fatalf("checkpoint=%d after the rebuild, want %d", checkpoint, f.lastPosition(t))
+	}
+
+	// running after the rebuild only handles the new events
+	f.deposit(t, "acc-1", 1)
+	f.run(t, r)
+	if got := balance(t, f.store, "acc-1"); got != 11 {
+		t.Fatalf("acc-1 balance=%d, want 11", got)
+	}
+	if got := f.handledCount(); got != 3 {
+		t.Fatalf("%d events handled, want 3", got)
+	}
+}
+
+func TestRebuildWhileRunning(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	f := newFixture(t)
+	for i := 0; i < 50; i++ {
+		f.deposit(t, "acc-1", 1)
+	}
+
+	r := projection.NewRunner(f.es, f.store, f.balances())
+	done := make(chan error, 1)
+	go func() { done <- r.Run(ctx) }()
+
+	// deposits saved during the rebuild are either replayed into the shadow or applied live after the swap
+	writes := make(chan error, 1)
+	go func() {
+		for i := 0; i < 50; i++ {
+			if err := f.save("acc-1", 1); err != nil {
+				writes <- err
+				return
+			}
+		}
+		writes <- nil
+	}()
+	if err := r.Rebuild(ctx, "balances"); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-writes; err != nil {
+		t.Fatal(err)
+	}
+
+	f.waitCheckpoint(t, f.lastPosition(t), done)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := balance(t, f.store, "acc-1"); got != 100 {
+		t.Fatalf("acc-1 balance=%d, want 100", got)
+	}
+}
+
+// hookedStore runs beforeArchiveCheck on the first ArchivedPosition call, which the runner makes between loading
+// its checkpoint and subscribing
+type hookedStore struct {
+	repos.EventStore
+	hooked             atomic.Bool
+	beforeArchiveCheck func()
+}
+
+func (h *hookedStore) ArchivedPosition(ctx context.Context) (int64, error) {
+	if h.hooked.CompareAndSwap(false, true) {
+		h.beforeArchiveCheck()
+	}
+	return h.EventStore.ArchivedPosition(ctx)
+}
+
+func TestRebuildBetweenCheckpointLoadAndSubscribe(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	f.deposit(t, "acc-1", 10)
+	f.deposit(t, "acc-1", 5)
+
+	var r *projection.Runner
+	es := &hookedStore{EventStore: f.es}
+	es.beforeArchiveCheck = func() {
+		if err := r.Rebuild(ctx, "balances"); err != nil {
+			t.Error(err)
+		}
+	}
+	r = projection.NewRunner(es, f.store, f.balances())
+
+	// the run loaded checkpoint 0 but the rebuild already applied both deposits, they are not handled again
+	f.run(t, r)
+	if got := f.handledCount(); got != 2 {
+		t.Fatalf("%d events handled, want 2", got)
+	}
+	if got := balance(t, f.store, "acc-1"); got != 15 {
+		t.Fatalf("acc-1 balance=%d, want 15", got)
+	}
+
+	f.deposit(t, "acc-1", 1)
+	f.run(t, r)
+	if got := f.handledCount(); got != 3 {
+		t.Fatalf("%d events handled, want 3", got)
+	}
+	if got := balance(t, f.store, "acc-1"); got != 16 {
+		t.Fatalf("acc-1 balance=%d, want 16", got)
+	}
+}
+
+func TestSQLStoreShadowSwap(t *testing.T) {
+	ctx := context.Background()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "es.db")), &gorm.Config{Logger: logger.Discard})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Migrate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec(`CREATE TABLE balances (id TEXT NOT NULL PRIMARY KEY, balance INTEGER NOT NULL)`).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec(`INSERT INTO balances(id, balance) VALUES ('acc-1', 1000)`).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	store := projection.NewStore(db)
+	shadow, err := store.CreateShadow(ctx, "balances")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Exec(`INSERT INTO ` + shadow + `(id, balance) VALUES ('acc-1', 10)`).Error; err != nil {
+		t.Fatal(err)
+	}
+	// the shadow keeps the constraints of the table
+	if err := db.Exec(`INSERT INTO ` + shadow + `(id, balance) VALUES ('acc-1', 20)`).Error; err == nil {
+		t.Fatal("duplicate primary key inserted into the shadow table")
+	}
+	if err := store.Swap(ctx, "balances", shadow); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []int
+	if err := db.Raw(`SELECT balance FROM balances`).Scan(&got).Error; err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != 10 {
+		t.Fatalf("balances=%v after the swap, want [10]", got)
+	}
+	var tables []string
+	err = db.Raw(`SELECT name FROM sqlite_master WHERE type = 'table' AND name LIKE 'balances%' ORDER BY name`).
+		Scan(&tables).Error
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 1 {
+		t.Fatalf("tables=%v after the swap, want only balances", tables)
+	}
+
+	for _, position := range []int64{5, 9} {
+		if err := store.SaveCheckpoint(ctx, "balances", position); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkpoint, err := store.LoadCheckpoint(ctx, "balances")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkpoint != 9 {
+		t.Fatalf("checkpoint=%d, want 9", checkpoint)
+	}
+}
@@ -0,0 +1,152 @@
+package projection
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+
+	"event_sourcing_golang/eventstore/repos"
+
+	"gorm.io/gorm"
+)
+
+var _ Store = (*store)(nil)
+
+// Store keeps projection checkpoints and manages the shadow tables used by rebuilds
+type Store interface {
+	// LoadCheckpoint returns the last processed position of the projection, 0 if it never ran
+	LoadCheckpoint(ctx context.Context, name string) (int64, error)
+	SaveCheckpoint(ctx context.Context, name string, position int64) error
+
+	// CreateShadow creates an empty copy of table to rebuild into and returns its name
+	CreateShadow(ctx context.Context, table string) (string, error)
+	// Swap replaces table with shadow and drops the old table
+	Swap(ctx context.Context, table, shadow string) error
+}
+
+type store struct {
+	db      *gorm.DB
+	dialect repos.Dialect
+}
+
+// NewStore creates a Store keeping checkpoints in es_projection_checkpoint, created by repos.Migrate
+func NewStore(db *gorm.DB) Store {
+	return &store{
+		db:      db,
+		dialect: repos.DialectOf(db),
+	}
+}
+
+func (s *store) LoadCheckpoint(ctx context.Context, name string) (int64, error) {
+	var position int64
+	err := s.db.WithContext(ctx).Raw(`
+		SELECT position
+		FROM es_projection_checkpoint
+		WHERE name = ?`, name).Row().Scan(&position)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("load checkpoint err=%w", err)
+	}
+
+	return position, nil
+}
+
+func (s *store) SaveCheckpoint(ctx context.Context, name string, position int64) error {
+	query := `
+		INSERT INTO es_projection_checkpoint(name, position)
+		VALUES(?, ?)
+		ON CONFLICT(name) DO UPDATE SET position = excluded.position`
+	if s.dialect == repos.DialectMySQL {
+		query = `
+		INSERT INTO es_projection_checkpoint(name, position)
+		VALUES(?, ?)
+		ON DUPLICATE KEY UPDATE position = VALUES(position)`
+	}
+
+	err := s.db.WithContext(ctx).Exec(query, name, position).Error
+	if err != nil {
+		return fmt.Errorf("save checkpoint err=%w", err)
+	}
+
+	return nil
+}
+
+func (s *store) CreateShadow(ctx context.Context, table string) (string, error) {
+	shadow := table + "_shadow"
+	db := s.db.WithContext(ctx)
+
+	if err := db.Exec("DROP TABLE IF EXISTS " + shadow).Error; err != nil {
+		return "", fmt.Errorf("drop shadow table err=%w", err)
+	}
+
+	var err error
+	switch s.dialect {
+	case repos.DialectPostgres:
+		err = db.Exec("CREATE TABLE " + shadow + " (LIKE " + table + " INCLUDING ALL)").Error
+	case repos.DialectSQLite:
+		err = s.createShadowSQLite(db, table, shadow)
+	default:
+		err = db.Exec("CREATE TABLE " + shadow + " LIKE " + table).Error
+	}
+	if err != nil {
+		return "", fmt.Errorf("create shadow table err=%w", err)
+	}
+
+	return shadow, nil
+}
+
+// createShadowSQLite replays the CREATE TABLE statement of table under the shadow name, so the shadow keeps
+// the columns and constraints of table. Indexes created separately are not copied.
+func (s *store) createShadowSQLite(db *gorm.DB, table, shadow string) error {
+	var ddl string
+	err := db.Raw(`
+		SELECT sql
+		FROM sqlite_master
+		WHERE type = 'table' AND name = ?`, table).Row().Scan(&ddl)
+	if err != nil {
+		return fmt.Errorf("read table %s definition err=%w", table, err)
+	}
+
+	i := strings.Index(ddl, table)
+	if i < 0 {
+		return fmt.Errorf("table %s definition does not name it", table)
+	}
+
+	return db.Exec(ddl[:i] + shadow + ddl[i+len(table):]).Error
+}
+
+func (s *store) Swap(ctx context.Context, table, shadow string) error {
+	old := table + "_old"
+	db := s.db.WithContext(ctx)
+
+	if s.dialect != repos.DialectMySQL {
+		// Postgres and SQLite run DDL in transactions, so both renames are seen at once
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := tx.Exec("ALTER TABLE " + table + " RENAME TO " + old).Error; err != nil {
+				return err
+			}
+			if err := tx.Exec("ALTER TABLE " + shadow + " RENAME TO " + table).Error; err != nil {
+				return err
+			}
+			return tx.Exec("DROP TABLE " + old).Error
+		})
+		if err != nil {
+			return fmt.Errorf("swap shadow table err=%w", err)
+		}
+		return nil
+	}
+
+	// RENAME TABLE swaps both names atomically so readers never see a missing table
+	if err := db.Exec("RENAME TABLE " + table + " TO " + old + ", " + shadow + " TO " + table).Error; err != nil {
+		return fmt.Errorf("swap shadow table err=%w", err)
+	}
+	if err := db.Exec("DROP TABLE " + old).Error; err != nil {
+		return fmt.Errorf("drop old table err=%w", err)
+	}
+
+	return nil
+}
@@ -2,6 +2,8 @@ package repos
 
 import (
 	"context"
+	"fmt"
+	"time"
 
 	"event_sourcing_golang/pkg/eventsourcing"
 
@@ -21,10 +23,17 @@ func newAggregateRepo(db *gorm.DB, s eventsourcing.Serializer) *aggregateRepo {
 }
 
 func (r *aggregateRepo) CreateIfNotExist(ctx context.Context, id, typ string) error {
-	err := r.db.Exec(`
-		INSERT IGNORE INTO es_aggregate(id, version, aggregate_type)	
+	query := `
+		INSERT INTO es_aggregate(id, version, aggregate_type)
 		VALUES(?, 0, ?)
-	`, id, typ).Error
+		ON CONFLICT DO NOTHING`
+	if DialectOf(r.db) == DialectMySQL {
+		query = `
+		INSERT IGNORE INTO es_aggregate(id, version, aggregate_type)
+		VALUES(?, 0, ?)`
+	}
+
+	err := r.db.Exec(query, id, typ).Error
 	if err != nil {
 		return err
 	}
@@ -32,7 +41,41 @@ func (r *aggregateRepo) CreateIfNotExist(ctx context.Context, id, typ string) er
 	return nil
 }
 
-func (r *aggregateRepo) CheckAndUpdateVersion(ctx context.Context, agg eventsourcing.Aggregate) bool {
+func (r *aggregateRepo) AggregateVersion(ctx context.Context, id string) (int, error) {
+	var version []int
+	err := r.db.Raw(`
+		SELECT version
+		FROM es_aggregate
+		WHERE id = ?
+	`, id).Scan(&version).Error
+	if err != nil {
+		return 0, fmt.Errorf("read aggregate version err=%w", err)
+	}
+	if len(version) == 0 {
+		return 0, fmt.Errorf("%w id=%s", ErrAggregateNotFound, id)
+	}
+
+	return version[0], nil
+}
+
+func (r *aggregateRepo) Aggregates(ctx context.Context, aggType, afterID string, limit int) ([]AggregateInfo, error) {
+	var result []AggregateInfo
+	err := r.db.Raw(`
+		SELECT id, aggregate_type AS type, version
+		FROM es_aggregate
+		WHERE (? = '' OR aggregate_type = ?)
+			AND id > ?
+		ORDER BY id ASC
+		LIMIT ?
+	`, aggType, aggType, afterID, limit).Scan(&result).Error
+	if err != nil {
+		return nil, fmt.Errorf("list aggregates err=%w", err)
+	}
+
+	return result, nil
+}
+
+func (r *aggregateRepo) CheckAndUpdateVersion(ctx context.Context, agg eventsourcing.Aggregate) error {
 	root := agg.Root()
 
 	aggregateId := root.AggregateID()
@@ -47,22 +90,45 @@ func (r *aggregateRepo) CheckAndUpdateVersion(ctx context.Context, agg eventsour
 	`, newVersion, aggregateId, expectedVersion)
 	err := query.Error
 	if err != nil {
-		return false
+		return fmt.Errorf("update aggregate version err=%w", err)
+	}
+	if query.RowsAffected > 0 {
+		return nil
+	}
+
+	var actual []int
+	err = r.db.Raw(`
+		SELECT version
+		FROM es_aggregate
+		WHERE id = ?
+	`, aggregateId).Scan(&actual).Error
+	if err != nil {
+		return fmt.Errorf("read aggregate version err=%w", err)
+	}
+	if len(actual) == 0 {
+		return fmt.Errorf("%w id=%s", ErrAggregateNotFound, aggregateId)
+	}
+	// MySQL reports no affected row when the version is unchanged, which is a successful check
+	if actual[0] == expectedVersion && newVersion == expectedVersion {
+		return nil
 	}
 
-	return query.RowsAffected > 0
+	return &ErrConcurrencyConflict{AggregateID: aggregateId, Expected: expectedVersion, Actual: actual[0]}
 }
 
-func (r *aggregateRepo) ReadSnapshot(ctx context.Context, aggregateID string, version int, agg eventsourcing.Aggregate) bool {
+func (r *aggregateRepo) ReadSnapshot(ctx context.Context, aggregateID string, version int, agg eventsourcing.Aggregate) error {
 	result := struct {
 		AggregateType    string `json:"aggregate_type"`
 		AggregateVersion int    `json:"aggregate_version"`
 		SnapshotVersion  int    `json:"snapshot_version"`
+		SnapshotSchema   string `json:"snapshot_schema"`
+		Codec            string `json:"codec"`
 		Data             string `json:"data"`
 	}{}
 
 	err := r.db.Raw(`
-		SELECT a.aggregate_type, a.version as aggregate_version, eas.version as snapshot_version, eas.data
+		SELECT a.aggregate_type, a.version as aggregate_version, eas.version as snapshot_version, eas.snapshot_schema,
+			eas.codec, eas.data
 		FROM es_aggregate_snapshot eas
 		JOIN es_aggregate a ON eas.aggregate_id = a.id
 		WHERE eas.aggregate_id = ?
@@ -71,40 +137,112 @@ func (r *aggregateRepo) ReadSnapshot(ctx context.Context, aggregateID string, ve
 		LIMIT 1
 		`, aggregateID, version).Scan(&result).Error
 	if err != nil {
-		return false
+		return fmt.Errorf("read snapshot err=%w", err)
 	}
 
 	if result.Data == "" {
-		return false
+		return ErrSnapshotNotFound
+	}
+	if err := checkSnapshotSchema(aggregateID, result.SnapshotVersion, result.SnapshotSchema, agg); err != nil {
+		return err
 	}
 
 	root := agg.Root()
 
-	err = r.serialize.Unmarshal([]byte(result.Data), agg)
+	err = r.serialize.DecodeSnapshot(aggregateID, result.Codec, []byte(result.Data), agg)
 	if err != nil {
-		return false
+		return fmt.Errorf("unmarshal snapshot err=%w", err)
 	}
 
 	root.SetInternal(aggregateID, result.SnapshotVersion, result.AggregateVersion)
 
-	return true
+	return nil
+}
+
+func (r *aggregateRepo) ReadSnapshotAt(ctx context.Context, aggregateID string, maxVersion int, agg eventsourcing.Aggregate) error {
+	result := struct {
+		Version        int
+		SnapshotSchema string
+		Codec          string
+		Data           string
+	}{}
+
+	err := r.db.Raw(`
+		SELECT version, snapshot_schema, codec, data
+		FROM es_aggregate_snapshot
+		WHERE aggregate_id = ?
+			AND version <= ?
+		ORDER BY version DESC
+		LIMIT 1
+		`, aggregateID, maxVersion).Scan(&result).Error
+	if err != nil {
+		return fmt.Errorf("read snapshot err=%w", err)
+	}
+
+	if result.Data == "" {
+		return ErrSnapshotNotFound
+	}
+	if err := checkSnapshotSchema(aggregateID, result.Version, result.SnapshotSchema, agg); err != nil {
+		return err
+	}
+
+	err = r.serialize.DecodeSnapshot(aggregateID, result.Codec, []byte(result.Data), agg)
+	if err != nil {
+		return fmt.Errorf("unmarshal snapshot err=%w", err)
+	}
+
+	agg.Root().SetInternal(aggregateID, result.Version, result.Version)
+
+	return nil
 }
 
 func (r *aggregateRepo) CreateSnapshot(ctx context.Context, agg eventsourcing.Aggregate) error {
 	root := agg.Root()
 	aggregateId := root.AggregateID()
 	version := root.Version()
-	data, err := r.serialize.Marshal(agg)
+	codec, data, err := r.serialize.EncodeSnapshot(agg)
 	if err != nil {
 		return err
 	}
 
-	err = r.db.Exec(`
-		INSERT INTO es_aggregate_snapshot (aggregate_id, version, data)
-		VALUES(?, ?, ?)`, aggregateId, version, data).Error
+	// a snapshot taken again at the same version replaces the previous one, as regenerated snapshots do
+	query := `
+		INSERT INTO es_aggregate_snapshot (aggregate_id, version, snapshot_schema, codec, data, created_at)
+		VALUES(?, ?, ?, ?, ?, ?)
+		ON CONFLICT(aggregate_id, version) DO UPDATE SET snapshot_schema = excluded.snapshot_schema,
+			codec = excluded.codec, data = excluded.data, created_at = excluded.created_at`
+	if DialectOf(r.db) == DialectMySQL {
+		query = `
+		INSERT INTO es_aggregate_snapshot (aggregate_id, version, snapshot_schema, codec, data, created_at)
+		VALUES(?, ?, ?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE snapshot_schema = VALUES(snapshot_schema),
+			codec = VALUES(codec), data = VALUES(data), created_at = VALUES(created_at)`
+	}
+
+	err = r.db.Exec(query, aggregateId, version, eventsourcing.SnapshotSchema(agg), codec, data, time.Now().Unix()).Error
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+func (r *aggregateRepo) PurgeStaleSnapshots(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) (int, error) {
+	result := r.db.Exec(`
+		DELETE FROM es_aggregate_snapshot
+		WHERE aggregate_id = ?
+			AND snapshot_schema <> ?`, aggregateID, eventsourcing.SnapshotSchema(agg))
+	if result.Error != nil {
+		return 0, fmt.Errorf("purge stale snapshots err=%w", result.Error)
+	}
+
+	return int(result.RowsAffected), nil
+}
+
+// checkSnapshotSchema returns ErrSnapshotStale when the snapshot was written with another schema than agg's
+func checkSnapshotSchema(aggregateID string, version int, schema string, agg eventsourcing.Aggregate) error {
+	if want := eventsourcing.SnapshotSchema(agg); schema != want {
+		return fmt.Errorf("%w id=%s version=%d schema=%q want=%q", ErrSnapshotStale, aggregateID, version, schema, want)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package repos
+
+import (
+	"context"
+	"fmt"
+	"iter"
+	"time"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// StoredEvent is an event as it is stored, its payload still encoded with Codec and its Data nil.
+// The archive keeps events in this form so they are read back exactly like the events still in the store.
+type StoredEvent struct {
+	eventsourcing.Event
+	Codec   string `json:"codec"`
+	Payload []byte `json:"payload"`
+}
+
+// Archive gives back the events moved out of the store, see the archive package. The events of an aggregate are
+// always archived from its first version, reads of older versions than the first stored one go to the archive.
+type Archive interface {
+	// ArchivedEvents streams the archived events of the aggregate in (fromVersion, toVersion] in version order,
+	// iteration stops at the first error
+	ArchivedEvents(ctx context.Context, aggregateID string, fromVersion, toVersion int) iter.Seq2[StoredEvent, error]
+	// ArchivedVersionAt returns the version of the last archived event of the aggregate created at or before at,
+	// 0 if there is none
+	ArchivedVersionAt(ctx context.Context, aggregateID string, at time.Time) (int, error)
+}
+
+// readArchived streams the archived events of the aggregate in (fromVersion, toVersion] decoded, none without
+// archive. The archive is read as the events are consumed, so memory stays bounded however many were archived.
+func readArchived(ctx context.Context, a Archive, s eventsourcing.Serializer, aggregateID, aggType string,
+	fromVersion, toVersion int) iter.Seq2[eventsourcing.Event, error] {
+	return func(yield func(eventsourcing.Event, error) bool) {
+		if a == nil || toVersion <= fromVersion {
+			return
+		}
+
+		for se, err := range a.ArchivedEvents(ctx, aggregateID, fromVersion, toVersion) {
+			if err != nil {
+				yield(eventsourcing.Event{}, fmt.Errorf("read archived events id=%s err=%w", aggregateID, err))
+				return
+			}
+			evt := se.Event
+			evt.AggregateType = aggType
+			err := s.UnmarshalEvent(aggType, &evt, se.Codec, se.Payload)
+			if !yield(evt, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// CheckUnarchived fails with ErrEventsArchived when archived events have a position greater than fromPosition.
+// ReadAll and Subscribe skip them, so a reader of the global stream starting there would silently miss them.
+func CheckUnarchived(ctx context.Context, es EventStore, fromPosition int64) error {
+	archived, err := es.ArchivedPosition(ctx)
+	if err != nil {
+		return err
+	}
+	if archived > fromPosition {
+		return fmt.Errorf("%w position=%d archived_position=%d", ErrEventsArchived, fromPosition, archived)
+	}
+	return nil
+}
+
+// archivedVersionAt returns the version of the last archived event created at or before at, 0 without archive
+func archivedVersionAt(ctx context.Context, a Archive, aggregateID string, at time.Time) (int, error) {
+	if a == nil {
+		return 0, nil
+	}
+	version, err := a.ArchivedVersionAt(ctx, aggregateID, at)
+	if err != nil {
+		return 0, fmt.Errorf("read archived version at err=%w", err)
+	}
+	return version, nil
+}
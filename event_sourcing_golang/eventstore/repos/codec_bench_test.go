@@ -0,0 +1,124 @@
+package repos_test
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/eventstore/repos/internal/benchpb"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+const benchEvents = 100
+
+type BenchDeposited struct {
+	Amount int
+	Note   string
+}
+
+type BenchAccount struct {
+	eventsourcing.AggregateRoot
+	Balance int
+}
+
+func (a *BenchAccount) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&BenchDeposited{})
+}
+
+func (a *BenchAccount) Transition(e eventsourcing.Event) error {
+	if v, ok := e.Data.(*BenchDeposited); ok {
+		a.Balance += v.Amount
+	}
+	return nil
+}
+
+// BenchLedger is the aggregate of the codec benchmarks. Its payload is generated by protoc, so every codec,
+// protobuf included, encodes the same two fields.
+type BenchLedger struct {
+	eventsourcing.AggregateRoot
+	Balance int64
+}
+
+func (a *BenchLedger) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&benchpb.BenchDeposited{})
+}
+
+func (a *BenchLedger) Transition(e eventsourcing.Event) error {
+	if v, ok := e.Data.(*benchpb.BenchDeposited); ok {
+		a.Balance += v.GetAmount()
+	}
+	return nil
+}
+
+func BenchmarkCodecJSON(b *testing.B) {
+	benchmarkCodec(b, eventsourcing.JSONCodec())
+}
+
+func BenchmarkCodecMsgpack(b *testing.B) {
+	benchmarkCodec(b, eventsourcing.MsgpackCodec())
+}
+
+func BenchmarkCodecProtobuf(b *testing.B) {
+	benchmarkCodec(b, eventsourcing.ProtobufCodec())
+}
+
+// benchmarkCodec appends benchEvents events to a fresh ledger and loads it back through the in-memory store
+func benchmarkCodec(b *testing.B, codec eventsourcing.Codec) {
+	newAgg := func() eventsourcing.Aggregate { return &BenchLedger{} }
+	newEvent := func(i int) interface{} {
+		return &benchpb.BenchDeposited{Amount: int64(i), Note: "deposit from benchmark"}
+	}
+	ctx := context.Background()
+	s := eventsourcing.NewSerializer()
+	if err := s.RegisterAggregate(newAgg()); err != nil {
+		b.Fatal(err)
+	}
+	if err := s.RegisterCodec(codec); err != nil {
+		b.Fatal(err)
+	}
+	if err := s.UseCodec(codec.Name()); err != nil {
+		b.Fatal(err)
+	}
+	es := repos.NewInMemory(s).EventStore()
+	typ := reflect.TypeOf(newAgg()).Elem().Name()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		agg := newAgg()
+		id := fmt.Sprintf("agg-%d", i)
+		_ = agg.Root().SetID(id)
+		for j := 0; j < benchEvents; j++ {
+			if err := agg.Root().ApplyChange(agg, newEvent(j)); err != nil {
+				b.Fatal(err)
+			}
+		}
+
+		if err := es.CreateIfNotExist(ctx, id, typ); err != nil {
+			b.Fatal(err)
+		}
+		err := es.WithTransaction(ctx, func(txn repos.EventStore) error {
+			for _, e := range agg.Root().Events() {
+				e.AggregateType = typ
+				if err := txn.Append(ctx, e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		loaded := newAgg()
+		loaded.Root().SetAggregateType(typ)
+		if err := es.Get(ctx, id, 0, 0, loaded); err != nil {
+			b.Fatal(err)
+		}
+		if got := loaded.(*BenchLedger).Balance; got != benchEvents*(benchEvents-1)/2 {
+			b.Fatalf("balance=%d, want %d", got, benchEvents*(benchEvents-1)/2)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package repos
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// CommandRecord is the version an aggregate reached by handling a command
+type CommandRecord struct {
+	AggregateID string
+	Version     int
+}
+
+type commandRepo struct {
+	db *gorm.DB
+}
+
+func newCommandRepo(db *gorm.DB) *commandRepo {
+	return &commandRepo{
+		db: db,
+	}
+}
+
+// RecordCommand must run in the transaction appending the events of the command,
+// a command ID already recorded for one of the aggregates fails with ErrDuplicateCommand
+func (r *commandRepo) RecordCommand(ctx context.Context, commandID string, records ...CommandRecord) error {
+	query := `
+		INSERT INTO es_command(command_id, aggregate_id, version, created_at)
+		VALUES(?, ?, ?, ?)
+		ON CONFLICT DO NOTHING`
+	if DialectOf(r.db) == DialectMySQL {
+		query = `
+		INSERT IGNORE INTO es_command(command_id, aggregate_id, version, created_at)
+		VALUES(?, ?, ?, ?)`
+	}
+
+	now := time.Now().Unix()
+	for _, rec := range records {
+		res := r.db.Exec(query, commandID, rec.AggregateID, rec.Version, now)
+		if res.Error != nil {
+			return fmt.Errorf("record command err=%w", res.Error)
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("%w id=%s aggregate_id=%s", ErrDuplicateCommand, commandID, rec.AggregateID)
+		}
+	}
+
+	return nil
+}
+
+func (r *commandRepo) LookupCommand(ctx context.Context, commandID string) ([]CommandRecord, error) {
+	var records []CommandRecord
+	err := r.db.Raw(`
+		SELECT aggregate_id, version
+		FROM es_command
+		WHERE command_id = ?
+		ORDER BY aggregate_id ASC`, commandID).Scan(&records).Error
+	if err != nil {
+		return nil, fmt.Errorf("lookup command err=%w", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("%w id=%s", ErrCommandNotFound, commandID)
+	}
+
+	return records, nil
+}
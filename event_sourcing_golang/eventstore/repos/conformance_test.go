@@ -0,0 +1,21 @@
+package repos_test
+
+import (
+	"testing"
+
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/eventstore/repos/repostest"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+func TestInMemoryConformance(t *testing.T) {
+	repostest.Run(t, func(t *testing.T, s eventsourcing.Serializer, opts ...repos.Option) repos.EventStore {
+		return repos.NewInMemory(s, opts...).EventStore()
+	})
+}
+
+func TestSQLiteConformance(t *testing.T) {
+	repostest.Run(t, func(t *testing.T, s eventsourcing.Serializer, opts ...repos.Option) repos.EventStore {
+		return repos.New(openSQLite(t), s, opts...).EventStore()
+	})
+}
@@ -0,0 +1,31 @@
+package repos
+
+import (
+	"gorm.io/gorm"
+)
+
+// Dialect is the SQL flavour of the database behind the gorm store
+type Dialect string
+
+const (
+	DialectMySQL    Dialect = "mysql"
+	DialectPostgres Dialect = "postgres"
+	DialectSQLite   Dialect = "sqlite"
+)
+
+// DialectOf returns the dialect of db from its gorm dialector. Unknown dialectors are treated as MySQL,
+// the dialect the store was first written for.
+func DialectOf(db *gorm.DB) Dialect {
+	if db == nil || db.Dialector == nil {
+		return DialectMySQL
+	}
+
+	switch db.Dialector.Name() {
+	case "postgres":
+		return DialectPostgres
+	case "sqlite", "sqlite3":
+		return DialectSQLite
+	default:
+		return DialectMySQL
+	}
+}
@@ -0,0 +1,54 @@
+package repos
+
+import (
+	"errors"
+	"fmt"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+var (
+	// ErrAggregateNotFound is returned when the aggregate has never been stored
+	ErrAggregateNotFound = errors.New("aggregate not found")
+	// ErrVersionGap is returned when appending an event whose version is not the next version of its aggregate
+	ErrVersionGap = errors.New("event version does not follow the last stored version")
+	// ErrSnapshotNotFound is returned when the aggregate has no snapshot matching the request
+	ErrSnapshotNotFound = errors.New("snapshot not found")
+	// ErrSnapshotStale is returned when the snapshot was written with another schema than the aggregate's, see
+	// eventsourcing.SnapshotSchema. It is an ErrSnapshotNotFound so readers fall back to replaying the events.
+	ErrSnapshotStale = fmt.Errorf("%w: written with another schema", ErrSnapshotNotFound)
+	// ErrDuplicateCommand is returned when recording a command ID that was already recorded
+	ErrDuplicateCommand = errors.New("duplicate command")
+	// ErrCommandNotFound is returned when no command was recorded with the ID
+	ErrCommandNotFound = errors.New("command not found")
+	// ErrEventsArchived is returned when reading the global stream from a position some archived events come after,
+	// ReadAll and Subscribe skip the archived events
+	ErrEventsArchived = errors.New("events after the position were archived")
+	// ErrInvalidLimit is returned when reading the global stream with a limit that is not positive
+	ErrInvalidLimit = errors.New("limit must be positive")
+	// ErrUnknownEventType is returned when a stored event type is not registered in the serializer
+	ErrUnknownEventType = eventsourcing.ErrUnknownEventType
+)
+
+// ErrConcurrencyConflict is returned when the stored version of an aggregate is not the version it was loaded at
+type ErrConcurrencyConflict struct {
+	AggregateID string
+	Expected    int
+	Actual      int
+}
+
+func (e *ErrConcurrencyConflict) Error() string {
+	return fmt.Sprintf("optimistic concurrency control failed id=%s, expectedVersion=%d, actualVersion=%d",
+		e.AggregateID, e.Expected, e.Actual)
+}
+
+// Is makes errors.Is(err, &ErrConcurrencyConflict{}) match any concurrency conflict
+func (e *ErrConcurrencyConflict) Is(target error) bool {
+	_, ok := target.(*ErrConcurrencyConflict)
+	return ok
+}
+
+// IsConcurrencyConflict reports whether err is caused by an ErrConcurrencyConflict
+func IsConcurrencyConflict(err error) bool {
+	return errors.Is(err, &ErrConcurrencyConflict{})
+}
@@ -3,69 +3,258 @@ package repos
 import (
 	"context"
 	"fmt"
+	"iter"
+	"time"
 
 	"event_sourcing_golang/pkg/eventsourcing"
 
 	"gorm.io/gorm"
 )
 
+// hydrateBatchSize is how many events of an aggregate are read per query when loading or streaming it
+const hydrateBatchSize = 500
+
 type eventRepo struct {
 	db        *gorm.DB
 	serialize eventsourcing.Serializer
+	// archive has the events deleted by DeleteEvents, nil without archive
+	archive Archive
 }
 
-func newEventRepo(db *gorm.DB, s eventsourcing.Serializer) *eventRepo {
+func newEventRepo(db *gorm.DB, s eventsourcing.Serializer, archive Archive) *eventRepo {
 	return &eventRepo{
 		db:        db,
 		serialize: s,
+		archive:   archive,
 	}
 }
 
 func (r *eventRepo) Get(ctx context.Context, aggregateID string, fromVersion, toVersion int, agg eventsourcing.Aggregate) error {
 	root := agg.Root()
+	for evt, err := range r.events(ctx, aggregateID, root.AggregateType(), fromVersion, toVersion) {
+		if err != nil {
+			return err
+		}
+		root.LoadFromHistory(agg, []eventsourcing.Event{evt})
+	}
+
+	return nil
+}
+
+// Events streams the events of an aggregate with a version greater than fromVersion, decoded using the
+// aggregate type it was created with. An aggregate that was never stored yields no events.
+func (r *eventRepo) Events(ctx context.Context, aggregateID string, fromVersion int) iter.Seq2[eventsourcing.Event, error] {
+	return func(yield func(eventsourcing.Event, error) bool) {
+		var types []string
+		err := r.db.Raw(`
+			SELECT aggregate_type
+			FROM es_aggregate
+			WHERE id = ?`, aggregateID).Scan(&types).Error
+		if err != nil {
+			yield(eventsourcing.Event{}, fmt.Errorf("read aggregate type err=%w", err))
+			return
+		}
+		if len(types) == 0 {
+			return
+		}
+
+		for evt, err := range r.events(ctx, aggregateID, types[0], fromVersion, 0) {
+			if !yield(evt, err) || err != nil {
+				return
+			}
+		}
+	}
+}
+
+// events streams the events of an aggregate in (fromVersion, toVersion], toVersion 0 meaning the latest.
+// Events are read in pages of hydrateBatchSize using the last read version as key, each page is read in full
+// before it is yielded so the connection is free while the caller handles the events.
+// The versions missing before the first page were archived, they are read from the archive first.
+func (r *eventRepo) events(ctx context.Context, aggregateID, aggType string, fromVersion, toVersion int) iter.Seq2[eventsourcing.Event, error] {
+	return func(yield func(eventsourcing.Event, error) bool) {
+		after := fromVersion
+		for first := true; ; first = false {
+			page, err := r.page(ctx, aggregateID, aggType, after, toVersion)
+			if err != nil {
+				yield(eventsourcing.Event{}, err)
+				return
+			}
+			if first {
+				// the last event is never archived, an empty read up to the latest version has nothing archived
+				archivedTo := toVersion
+				if len(page) > 0 {
+					archivedTo = page[0].Version - 1
+				}
+				for evt, err := range readArchived(ctx, r.archive, r.serialize, aggregateID, aggType, after, archivedTo) {
+					if !yield(evt, err) || err != nil {
+						return
+					}
+				}
+			}
+
+			for _, evt := range page {
+				if !yield(evt, nil) {
+					return
+				}
+			}
+			if len(page) < hydrateBatchSize {
+				return
+			}
+			after = page[len(page)-1].Version
+		}
+	}
+}
+
+func (r *eventRepo) page(ctx context.Context, aggregateID, aggType string, afterVersion, toVersion int) ([]eventsourcing.Event, error) {
 	rows, err := r.db.Raw(`
-			SELECT id, aggregate_id, event_type, version, data
-			FROM es_event
-			WHERE aggregate_id = ?
-				AND (? = 0 OR version > ?)
-				AND (? = 0 OR version <= ?)
-			ORDER BY version ASC`, aggregateID, fromVersion, fromVersion, toVersion, toVersion).Rows()
+		SELECT id, aggregate_id, event_type, schema_version, version, codec, data, metadata, created_at
+		FROM es_event
+		WHERE aggregate_id = ?
+			AND version > ?
+			AND (? = 0 OR version <= ?)
+		ORDER BY version ASC
+		LIMIT ?`, aggregateID, afterVersion, toVersion, toVersion, hydrateBatchSize).Rows()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer rows.Close()
 
+	result := make([]eventsourcing.Event, 0, hydrateBatchSize)
 	for rows.Next() {
 		var evt eventsourcing.Event
-		var data string
-		if err := rows.Scan(&evt.ID, &evt.AggregateID, &evt.EventType, &evt.Version, &data); err != nil {
-			return err
+		var codec, data, metadata string
+		if err := rows.Scan(&evt.ID, &evt.AggregateID, &evt.EventType, &evt.SchemaVersion, &evt.Version, &codec, &data, &metadata, &evt.CreatedAt); err != nil {
+			return nil, err
 		}
+		evt.AggregateType = aggType
+		evt.Position = evt.ID
 
-		f, ok := r.serialize.Type(root.AggregateType(), evt.EventType)
-		if !ok {
-			return fmt.Errorf("cant serialize event with type: %s_%s", root.AggregateType(), evt.EventType)
+		if err := r.serialize.UnmarshalEvent(aggType, &evt, codec, []byte(data)); err != nil {
+			return nil, err
+		}
+		if metadata != "" {
+			if err := r.serialize.Unmarshal([]byte(metadata), &evt.Metadata); err != nil {
+				return nil, fmt.Errorf("unmarshal event metadata failed with err=%w", err)
+			}
 		}
 
-		eventData := f()
-		err := r.serialize.Unmarshal([]byte(data), &eventData)
+		result = append(result, evt)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Get event rows.err err=%w", err)
+	}
+
+	return result, nil
+}
+
+func (r *eventRepo) VersionAt(ctx context.Context, aggregateID string, at time.Time) (int, error) {
+	var version int
+	err := r.db.Raw(`
+		SELECT COALESCE(MAX(version), 0)
+		FROM es_event
+		WHERE aggregate_id = ?
+			AND created_at <= ?`, aggregateID, at.Unix()).Row().Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("read version at err=%w", err)
+	}
+	// the archived events are older than the stored ones
+	if version == 0 {
+		return archivedVersionAt(ctx, r.archive, aggregateID, at)
+	}
+
+	return version, nil
+}
+
+func (r *eventRepo) StoredEvents(ctx context.Context, aggregateID string, fromVersion, toVersion int) ([]StoredEvent, error) {
+	rows, err := r.db.Raw(`
+		SELECT e.id, e.aggregate_id, a.aggregate_type, e.event_type, e.schema_version, e.version, e.codec, e.data,
+			e.metadata, e.created_at
+		FROM es_event e
+		JOIN es_aggregate a ON a.id = e.aggregate_id
+		WHERE e.aggregate_id = ?
+			AND e.version > ?
+			AND (? = 0 OR e.version <= ?)
+		ORDER BY e.version ASC`, aggregateID, fromVersion, toVersion, toVersion).Rows()
+	if err != nil {
+		return nil, fmt.Errorf("read stored events err=%w", err)
+	}
+	defer rows.Close()
+
+	var result []StoredEvent
+	for rows.Next() {
+		var se StoredEvent
+		var data, metadata string
+		err := rows.Scan(&se.ID, &se.AggregateID, &se.AggregateType, &se.EventType, &se.SchemaVersion, &se.Version,
+			&se.Codec, &data, &metadata, &se.CreatedAt)
 		if err != nil {
-			return fmt.Errorf("unmarshal event failed with err=%w", err)
+			return nil, err
+		}
+		se.Position = se.ID
+		se.Payload = []byte(data)
+		if metadata != "" {
+			if err := r.serialize.Unmarshal([]byte(metadata), &se.Metadata); err != nil {
+				return nil, fmt.Errorf("unmarshal event metadata failed with err=%w", err)
+			}
 		}
+		result = append(result, se)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("read stored events rows.err err=%w", err)
+	}
 
-		evt.Data = eventData
-		root.LoadFromHistory(agg, []eventsourcing.Event{evt})
+	return result, nil
+}
+
+func (r *eventRepo) DeleteEvents(ctx context.Context, aggregateID string, toVersion int) (int, error) {
+	var last int
+	err := r.db.Raw(`SELECT COALESCE(MAX(version), 0) FROM es_event WHERE aggregate_id = ?`, aggregateID).
+		Row().Scan(&last)
+	if err != nil {
+		return 0, fmt.Errorf("read last event version err=%w", err)
+	}
+	if toVersion >= last {
+		return 0, fmt.Errorf("delete events id=%s up to version %d would delete the last event version %d",
+			aggregateID, toVersion, last)
 	}
 
-	if err := rows.Err(); err != nil {
-		return fmt.Errorf("Get event rows.err err=%w", err)
+	// the position is recorded first, a failed delete leaves it ahead of the archived events, which is only stricter
+	var position int64
+	err = r.db.Raw(`SELECT COALESCE(MAX(id), 0) FROM es_event WHERE aggregate_id = ? AND version <= ?`,
+		aggregateID, toVersion).Row().Scan(&position)
+	if err != nil {
+		return 0, fmt.Errorf("read archived position err=%w", err)
+	}
+	err = r.db.Exec(`UPDATE es_archive_position SET position = ? WHERE id = 1 AND position < ?`, position, position).Error
+	if err != nil {
+		return 0, fmt.Errorf("record archived position err=%w", err)
 	}
 
-	return nil
+	result := r.db.Exec(`
+		DELETE FROM es_event
+		WHERE aggregate_id = ?
+			AND version <= ?`, aggregateID, toVersion)
+	if result.Error != nil {
+		return 0, fmt.Errorf("delete events err=%w", result.Error)
+	}
+
+	return int(result.RowsAffected), nil
 }
 
+func (r *eventRepo) ArchivedPosition(ctx context.Context) (int64, error) {
+	var position []int64
+	if err := r.db.Raw(`SELECT position FROM es_archive_position WHERE id = 1`).Scan(&position).Error; err != nil {
+		return 0, fmt.Errorf("read archived position err=%w", err)
+	}
+	if len(position) == 0 {
+		return 0, nil
+	}
+	return position[0], nil
+}
+
+// Append inserts the event, the unique (aggregate_id, version) key rejects duplicates and eventStore.Append the gaps
 func (r *eventRepo) Append(ctx context.Context, e eventsourcing.Event) error {
-	eData, err := r.serialize.Marshal(e.Data)
+	codec, eData, err := r.serialize.EncodeEvent(e)
 	if err != nil {
 		return fmt.Errorf("serilize e.Data err=%w", err)
 	}
@@ -76,12 +265,71 @@ func (r *eventRepo) Append(ctx context.Context, e eventsourcing.Event) error {
 	}
 
 	err = r.db.Exec(`
-		INSERT INTO es_event(aggregate_id, event_type, version, data, metadata, created_at)
-		VALUES(?, ?, ?, ?, ?, ?)`,
-		e.AggregateID, e.EventType, e.Version, eData, eMetadata, e.CreatedAt).Error
+		INSERT INTO es_event(aggregate_id, event_type, schema_version, version, codec, data, metadata, created_at)
+		VALUES(?, ?, ?, ?, ?, ?, ?, ?)`,
+		e.AggregateID, e.EventType, e.SchemaVersion, e.Version, codec, eData, string(eMetadata), e.CreatedAt).Error
 	if err != nil {
 		return fmt.Errorf("append event err=%w", err)
 	}
 
 	return nil
 }
+
+// lastVersion returns the version of the last stored event of the aggregate, 0 if it has none
+func (r *eventRepo) lastVersion(ctx context.Context, aggregateID string) (int, error) {
+	var last int
+	err := r.db.Raw(`SELECT COALESCE(MAX(version), 0) FROM es_event WHERE aggregate_id = ?`, aggregateID).
+		Row().Scan(&last)
+	if err != nil {
+		return 0, fmt.Errorf("read last event version err=%w", err)
+	}
+	return last, nil
+}
+
+// ReadAll returns up to limit events of every aggregate with a position greater than fromPosition, ordered by position
+func (r *eventRepo) ReadAll(ctx context.Context, fromPosition int64, limit int) ([]eventsourcing.Event, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("%w limit=%d", ErrInvalidLimit, limit)
+	}
+
+	rows, err := r.db.Raw(`
+		SELECT e.id, e.aggregate_id, a.aggregate_type, e.event_type, e.schema_version, e.version, e.codec, e.data, e.metadata, e.created_at
+		FROM es_event e
+		JOIN es_aggregate a ON a.id = e.aggregate_id
+		WHERE e.id > ?
+		ORDER BY e.id ASC
+		LIMIT ?`, fromPosition, limit).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	result := make([]eventsourcing.Event, 0, limit)
+	for rows.Next() {
+		var evt eventsourcing.Event
+		var codec, data string
+		var metadata string
+		if err := rows.Scan(&evt.ID, &evt.AggregateID, &evt.AggregateType, &evt.EventType, &evt.SchemaVersion, &evt.Version, &codec, &data, &metadata, &evt.CreatedAt); err != nil {
+			return nil, err
+		}
+		evt.Position = evt.ID
+
+		if err := r.serialize.UnmarshalEvent(evt.AggregateType, &evt, codec, []byte(data)); err != nil {
+			return nil, err
+		}
+
+		if metadata != "" {
+			if err := r.serialize.Unmarshal([]byte(metadata), &evt.Metadata); err != nil {
+				return nil, fmt.Errorf("unmarshal event metadata failed with err=%w", err)
+			}
+		}
+
+		result = append(result, evt)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ReadAll event rows.err err=%w", err)
+	}
+
+	return result, nil
+}
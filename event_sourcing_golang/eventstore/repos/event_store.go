@@ -3,6 +3,9 @@ package repos
 import (
 	"context"
 	"fmt"
+	"iter"
+	"reflect"
+	"time"
 
 	"event_sourcing_golang/pkg/eventsourcing"
 
@@ -18,30 +21,112 @@ type EventStore interface {
 	Append(context.Context, eventsourcing.Event) error
 
 	CreateIfNotExist(ctx context.Context, id, typ string) error
-	CheckAndUpdateVersion(ctx context.Context, agg eventsourcing.Aggregate) bool
+	// AggregateVersion returns the stored version of the aggregate, ErrAggregateNotFound if it was never created
+	AggregateVersion(ctx context.Context, id string) (int, error)
+	// Aggregates returns up to limit aggregates of aggType, or of every type when it is empty, with an ID greater
+	// than afterID in ID order
+	Aggregates(ctx context.Context, aggType, afterID string, limit int) ([]AggregateInfo, error)
+	// CheckAndUpdateVersion moves the stored version of agg to its new version, it fails with ErrConcurrencyConflict
+	// when the stored version is not agg's base version and ErrAggregateNotFound when agg was never created
+	CheckAndUpdateVersion(ctx context.Context, agg eventsourcing.Aggregate) error
 	CreateSnapshot(ctx context.Context, agg eventsourcing.Aggregate) error
-	ReadSnapshot(ctx context.Context, aggregateID string, version int, agg eventsourcing.Aggregate) bool
+	// ReadSnapshot loads the latest snapshot at or above version into agg, ErrSnapshotNotFound if there is none and
+	// ErrSnapshotStale if it was written with another schema than agg's
+	ReadSnapshot(ctx context.Context, aggregateID string, version int, agg eventsourcing.Aggregate) error
+	// ReadSnapshotAt loads the latest snapshot at or below maxVersion into agg, with agg's version set to the
+	// snapshot version. ErrSnapshotNotFound if there is none and ErrSnapshotStale if it has another schema.
+	ReadSnapshotAt(ctx context.Context, aggregateID string, maxVersion int, agg eventsourcing.Aggregate) error
+	// PurgeStaleSnapshots deletes the snapshots of the aggregate written with another schema than agg's and
+	// returns how many were deleted
+	PurgeStaleSnapshots(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) (int, error)
 	WithTransaction(ctx context.Context, fn func(EventStore) error) (err error)
 
+	// StoredEvents returns the events of the aggregate in (fromVersion, toVersion] still in the store, undecoded
+	StoredEvents(ctx context.Context, aggregateID string, fromVersion, toVersion int) ([]StoredEvent, error)
+	// DeleteEvents deletes the events of the aggregate up to toVersion once they are archived and returns how many
+	// were deleted. The last event is always kept as appends check their version against it.
+	DeleteEvents(ctx context.Context, aggregateID string, toVersion int) (int, error)
+	// ArchivedPosition returns the greatest position of the events deleted by DeleteEvents, 0 if none was
+	ArchivedPosition(ctx context.Context) (int64, error)
+
 	// List returns all events for an aggregate, fully deserialized using agg's registered types
 	List(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) ([]eventsourcing.Event, error)
-	// SnapshotVersion returns the latest snapshot version for the aggregate if exists
-	SnapshotVersion(ctx context.Context, aggregateID string) (int, bool)
+	// Events streams the events of an aggregate with a version greater than fromVersion, reading them in batches
+	// so memory stays bounded however long the stream is. Iteration stops at the first error.
+	Events(ctx context.Context, aggregateID string, fromVersion int) iter.Seq2[eventsourcing.Event, error]
+	// VersionAt returns the version of the last event of the aggregate created at or before at, 0 if there is none
+	VersionAt(ctx context.Context, aggregateID string, at time.Time) (int, error)
+	// SnapshotVersion returns the latest snapshot version for the aggregate, ErrSnapshotNotFound if there is none
+	SnapshotVersion(ctx context.Context, aggregateID string) (int, error)
+	// LastSnapshot returns the version and creation time of the latest snapshot, ErrSnapshotNotFound if there is none
+	LastSnapshot(ctx context.Context, aggregateID string) (SnapshotMeta, error)
+	// Snapshots returns every stored snapshot of the aggregate in version order
+	Snapshots(ctx context.Context, aggregateID string) ([]SnapshotMeta, error)
+
+	// ReadAll returns up to limit events across all aggregates with position greater than fromPosition, in position
+	// order. limit must be positive, ErrInvalidLimit otherwise. Positions are given in commit order: once an event is
+	// read, no event with a lower position can appear later, so readers can resume after the last position they read.
+	ReadAll(ctx context.Context, fromPosition int64, limit int) ([]eventsourcing.Event, error)
+	// Subscribe catches up on events after fromPosition and then tails newly appended events until ctx is done
+	Subscribe(ctx context.Context, fromPosition int64) *Subscription
+
+	// AppendOutbox records events to be published by the outbox relay, in the same transaction as Append
+	AppendOutbox(ctx context.Context, events ...eventsourcing.Event) error
+	// PendingOutbox returns up to limit undelivered outbox messages due at now, at most one per aggregate
+	PendingOutbox(ctx context.Context, now time.Time, limit int) ([]OutboxMessage, error)
+	// UndeliveredOutboxVersion returns the version of the oldest undelivered outbox message of the aggregate,
+	// 0 if there is none
+	UndeliveredOutboxVersion(ctx context.Context, aggregateID string) (int, error)
+	MarkOutboxDelivered(ctx context.Context, id int64) error
+	MarkOutboxFailed(ctx context.Context, id int64, nextAttemptAt time.Time, reason string) error
+
+	// RecordCommand records the versions the aggregates reached by handling a command, in the same transaction as
+	// Append. It fails with ErrDuplicateCommand when the command ID was already recorded.
+	RecordCommand(ctx context.Context, commandID string, records ...CommandRecord) error
+	// LookupCommand returns the versions recorded for a command, ErrCommandNotFound if it was never recorded
+	LookupCommand(ctx context.Context, commandID string) ([]CommandRecord, error)
+}
+
+// AggregateInfo describes a stored aggregate
+type AggregateInfo struct {
+	ID      string
+	Type    string
+	Version int
+}
+
+// SnapshotMeta describes a stored snapshot without its data
+type SnapshotMeta struct {
+	Version   int
+	CreatedAt time.Time
+	// Schema is the schema of the aggregate the snapshot was written from, see eventsourcing.SnapshotSchema
+	Schema string
 }
 
 type eventStore struct {
 	*aggregateRepo
 	*eventRepo
+	*outboxRepo
+	*commandRepo
 	db         *gorm.DB
 	serializer eventsourcing.Serializer
+	archive    Archive
+
+	// tx is set on the store handed to WithTransaction, positionsLocked once it holds the position lock
+	tx              bool
+	positionsLocked bool
+	// next holds the version the next event appended to each aggregate in the transaction must have
+	next map[string]int
 }
 
-func newEventStore(db *gorm.DB, s eventsourcing.Serializer) EventStore {
+func newEventStore(db *gorm.DB, s eventsourcing.Serializer, cfg config) EventStore {
 	return &eventStore{
 		db:            db,
 		serializer:    s,
+		archive:       cfg.archive,
 		aggregateRepo: newAggregateRepo(db, s),
-		eventRepo:     newEventRepo(db, s),
+		eventRepo:     newEventRepo(db, s, cfg.archive),
+		outboxRepo:    newOutboxRepo(db, s),
+		commandRepo:   newCommandRepo(db),
 	}
 }
 
@@ -49,8 +134,14 @@ func (r *eventStore) WithTransaction(ctx context.Context, fn func(EventStore) er
 	tx := r.db.Begin()
 	tr := &eventStore{
 		db:            tx,
+		serializer:    r.serializer,
+		archive:       r.archive,
 		aggregateRepo: newAggregateRepo(tx, r.serializer),
-		eventRepo:     newEventRepo(tx, r.serializer),
+		eventRepo:     newEventRepo(tx, r.serializer, r.archive),
+		outboxRepo:    newOutboxRepo(tx, r.serializer),
+		commandRepo:   newCommandRepo(tx),
+		tx:            true,
+		next:          make(map[string]int),
 	}
 	err = tx.Error
 	if err != nil {
@@ -73,64 +164,138 @@ func (r *eventStore) WithTransaction(ctx context.Context, fn func(EventStore) er
 	return err
 }
 
-// List returns all events for an aggregate, deserialized using the aggregate's registered event types
-func (r *eventStore) List(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) ([]eventsourcing.Event, error) {
-	root := agg.Root()
-	rows, err := r.db.Raw(`
-            SELECT id, aggregate_id, event_type, version, data, metadata, created_at
-            FROM es_event
-            WHERE aggregate_id = ?
-            ORDER BY version ASC`, aggregateID).Rows()
-	if err != nil {
-		return nil, err
+// CheckAndUpdateVersion takes the position lock before the row of the aggregate, so transactions saving several
+// aggregates take their locks in the same order as the others. The checked version is where the events appended
+// next in the transaction start.
+func (r *eventStore) CheckAndUpdateVersion(ctx context.Context, agg eventsourcing.Aggregate) error {
+	if err := r.lockPositions(); err != nil {
+		return err
+	}
+	if err := r.aggregateRepo.CheckAndUpdateVersion(ctx, agg); err != nil {
+		return err
 	}
-	defer rows.Close()
+	if _, ok := r.next[agg.Root().AggregateID()]; !ok && r.tx {
+		r.next[agg.Root().AggregateID()] = agg.Root().BaseVersion() + 1
+	}
+	return nil
+}
 
-	var result []eventsourcing.Event
-	for rows.Next() {
-		var evt eventsourcing.Event
-		var dataStr string
-		var metaStr string
-		if err := rows.Scan(&evt.ID, &evt.AggregateID, &evt.EventType, &evt.Version, &dataStr, &metaStr, &evt.CreatedAt); err != nil {
-			return nil, err
-		}
+// Append runs in its own transaction outside WithTransaction, as the position lock is only held by transactions.
+// The version of the event must follow the version checked by CheckAndUpdateVersion or the last appended one,
+// the last stored version is only read for aggregates appended to without either.
+func (r *eventStore) Append(ctx context.Context, e eventsourcing.Event) error {
+	if !r.tx {
+		return r.WithTransaction(ctx, func(tx EventStore) error {
+			return tx.Append(ctx, e)
+		})
+	}
+	if err := r.lockPositions(); err != nil {
+		return err
+	}
 
-		f, ok := r.serializer.Type(root.AggregateType(), evt.EventType)
-		if !ok {
-			return nil, fmt.Errorf("cant serialize event with type: %s_%s", root.AggregateType(), evt.EventType)
+	want, ok := r.next[e.AggregateID]
+	if !ok {
+		last, err := r.lastVersion(ctx, e.AggregateID)
+		if err != nil {
+			return err
 		}
-		eventData := f()
-		if err := r.serializer.Unmarshal([]byte(dataStr), &eventData); err != nil {
+		want = last + 1
+	}
+	if e.Version != want {
+		return fmt.Errorf("%w aggregate_id=%s version=%d want=%d", ErrVersionGap, e.AggregateID, e.Version, want)
+	}
+	if err := r.eventRepo.Append(ctx, e); err != nil {
+		return err
+	}
+	r.next[e.AggregateID] = e.Version + 1
+	return nil
+}
+
+// lockPositions locks the row of es_position_lock until the transaction ends. The ids of es_event, the positions
+// of the events, are then given to one transaction at a time and committed in order: without the lock, a
+// transaction could commit the id 11 while the one holding the id 10 is still running, and a reader at 11 would
+// never read 10. Outside a transaction there is nothing to lock.
+func (r *eventStore) lockPositions() error {
+	if !r.tx || r.positionsLocked {
+		return nil
+	}
+	err := r.db.Exec(`UPDATE es_position_lock SET locked_at = ? WHERE id = 1`, time.Now().Unix()).Error
+	if err != nil {
+		return fmt.Errorf("lock event positions err=%w", err)
+	}
+	r.positionsLocked = true
+	return nil
+}
+
+// Subscribe polls ReadAll, as the database gives no notification of new appends
+func (r *eventStore) Subscribe(ctx context.Context, fromPosition int64) *Subscription {
+	return newSubscription(ctx, fromPosition, r.ReadAll, pollWait)
+}
+
+// List returns all events for an aggregate, deserialized using the aggregate's registered event types
+func (r *eventStore) List(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) ([]eventsourcing.Event, error) {
+	var result []eventsourcing.Event
+	// like the in-memory store, the type is the name of agg's type as it may not be set yet
+	for evt, err := range r.events(ctx, aggregateID, reflect.TypeOf(agg).Elem().Name(), 0, 0) {
+		if err != nil {
 			return nil, err
 		}
-		var metadata interface{}
-		if metaStr != "" {
-			if err := r.serializer.Unmarshal([]byte(metaStr), &metadata); err != nil {
-				return nil, err
-			}
-		}
-		evt.Data = eventData
-		evt.Metadata = metadata
 		result = append(result, evt)
 	}
 	return result, nil
 }
 
-// SnapshotVersion returns the latest snapshot version if exists
-func (r *eventStore) SnapshotVersion(ctx context.Context, aggregateID string) (int, bool) {
-	var v int
+func (r *eventStore) Snapshots(ctx context.Context, aggregateID string) ([]SnapshotMeta, error) {
+	var rows []struct {
+		Version        int
+		CreatedAt      int64
+		SnapshotSchema string
+	}
+	err := r.db.Raw(`
+        SELECT version, created_at, snapshot_schema
+        FROM es_aggregate_snapshot
+        WHERE aggregate_id = ?
+        ORDER BY version ASC
+    `, aggregateID).Scan(&rows).Error
+	if err != nil {
+		return nil, fmt.Errorf("read snapshots err=%w", err)
+	}
+
+	result := make([]SnapshotMeta, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, SnapshotMeta{Version: row.Version, CreatedAt: time.Unix(row.CreatedAt, 0), Schema: row.SnapshotSchema})
+	}
+	return result, nil
+}
+
+// SnapshotVersion returns the latest snapshot version, ErrSnapshotNotFound if there is none
+func (r *eventStore) SnapshotVersion(ctx context.Context, aggregateID string) (int, error) {
+	meta, err := r.LastSnapshot(ctx, aggregateID)
+	if err != nil {
+		return 0, err
+	}
+	return meta.Version, nil
+}
+
+// LastSnapshot returns the version and creation time of the latest snapshot, ErrSnapshotNotFound if there is none
+func (r *eventStore) LastSnapshot(ctx context.Context, aggregateID string) (SnapshotMeta, error) {
+	var meta struct {
+		Version        int
+		CreatedAt      int64
+		SnapshotSchema string
+	}
 	err := r.db.Raw(`
-        SELECT version
+        SELECT version, created_at, snapshot_schema
         FROM es_aggregate_snapshot
         WHERE aggregate_id = ?
         ORDER BY version DESC
         LIMIT 1
-    `, aggregateID).Scan(&v).Error
+    `, aggregateID).Scan(&meta).Error
 	if err != nil {
-		return 0, false
+		return SnapshotMeta{}, fmt.Errorf("read last snapshot err=%w", err)
 	}
-	if v == 0 {
-		return 0, false
+	if meta.Version == 0 {
+		return SnapshotMeta{}, ErrSnapshotNotFound
 	}
-	return v, true
+	return SnapshotMeta{Version: meta.Version, CreatedAt: time.Unix(meta.CreatedAt, 0), Schema: meta.SnapshotSchema}, nil
 }
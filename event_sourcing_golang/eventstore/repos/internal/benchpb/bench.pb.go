@@ -0,0 +1,132 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// versions:
+// 	protoc-gen-go v1.36.10
+// 	protoc        v5.29.3
+// source: bench.proto
+
+package benchpb
+
+import (
+	protoreflect "google.golang.org/protobuf/reflect/protoreflect"
+	protoimpl "google.golang.org/protobuf/runtime/protoimpl"
+	reflect "reflect"
+	sync "sync"
+	unsafe "unsafe"
+)
+
+const (
+	// Verify that this generated code is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(20 - protoimpl.MinVersion)
+	// Verify that runtime/protoimpl is sufficiently up-to-date.
+	_ = protoimpl.EnforceVersion(protoimpl.MaxVersion - 20)
+)
+
+// BenchDeposited is the event payload of the codec benchmarks, encoded by every codec
+type BenchDeposited struct {
+	state         protoimpl.MessageState `protogen:"open.v1"`
+	Amount        int64                  `protobuf:"varint,1,opt,name=amount,proto3" json:"amount,omitempty"`
+	Note          string                 `protobuf:"bytes,2,opt,name=note,proto3" json:"note,omitempty"`
+	unknownFields protoimpl.UnknownFields
+	sizeCache     protoimpl.SizeCache
+}
+
+func (x *BenchDeposited) Reset() {
+	*x = BenchDeposited{}
+	mi := &file_bench_proto_msgTypes[0]
+	ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+	ms.StoreMessageInfo(mi)
+}
+
+func (x *BenchDeposited) String() string {
+	return protoimpl.X.MessageStringOf(x)
+}
+
+func (*BenchDeposited) ProtoMessage() {}
+
+func (x *BenchDeposited) ProtoReflect() protoreflect.Message {
+	mi := &file_bench_proto_msgTypes[0]
+	if x != nil {
+		ms := protoimpl.X.MessageStateOf(protoimpl.Pointer(x))
+		if ms.LoadMessageInfo() == nil {
+			ms.StoreMessageInfo(mi)
+		}
+		return ms
+	}
+	return mi.MessageOf(x)
+}
+
+// Deprecated: Use BenchDeposited.ProtoReflect.Descriptor instead.
+func (*BenchDeposited) Descriptor() ([]byte, []int) {
+	return file_bench_proto_rawDescGZIP(), []int{0}
+}
+
+func (x *BenchDeposited) GetAmount() int64 {
+	if x != nil {
+		return x.Amount
+	}
+	return 0
+}
+
+func (x *BenchDeposited) GetNote() string {
+	if x != nil {
+		return x.Note
+	}
+	return ""
+}
+
+var File_bench_proto protoreflect.FileDescriptor
+
+const file_bench_proto_rawDesc = "" +
+	"\n" +
+	"\vbench.proto\x12\abenchpb\"<\n" +
+	"\x0eBenchDeposited\x12\x16\n" +
+	"\x06amount\x18\x01 \x01(\x03R\x06amount\x12\x12\n" +
+	"\x04note\x18\x02 \x01(\tR\x04noteB9Z7event_sourcing_golang/eventstore/repos/internal/benchpbb\x06proto3"
+
+var (
+	file_bench_proto_rawDescOnce sync.Once
+	file_bench_proto_rawDescData []byte
+)
+
+func file_bench_proto_rawDescGZIP() []byte {
+	file_bench_proto_rawDescOnce.Do(func() {
+		file_bench_proto_rawDescData = protoimpl.X.CompressGZIP(unsafe.Slice(unsafe.StringData(file_bench_proto_rawDesc), len(file_bench_proto_rawDesc)))
+	})
+	return file_bench_proto_rawDescData
+}
+
+var file_bench_proto_msgTypes = make([]protoimpl.MessageInfo, 1)
+var file_bench_proto_goTypes = []any{
+	(*BenchDeposited)(nil), // 0: benchpb.BenchDeposited
+}
+var file_bench_proto_depIdxs = []int32{
+	0, // [0:0] is the sub-list for method output_type
+	0, // [0:0] is the sub-list for method input_type
+	0, // [0:0] is the sub-list for extension type_name
+	0, // [0:0] is the sub-list for extension extendee
+	0, // [0:0] is the sub-list for field type_name
+}
+
+func init() { file_bench_proto_init() }
+func file_bench_proto_init() {
+	if File_bench_proto != nil {
+		return
+	}
+	type x struct{}
+	out := protoimpl.TypeBuilder{
+		File: protoimpl.DescBuilder{
+			GoPackagePath: reflect.TypeOf(x{}).PkgPath(),
+			RawDescriptor: unsafe.Slice(unsafe.StringData(file_bench_proto_rawDesc), len(file_bench_proto_rawDesc)),
+			NumEnums:      0,
+			NumMessages:   1,
+			NumExtensions: 0,
+			NumServices:   0,
+		},
+		GoTypes:           file_bench_proto_goTypes,
+		DependencyIndexes: file_bench_proto_depIdxs,
+		MessageInfos:      file_bench_proto_msgTypes,
+	}.Build()
+	File_bench_proto = out.File
+	file_bench_proto_goTypes = nil
+	file_bench_proto_depIdxs = nil
+}
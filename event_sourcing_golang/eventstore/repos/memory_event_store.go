@@ -3,8 +3,12 @@ package repos
 import (
 	"context"
 	"fmt"
+	"iter"
 	"reflect"
+	"slices"
+	"strings"
 	"sync"
+	"time"
 
 	"event_sourcing_golang/pkg/eventsourcing"
 )
@@ -17,9 +21,19 @@ type memEventStore struct {
 	// aggregates keeps latest persisted version per aggregate
 	aggregates map[string]*memAggregate
 	// events keeps ordered events per aggregate id
-	events map[string][]eventsourcing.Event
-	// snapshots keeps the latest snapshot per aggregate id (by version)
-	snapshots map[string]memSnapshot
+	events map[string][]memEvent
+	// snapshots keeps the snapshots per aggregate id ordered by version
+	snapshots map[string][]memSnapshot
+	// all keeps every event in append order, event at index i has position i+1
+	all []memEvent
+	// appended is closed and replaced whenever new events are appended to wake up subscribers
+	appended chan struct{}
+	// outbox keeps outbox messages in insertion order, message at index i has id i+1
+	outbox []*memOutboxMessage
+	// commands keeps the records of every handled command ID
+	commands map[string][]CommandRecord
+	// archive has the events deleted by DeleteEvents, nil without archive
+	archive Archive
 }
 
 type memAggregate struct {
@@ -27,39 +41,318 @@ type memAggregate struct {
 	AggregateType string
 }
 
+// memEvent is a stored event, its payload is kept encoded like a database row
+type memEvent struct {
+	eventsourcing.Event
+	Codec   string
+	Payload []byte
+	// Archived is set once DeleteEvents moved the event to the archive, only its header is kept
+	Archived bool
+}
+
+type memOutboxMessage struct {
+	AggregateID   string
+	Version       int
+	Attempts      int
+	NextAttemptAt time.Time
+	Delivered     bool
+	LastError     string
+}
+
 type memSnapshot struct {
-	Version int
-	Data    []byte
-	// AggregateVersion at snapshot time
-	AggregateVersion int
+	Version   int
+	Schema    string
+	Codec     string
+	Data      []byte
+	CreatedAt time.Time
 }
 
-func newMemoryEventStore(s eventsourcing.Serializer) EventStore {
+func newMemoryEventStore(s eventsourcing.Serializer, cfg config) EventStore {
 	return &memEventStore{
 		serializer: s,
+		archive:    cfg.archive,
 		aggregates: make(map[string]*memAggregate),
-		events:     make(map[string][]eventsourcing.Event),
-		snapshots:  make(map[string]memSnapshot),
+		events:     make(map[string][]memEvent),
+		snapshots:  make(map[string][]memSnapshot),
+		appended:   make(chan struct{}),
+		commands:   make(map[string][]CommandRecord),
 	}
 }
 
 func (m *memEventStore) WithTransaction(ctx context.Context, fn func(EventStore) error) (err error) {
-	// In-memory variant runs the fn under the same mutex; emulate transactional behavior.
+	// In-memory variant runs the fn under the same mutex and undoes its writes when it fails,
+	// readers wait for the lock so they never see the writes of a transaction before it commits
 	m.mu.Lock()
 	defer m.mu.Unlock()
-	return fn(m)
+
+	tx := &memTx{}
+	defer func() {
+		p := recover()
+		if p != nil || err != nil {
+			for i := len(tx.undo) - 1; i >= 0; i-- {
+				tx.undo[i]()
+			}
+		} else if tx.appended {
+			m.notifyAppended()
+		}
+		if p != nil {
+			panic(p)
+		}
+	}()
+
+	return fn(memTxn{memEventStore: m, tx: tx})
+}
+
+// memTxn is the EventStore handed to fn by WithTransaction, it uses the lock free variants of the store methods
+// as the store lock is already held, and its writes record how to undo them
+type memTxn struct {
+	*memEventStore
+	tx *memTx
+}
+
+type memTx struct {
+	undo []func()
+	// appended tells if subscribers must be woken up once the transaction commits
+	appended bool
+}
+
+func (t memTxn) onRollback(fn func()) {
+	t.tx.undo = append(t.tx.undo, fn)
+}
+
+func (t memTxn) WithTransaction(ctx context.Context, fn func(EventStore) error) error {
+	return fn(t)
+}
+
+func (t memTxn) CreateIfNotExist(ctx context.Context, id, typ string) error {
+	if _, ok := t.aggregates[id]; !ok {
+		t.onRollback(func() { delete(t.aggregates, id) })
+	}
+	return t.createIfNotExist(id, typ)
+}
+
+func (t memTxn) CheckAndUpdateVersion(ctx context.Context, agg eventsourcing.Aggregate) error {
+	if a, ok := t.aggregates[agg.Root().AggregateID()]; ok {
+		prev := a.Version
+		t.onRollback(func() { a.Version = prev })
+	}
+	return t.checkAndUpdateVersion(agg)
+}
+
+// Append is undone by truncating the event lists, clipped so the next append does not overwrite the
+// rolled back events in an array still read by an iterator
+func (t memTxn) Append(ctx context.Context, e eventsourcing.Event) error {
+	id := e.AggregateID
+	events, all := len(t.events[id]), len(t.all)
+	t.onRollback(func() {
+		if events == 0 {
+			delete(t.events, id)
+		} else {
+			t.events[id] = slices.Clip(t.events[id][:events])
+		}
+		t.all = slices.Clip(t.all[:all])
+	})
+	if err := t.append(e); err != nil {
+		return err
+	}
+	t.tx.appended = true
+	return nil
+}
+
+func (t memTxn) StoredEvents(ctx context.Context, aggregateID string, fromVersion, toVersion int) ([]StoredEvent, error) {
+	return t.storedEvents(aggregateID, fromVersion, toVersion), nil
+}
+
+func (t memTxn) DeleteEvents(ctx context.Context, aggregateID string, toVersion int) (int, error) {
+	prev := t.events[aggregateID]
+	t.onRollback(func() {
+		t.events[aggregateID] = prev
+		for _, me := range prev {
+			t.all[me.Position-1] = me
+		}
+	})
+	return t.deleteEvents(aggregateID, toVersion)
+}
+
+func (t memTxn) ArchivedPosition(ctx context.Context) (int64, error) {
+	return t.archivedPosition(), nil
+}
+
+func (t memTxn) CreateSnapshot(ctx context.Context, agg eventsourcing.Aggregate) error {
+	t.restoreSnapshotsOnRollback(agg.Root().AggregateID())
+	return t.createSnapshot(agg)
+}
+
+func (t memTxn) PurgeStaleSnapshots(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) (int, error) {
+	t.restoreSnapshotsOnRollback(aggregateID)
+	return t.purgeStaleSnapshots(aggregateID, agg), nil
+}
+
+func (t memTxn) restoreSnapshotsOnRollback(id string) {
+	prev, ok := t.snapshots[id]
+	prev = slices.Clone(prev)
+	t.onRollback(func() {
+		if ok {
+			t.snapshots[id] = prev
+		} else {
+			delete(t.snapshots, id)
+		}
+	})
+}
+
+func (t memTxn) AppendOutbox(ctx context.Context, events ...eventsourcing.Event) error {
+	n := len(t.outbox)
+	t.onRollback(func() { t.outbox = slices.Clip(t.outbox[:n]) })
+	t.appendOutbox(events...)
+	return nil
+}
+
+func (t memTxn) MarkOutboxDelivered(ctx context.Context, id int64) error {
+	msg, err := t.outboxMessage(id)
+	if err != nil {
+		return err
+	}
+	prev := *msg
+	t.onRollback(func() { *msg = prev })
+	return t.markOutboxDelivered(id)
+}
+
+func (t memTxn) MarkOutboxFailed(ctx context.Context, id int64, nextAttemptAt time.Time, reason string) error {
+	msg, err := t.outboxMessage(id)
+	if err != nil {
+		return err
+	}
+	prev := *msg
+	t.onRollback(func() { *msg = prev })
+	return t.markOutboxFailed(id, nextAttemptAt, reason)
+}
+
+func (t memTxn) RecordCommand(ctx context.Context, commandID string, records ...CommandRecord) error {
+	prev, ok := t.commands[commandID]
+	t.onRollback(func() {
+		if ok {
+			t.commands[commandID] = prev
+		} else {
+			delete(t.commands, commandID)
+		}
+	})
+	return t.recordCommand(commandID, records...)
+}
+
+func (t memTxn) LookupCommand(ctx context.Context, commandID string) ([]CommandRecord, error) {
+	return t.lookupCommand(commandID)
+}
+
+func (t memTxn) Get(ctx context.Context, aggregateID string, fromVersion, toVersion int, agg eventsourcing.Aggregate) error {
+	return t.get(ctx, t.events[aggregateID], fromVersion, toVersion, agg)
+}
+
+func (t memTxn) Events(ctx context.Context, aggregateID string, fromVersion int) iter.Seq2[eventsourcing.Event, error] {
+	return t.aggregateEvents(ctx, aggregateID, fromVersion)
+}
+
+func (t memTxn) List(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) ([]eventsourcing.Event, error) {
+	return t.list(ctx, t.events[aggregateID], agg)
+}
+
+func (t memTxn) VersionAt(ctx context.Context, aggregateID string, at time.Time) (int, error) {
+	return t.versionAt(aggregateID, at), nil
+}
+
+func (t memTxn) ReadSnapshot(ctx context.Context, aggregateID string, version int, agg eventsourcing.Aggregate) error {
+	return t.readSnapshot(aggregateID, version, agg)
+}
+
+func (t memTxn) ReadSnapshotAt(ctx context.Context, aggregateID string, maxVersion int, agg eventsourcing.Aggregate) error {
+	return t.readSnapshotAt(aggregateID, maxVersion, agg)
+}
+
+func (t memTxn) SnapshotVersion(ctx context.Context, aggregateID string) (int, error) {
+	return t.snapshotVersion(aggregateID)
+}
+
+func (t memTxn) LastSnapshot(ctx context.Context, aggregateID string) (SnapshotMeta, error) {
+	return t.lastSnapshot(aggregateID)
+}
+
+func (t memTxn) Snapshots(ctx context.Context, aggregateID string) ([]SnapshotMeta, error) {
+	return t.snapshotMetas(aggregateID), nil
+}
+
+func (t memTxn) AggregateVersion(ctx context.Context, id string) (int, error) {
+	return t.aggregateVersion(id)
+}
+
+func (t memTxn) Aggregates(ctx context.Context, aggType, afterID string, limit int) ([]AggregateInfo, error) {
+	return t.aggregateInfos(aggType, afterID, limit), nil
+}
+
+func (t memTxn) ReadAll(ctx context.Context, fromPosition int64, limit int) ([]eventsourcing.Event, error) {
+	return t.readAll(fromPosition, limit)
+}
+
+func (t memTxn) PendingOutbox(ctx context.Context, now time.Time, limit int) ([]OutboxMessage, error) {
+	return t.pendingOutbox(now, limit)
+}
+
+func (t memTxn) UndeliveredOutboxVersion(ctx context.Context, aggregateID string) (int, error) {
+	return t.undeliveredOutboxVersion(aggregateID), nil
 }
 
 func (m *memEventStore) CreateIfNotExist(ctx context.Context, id, typ string) error {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	return m.createIfNotExist(id, typ)
+}
+
+func (m *memEventStore) createIfNotExist(id, typ string) error {
 	if _, ok := m.aggregates[id]; !ok {
 		m.aggregates[id] = &memAggregate{Version: 0, AggregateType: typ}
 	}
 	return nil
 }
 
-func (m *memEventStore) CheckAndUpdateVersion(ctx context.Context, agg eventsourcing.Aggregate) bool {
+func (m *memEventStore) AggregateVersion(ctx context.Context, id string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.aggregateVersion(id)
+}
+
+func (m *memEventStore) aggregateVersion(id string) (int, error) {
+	a, ok := m.aggregates[id]
+	if !ok {
+		return 0, fmt.Errorf("%w id=%s", ErrAggregateNotFound, id)
+	}
+	return a.Version, nil
+}
+
+func (m *memEventStore) Aggregates(ctx context.Context, aggType, afterID string, limit int) ([]AggregateInfo, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.aggregateInfos(aggType, afterID, limit), nil
+}
+
+func (m *memEventStore) aggregateInfos(aggType, afterID string, limit int) []AggregateInfo {
+	var result []AggregateInfo
+	for id, a := range m.aggregates {
+		if id > afterID && (aggType == "" || a.AggregateType == aggType) {
+			result = append(result, AggregateInfo{ID: id, Type: a.AggregateType, Version: a.Version})
+		}
+	}
+	slices.SortFunc(result, func(a, b AggregateInfo) int { return strings.Compare(a.ID, b.ID) })
+	if limit > 0 && len(result) > limit {
+		result = result[:limit]
+	}
+	return result
+}
+
+func (m *memEventStore) CheckAndUpdateVersion(ctx context.Context, agg eventsourcing.Aggregate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.checkAndUpdateVersion(agg)
+}
+
+func (m *memEventStore) checkAndUpdateVersion(agg eventsourcing.Aggregate) error {
 	root := agg.Root()
 	id := root.AggregateID()
 	expected := root.BaseVersion()
@@ -67,110 +360,572 @@ func (m *memEventStore) CheckAndUpdateVersion(ctx context.Context, agg eventsour
 
 	a, ok := m.aggregates[id]
 	if !ok {
-		return false
+		return fmt.Errorf("%w id=%s", ErrAggregateNotFound, id)
 	}
 	if a.Version != expected {
-		return false
+		return &ErrConcurrencyConflict{AggregateID: id, Expected: expected, Actual: a.Version}
 	}
 	a.Version = newVersion
-	return true
+	return nil
 }
 
 func (m *memEventStore) Append(ctx context.Context, e eventsourcing.Event) error {
-	// Ensure sequence
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.append(e); err != nil {
+		return err
+	}
+	m.notifyAppended()
+	return nil
+}
+
+func (m *memEventStore) append(e eventsourcing.Event) error {
+	// Ensure sequence, the event at index i has version i+1
 	list := m.events[e.AggregateID]
-	if len(list) > 0 {
-		last := list[len(list)-1]
-		if e.Version != last.Version+1 {
-			return fmt.Errorf("version gap for aggregate %s, got=%d want=%d", e.AggregateID, e.Version, last.Version+1)
-		}
-	} else {
-		if e.Version != 1 {
-			return fmt.Errorf("first event must have version=1, got=%d", e.Version)
+	if e.Version != len(list)+1 {
+		return fmt.Errorf("%w aggregate_id=%s version=%d want=%d", ErrVersionGap, e.AggregateID, e.Version, len(list)+1)
+	}
+	if e.AggregateType == "" {
+		if a, ok := m.aggregates[e.AggregateID]; ok {
+			e.AggregateType = a.AggregateType
 		}
 	}
-	m.events[e.AggregateID] = append(list, e)
+	codec, payload, err := m.serializer.EncodeEvent(e)
+	if err != nil {
+		return fmt.Errorf("serilize e.Data err=%w", err)
+	}
+	e.Data = nil
+	e.Position = int64(len(m.all) + 1)
+	e.ID = e.Position
+
+	me := memEvent{Event: e, Codec: codec, Payload: payload}
+	m.events[e.AggregateID] = append(list, me)
+	m.all = append(m.all, me)
 	return nil
 }
 
+// notifyAppended wakes up the subscribers waiting for new events, the caller holds the write lock
+func (m *memEventStore) notifyAppended() {
+	close(m.appended)
+	m.appended = make(chan struct{})
+}
+
+// eventList returns the stored events of an aggregate. Stored events are never modified in place, DeleteEvents
+// replaces the list, and appends never overwrite the array of a returned list, so it can be read once the lock
+// is released.
+func (m *memEventStore) eventList(aggregateID string) []memEvent {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.events[aggregateID]
+}
+
 func (m *memEventStore) Get(ctx context.Context, aggregateID string, fromVersion, toVersion int, agg eventsourcing.Aggregate) error {
+	return m.get(ctx, m.eventList(aggregateID), fromVersion, toVersion, agg)
+}
+
+func (m *memEventStore) get(ctx context.Context, list []memEvent, fromVersion, toVersion int, agg eventsourcing.Aggregate) error {
 	root := agg.Root()
-	events := m.events[aggregateID]
-	for _, evt := range events {
-		if (fromVersion == 0 || evt.Version > fromVersion) && (toVersion == 0 || evt.Version <= toVersion) {
-			f, ok := m.serializer.Type(root.AggregateType(), evt.EventType)
-			if !ok {
-				return fmt.Errorf("cant serialize event with type: %s_%s", root.AggregateType(), evt.EventType)
-			}
-			eventData := f()
-			// Convert evt.Data to correct concrete type via marshal/unmarshal to be safe.
-			b, err := m.serializer.Marshal(evt.Data)
-			if err != nil {
-				return err
+	for evt, err := range m.stream(ctx, list, root.AggregateType(), fromVersion, toVersion) {
+		if err != nil {
+			return err
+		}
+		root.LoadFromHistory(agg, []eventsourcing.Event{evt})
+	}
+	return nil
+}
+
+// Events decodes the stored events one at a time while the caller iterates
+func (m *memEventStore) Events(ctx context.Context, aggregateID string, fromVersion int) iter.Seq2[eventsourcing.Event, error] {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.aggregateEvents(ctx, aggregateID, fromVersion)
+}
+
+func (m *memEventStore) aggregateEvents(ctx context.Context, aggregateID string, fromVersion int) iter.Seq2[eventsourcing.Event, error] {
+	a, ok := m.aggregates[aggregateID]
+	if !ok {
+		return func(yield func(eventsourcing.Event, error) bool) {}
+	}
+	return m.stream(ctx, m.events[aggregateID], a.AggregateType, fromVersion, 0)
+}
+
+// stream yields the events of list in (fromVersion, toVersion], toVersion 0 meaning the latest
+func (m *memEventStore) stream(ctx context.Context, list []memEvent, aggType string, fromVersion, toVersion int) iter.Seq2[eventsourcing.Event, error] {
+	return func(yield func(eventsourcing.Event, error) bool) {
+		if fromVersion >= len(list) {
+			return
+		}
+		if toVersion > 0 && toVersion < len(list) {
+			list = list[:toVersion]
+		}
+		// event at index i has version i+1, as Append rejects version gaps
+		list = list[max(fromVersion, 0):]
+
+		// archived events are the first ones of the aggregate
+		archived := 0
+		for archived < len(list) && list[archived].Archived {
+			archived++
+		}
+		if archived > 0 {
+			events := readArchived(ctx, m.archive, m.serializer, list[0].AggregateID, aggType,
+				list[0].Version-1, list[archived-1].Version)
+			for evt, err := range events {
+				if !yield(evt, err) || err != nil {
+					return
+				}
 			}
-			if err := m.serializer.Unmarshal(b, &eventData); err != nil {
-				return err
+		}
+
+		for _, me := range list[archived:] {
+			evt, err := m.decode(aggType, me)
+			if !yield(evt, err) || err != nil {
+				return
 			}
-			evt.Data = eventData
-			root.LoadFromHistory(agg, []eventsourcing.Event{evt})
 		}
 	}
-	return nil
+}
+
+// decode returns the stored event with its payload decoded into the type registered for aggType
+func (m *memEventStore) decode(aggType string, me memEvent) (eventsourcing.Event, error) {
+	evt := me.Event
+	if err := m.serializer.UnmarshalEvent(aggType, &evt, me.Codec, me.Payload); err != nil {
+		return evt, err
+	}
+	return evt, nil
+}
+
+func (m *memEventStore) StoredEvents(ctx context.Context, aggregateID string, fromVersion, toVersion int) ([]StoredEvent, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.storedEvents(aggregateID, fromVersion, toVersion), nil
+}
+
+func (m *memEventStore) storedEvents(aggregateID string, fromVersion, toVersion int) []StoredEvent {
+	var result []StoredEvent
+	for _, me := range m.events[aggregateID] {
+		if me.Archived || me.Version <= fromVersion || (toVersion > 0 && me.Version > toVersion) {
+			continue
+		}
+		result = append(result, StoredEvent{Event: me.Event, Codec: me.Codec, Payload: me.Payload})
+	}
+	return result
+}
+
+func (m *memEventStore) DeleteEvents(ctx context.Context, aggregateID string, toVersion int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.deleteEvents(aggregateID, toVersion)
+}
+
+// deleteEvents replaces the events up to toVersion with their header, in a copy of the list as returned lists
+// are read without lock
+func (m *memEventStore) deleteEvents(aggregateID string, toVersion int) (int, error) {
+	list := m.events[aggregateID]
+	if toVersion >= len(list) {
+		return 0, fmt.Errorf("delete events id=%s up to version %d would delete the last event version %d",
+			aggregateID, toVersion, len(list))
+	}
+
+	list = slices.Clone(list)
+	deleted := 0
+	for i := range list[:max(toVersion, 0)] {
+		if list[i].Archived {
+			continue
+		}
+		list[i].Archived = true
+		list[i].Codec, list[i].Payload = "", nil
+		m.all[list[i].Position-1] = list[i]
+		deleted++
+	}
+	m.events[aggregateID] = list
+	return deleted, nil
+}
+
+func (m *memEventStore) ArchivedPosition(ctx context.Context) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.archivedPosition(), nil
+}
+
+func (m *memEventStore) archivedPosition() int64 {
+	var position int64
+	for _, me := range m.all {
+		if me.Archived {
+			position = me.Position
+		}
+	}
+	return position
 }
 
 func (m *memEventStore) CreateSnapshot(ctx context.Context, agg eventsourcing.Aggregate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.createSnapshot(agg)
+}
+
+func (m *memEventStore) createSnapshot(agg eventsourcing.Aggregate) error {
 	root := agg.Root()
-	data, err := m.serializer.Marshal(agg)
+	codec, data, err := m.serializer.EncodeSnapshot(agg)
 	if err != nil {
 		return err
 	}
-	m.snapshots[root.AggregateID()] = memSnapshot{Version: root.Version(), Data: data, AggregateVersion: root.Version()}
+	snap := memSnapshot{
+		Version:   root.Version(),
+		Schema:    eventsourcing.SnapshotSchema(agg),
+		Codec:     codec,
+		Data:      data,
+		CreatedAt: time.Now(),
+	}
+
+	// async snapshots may be written out of order, keep the list sorted by version
+	list := m.snapshots[root.AggregateID()]
+	i, found := slices.BinarySearchFunc(list, snap.Version, func(s memSnapshot, v int) int { return s.Version - v })
+	if found {
+		list[i] = snap
+	} else {
+		list = slices.Insert(list, i, snap)
+	}
+	m.snapshots[root.AggregateID()] = list
 	return nil
 }
 
-func (m *memEventStore) ReadSnapshot(ctx context.Context, aggregateID string, version int, agg eventsourcing.Aggregate) bool {
-	snap, ok := m.snapshots[aggregateID]
+func (m *memEventStore) PurgeStaleSnapshots(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.purgeStaleSnapshots(aggregateID, agg), nil
+}
+
+func (m *memEventStore) purgeStaleSnapshots(aggregateID string, agg eventsourcing.Aggregate) int {
+	schema := eventsourcing.SnapshotSchema(agg)
+	list := m.snapshots[aggregateID]
+	kept := slices.DeleteFunc(list, func(s memSnapshot) bool { return s.Schema != schema })
+	if len(kept) == 0 {
+		delete(m.snapshots, aggregateID)
+	} else {
+		m.snapshots[aggregateID] = kept
+	}
+	return len(list) - len(kept)
+}
+
+// latestSnapshot returns the snapshot with the highest version, at or below maxVersion unless it is 0
+func (m *memEventStore) latestSnapshot(aggregateID string, maxVersion int) (memSnapshot, bool) {
+	list := m.snapshots[aggregateID]
+	for i := len(list) - 1; i >= 0; i-- {
+		if maxVersion == 0 || list[i].Version <= maxVersion {
+			return list[i], true
+		}
+	}
+	return memSnapshot{}, false
+}
+
+func (m *memEventStore) ReadSnapshot(ctx context.Context, aggregateID string, version int, agg eventsourcing.Aggregate) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.readSnapshot(aggregateID, version, agg)
+}
+
+func (m *memEventStore) readSnapshot(aggregateID string, version int, agg eventsourcing.Aggregate) error {
+	snap, ok := m.latestSnapshot(aggregateID, 0)
+	if !ok || snap.Version < version {
+		return ErrSnapshotNotFound
+	}
+	if err := checkSnapshotSchema(aggregateID, snap.Version, snap.Schema, agg); err != nil {
+		return err
+	}
+	if err := m.serializer.DecodeSnapshot(aggregateID, snap.Codec, snap.Data, agg); err != nil {
+		return fmt.Errorf("unmarshal snapshot err=%w", err)
+	}
+	// like the SQL store, the version is the stored aggregate version so the events after the snapshot get replayed
+	aggVersion := snap.Version
+	if a, ok := m.aggregates[aggregateID]; ok {
+		aggVersion = a.Version
+	}
+	agg.Root().SetInternal(aggregateID, snap.Version, aggVersion)
+	return nil
+}
+
+func (m *memEventStore) ReadSnapshotAt(ctx context.Context, aggregateID string, maxVersion int, agg eventsourcing.Aggregate) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.readSnapshotAt(aggregateID, maxVersion, agg)
+}
+
+func (m *memEventStore) readSnapshotAt(aggregateID string, maxVersion int, agg eventsourcing.Aggregate) error {
+	snap, ok := m.latestSnapshot(aggregateID, maxVersion)
 	if !ok {
-		return false
+		return ErrSnapshotNotFound
 	}
-	if snap.Version < version {
-		return false
+	if err := checkSnapshotSchema(aggregateID, snap.Version, snap.Schema, agg); err != nil {
+		return err
 	}
-	if err := m.serializer.Unmarshal(snap.Data, agg); err != nil {
-		return false
+	if err := m.serializer.DecodeSnapshot(aggregateID, snap.Codec, snap.Data, agg); err != nil {
+		return fmt.Errorf("unmarshal snapshot err=%w", err)
+	}
+	agg.Root().SetInternal(aggregateID, snap.Version, snap.Version)
+	return nil
+}
+
+func (m *memEventStore) VersionAt(ctx context.Context, aggregateID string, at time.Time) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.versionAt(aggregateID, at), nil
+}
+
+func (m *memEventStore) versionAt(aggregateID string, at time.Time) int {
+	list := m.events[aggregateID]
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].CreatedAt <= at.Unix() {
+			return list[i].Version
+		}
 	}
-	agg.Root().SetInternal(aggregateID, snap.Version, snap.AggregateVersion)
-	return true
+	return 0
 }
 
 func (m *memEventStore) List(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) ([]eventsourcing.Event, error) {
+	return m.list(ctx, m.eventList(aggregateID), agg)
+}
+
+func (m *memEventStore) list(ctx context.Context, list []memEvent, agg eventsourcing.Aggregate) ([]eventsourcing.Event, error) {
 	// derive aggregate type via reflection to ensure it's set
 	aggType := reflect.TypeOf(agg).Elem().Name()
-	list := m.events[aggregateID]
 	res := make([]eventsourcing.Event, 0, len(list))
-	for _, evt := range list {
-		f, ok := m.serializer.Type(aggType, evt.EventType)
-		if !ok {
-			return nil, fmt.Errorf("cant serialize event with type: %s_%s", aggType, evt.EventType)
-		}
-		eventData := f()
-		b, err := m.serializer.Marshal(evt.Data)
+	for evt, err := range m.stream(ctx, list, aggType, 0, 0) {
 		if err != nil {
 			return nil, err
 		}
-		if err := m.serializer.Unmarshal(b, &eventData); err != nil {
+		res = append(res, evt)
+	}
+	return res, nil
+}
+
+func (m *memEventStore) SnapshotVersion(ctx context.Context, aggregateID string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.snapshotVersion(aggregateID)
+}
+
+func (m *memEventStore) snapshotVersion(aggregateID string) (int, error) {
+	snap, ok := m.latestSnapshot(aggregateID, 0)
+	if !ok {
+		return 0, ErrSnapshotNotFound
+	}
+	return snap.Version, nil
+}
+
+func (m *memEventStore) LastSnapshot(ctx context.Context, aggregateID string) (SnapshotMeta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lastSnapshot(aggregateID)
+}
+
+func (m *memEventStore) lastSnapshot(aggregateID string) (SnapshotMeta, error) {
+	snap, ok := m.latestSnapshot(aggregateID, 0)
+	if !ok {
+		return SnapshotMeta{}, ErrSnapshotNotFound
+	}
+	return SnapshotMeta{Version: snap.Version, CreatedAt: snap.CreatedAt, Schema: snap.Schema}, nil
+}
+
+func (m *memEventStore) Snapshots(ctx context.Context, aggregateID string) ([]SnapshotMeta, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.snapshotMetas(aggregateID), nil
+}
+
+func (m *memEventStore) snapshotMetas(aggregateID string) []SnapshotMeta {
+	list := m.snapshots[aggregateID]
+	result := make([]SnapshotMeta, 0, len(list))
+	for _, snap := range list {
+		result = append(result, SnapshotMeta{Version: snap.Version, CreatedAt: snap.CreatedAt, Schema: snap.Schema})
+	}
+	return result
+}
+
+func (m *memEventStore) ReadAll(ctx context.Context, fromPosition int64, limit int) ([]eventsourcing.Event, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.readAll(fromPosition, limit)
+}
+
+func (m *memEventStore) readAll(fromPosition int64, limit int) ([]eventsourcing.Event, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("%w limit=%d", ErrInvalidLimit, limit)
+	}
+	if fromPosition < 0 {
+		fromPosition = 0
+	}
+	if fromPosition >= int64(len(m.all)) {
+		return []eventsourcing.Event{}, nil
+	}
+
+	// archived events are skipped like the rows deleted from a database
+	res := []eventsourcing.Event{}
+	for _, me := range m.all[fromPosition:] {
+		if len(res) == limit {
+			break
+		}
+		if me.Archived {
+			continue
+		}
+		evt, err := m.decode(me.AggregateType, me)
+		if err != nil {
 			return nil, err
 		}
-		evt.Data = eventData
 		res = append(res, evt)
 	}
 	return res, nil
 }
 
-func (m *memEventStore) SnapshotVersion(ctx context.Context, aggregateID string) (int, bool) {
-	snap, ok := m.snapshots[aggregateID]
+// Subscribe is woken up directly by Append instead of polling
+func (m *memEventStore) Subscribe(ctx context.Context, fromPosition int64) *Subscription {
+	return newSubscription(ctx, fromPosition, m.ReadAll, m.appendedCh)
+}
+
+func (m *memEventStore) appendedCh() <-chan struct{} {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.appended
+}
+
+func (m *memEventStore) AppendOutbox(ctx context.Context, events ...eventsourcing.Event) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.appendOutbox(events...)
+	return nil
+}
+
+func (m *memEventStore) appendOutbox(events ...eventsourcing.Event) {
+	now := time.Now()
+	for _, e := range events {
+		m.outbox = append(m.outbox, &memOutboxMessage{AggregateID: e.AggregateID, Version: e.Version, NextAttemptAt: now})
+	}
+}
+
+func (m *memEventStore) PendingOutbox(ctx context.Context, now time.Time, limit int) ([]OutboxMessage, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.pendingOutbox(now, limit)
+}
+
+func (m *memEventStore) pendingOutbox(now time.Time, limit int) ([]OutboxMessage, error) {
+	res := []OutboxMessage{}
+	// blocked keeps aggregates with an older undelivered message, their later messages must wait
+	blocked := make(map[string]bool)
+	for i, msg := range m.outbox {
+		if len(res) == limit {
+			break
+		}
+		if msg.Delivered || blocked[msg.AggregateID] {
+			continue
+		}
+		blocked[msg.AggregateID] = true
+		if msg.NextAttemptAt.After(now) {
+			continue
+		}
+
+		stored := m.events[msg.AggregateID]
+		if msg.Version < 1 || msg.Version > len(stored) {
+			return nil, fmt.Errorf("outbox message %d references missing event %s v%d", i+1, msg.AggregateID, msg.Version)
+		}
+		me := stored[msg.Version-1]
+		evt, err := m.decode(me.AggregateType, me)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, OutboxMessage{ID: int64(i + 1), Event: evt, Attempts: msg.Attempts})
+	}
+	return res, nil
+}
+
+func (m *memEventStore) UndeliveredOutboxVersion(ctx context.Context, aggregateID string) (int, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.undeliveredOutboxVersion(aggregateID), nil
+}
+
+// undeliveredOutboxVersion returns the version of the first undelivered message of the aggregate, messages of an
+// aggregate are appended in version order
+func (m *memEventStore) undeliveredOutboxVersion(aggregateID string) int {
+	for _, msg := range m.outbox {
+		if msg.AggregateID == aggregateID && !msg.Delivered {
+			return msg.Version
+		}
+	}
+	return 0
+}
+
+func (m *memEventStore) MarkOutboxDelivered(ctx context.Context, id int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.markOutboxDelivered(id)
+}
+
+func (m *memEventStore) markOutboxDelivered(id int64) error {
+	msg, err := m.outboxMessage(id)
+	if err != nil {
+		return err
+	}
+	msg.Attempts++
+	msg.Delivered = true
+	return nil
+}
+
+func (m *memEventStore) MarkOutboxFailed(ctx context.Context, id int64, nextAttemptAt time.Time, reason string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.markOutboxFailed(id, nextAttemptAt, reason)
+}
+
+func (m *memEventStore) markOutboxFailed(id int64, nextAttemptAt time.Time, reason string) error {
+	msg, err := m.outboxMessage(id)
+	if err != nil {
+		return err
+	}
+	msg.Attempts++
+	msg.NextAttemptAt = nextAttemptAt
+	msg.LastError = reason
+	return nil
+}
+
+func (m *memEventStore) outboxMessage(id int64) (*memOutboxMessage, error) {
+	if id < 1 || id > int64(len(m.outbox)) {
+		return nil, fmt.Errorf("outbox message %d not found", id)
+	}
+	return m.outbox[id-1], nil
+}
+
+func (m *memEventStore) RecordCommand(ctx context.Context, commandID string, records ...CommandRecord) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.recordCommand(commandID, records...)
+}
+
+func (m *memEventStore) recordCommand(commandID string, records ...CommandRecord) error {
+	recorded := m.commands[commandID]
+	for _, rec := range records {
+		for _, r := range recorded {
+			if r.AggregateID == rec.AggregateID {
+				return fmt.Errorf("%w id=%s aggregate_id=%s", ErrDuplicateCommand, commandID, rec.AggregateID)
+			}
+		}
+	}
+
+	m.commands[commandID] = append(slices.Clip(recorded), records...)
+	return nil
+}
+
+func (m *memEventStore) LookupCommand(ctx context.Context, commandID string) ([]CommandRecord, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.lookupCommand(commandID)
+}
+
+func (m *memEventStore) lookupCommand(commandID string) ([]CommandRecord, error) {
+	records, ok := m.commands[commandID]
 	if !ok {
-		return 0, false
+		return nil, fmt.Errorf("%w id=%s", ErrCommandNotFound, commandID)
 	}
-	return snap.Version, true
+	return slices.Clone(records), nil
 }
@@ -0,0 +1,97 @@
+package repos
+
+import (
+	"context"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+//go:embed migrations
+var migrations embed.FS
+
+// Migrate creates or upgrades the event store tables of db using the schema shipped for its dialect.
+// Applied migrations are recorded in es_schema_migrations, so Migrate is safe to run at every start.
+// MySQL commits DDL implicitly, a migration failing there halfway must be fixed by hand.
+func Migrate(ctx context.Context, db *gorm.DB) error {
+	db = db.WithContext(ctx)
+	dir := path.Join("migrations", string(DialectOf(db)))
+
+	entries, err := migrations.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("read migrations dir=%s err=%w", dir, err)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	err = db.Exec(`
+		CREATE TABLE IF NOT EXISTS es_schema_migrations (
+			version    INT    NOT NULL PRIMARY KEY,
+			applied_at BIGINT NOT NULL
+		)`).Error
+	if err != nil {
+		return fmt.Errorf("create es_schema_migrations err=%w", err)
+	}
+
+	var applied []int
+	if err := db.Raw(`SELECT version FROM es_schema_migrations`).Scan(&applied).Error; err != nil {
+		return fmt.Errorf("read applied migrations err=%w", err)
+	}
+	done := make(map[int]bool, len(applied))
+	for _, v := range applied {
+		done[v] = true
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		version, err := migrationVersion(name)
+		if err != nil {
+			return err
+		}
+		if done[version] {
+			continue
+		}
+
+		script, err := migrations.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return fmt.Errorf("read migration %s err=%w", name, err)
+		}
+
+		err = db.Transaction(func(tx *gorm.DB) error {
+			for _, stmt := range strings.Split(string(script), ";") {
+				if strings.TrimSpace(stmt) == "" {
+					continue
+				}
+				if err := tx.Exec(stmt).Error; err != nil {
+					return err
+				}
+			}
+			return tx.Exec(`
+				INSERT INTO es_schema_migrations(version, applied_at)
+				VALUES(?, ?)`, version, time.Now().Unix()).Error
+		})
+		if err != nil {
+			return fmt.Errorf("apply migration %s err=%w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// migrationVersion parses the numeric prefix of a migration file name such as 0001_init.sql
+func migrationVersion(name string) (int, error) {
+	prefix, _, ok := strings.Cut(name, "_")
+	if !ok {
+		return 0, fmt.Errorf("migration %s is not named <version>_<name>.sql", name)
+	}
+	version, err := strconv.Atoi(prefix)
+	if err != nil {
+		return 0, fmt.Errorf("migration %s has an invalid version err=%w", name, err)
+	}
+	return version, nil
+}
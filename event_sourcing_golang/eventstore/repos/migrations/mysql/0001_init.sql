@@ -0,0 +1,49 @@
+CREATE TABLE IF NOT EXISTS es_aggregate (
+    id             VARCHAR(255) NOT NULL,
+    version        INT          NOT NULL DEFAULT 0,
+    aggregate_type VARCHAR(255) NOT NULL,
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS es_event (
+    id             BIGINT       NOT NULL AUTO_INCREMENT,
+    aggregate_id   VARCHAR(255) NOT NULL,
+    event_type     VARCHAR(255) NOT NULL,
+    schema_version INT          NOT NULL DEFAULT 1,
+    version        INT          NOT NULL,
+    codec          VARCHAR(32)  NOT NULL DEFAULT 'json',
+    data           LONGBLOB     NOT NULL,
+    metadata       TEXT         NOT NULL,
+    created_at     BIGINT       NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY uq_es_event_aggregate_version (aggregate_id, version)
+);
+
+CREATE TABLE IF NOT EXISTS es_aggregate_snapshot (
+    aggregate_id VARCHAR(255) NOT NULL,
+    version      INT          NOT NULL,
+    codec        VARCHAR(32)  NOT NULL DEFAULT 'json',
+    data         LONGBLOB     NOT NULL,
+    created_at   BIGINT       NOT NULL,
+    PRIMARY KEY (aggregate_id, version)
+);
+
+CREATE TABLE IF NOT EXISTS es_outbox (
+    id              BIGINT       NOT NULL AUTO_INCREMENT,
+    aggregate_id    VARCHAR(255) NOT NULL,
+    version         INT          NOT NULL,
+    attempts        INT          NOT NULL DEFAULT 0,
+    next_attempt_at BIGINT       NOT NULL,
+    delivered_at    BIGINT       NULL,
+    last_error      TEXT         NULL,
+    created_at      BIGINT       NOT NULL,
+    PRIMARY KEY (id),
+    UNIQUE KEY uq_es_outbox_aggregate_version (aggregate_id, version),
+    KEY ix_es_outbox_pending (delivered_at, next_attempt_at)
+);
+
+CREATE TABLE IF NOT EXISTS es_projection_checkpoint (
+    name     VARCHAR(255) NOT NULL,
+    position BIGINT       NOT NULL,
+    PRIMARY KEY (name)
+);
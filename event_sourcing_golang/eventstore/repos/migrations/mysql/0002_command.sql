@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS es_command (
+    command_id   VARCHAR(255) NOT NULL,
+    aggregate_id VARCHAR(255) NOT NULL,
+    version      INT          NOT NULL,
+    created_at   BIGINT       NOT NULL,
+    PRIMARY KEY (command_id, aggregate_id)
+);
@@ -0,0 +1,2 @@
+-- snapshots written before schemas were recorded match no schema, so they are replayed over until regenerated
+ALTER TABLE es_aggregate_snapshot ADD COLUMN snapshot_schema VARCHAR(64) NOT NULL DEFAULT '';
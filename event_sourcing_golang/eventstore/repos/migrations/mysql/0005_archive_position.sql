@@ -0,0 +1,7 @@
+-- the greatest position of the events deleted once archived, full replays of the global stream check it
+CREATE TABLE IF NOT EXISTS es_archive_position (
+    id       INT    NOT NULL PRIMARY KEY,
+    position BIGINT NOT NULL
+);
+
+INSERT INTO es_archive_position(id, position) VALUES (1, 0);
@@ -0,0 +1,46 @@
+CREATE TABLE IF NOT EXISTS es_aggregate (
+    id             VARCHAR(255) NOT NULL PRIMARY KEY,
+    version        INT          NOT NULL DEFAULT 0,
+    aggregate_type VARCHAR(255) NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS es_event (
+    id             BIGSERIAL    NOT NULL PRIMARY KEY,
+    aggregate_id   VARCHAR(255) NOT NULL,
+    event_type     VARCHAR(255) NOT NULL,
+    schema_version INT          NOT NULL DEFAULT 1,
+    version        INT          NOT NULL,
+    codec          VARCHAR(32)  NOT NULL DEFAULT 'json',
+    data           BYTEA        NOT NULL,
+    metadata       TEXT         NOT NULL,
+    created_at     BIGINT       NOT NULL,
+    CONSTRAINT uq_es_event_aggregate_version UNIQUE (aggregate_id, version)
+);
+
+CREATE TABLE IF NOT EXISTS es_aggregate_snapshot (
+    aggregate_id VARCHAR(255) NOT NULL,
+    version      INT          NOT NULL,
+    codec        VARCHAR(32)  NOT NULL DEFAULT 'json',
+    data         BYTEA        NOT NULL,
+    created_at   BIGINT       NOT NULL,
+    PRIMARY KEY (aggregate_id, version)
+);
+
+CREATE TABLE IF NOT EXISTS es_outbox (
+    id              BIGSERIAL    NOT NULL PRIMARY KEY,
+    aggregate_id    VARCHAR(255) NOT NULL,
+    version         INT          NOT NULL,
+    attempts        INT          NOT NULL DEFAULT 0,
+    next_attempt_at BIGINT       NOT NULL,
+    delivered_at    BIGINT       NULL,
+    last_error      TEXT         NULL,
+    created_at      BIGINT       NOT NULL,
+    CONSTRAINT uq_es_outbox_aggregate_version UNIQUE (aggregate_id, version)
+);
+
+CREATE INDEX IF NOT EXISTS ix_es_outbox_pending ON es_outbox (next_attempt_at) WHERE delivered_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS es_projection_checkpoint (
+    name     VARCHAR(255) NOT NULL PRIMARY KEY,
+    position BIGINT       NOT NULL
+);
@@ -0,0 +1,7 @@
+-- the single row locked by every transaction appending events until it commits, so event ids are committed in order
+CREATE TABLE IF NOT EXISTS es_position_lock (
+    id        INT    NOT NULL PRIMARY KEY,
+    locked_at BIGINT NOT NULL
+);
+
+INSERT INTO es_position_lock(id, locked_at) VALUES (1, 0);
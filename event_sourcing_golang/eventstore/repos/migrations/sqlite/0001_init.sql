@@ -0,0 +1,46 @@
+CREATE TABLE IF NOT EXISTS es_aggregate (
+    id             TEXT    NOT NULL PRIMARY KEY,
+    version        INTEGER NOT NULL DEFAULT 0,
+    aggregate_type TEXT    NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS es_event (
+    id             INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    aggregate_id   TEXT    NOT NULL,
+    event_type     TEXT    NOT NULL,
+    schema_version INTEGER NOT NULL DEFAULT 1,
+    version        INTEGER NOT NULL,
+    codec          TEXT    NOT NULL DEFAULT 'json',
+    data           BLOB    NOT NULL,
+    metadata       TEXT    NOT NULL,
+    created_at     INTEGER NOT NULL,
+    UNIQUE (aggregate_id, version)
+);
+
+CREATE TABLE IF NOT EXISTS es_aggregate_snapshot (
+    aggregate_id TEXT    NOT NULL,
+    version      INTEGER NOT NULL,
+    codec        TEXT    NOT NULL DEFAULT 'json',
+    data         BLOB    NOT NULL,
+    created_at   INTEGER NOT NULL,
+    PRIMARY KEY (aggregate_id, version)
+);
+
+CREATE TABLE IF NOT EXISTS es_outbox (
+    id              INTEGER NOT NULL PRIMARY KEY AUTOINCREMENT,
+    aggregate_id    TEXT    NOT NULL,
+    version         INTEGER NOT NULL,
+    attempts        INTEGER NOT NULL DEFAULT 0,
+    next_attempt_at INTEGER NOT NULL,
+    delivered_at    INTEGER NULL,
+    last_error      TEXT    NULL,
+    created_at      INTEGER NOT NULL,
+    UNIQUE (aggregate_id, version)
+);
+
+CREATE INDEX IF NOT EXISTS ix_es_outbox_pending ON es_outbox (next_attempt_at) WHERE delivered_at IS NULL;
+
+CREATE TABLE IF NOT EXISTS es_projection_checkpoint (
+    name     TEXT    NOT NULL PRIMARY KEY,
+    position INTEGER NOT NULL
+);
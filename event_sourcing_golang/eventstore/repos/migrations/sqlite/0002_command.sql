@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS es_command (
+    command_id   TEXT    NOT NULL,
+    aggregate_id TEXT    NOT NULL,
+    version      INTEGER NOT NULL,
+    created_at   INTEGER NOT NULL,
+    PRIMARY KEY (command_id, aggregate_id)
+);
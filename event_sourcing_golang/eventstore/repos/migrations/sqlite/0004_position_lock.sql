@@ -0,0 +1,7 @@
+-- the single row locked by every transaction appending events until it commits, so event ids are committed in order
+CREATE TABLE IF NOT EXISTS es_position_lock (
+    id        INTEGER NOT NULL PRIMARY KEY,
+    locked_at INTEGER NOT NULL
+);
+
+INSERT INTO es_position_lock(id, locked_at) VALUES (1, 0);
@@ -0,0 +1,136 @@
+package repos
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+
+	"gorm.io/gorm"
+)
+
+// OutboxMessage is an event waiting in the outbox to be published
+type OutboxMessage struct {
+	ID       int64
+	Event    eventsourcing.Event
+	Attempts int
+}
+
+type outboxRepo struct {
+	db        *gorm.DB
+	serialize eventsourcing.Serializer
+}
+
+func newOutboxRepo(db *gorm.DB, s eventsourcing.Serializer) *outboxRepo {
+	return &outboxRepo{
+		db:        db,
+		serialize: s,
+	}
+}
+
+// AppendOutbox references the appended events from es_outbox, it must run in the transaction appending them
+func (r *outboxRepo) AppendOutbox(ctx context.Context, events ...eventsourcing.Event) error {
+	now := time.Now().Unix()
+	for _, e := range events {
+		err := r.db.Exec(`
+			INSERT INTO es_outbox(aggregate_id, version, attempts, next_attempt_at, created_at)
+			VALUES(?, ?, 0, ?, ?)`, e.AggregateID, e.Version, now, now).Error
+		if err != nil {
+			return fmt.Errorf("append outbox err=%w", err)
+		}
+	}
+
+	return nil
+}
+
+// PendingOutbox returns undelivered messages due at now. Only the oldest undelivered message of each aggregate
+// is returned, so a failing event holds back the later events of its aggregate and they are published in order.
+func (r *outboxRepo) PendingOutbox(ctx context.Context, now time.Time, limit int) ([]OutboxMessage, error) {
+	rows, err := r.db.Raw(`
+		SELECT o.id, o.attempts, e.id, e.aggregate_id, a.aggregate_type, e.event_type, e.schema_version, e.version, e.codec, e.data, e.metadata, e.created_at
+		FROM es_outbox o
+		JOIN es_event e ON e.aggregate_id = o.aggregate_id AND e.version = o.version
+		JOIN es_aggregate a ON a.id = o.aggregate_id
+		WHERE o.delivered_at IS NULL
+			AND o.next_attempt_at <= ?
+			AND NOT EXISTS (
+				SELECT 1
+				FROM es_outbox p
+				WHERE p.aggregate_id = o.aggregate_id
+					AND p.delivered_at IS NULL
+					AND p.id < o.id
+			)
+		ORDER BY o.id ASC
+		LIMIT ?`, now.Unix(), limit).Rows()
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []OutboxMessage
+	for rows.Next() {
+		var msg OutboxMessage
+		var codec, data, metadata string
+		evt := &msg.Event
+		if err := rows.Scan(&msg.ID, &msg.Attempts, &evt.ID, &evt.AggregateID, &evt.AggregateType, &evt.EventType, &evt.SchemaVersion, &evt.Version, &codec, &data, &metadata, &evt.CreatedAt); err != nil {
+			return nil, err
+		}
+		evt.Position = evt.ID
+
+		if err := r.serialize.UnmarshalEvent(evt.AggregateType, evt, codec, []byte(data)); err != nil {
+			return nil, err
+		}
+		if metadata != "" {
+			if err := r.serialize.Unmarshal([]byte(metadata), &evt.Metadata); err != nil {
+				return nil, fmt.Errorf("unmarshal event metadata failed with err=%w", err)
+			}
+		}
+
+		result = append(result, msg)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("PendingOutbox rows.err err=%w", err)
+	}
+
+	return result, nil
+}
+
+func (r *outboxRepo) UndeliveredOutboxVersion(ctx context.Context, aggregateID string) (int, error) {
+	var version int
+	err := r.db.Raw(`
+		SELECT COALESCE(MIN(version), 0)
+		FROM es_outbox
+		WHERE aggregate_id = ?
+			AND delivered_at IS NULL`, aggregateID).Row().Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("read undelivered outbox version err=%w", err)
+	}
+
+	return version, nil
+}
+
+func (r *outboxRepo) MarkOutboxDelivered(ctx context.Context, id int64) error {
+	err := r.db.Exec(`
+		UPDATE es_outbox
+		SET delivered_at = ?, attempts = attempts + 1
+		WHERE id = ?`, time.Now().Unix(), id).Error
+	if err != nil {
+		return fmt.Errorf("mark outbox delivered err=%w", err)
+	}
+
+	return nil
+}
+
+func (r *outboxRepo) MarkOutboxFailed(ctx context.Context, id int64, nextAttemptAt time.Time, reason string) error {
+	err := r.db.Exec(`
+		UPDATE es_outbox
+		SET attempts = attempts + 1, next_attempt_at = ?, last_error = ?
+		WHERE id = ?`, nextAttemptAt.Unix(), reason, id).Error
+	if err != nil {
+		return fmt.Errorf("mark outbox failed err=%w", err)
+	}
+
+	return nil
+}
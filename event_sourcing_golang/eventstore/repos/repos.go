@@ -10,29 +10,58 @@ var _ Repos = (*repos)(nil)
 
 type Repos interface {
 	EventStore() EventStore
+	Serializer() eventsourcing.Serializer
 }
 
 type repos struct {
 	ev EventStore
+	s  eventsourcing.Serializer
 }
 
-func New(db *gorm.DB, s eventsourcing.Serializer) Repos {
-	ev := newEventStore(db, s)
+type Option func(*config)
+
+type config struct {
+	archive Archive
+}
+
+// WithArchive makes the reads of the events moved out of the store by the archiver go to a
+func WithArchive(a Archive) Option {
+	return func(c *config) {
+		c.archive = a
+	}
+}
+
+func newConfig(opts []Option) config {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	return cfg
+}
+
+func New(db *gorm.DB, s eventsourcing.Serializer, opts ...Option) Repos {
+	ev := newEventStore(db, s, newConfig(opts))
 
 	return &repos{
 		ev: ev,
+		s:  s,
 	}
 }
 
 // NewInMemory creates a Repos backed by in-memory event store
-func NewInMemory(s eventsourcing.Serializer) Repos {
-	ev := newMemoryEventStore(s)
+func NewInMemory(s eventsourcing.Serializer, opts ...Option) Repos {
+	ev := newMemoryEventStore(s, newConfig(opts))
 
 	return &repos{
 		ev: ev,
+		s:  s,
 	}
 }
 
 func (r *repos) EventStore() EventStore {
 	return r.ev
 }
+
+func (r *repos) Serializer() eventsourcing.Serializer {
+	return r.s
+}
@@ -0,0 +1,891 @@
+// Package repostest is the conformance suite every repos.EventStore implementation has to pass:
+//
+//	func TestMyStore(t *testing.T) {
+//		repostest.Run(t, func(t *testing.T, s eventsourcing.Serializer, opts ...repos.Option) repos.EventStore {
+//			return newMyStore(t, s, opts...)
+//		})
+//	}
+package repostest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"sync"
+	"testing"
+	"time"
+
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// NewStore returns an empty store using s and opts, it is called once per test
+type NewStore func(t *testing.T, s eventsourcing.Serializer, opts ...repos.Option) repos.EventStore
+
+// Run runs the conformance suite against the stores returned by newStore
+func Run(t *testing.T, newStore NewStore) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, es repos.EventStore)
+	}{
+		{"ConcurrencyConflict", testConcurrencyConflict},
+		{"ConcurrentSaves", testConcurrentSaves},
+		{"VersionGap", testVersionGap},
+		{"SnapshotReads", testSnapshotReads},
+		{"StaleSnapshots", testStaleSnapshots},
+		{"SnapshotAtSameVersion", testSnapshotAtSameVersion},
+		{"Rollback", testRollback},
+		{"TransactionReadsOwnWrites", testTransactionReadsOwnWrites},
+		{"ListOrdering", testListOrdering},
+		{"ReadAllLimit", testReadAllLimit},
+		{"SubscribeConcurrentSaves", testSubscribeConcurrentSaves},
+		{"Commands", testCommands},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t, newSerializer(t)))
+		})
+	}
+	t.Run("ArchivedReads", func(t *testing.T) {
+		archive := &memArchive{}
+		testArchivedReads(t, newStore(t, newSerializer(t), repos.WithArchive(archive)), archive)
+	})
+}
+
+func newSerializer(t *testing.T) eventsourcing.Serializer {
+	t.Helper()
+	s := eventsourcing.NewSerializer()
+	if err := s.RegisterAggregate(&account{}); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+const accountType = "account"
+
+// farFuture makes every outbox message due
+var farFuture = time.Now().Add(24 * time.Hour)
+
+type opened struct{ Owner string }
+type deposited struct{ Amount int }
+
+type account struct {
+	eventsourcing.AggregateRoot
+	Owner   string
+	Balance int
+}
+
+func (a *account) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&opened{}, &deposited{})
+}
+
+func (a *account) Transition(e eventsourcing.Event) error {
+	switch v := e.Data.(type) {
+	case *opened:
+		a.Owner = v.Owner
+	case *deposited:
+		a.Balance += v.Amount
+	}
+	return nil
+}
+
+// accountV2 is account after a change of its fields, the snapshots of account are stale for it
+type accountV2 struct {
+	account
+	Currency string
+}
+
+func newAccount(t *testing.T, id string) *account {
+	t.Helper()
+	a := &account{}
+	if err := a.SetID(id); err != nil {
+		t.Fatal(err)
+	}
+	a.SetAggregateType(accountType)
+	change(t, a, &opened{Owner: "owner of " + id})
+	return a
+}
+
+func change(t *testing.T, a *account, data interface{}) {
+	t.Helper()
+	if err := a.ApplyChange(a, data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// save stores the changes of a the way the aggregate store does
+func save(ctx context.Context, es repos.EventStore, a *account) error {
+	if err := es.CreateIfNotExist(ctx, a.AggregateID(), accountType); err != nil {
+		return err
+	}
+	err := es.WithTransaction(ctx, func(txn repos.EventStore) error {
+		if err := txn.CheckAndUpdateVersion(ctx, a); err != nil {
+			return err
+		}
+		for _, e := range a.Events() {
+			e.AggregateType = accountType
+			if err := txn.Append(ctx, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	a.Update()
+	return nil
+}
+
+func mustSave(t *testing.T, es repos.EventStore, a *account) {
+	t.Helper()
+	if err := save(context.Background(), es, a); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// load replays the stored events of id into a new account
+func load(t *testing.T, es repos.EventStore, id string) *account {
+	t.Helper()
+	a := &account{}
+	a.SetAggregateType(accountType)
+	if err := es.Get(context.Background(), id, 0, 0, a); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func testConcurrencyConflict(t *testing.T, es repos.EventStore) {
+	ctx := context.Background()
+	a := newAccount(t, "acc-1")
+	mustSave(t, es, a)
+
+	first, second := load(t, es, "acc-1"), load(t, es, "acc-1")
+	change(t, first, &deposited{Amount: 1})
+	mustSave(t, es, first)
+
+	change(t, second, &deposited{Amount: 2})
+	err := save(ctx, es, second)
+	var conflict *repos.ErrConcurrencyConflict
+	if !errors.As(err, &conflict) {
+		t.Fatalf("stale save err=%v, want ErrConcurrencyConflict", err)
+	}
+	if conflict.Expected != 1 || conflict.Actual != 2 {
+		t.Fatalf("conflict expected=%d actual=%d, want 1 and 2", conflict.Expected, conflict.Actual)
+	}
+	if got := load(t, es, "acc-1"); got.Balance != 1 || got.Version() != 2 {
+		t.Fatalf("balance=%d version=%d after the conflict, want 1 and 2", got.Balance, got.Version())
+	}
+
+	unknown := &account{}
+	_ = unknown.SetID("acc-unknown")
+	unknown.SetInternal("acc-unknown", 0, 1)
+	if err := es.CheckAndUpdateVersion(ctx, unknown); !errors.Is(err, repos.ErrAggregateNotFound) {
+		t.Fatalf("version check of an unknown aggregate err=%v, want ErrAggregateNotFound", err)
+	}
+	if _, err := es.AggregateVersion(ctx, "acc-unknown"); !errors.Is(err, repos.ErrAggregateNotFound) {
+		t.Fatalf("version of an unknown aggregate err=%v, want ErrAggregateNotFound", err)
+	}
+}
+
+func testConcurrentSaves(t *testing.T, es repos.EventStore) {
+	ctx := context.Background()
+	mustSave(t, es, newAccount(t, "acc-1"))
+
+	// every writer loads version 1 before any of them saves
+	writers := make([]*account, 8)
+	for i := range writers {
+		writers[i] = load(t, es, "acc-1")
+		change(t, writers[i], &deposited{Amount: 1})
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(writers))
+	for _, a := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- save(ctx, es, a)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	saved := 0
+	for err := range errs {
+		switch {
+		case err == nil:
+			saved++
+		case !repos.IsConcurrencyConflict(err):
+			t.Fatalf("concurrent save err=%v, want nil or ErrConcurrencyConflict", err)
+		}
+	}
+	if saved != 1 {
+		t.Fatalf("%d concurrent saves of the same version succeeded, want 1", saved)
+	}
+	if got := load(t, es, "acc-1"); got.Balance != 1 || got.Version() != 2 {
+		t.Fatalf("balance=%d version=%d, want 1 and 2", got.Balance, got.Version())
+	}
+}
+
+func testVersionGap(t *testing.T, es repos.EventStore) {
+	ctx := context.Background()
+	a := newAccount(t, "acc-1")
+	mustSave(t, es, a)
+
+	event := func(version int) eventsourcing.Event {
+		return eventsourcing.Event{
+			AggregateID:   "acc-1",
+			AggregateType: accountType,
+			Version:       version,
+			EventType:     "deposited",
+			SchemaVersion: 1,
+			Data:          &deposited{Amount: 1},
+		}
+	}
+	for _, version := range []int{1, 3} {
+		if err := es.Append(ctx, event(version)); !errors.Is(err, repos.ErrVersionGap) {
+			t.Fatalf("append version=%d after version=1 err=%v, want ErrVersionGap", version, err)
+		}
+	}
+	if err := es.CreateIfNotExist(ctx, "acc-2", accountType); err != nil {
+		t.Fatal(err)
+	}
+	first := event(2)
+	first.AggregateID = "acc-2"
+	if err := es.Append(ctx, first); !errors.Is(err, repos.ErrVersionGap) {
+		t.Fatalf("append version=2 as first event err=%v, want ErrVersionGap", err)
+	}
+
+	if err := es.Append(ctx, event(2)); err != nil {
+		t.Fatal(err)
+	}
+	events, err := es.List(ctx, "acc-1", &account{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 {
+		t.Fatalf("%d events stored, want 2", len(events))
+	}
+
+	// in a transaction the appended versions follow the checked version
+	mustSave(t, es, newAccount(t, "acc-3"))
+	appendAfterCheck := func(versions ...int) error {
+		return es.WithTransaction(ctx, func(txn repos.EventStore) error {
+			a := &account{}
+			a.SetInternal("acc-3", 1, 1+len(versions))
+			if err := txn.CheckAndUpdateVersion(ctx, a); err != nil {
+				return err
+			}
+			for _, version := range versions {
+				e := event(version)
+				e.AggregateID = "acc-3"
+				if err := txn.Append(ctx, e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	if err := appendAfterCheck(2, 4); !errors.Is(err, repos.ErrVersionGap) {
+		t.Fatalf("append versions 2 and 4 after version=1 err=%v, want ErrVersionGap", err)
+	}
+	if err := appendAfterCheck(2, 3); err != nil {
+		t.Fatal(err)
+	}
+	if got := load(t, es, "acc-3"); got.Version() != 3 {
+		t.Fatalf("version=%d, want 3", got.Version())
+	}
+}
+
+func testSnapshotReads(t *testing.T, es repos.EventStore) {
+	ctx := context.Background()
+	if err := es.ReadSnapshot(ctx, "acc-1", 0, &account{}); !errors.Is(err, repos.ErrSnapshotNotFound) {
+		t.Fatalf("read missing snapshot err=%v, want ErrSnapshotNotFound", err)
+	}
+	if _, err := es.SnapshotVersion(ctx, "acc-1"); !errors.Is(err, repos.ErrSnapshotNotFound) {
+		t.Fatalf("missing snapshot version err=%v, want ErrSnapshotNotFound", err)
+	}
+
+	// snapshots at versions 2 and 4, the aggregate is at version 5
+	a := newAccount(t, "acc-1")
+	for v := 2; v <= 5; v++ {
+		change(t, a, &deposited{Amount: 10})
+		mustSave(t, es, a)
+		if v%2 == 0 {
+			if err := es.CreateSnapshot(ctx, a); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	latest := &account{}
+	if err := es.ReadSnapshot(ctx, "acc-1", 0, latest); err != nil {
+		t.Fatal(err)
+	}
+	if latest.Balance != 30 || latest.BaseVersion() != 4 || latest.Version() != 5 {
+		t.Fatalf("latest snapshot balance=%d base=%d version=%d, want 30, 4 and 5",
+			latest.Balance, latest.BaseVersion(), latest.Version())
+	}
+	if err := es.ReadSnapshot(ctx, "acc-1", 5, &account{}); !errors.Is(err, repos.ErrSnapshotNotFound) {
+		t.Fatalf("read snapshot at or above version 5 err=%v, want ErrSnapshotNotFound", err)
+	}
+
+	past := &account{}
+	if err := es.ReadSnapshotAt(ctx, "acc-1", 3, past); err != nil {
+		t.Fatal(err)
+	}
+	if past.Balance != 10 || past.Version() != 2 {
+		t.Fatalf("snapshot at or below version 3 balance=%d version=%d, want 10 and 2", past.Balance, past.Version())
+	}
+	if err := es.ReadSnapshotAt(ctx, "acc-1", 1, &account{}); !errors.Is(err, repos.ErrSnapshotNotFound) {
+		t.Fatalf("read snapshot at or below version 1 err=%v, want ErrSnapshotNotFound", err)
+	}
+
+	if v, err := es.SnapshotVersion(ctx, "acc-1"); err != nil || v != 4 {
+		t.Fatalf("snapshot version=%d err=%v, want 4", v, err)
+	}
+	snapshots, err := es.Snapshots(ctx, "acc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0].Version != 2 || snapshots[1].Version != 4 {
+		t.Fatalf("snapshots=%+v, want versions 2 and 4", snapshots)
+	}
+}
+
+func testStaleSnapshots(t *testing.T, es repos.EventStore) {
+	ctx := context.Background()
+	a := newAccount(t, "acc-1")
+	mustSave(t, es, a)
+	if err := es.CreateSnapshot(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+
+	meta, err := es.LastSnapshot(ctx, "acc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Schema != eventsourcing.SnapshotSchema(a) {
+		t.Fatalf("snapshot schema=%q, want %q", meta.Schema, eventsourcing.SnapshotSchema(a))
+	}
+	if eventsourcing.SnapshotSchema(&accountV2{}) == meta.Schema {
+		t.Fatal("accountV2 has the schema of account")
+	}
+
+	// a stale snapshot is not found, so readers replay the events
+	err = es.ReadSnapshot(ctx, "acc-1", 0, &accountV2{})
+	if !errors.Is(err, repos.ErrSnapshotStale) || !errors.Is(err, repos.ErrSnapshotNotFound) {
+		t.Fatalf("read stale snapshot err=%v, want ErrSnapshotStale", err)
+	}
+	if err := es.ReadSnapshotAt(ctx, "acc-1", 1, &accountV2{}); !errors.Is(err, repos.ErrSnapshotStale) {
+		t.Fatalf("read stale snapshot at version 1 err=%v, want ErrSnapshotStale", err)
+	}
+
+	if n, err := es.PurgeStaleSnapshots(ctx, "acc-1", a); err != nil || n != 0 {
+		t.Fatalf("purge snapshots of the current schema n=%d err=%v, want 0", n, err)
+	}
+	errAbort := errors.New("abort")
+	err = es.WithTransaction(ctx, func(txn repos.EventStore) error {
+		if n, err := txn.PurgeStaleSnapshots(ctx, "acc-1", &accountV2{}); err != nil || n != 1 {
+			t.Errorf("purge in transaction n=%d err=%v, want 1", n, err)
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("transaction err=%v, want abort", err)
+	}
+	if snapshots, err := es.Snapshots(ctx, "acc-1"); err != nil || len(snapshots) != 1 {
+		t.Fatalf("snapshots after rolled back purge=%+v err=%v, want 1", snapshots, err)
+	}
+
+	if n, err := es.PurgeStaleSnapshots(ctx, "acc-1", &accountV2{}); err != nil || n != 1 {
+		t.Fatalf("purge stale snapshots n=%d err=%v, want 1", n, err)
+	}
+	if snapshots, err := es.Snapshots(ctx, "acc-1"); err != nil || len(snapshots) != 0 {
+		t.Fatalf("snapshots after purge=%+v err=%v, want none", snapshots, err)
+	}
+}
+
+func testSnapshotAtSameVersion(t *testing.T, es repos.EventStore) {
+	ctx := context.Background()
+	a := newAccount(t, "acc-1")
+	change(t, a, &deposited{Amount: 10})
+	mustSave(t, es, a)
+	if err := es.CreateSnapshot(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+
+	// the second snapshot at version 2 replaces the first one
+	a.Balance = 20
+	if err := es.CreateSnapshot(ctx, a); err != nil {
+		t.Fatalf("second snapshot at the same version err=%v", err)
+	}
+	snapshots, err := es.Snapshots(ctx, "acc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 1 || snapshots[0].Version != 2 {
+		t.Fatalf("snapshots=%+v, want one at version 2", snapshots)
+	}
+	latest := &account{}
+	if err := es.ReadSnapshot(ctx, "acc-1", 0, latest); err != nil {
+		t.Fatal(err)
+	}
+	if latest.Balance != 20 {
+		t.Fatalf("snapshot balance=%d, want the 20 of the second snapshot", latest.Balance)
+	}
+}
+
+// memArchive is a repos.Archive keeping the events the test archives
+type memArchive struct {
+	events []repos.StoredEvent
+}
+
+func (a *memArchive) ArchivedEvents(ctx context.Context, aggregateID string, fromVersion, toVersion int) iter.Seq2[repos.StoredEvent, error] {
+	return func(yield func(repos.StoredEvent, error) bool) {
+		for _, se := range a.events {
+			if se.AggregateID == aggregateID && se.Version > fromVersion && (toVersion == 0 || se.Version <= toVersion) {
+				if !yield(se, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *memArchive) ArchivedVersionAt(ctx context.Context, aggregateID string, at time.Time) (int, error) {
+	version := 0
+	for _, se := range a.events {
+		if se.AggregateID == aggregateID && se.CreatedAt <= at.Unix() {
+			version = max(version, se.Version)
+		}
+	}
+	return version, nil
+}
+
+func testArchivedReads(t *testing.T, es repos.EventStore, archive *memArchive) {
+	ctx := context.Background()
+	a := newAccount(t, "acc-1")
+	for i := 0; i < 4; i++ {
+		change(t, a, &deposited{Amount: 10})
+	}
+	mustSave(t, es, a)
+
+	stored, err := es.StoredEvents(ctx, "acc-1", 0, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stored) != 3 || stored[0].Version != 1 || stored[2].Version != 3 || len(stored[0].Payload) == 0 ||
+		stored[0].AggregateType != accountType {
+		t.Fatalf("stored events=%+v, want versions 1 to 3 with their payload", stored)
+	}
+	if _, err := es.DeleteEvents(ctx, "acc-1", 5); err == nil {
+		t.Fatal("deleting the last event succeeded")
+	}
+
+	errAbort := errors.New("abort")
+	err = es.WithTransaction(ctx, func(txn repos.EventStore) error {
+		if _, err := txn.DeleteEvents(ctx, "acc-1", 3); err != nil {
+			t.Error(err)
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("transaction err=%v, want abort", err)
+	}
+	if all, err := es.StoredEvents(ctx, "acc-1", 0, 0); err != nil || len(all) != 5 {
+		t.Fatalf("stored events after rolled back delete=%d err=%v, want 5", len(all), err)
+	}
+	if err := repos.CheckUnarchived(ctx, es, 0); err != nil {
+		t.Fatalf("check before archiving err=%v", err)
+	}
+
+	archive.events = append(archive.events, stored...)
+	if n, err := es.DeleteEvents(ctx, "acc-1", 3); err != nil || n != 3 {
+		t.Fatalf("delete archived events n=%d err=%v, want 3", n, err)
+	}
+	if left, err := es.StoredEvents(ctx, "acc-1", 0, 0); err != nil || len(left) != 2 || left[0].Version != 4 {
+		t.Fatalf("stored events after delete=%+v err=%v, want versions 4 and 5", left, err)
+	}
+
+	// readers of the global stream starting before the archived events are refused
+	if position, err := es.ArchivedPosition(ctx); err != nil || position != stored[2].Position {
+		t.Fatalf("archived position=%d err=%v, want %d", position, err, stored[2].Position)
+	}
+	if err := repos.CheckUnarchived(ctx, es, 0); !errors.Is(err, repos.ErrEventsArchived) {
+		t.Fatalf("check from position 0 err=%v, want %v", err, repos.ErrEventsArchived)
+	}
+	if err := repos.CheckUnarchived(ctx, es, stored[2].Position); err != nil {
+		t.Fatalf("check after the archived events err=%v", err)
+	}
+
+	// reads of the archived versions go to the archive
+	if got := load(t, es, "acc-1"); got.Balance != 40 || got.Owner != "owner of acc-1" || got.Version() != 5 {
+		t.Fatalf("loaded balance=%d owner=%q version=%d, want 40, owner of acc-1 and 5", got.Balance, got.Owner, got.Version())
+	}
+	past := &account{}
+	past.SetAggregateType(accountType)
+	if err := es.Get(ctx, "acc-1", 0, 2, past); err != nil || past.Balance != 10 || past.Version() != 2 {
+		t.Fatalf("loaded up to version 2 balance=%d version=%d err=%v, want 10 and 2", past.Balance, past.Version(), err)
+	}
+	events, err := es.List(ctx, "acc-1", &account{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range events {
+		if e.Version != i+1 || e.Data == nil {
+			t.Fatalf("listed event %d=%+v, want version %d with its data", i, e, i+1)
+		}
+	}
+	if len(events) != 5 {
+		t.Fatalf("listed %d events, want 5", len(events))
+	}
+	var versions []int
+	for e, err := range es.Events(ctx, "acc-1", 2) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, e.Version)
+	}
+	if fmt.Sprint(versions) != "[3 4 5]" {
+		t.Fatalf("events after version 2=%v, want [3 4 5]", versions)
+	}
+
+	// the global stream only has the events still stored
+	all, err := es.ReadAll(ctx, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || all[0].Version != 4 {
+		t.Fatalf("read all=%+v, want version 4", all)
+	}
+
+	change(t, a, &deposited{Amount: 10})
+	mustSave(t, es, a)
+	if got := load(t, es, "acc-1"); got.Balance != 50 || got.Version() != 6 {
+		t.Fatalf("loaded after append balance=%d version=%d, want 50 and 6", got.Balance, got.Version())
+	}
+}
+
+func testRollback(t *testing.T, es repos.EventStore) {
+	ctx := context.Background()
+	a := newAccount(t, "acc-1")
+	mustSave(t, es, a)
+	change(t, a, &deposited{Amount: 5})
+	b := newAccount(t, "acc-2")
+
+	// write everything a save can write, then fail
+	failed := errors.New("fail")
+	write := func(txn repos.EventStore) error {
+		for _, agg := range []*account{a, b} {
+			if err := txn.CreateIfNotExist(ctx, agg.AggregateID(), accountType); err != nil {
+				return err
+			}
+			if err := txn.CheckAndUpdateVersion(ctx, agg); err != nil {
+				return err
+			}
+			for _, e := range agg.Events() {
+				e.AggregateType = accountType
+				if err := txn.Append(ctx, e); err != nil {
+					return err
+				}
+			}
+			if err := txn.AppendOutbox(ctx, agg.Events()...); err != nil {
+				return err
+			}
+			if err := txn.CreateSnapshot(ctx, agg); err != nil {
+				return err
+			}
+		}
+		return txn.RecordCommand(ctx, "cmd-1", repos.CommandRecord{AggregateID: "acc-1", Version: 2})
+	}
+
+	err := es.WithTransaction(ctx, func(txn repos.EventStore) error {
+		if err := write(txn); err != nil {
+			return err
+		}
+		return failed
+	})
+	if !errors.Is(err, failed) {
+		t.Fatalf("transaction err=%v, want the error of fn", err)
+	}
+	assertRolledBack(t, es)
+
+	func() {
+		defer func() {
+			if p := recover(); p != failed {
+				t.Fatalf("recovered %v, want the panic of fn", p)
+			}
+		}()
+		_ = es.WithTransaction(ctx, func(txn repos.EventStore) error {
+			if err := write(txn); err != nil {
+				return err
+			}
+			panic(failed)
+		})
+	}()
+	assertRolledBack(t, es)
+
+	// the store is still usable after the rollbacks
+	if err := es.WithTransaction(ctx, write); err != nil {
+		t.Fatal(err)
+	}
+	if got := load(t, es, "acc-2"); got.Version() != 1 {
+		t.Fatalf("acc-2 version=%d after the commit, want 1", got.Version())
+	}
+}
+
+// assertRolledBack checks the store is back to acc-1 at version 1 and nothing else
+func assertRolledBack(t *testing.T, es repos.EventStore) {
+	t.Helper()
+	ctx := context.Background()
+
+	if v, err := es.AggregateVersion(ctx, "acc-1"); err != nil || v != 1 {
+		t.Fatalf("acc-1 version=%d err=%v after the rollback, want 1", v, err)
+	}
+	if _, err := es.AggregateVersion(ctx, "acc-2"); !errors.Is(err, repos.ErrAggregateNotFound) {
+		t.Fatalf("acc-2 version err=%v after the rollback, want ErrAggregateNotFound", err)
+	}
+	events, err := es.ReadAll(ctx, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("%d events after the rollback, want 1", len(events))
+	}
+	if _, err := es.SnapshotVersion(ctx, "acc-1"); !errors.Is(err, repos.ErrSnapshotNotFound) {
+		t.Fatalf("acc-1 snapshot err=%v after the rollback, want ErrSnapshotNotFound", err)
+	}
+	pending, err := es.PendingOutbox(ctx, farFuture, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("%d outbox messages after the rollback, want 0", len(pending))
+	}
+	if _, err := es.LookupCommand(ctx, "cmd-1"); !errors.Is(err, repos.ErrCommandNotFound) {
+		t.Fatalf("command lookup err=%v after the rollback, want ErrCommandNotFound", err)
+	}
+}
+
+func testTransactionReadsOwnWrites(t *testing.T, es repos.EventStore) {
+	ctx := context.Background()
+	a := newAccount(t, "acc-1")
+	change(t, a, &deposited{Amount: 7})
+
+	err := es.WithTransaction(ctx, func(txn repos.EventStore) error {
+		if err := txn.CreateIfNotExist(ctx, "acc-1", accountType); err != nil {
+			return err
+		}
+		if err := txn.CheckAndUpdateVersion(ctx, a); err != nil {
+			return err
+		}
+		for _, e := range a.Events() {
+			e.AggregateType = accountType
+			if err := txn.Append(ctx, e); err != nil {
+				return err
+			}
+		}
+
+		if v, err := txn.AggregateVersion(ctx, "acc-1"); err != nil || v != 2 {
+			return fmt.Errorf("version=%d err=%v inside the transaction, want 2", v, err)
+		}
+		got := &account{}
+		got.SetAggregateType(accountType)
+		if err := txn.Get(ctx, "acc-1", 0, 0, got); err != nil {
+			return err
+		}
+		if got.Balance != 7 {
+			return fmt.Errorf("balance=%d inside the transaction, want 7", got.Balance)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testListOrdering(t *testing.T, es repos.EventStore) {
+	ctx := context.Background()
+
+	// interleave the saves of two aggregates
+	a, b := newAccount(t, "acc-a"), newAccount(t, "acc-b")
+	mustSave(t, es, a)
+	mustSave(t, es, b)
+	for i := 1; i <= 5; i++ {
+		change(t, a, &deposited{Amount: i})
+		mustSave(t, es, a)
+		change(t, b, &deposited{Amount: 10 * i})
+		mustSave(t, es, b)
+	}
+
+	events, err := es.List(ctx, "acc-a", &account{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 6 {
+		t.Fatalf("%d events listed, want 6", len(events))
+	}
+	for i, e := range events {
+		if e.Version != i+1 || e.AggregateID != "acc-a" {
+			t.Fatalf("event %d is %s v%d, want acc-a v%d", i, e.AggregateID, e.Version, i+1)
+		}
+		if i > 0 {
+			if d, ok := e.Data.(*deposited); !ok || d.Amount != i {
+				t.Fatalf("event %d data=%#v, want deposited %d", i, e.Data, i)
+			}
+		}
+	}
+
+	var versions []int
+	for e, err := range es.Events(ctx, "acc-b", 3) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, e.Version)
+	}
+	if fmt.Sprint(versions) != "[4 5 6]" {
+		t.Fatalf("streamed versions after 3=%v, want [4 5 6]", versions)
+	}
+
+	partial := &account{}
+	partial.SetAggregateType(accountType)
+	if err := es.Get(ctx, "acc-b", 0, 3, partial); err != nil {
+		t.Fatal(err)
+	}
+	if partial.Version() != 3 || partial.Balance != 30 {
+		t.Fatalf("get up to version 3 version=%d balance=%d, want 3 and 30", partial.Version(), partial.Balance)
+	}
+
+	all, err := es.ReadAll(ctx, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 12 {
+		t.Fatalf("%d events read, want 12", len(all))
+	}
+	want := []string{"acc-a", "acc-b"}
+	for i, e := range all {
+		if i > 0 && e.Position <= all[i-1].Position {
+			t.Fatalf("position %d follows position %d", e.Position, all[i-1].Position)
+		}
+		if e.AggregateID != want[i%2] || e.Version != i/2+1 {
+			t.Fatalf("event %d of the global stream is %s v%d, want %s v%d", i, e.AggregateID, e.Version, want[i%2], i/2+1)
+		}
+	}
+
+	// reading from a position resumes right after it
+	rest, err := es.ReadAll(ctx, all[4].Position, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rest) != 3 || rest[0].Position != all[5].Position {
+		t.Fatalf("read after position %d returned %d events, want 3 from position %d",
+			all[4].Position, len(rest), all[5].Position)
+	}
+}
+
+func testReadAllLimit(t *testing.T, es repos.EventStore) {
+	ctx := context.Background()
+	a := newAccount(t, "acc-1")
+	change(t, a, &deposited{Amount: 1})
+	mustSave(t, es, a)
+
+	for _, limit := range []int{0, -1} {
+		if _, err := es.ReadAll(ctx, 0, limit); !errors.Is(err, repos.ErrInvalidLimit) {
+			t.Fatalf("read with limit=%d err=%v, want ErrInvalidLimit", limit, err)
+		}
+	}
+	events, err := es.ReadAll(ctx, 0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("%d events read with limit=1, want 1", len(events))
+	}
+}
+
+// testSubscribeConcurrentSaves checks a subscriber tailing concurrent writers gets every event once in position
+// order, which needs positions to become visible in order
+func testSubscribeConcurrentSaves(t *testing.T, es repos.EventStore) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	const writers, saves = 4, 10
+
+	sub := es.Subscribe(ctx, 0)
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			a := &account{}
+			_ = a.SetID(fmt.Sprintf("acc-%d", w))
+			a.SetAggregateType(accountType)
+			for i := 0; i < saves; i++ {
+				_ = a.ApplyChange(a, &deposited{Amount: 1})
+				if err := save(ctx, es, a); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	seen := make(map[string]int)
+	var last int64
+	timeout := time.After(10 * time.Second)
+	for received := 0; received < writers*saves; received++ {
+		select {
+		case e, ok := <-sub.Events():
+			if !ok {
+				t.Fatalf("subscription stopped err=%v", sub.Err())
+			}
+			if e.Position <= last {
+				t.Fatalf("position %d received after %d", e.Position, last)
+			}
+			last = e.Position
+			if e.Version != seen[e.AggregateID]+1 {
+				t.Fatalf("%s v%d received after v%d", e.AggregateID, e.Version, seen[e.AggregateID])
+			}
+			seen[e.AggregateID] = e.Version
+		case err := <-errs:
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatalf("%d events received, want %d", received, writers*saves)
+		}
+	}
+	wg.Wait()
+}
+
+func testCommands(t *testing.T, es repos.EventStore) {
+	ctx := context.Background()
+	record := repos.CommandRecord{AggregateID: "acc-1", Version: 3}
+
+	record1 := func() error {
+		return es.WithTransaction(ctx, func(txn repos.EventStore) error {
+			return txn.RecordCommand(ctx, "cmd-1", record)
+		})
+	}
+	if err := record1(); err != nil {
+		t.Fatal(err)
+	}
+	if err := record1(); !errors.Is(err, repos.ErrDuplicateCommand) {
+		t.Fatalf("record the command again err=%v, want ErrDuplicateCommand", err)
+	}
+
+	records, err := es.LookupCommand(ctx, "cmd-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0] != record {
+		t.Fatalf("records=%+v, want %+v", records, record)
+	}
+	if _, err := es.LookupCommand(ctx, "cmd-2"); !errors.Is(err, repos.ErrCommandNotFound) {
+		t.Fatalf("lookup unknown command err=%v, want ErrCommandNotFound", err)
+	}
+}
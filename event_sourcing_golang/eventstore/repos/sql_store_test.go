@@ -0,0 +1,192 @@
+package repos_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// openSQLite returns a migrated SQLite database in a temporary file
+func openSQLite(t *testing.T) *gorm.DB {
+	t.Helper()
+	db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "es.db")), &gorm.Config{
+		Logger: logger.Discard,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := repos.Migrate(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestSQLiteStore(t *testing.T) {
+	ctx := context.Background()
+	db := openSQLite(t)
+	if got := repos.DialectOf(db); got != repos.DialectSQLite {
+		t.Fatalf("dialect=%s", got)
+	}
+	// running the migrations again must be a no-op
+	if err := repos.Migrate(ctx, db); err != nil {
+		t.Fatal(err)
+	}
+
+	s := eventsourcing.NewSerializer()
+	if err := s.RegisterAggregate(&BenchAccount{}); err != nil {
+		t.Fatal(err)
+	}
+	es := repos.New(db, s).EventStore()
+
+	acc := &BenchAccount{}
+	_ = acc.SetID("acc-1")
+	acc.SetAggregateType("BenchAccount")
+	for i := 1; i <= 3; i++ {
+		if err := acc.ApplyChange(acc, &BenchDeposited{Amount: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := es.CreateIfNotExist(ctx, "acc-1", "BenchAccount"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := es.WithTransaction(ctx, func(txn repos.EventStore) error {
+		if err := txn.CheckAndUpdateVersion(ctx, acc); err != nil {
+			return err
+		}
+		for _, e := range acc.Events() {
+			e.AggregateType = "BenchAccount"
+			if err := txn.Append(ctx, e); err != nil {
+				return err
+			}
+		}
+		if err := txn.AppendOutbox(ctx, acc.Events()...); err != nil {
+			return err
+		}
+		return txn.CreateSnapshot(ctx, acc)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := &BenchAccount{}
+	loaded.SetAggregateType("BenchAccount")
+	if err := es.Get(ctx, "acc-1", 0, 0, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Balance != 6 {
+		t.Fatalf("balance=%d, want 6", loaded.Balance)
+	}
+
+	snap := &BenchAccount{}
+	snap.SetAggregateType("BenchAccount")
+	if err := es.ReadSnapshot(ctx, "acc-1", 0, snap); err != nil {
+		t.Fatal(err)
+	}
+	if snap.Balance != 6 || snap.Root().Version() != 3 {
+		t.Fatalf("snapshot balance=%d version=%d", snap.Balance, snap.Root().Version())
+	}
+
+	stale := &BenchAccount{}
+	_ = stale.SetID("acc-1")
+	_ = stale.ApplyChange(stale, &BenchDeposited{Amount: 1})
+	if err := es.CheckAndUpdateVersion(ctx, stale); !repos.IsConcurrencyConflict(err) {
+		t.Fatalf("err=%v, want concurrency conflict", err)
+	}
+
+	all, err := es.ReadAll(ctx, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || all[0].Position != 2 || all[0].AggregateType != "BenchAccount" {
+		t.Fatalf("ReadAll=%+v", all)
+	}
+
+	pending, err := es.PendingOutbox(ctx, time.Now(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != 1 || pending[0].Event.Version != 1 {
+		t.Fatalf("pending=%+v, want only version 1", pending)
+	}
+	if err := es.MarkOutboxDelivered(ctx, pending[0].ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := es.SnapshotVersion(ctx, "acc-2"); !errors.Is(err, repos.ErrSnapshotNotFound) {
+		t.Fatalf("err=%v, want ErrSnapshotNotFound", err)
+	}
+}
+
+func TestSQLiteEventsPaging(t *testing.T) {
+	ctx := context.Background()
+	s := eventsourcing.NewSerializer()
+	if err := s.RegisterAggregate(&BenchAccount{}); err != nil {
+		t.Fatal(err)
+	}
+	es := repos.New(openSQLite(t), s).EventStore()
+
+	// more events than one hydration batch
+	const total = 1234
+	acc := &BenchAccount{}
+	_ = acc.SetID("acc-1")
+	for i := 1; i <= total; i++ {
+		_ = acc.ApplyChange(acc, &BenchDeposited{Amount: 1})
+	}
+	if err := es.CreateIfNotExist(ctx, "acc-1", "BenchAccount"); err != nil {
+		t.Fatal(err)
+	}
+	err := es.WithTransaction(ctx, func(txn repos.EventStore) error {
+		for _, e := range acc.Events() {
+			e.AggregateType = "BenchAccount"
+			if err := txn.Append(ctx, e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := 11
+	for e, err := range es.Events(ctx, "acc-1", 10) {
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.Version != want || e.AggregateType != "BenchAccount" {
+			t.Fatalf("got version=%d type=%s, want version=%d", e.Version, e.AggregateType, want)
+		}
+		if _, ok := e.Data.(*BenchDeposited); !ok {
+			t.Fatalf("data=%T", e.Data)
+		}
+		want++
+	}
+	if want != total+1 {
+		t.Fatalf("streamed up to version %d, want %d", want-1, total)
+	}
+
+	loaded := &BenchAccount{}
+	loaded.SetAggregateType("BenchAccount")
+	if err := es.Get(ctx, "acc-1", 100, 1100, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Balance != 1000 {
+		t.Fatalf("balance=%d, want 1000", loaded.Balance)
+	}
+
+	for range es.Events(ctx, "missing", 0) {
+		t.Fatal("unknown aggregate must yield no events")
+	}
+}
@@ -0,0 +1,101 @@
+package repos
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+const (
+	// subscribeBatchSize is how many events a subscription reads per ReadAll call
+	subscribeBatchSize = 256
+	// subscribePollInterval is how often a polling subscription checks for new events once caught up
+	subscribePollInterval = 500 * time.Millisecond
+)
+
+// Subscription delivers events from the global stream in position order.
+// It first catches up from the requested position and then tails new events until ctx is done.
+type Subscription struct {
+	events chan eventsourcing.Event
+
+	mu  sync.Mutex
+	err error
+}
+
+type readAllFunc = func(ctx context.Context, fromPosition int64, limit int) ([]eventsourcing.Event, error)
+
+// waitFunc returns a channel that is ready once new events may be available
+type waitFunc = func() <-chan struct{}
+
+func newSubscription(ctx context.Context, fromPosition int64, read readAllFunc, wait waitFunc) *Subscription {
+	sub := &Subscription{
+		events: make(chan eventsourcing.Event),
+	}
+
+	go sub.run(ctx, fromPosition, read, wait)
+
+	return sub
+}
+
+// Events returns the channel of events, closed when the subscription stops
+func (s *Subscription) Events() <-chan eventsourcing.Event {
+	return s.events
+}
+
+// Err returns the error that stopped the subscription, if any. It is only meaningful once Events is closed.
+func (s *Subscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Subscription) run(ctx context.Context, position int64, read readAllFunc, wait waitFunc) {
+	defer close(s.events)
+
+	for {
+		// grab the wake up channel before reading so appends in between are not missed
+		wake := wait()
+
+		events, err := read(ctx, position, subscribeBatchSize)
+		if err != nil {
+			s.setErr(err)
+			return
+		}
+
+		for _, e := range events {
+			select {
+			case s.events <- e:
+				position = e.Position
+			case <-ctx.Done():
+				s.setErr(ctx.Err())
+				return
+			}
+		}
+
+		if len(events) == subscribeBatchSize {
+			continue
+		}
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			s.setErr(ctx.Err())
+			return
+		}
+	}
+}
+
+func (s *Subscription) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+// pollWait is a waitFunc for backends without change notification
+func pollWait() <-chan struct{} {
+	ch := make(chan struct{})
+	time.AfterFunc(subscribePollInterval, func() { close(ch) })
+	return ch
+}
@@ -0,0 +1,136 @@
+package eventstore
+
+import (
+	"context"
+	"reflect"
+	"time"
+
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// RetryPolicy controls how Repository.Update retries on optimistic concurrency conflicts
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one
+	MaxAttempts int
+	// Backoff returns how long to wait before the given retry, starting at 1
+	Backoff func(retry int) time.Duration
+}
+
+// DefaultRetryPolicy tries 3 times, waiting 10ms then 20ms between attempts
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		Backoff: func(retry int) time.Duration {
+			return time.Duration(retry) * 10 * time.Millisecond
+		},
+	}
+}
+
+// NoRetry makes Update fail on the first conflict
+func NoRetry() RetryPolicy {
+	return RetryPolicy{MaxAttempts: 1}
+}
+
+type repositoryOptions struct {
+	retry RetryPolicy
+}
+
+type RepositoryOption func(*repositoryOptions)
+
+func WithRetryPolicy(p RetryPolicy) RepositoryOption {
+	return func(o *repositoryOptions) {
+		o.retry = p
+	}
+}
+
+// Repository loads and saves aggregates of type T, which must be a pointer to an aggregate struct
+type Repository[T eventsourcing.Aggregate] struct {
+	store AggregateStore
+	retry RetryPolicy
+}
+
+func NewRepository[T eventsourcing.Aggregate](store AggregateStore, opts ...RepositoryOption) *Repository[T] {
+	o := repositoryOptions{retry: DefaultRetryPolicy()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return &Repository[T]{
+		store: store,
+		retry: o.retry,
+	}
+}
+
+// Load returns the latest state of the aggregate, ErrAggregateNotFound if it has no event
+func (r *Repository[T]) Load(ctx context.Context, id string) (T, error) {
+	agg := r.new()
+	if err := r.store.Get(ctx, id, agg); err != nil {
+		return agg, err
+	}
+
+	return agg, nil
+}
+
+// Create builds a new aggregate with fn and saves it, it fails with ErrConcurrencyConflict if id already exists
+func (r *Repository[T]) Create(ctx context.Context, id string, fn func(T) error) (T, error) {
+	agg := r.new()
+	if err := agg.Root().SetID(id); err != nil {
+		return agg, err
+	}
+	if err := fn(agg); err != nil {
+		return agg, err
+	}
+	if err := r.store.Save(ctx, agg); err != nil {
+		return agg, err
+	}
+
+	return agg, nil
+}
+
+// Update loads the aggregate, applies fn and saves it. On a concurrency conflict the aggregate is reloaded
+// and fn runs again according to the retry policy, so fn must not have side effects besides changing the aggregate.
+func (r *Repository[T]) Update(ctx context.Context, id string, fn func(T) error) (T, error) {
+	var agg T
+	var err error
+	for attempt := 1; ; attempt++ {
+		agg, err = r.update(ctx, id, fn)
+		if err == nil || !repos.IsConcurrencyConflict(err) || attempt >= r.retry.MaxAttempts {
+			return agg, err
+		}
+
+		if r.retry.Backoff != nil {
+			select {
+			case <-ctx.Done():
+				return agg, ctx.Err()
+			case <-time.After(r.retry.Backoff(attempt)):
+			}
+		}
+	}
+}
+
+func (r *Repository[T]) update(ctx context.Context, id string, fn func(T) error) (T, error) {
+	agg, err := r.Load(ctx, id)
+	if err != nil {
+		return agg, err
+	}
+	if err := fn(agg); err != nil {
+		return agg, err
+	}
+	if !agg.Root().IsUnsaved() {
+		return agg, nil
+	}
+	if err := r.store.Save(ctx, agg); err != nil {
+		return agg, err
+	}
+
+	return agg, nil
+}
+
+// new returns a zero aggregate of type T naming the events it applies with the serializer of the store
+func (r *Repository[T]) new() T {
+	var zero T
+	agg := reflect.New(reflect.TypeOf(zero).Elem()).Interface().(T)
+	agg.Root().SetEventNamer(r.store.Serializer())
+	return agg
+}
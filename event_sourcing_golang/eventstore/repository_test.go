@@ -0,0 +1,204 @@
+package eventstore_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+type Deposited struct{ Amount int }
+
+type Account struct {
+	eventsourcing.AggregateRoot
+	Balance int
+}
+
+func (a *Account) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&Deposited{})
+}
+
+func (a *Account) Transition(e eventsourcing.Event) error {
+	if v, ok := e.Data.(*Deposited); ok {
+		a.Balance += v.Amount
+	}
+	return nil
+}
+
+func deposit(amount int) func(*Account) error {
+	return func(a *Account) error {
+		return a.ApplyChange(a, &Deposited{Amount: amount})
+	}
+}
+
+// newRepos returns an in-memory store with Account registered
+func newRepos(t *testing.T, opts ...repos.Option) repos.Repos {
+	t.Helper()
+	s := eventsourcing.NewSerializer()
+	if err := s.RegisterAggregate(&Account{}); err != nil {
+		t.Fatal(err)
+	}
+	return repos.NewInMemory(s, opts...)
+}
+
+func noWait(int) time.Duration { return 0 }
+
+func TestUpdateRetriesOnConflict(t *testing.T) {
+	ctx := context.Background()
+	store := eventstore.NewAggregateStore(newRepos(t))
+	accounts := eventstore.NewRepository[*Account](store,
+		eventstore.WithRetryPolicy(eventstore.RetryPolicy{MaxAttempts: 3, Backoff: noWait}))
+	other := eventstore.NewRepository[*Account](store, eventstore.WithRetryPolicy(eventstore.NoRetry()))
+	if _, err := accounts.Create(ctx, "acc-1", deposit(10)); err != nil {
+		t.Fatal(err)
+	}
+
+	// another writer saves between the load and the save of the first attempt
+	calls := 0
+	acc, err := accounts.Update(ctx, "acc-1", func(a *Account) error {
+		calls++
+		if calls == 1 {
+			if _, err := other.Update(ctx, "acc-1", deposit(5)); err != nil {
+				return err
+			}
+		}
+		return deposit(1)(a)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if calls != 2 {
+		t.Fatalf("fn called %d times, want 2", calls)
+	}
+	if acc.Balance != 16 || acc.Version() != 3 {
+		t.Fatalf("balance=%d version=%d, want 16 at 3", acc.Balance, acc.Version())
+	}
+
+	loaded, err := accounts.Load(ctx, "acc-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.Balance != 16 {
+		t.Fatalf("loaded balance=%d, want 16", loaded.Balance)
+	}
+}
+
+func TestUpdateGivesUpAfterMaxAttempts(t *testing.T) {
+	ctx := context.Background()
+	store := eventstore.NewAggregateStore(newRepos(t))
+	other := eventstore.NewRepository[*Account](store, eventstore.WithRetryPolicy(eventstore.NoRetry()))
+	if _, err := other.Create(ctx, "acc-1", deposit(10)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, maxAttempts := range []int{1, 3} {
+		accounts := eventstore.NewRepository[*Account](store,
+			eventstore.WithRetryPolicy(eventstore.RetryPolicy{MaxAttempts: maxAttempts, Backoff: noWait}))
+		// every attempt loses the race
+		calls := 0
+		_, err := accounts.Update(ctx, "acc-1", func(a *Account) error {
+			calls++
+			if _, err := other.Update(ctx, "acc-1", deposit(1)); err != nil {
+				return err
+			}
+			return deposit(100)(a)
+		})
+		if !repos.IsConcurrencyConflict(err) {
+			t.Fatalf("max attempts=%d err=%v, want a concurrency conflict", maxAttempts, err)
+		}
+		if calls != maxAttempts {
+			t.Fatalf("max attempts=%d fn called %d times", maxAttempts, calls)
+		}
+	}
+}
+
+func TestUpdateDoesNotRetryOtherErrors(t *testing.T) {
+	ctx := context.Background()
+	accounts := eventstore.NewRepository[*Account](eventstore.NewAggregateStore(newRepos(t)),
+		eventstore.WithRetryPolicy(eventstore.RetryPolicy{MaxAttempts: 3, Backoff: noWait}))
+	if _, err := accounts.Update(ctx, "acc-1", deposit(1)); !errors.Is(err, eventstore.ErrAggregateNotFound) {
+		t.Fatalf("update of a missing aggregate err=%v, want ErrAggregateNotFound", err)
+	}
+
+	if _, err := accounts.Create(ctx, "acc-1", deposit(1)); err != nil {
+		t.Fatal(err)
+	}
+	rejected := errors.New("rejected")
+	calls := 0
+	_, err := accounts.Update(ctx, "acc-1", func(*Account) error {
+		calls++
+		return rejected
+	})
+	if !errors.Is(err, rejected) || calls != 1 {
+		t.Fatalf("err=%v after %d calls, want rejected after 1", err, calls)
+	}
+}
+
+func TestUpdateStopsWaitingWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	store := eventstore.NewAggregateStore(newRepos(t))
+	other := eventstore.NewRepository[*Account](store, eventstore.WithRetryPolicy(eventstore.NoRetry()))
+	if _, err := other.Create(ctx, "acc-1", deposit(10)); err != nil {
+		t.Fatal(err)
+	}
+
+	accounts := eventstore.NewRepository[*Account](store, eventstore.WithRetryPolicy(eventstore.RetryPolicy{
+		MaxAttempts: 3,
+		Backoff: func(int) time.Duration {
+			cancel()
+			return time.Hour
+		},
+	}))
+	_, err := accounts.Update(ctx, "acc-1", func(a *Account) error {
+		if _, err := other.Update(context.Background(), "acc-1", deposit(1)); err != nil {
+			return err
+		}
+		return deposit(1)(a)
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("err=%v, want context.Canceled", err)
+	}
+}
+
+func TestAppliedEventsHaveRegisteredName(t *testing.T) {
+	ctx := context.Background()
+	s := eventsourcing.NewSerializer()
+	if err := eventsourcing.Register[Deposited](s, "account.deposited.v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterAggregate(&Account{}); err != nil {
+		t.Fatal(err)
+	}
+	store := eventstore.NewAggregateStore(repos.NewInMemory(s))
+	accounts := eventstore.NewRepository[*Account](store)
+
+	// the name is set by ApplyChange, before the save
+	checkName := func(a *Account) error {
+		if err := deposit(1)(a); err != nil {
+			return err
+		}
+		events := a.Root().Events()
+		if got := events[len(events)-1].EventType; got != "account.deposited.v1" {
+			t.Errorf("applied event type=%s, want account.deposited.v1", got)
+		}
+		return nil
+	}
+	if _, err := accounts.Create(ctx, "acc-1", checkName); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := accounts.Update(ctx, "acc-1", checkName); err != nil {
+		t.Fatal(err)
+	}
+
+	acc := &Account{}
+	if err := store.Get(ctx, "acc-1", acc); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkName(acc); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,94 @@
+package eventstore
+
+import (
+	"time"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// SnapshotPolicy decides after each Save whether a new snapshot of the aggregate should be written
+type SnapshotPolicy interface {
+	ShouldSnapshot(info SnapshotInfo) bool
+}
+
+// SnapshotInfo describes the aggregate being saved and its latest snapshot
+type SnapshotInfo struct {
+	AggregateType string
+	// Version is the aggregate version once the save commits
+	Version int
+	// SnapshotVersion is the version of the latest snapshot, 0 if none or if it has another schema
+	SnapshotVersion int
+	// SnapshotAt is when the latest snapshot was taken, zero if none
+	SnapshotAt time.Time
+	// Events are the events appended by this save
+	Events []eventsourcing.Event
+}
+
+// EventsSinceSnapshot is the number of events a load has to replay on top of the latest snapshot
+func (i SnapshotInfo) EventsSinceSnapshot() int {
+	return i.Version - i.SnapshotVersion
+}
+
+// SnapshotPolicyFunc adapts a function to SnapshotPolicy
+type SnapshotPolicyFunc func(info SnapshotInfo) bool
+
+func (f SnapshotPolicyFunc) ShouldSnapshot(info SnapshotInfo) bool {
+	return f(info)
+}
+
+// EveryNEvents snapshots once n events were written since the latest snapshot
+func EveryNEvents(n int) SnapshotPolicy {
+	return SnapshotPolicyFunc(func(info SnapshotInfo) bool {
+		return n > 0 && info.EventsSinceSnapshot() >= n
+	})
+}
+
+// EveryInterval snapshots when the latest snapshot is older than d, or there is none yet
+func EveryInterval(d time.Duration) SnapshotPolicy {
+	return SnapshotPolicyFunc(func(info SnapshotInfo) bool {
+		return info.EventsSinceSnapshot() > 0 && time.Since(info.SnapshotAt) >= d
+	})
+}
+
+// SizeThreshold snapshots once the serialized events to replay since the latest snapshot exceed maxBytes.
+// The replay size is estimated from the average size of the events in the current save, marshal is
+// normally Serializer.Marshal.
+func SizeThreshold(maxBytes int, marshal func(v interface{}) ([]byte, error)) SnapshotPolicy {
+	return SnapshotPolicyFunc(func(info SnapshotInfo) bool {
+		if len(info.Events) == 0 {
+			return false
+		}
+
+		size := 0
+		for _, e := range info.Events {
+			b, err := marshal(e.Data)
+			if err != nil {
+				return false
+			}
+			size += len(b)
+		}
+
+		return size*info.EventsSinceSnapshot()/len(info.Events) >= maxBytes
+	})
+}
+
+// Never disables snapshots, aggregates are always loaded by replaying their events
+func Never() SnapshotPolicy {
+	return neverPolicy{}
+}
+
+type neverPolicy struct{}
+
+func (neverPolicy) ShouldSnapshot(SnapshotInfo) bool {
+	return false
+}
+
+// Async makes the snapshot decided by p be written in the background after the save commits,
+// so large snapshots don't add to the write latency
+func Async(p SnapshotPolicy) SnapshotPolicy {
+	return asyncPolicy{p}
+}
+
+type asyncPolicy struct {
+	SnapshotPolicy
+}
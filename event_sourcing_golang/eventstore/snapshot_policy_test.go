@@ -0,0 +1,172 @@
+package eventstore_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+func TestEveryInterval(t *testing.T) {
+	p := eventstore.EveryInterval(time.Hour)
+	old := time.Now().Add(-2 * time.Hour)
+	for name, tc := range map[string]struct {
+		info eventstore.SnapshotInfo
+		want bool
+	}{
+		"NoSnapshotYet":     {eventstore.SnapshotInfo{Version: 1}, true},
+		"RecentSnapshot":    {eventstore.SnapshotInfo{Version: 3, SnapshotVersion: 1, SnapshotAt: time.Now()}, false},
+		"OldSnapshot":       {eventstore.SnapshotInfo{Version: 3, SnapshotVersion: 1, SnapshotAt: old}, true},
+		"NothingSinceOld":   {eventstore.SnapshotInfo{Version: 3, SnapshotVersion: 3, SnapshotAt: old}, false},
+		"NothingAndNoneYet": {eventstore.SnapshotInfo{}, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := p.ShouldSnapshot(tc.info); got != tc.want {
+				t.Fatalf("ShouldSnapshot=%v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSizeThreshold(t *testing.T) {
+	// every deposit is {"Amount":10}, 13 bytes
+	events := []eventsourcing.Event{{Data: &Deposited{Amount: 10}}, {Data: &Deposited{Amount: 10}}}
+	failing := func(v interface{}) ([]byte, error) { return nil, errors.New("marshal failed") }
+	// 10 events of 13 bytes to replay
+	info := eventstore.SnapshotInfo{Version: 12, SnapshotVersion: 2, Events: events}
+	for name, tc := range map[string]struct {
+		p    eventstore.SnapshotPolicy
+		info eventstore.SnapshotInfo
+		want bool
+	}{
+		"Above":        {eventstore.SizeThreshold(130, json.Marshal), info, true},
+		"Below":        {eventstore.SizeThreshold(131, json.Marshal), info, false},
+		"NoEvents":     {eventstore.SizeThreshold(1, json.Marshal), eventstore.SnapshotInfo{Version: 12}, false},
+		"MarshalError": {eventstore.SizeThreshold(1, failing), eventstore.SnapshotInfo{Version: 12, Events: events}, false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if got := tc.p.ShouldSnapshot(tc.info); got != tc.want {
+				t.Fatalf("ShouldSnapshot=%v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestNeverAndAsync(t *testing.T) {
+	info := eventstore.SnapshotInfo{Version: 1000}
+	if eventstore.Never().ShouldSnapshot(info) {
+		t.Fatal("Never decided to snapshot")
+	}
+	if !eventstore.Async(eventstore.EveryNEvents(10)).ShouldSnapshot(info) {
+		t.Fatal("Async did not snapshot when its policy does")
+	}
+	if eventstore.Async(eventstore.Never()).ShouldSnapshot(info) {
+		t.Fatal("Async snapshot when its policy does not")
+	}
+}
+
+func TestNeverLoadsFromEvents(t *testing.T) {
+	ctx := context.Background()
+	r := newRepos(t)
+	saveDeposits(t, eventstore.NewAggregateStore(r, eventstore.WithSnapshotPolicy(&Account{}, eventstore.EveryNEvents(1))),
+		times(2)...)
+
+	// the snapshot at version 2 holds a balance no event leads to, a load without snapshots ignores it
+	acc := &Account{Balance: 1000}
+	acc.SetInternal("acc-1", 2, 2)
+	if err := r.EventStore().CreateSnapshot(ctx, acc); err != nil {
+		t.Fatal(err)
+	}
+	acc = &Account{}
+	store := eventstore.NewAggregateStore(r, eventstore.WithSnapshotPolicy(&Account{}, eventstore.Never()))
+	if err := store.Get(ctx, "acc-1", acc); err != nil {
+		t.Fatal(err)
+	}
+	if acc.Balance != 3 {
+		t.Fatalf("balance=%d, want 3 from the events", acc.Balance)
+	}
+}
+
+// waitSnapshot waits until the latest snapshot of acc-1 is at version
+func waitSnapshot(t *testing.T, es repos.EventStore, version int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got, err := es.SnapshotVersion(context.Background(), "acc-1")
+		if err != nil && !errors.Is(err, repos.ErrSnapshotNotFound) {
+			t.Fatal(err)
+		}
+		if got == version {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("snapshot version=%d, want %d", got, version)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// failingSnapshots fails every snapshot write, in transactions as well
+type failingSnapshots struct {
+	repos.EventStore
+}
+
+var errSnapshotWrite = errors.New("snapshot write failed")
+
+func (f failingSnapshots) CreateSnapshot(ctx context.Context, agg eventsourcing.Aggregate) error {
+	return errSnapshotWrite
+}
+
+func (f failingSnapshots) WithTransaction(ctx context.Context, fn func(repos.EventStore) error) error {
+	return f.EventStore.WithTransaction(ctx, func(txn repos.EventStore) error {
+		return fn(failingSnapshots{txn})
+	})
+}
+
+type failingSnapshotRepos struct {
+	repos.Repos
+}
+
+func (r failingSnapshotRepos) EventStore() repos.EventStore {
+	return failingSnapshots{r.Repos.EventStore()}
+}
+
+func TestAsyncSnapshots(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			r := open(t)
+			store := eventstore.NewAggregateStore(r,
+				eventstore.WithSnapshotPolicy(&Account{}, eventstore.Async(eventstore.EveryNEvents(2))))
+			saveDeposits(t, store, times(2)...)
+			waitSnapshot(t, r.EventStore(), 2)
+
+			errs := make(chan error, 1)
+			failing := eventstore.NewAggregateStore(failingSnapshotRepos{r},
+				eventstore.WithSnapshotPolicy(&Account{}, eventstore.Async(eventstore.EveryNEvents(2))),
+				eventstore.WithSnapshotErrorHandler(func(err error) { errs <- err }))
+			accounts := eventstore.NewRepository[*Account](failing)
+			for i := 0; i < 2; i++ {
+				// the save itself does not depend on the snapshot
+				if _, err := accounts.Update(context.Background(), "acc-1", deposit(1)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			select {
+			case err := <-errs:
+				if !errors.Is(err, errSnapshotWrite) {
+					t.Fatalf("snapshot error=%v, want errSnapshotWrite", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("the snapshot error never reached the handler")
+			}
+			if v, err := r.EventStore().SnapshotVersion(context.Background(), "acc-1"); err != nil || v != 2 {
+				t.Fatalf("snapshot version=%d err=%v, want 2", v, err)
+			}
+		})
+	}
+}
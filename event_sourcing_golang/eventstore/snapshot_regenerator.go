@@ -0,0 +1,129 @@
+package eventstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+const defaultRegenerateBatchSize = 100
+
+// SnapshotRegenerator replaces the stale snapshots of an aggregate type, written before a change of its schema,
+// with a snapshot of the current state of each aggregate. Loads replay all the events of these aggregates until
+// then, so it is meant to run in the background after deploying the change.
+// Aggregates without any snapshot are left to their snapshot policy.
+type SnapshotRegenerator struct {
+	es        repos.EventStore
+	aggType   reflect.Type
+	batchSize int
+}
+
+type RegeneratorOption func(*SnapshotRegenerator)
+
+// WithRegenerateBatchSize sets how many aggregates are listed at a time
+func WithRegenerateBatchSize(n int) RegeneratorOption {
+	return func(g *SnapshotRegenerator) {
+		if n > 0 {
+			g.batchSize = n
+		}
+	}
+}
+
+// NewSnapshotRegenerator returns a regenerator of the snapshots of the aggregates of agg's type
+func NewSnapshotRegenerator(r repos.Repos, agg eventsourcing.Aggregate, opts ...RegeneratorOption) *SnapshotRegenerator {
+	g := &SnapshotRegenerator{
+		es:        r.EventStore(),
+		aggType:   reflect.TypeOf(agg).Elem(),
+		batchSize: defaultRegenerateBatchSize,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+
+	return g
+}
+
+// Run regenerates the snapshots of every aggregate whose latest snapshot is stale and returns how many got a new
+// snapshot. It stops at the first error, running it again skips the aggregates already regenerated.
+func (g *SnapshotRegenerator) Run(ctx context.Context) (int, error) {
+	regenerated := 0
+	afterID := ""
+	for {
+		infos, err := g.es.Aggregates(ctx, g.aggType.Name(), afterID, g.batchSize)
+		if err != nil {
+			return regenerated, err
+		}
+
+		for _, info := range infos {
+			if err := ctx.Err(); err != nil {
+				return regenerated, err
+			}
+			done, err := g.regenerate(ctx, info.ID)
+			if err != nil {
+				return regenerated, fmt.Errorf("regenerate snapshot id=%s err=%w", info.ID, err)
+			}
+			if done {
+				regenerated++
+			}
+		}
+
+		if len(infos) < g.batchSize {
+			return regenerated, nil
+		}
+		afterID = infos[len(infos)-1].ID
+	}
+}
+
+// regenerate replays the aggregate and replaces its stale snapshots with one of its state,
+// it returns false when its latest snapshot is not stale
+func (g *SnapshotRegenerator) regenerate(ctx context.Context, aggregateID string) (bool, error) {
+	agg, ok := reflect.New(g.aggType).Interface().(eventsourcing.Aggregate)
+	if !ok {
+		return false, errors.New("aggregate type does not implement Aggregate")
+	}
+	if _, err := setAggregateType(agg); err != nil {
+		return false, err
+	}
+
+	last, err := g.es.LastSnapshot(ctx, aggregateID)
+	if errors.Is(err, repos.ErrSnapshotNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if last.Schema == eventsourcing.SnapshotSchema(agg) {
+		return false, nil
+	}
+
+	if err := g.es.Get(ctx, aggregateID, 0, 0, agg); err != nil {
+		return false, err
+	}
+
+	created := false
+	err = g.es.WithTransaction(ctx, func(txn repos.EventStore) error {
+		if _, err := txn.PurgeStaleSnapshots(ctx, aggregateID, agg); err != nil {
+			return err
+		}
+		// a save may have written a snapshot of the current schema since the aggregate was replayed
+		last, err := txn.LastSnapshot(ctx, aggregateID)
+		switch {
+		case err == nil && last.Version >= agg.Root().Version():
+			return nil
+		case err != nil && !errors.Is(err, repos.ErrSnapshotNotFound):
+			return err
+		}
+
+		created = true
+		return txn.CreateSnapshot(ctx, agg)
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return created, nil
+}
@@ -0,0 +1,159 @@
+package eventstore_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// accountV1 is the shape Account had before its balance was renamed, its snapshots are stale
+type accountV1 struct {
+	eventsourcing.AggregateRoot
+	Amount int
+}
+
+func (a *accountV1) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&Deposited{})
+}
+
+func (a *accountV1) Transition(e eventsourcing.Event) error {
+	return nil
+}
+
+// writeStaleSnapshot writes a snapshot of the old shape at version 1
+func writeStaleSnapshot(t *testing.T, es repos.EventStore, id string) {
+	t.Helper()
+	old := &accountV1{Amount: 1000}
+	old.SetInternal(id, 1, 1)
+	if err := es.CreateSnapshot(context.Background(), old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// checkSnapshots checks the aggregate only has a snapshot of the current shape at version
+func checkSnapshots(t *testing.T, es repos.EventStore, id string, version int) {
+	t.Helper()
+	snapshots, err := es.Snapshots(context.Background(), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := eventsourcing.SnapshotSchema(&Account{})
+	if len(snapshots) != 1 || snapshots[0].Version != version || snapshots[0].Schema != schema {
+		t.Fatalf("snapshots of %s=%+v, want one at version %d of schema %s", id, snapshots, version, schema)
+	}
+}
+
+func TestSnapshotRegeneratorRun(t *testing.T) {
+	ctx := context.Background()
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			r := open(t)
+			es := r.EventStore()
+			accounts := eventstore.NewRepository[*Account](eventstore.NewAggregateStore(r))
+			for i := 1; i <= 6; i++ {
+				id := fmt.Sprintf("acc-%d", i)
+				acc, err := accounts.Create(ctx, id, func(a *Account) error {
+					if err := deposit(1)(a); err != nil {
+						return err
+					}
+					return deposit(2)(a)
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				switch id {
+				case "acc-3":
+					// already current
+					if err := es.CreateSnapshot(ctx, acc); err != nil {
+						t.Fatal(err)
+					}
+				case "acc-6":
+					// no snapshot to regenerate
+				default:
+					writeStaleSnapshot(t, es, id)
+				}
+			}
+
+			// 3 pages of 2 aggregates
+			g := eventstore.NewSnapshotRegenerator(r, &Account{}, eventstore.WithRegenerateBatchSize(2))
+			n, err := g.Run(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 4 {
+				t.Fatalf("%d snapshots regenerated, want 4", n)
+			}
+			for _, id := range []string{"acc-1", "acc-2", "acc-3", "acc-4", "acc-5"} {
+				checkSnapshots(t, es, id, 2)
+			}
+			if _, err := es.LastSnapshot(ctx, "acc-6"); err == nil {
+				t.Fatal("a snapshot was written for an aggregate without one")
+			}
+
+			acc := &Account{}
+			if err := eventstore.NewAggregateStore(r).Get(ctx, "acc-1", acc); err != nil {
+				t.Fatal(err)
+			}
+			if acc.Balance != 3 {
+				t.Fatalf("balance=%d loaded from the regenerated snapshot, want 3", acc.Balance)
+			}
+
+			if n, err := g.Run(ctx); err != nil || n != 0 {
+				t.Fatalf("second run regenerated %d err=%v, want 0", n, err)
+			}
+		})
+	}
+}
+
+// savedMeanwhile writes a snapshot of the current shape right after the regenerator replayed the aggregate,
+// as a concurrent save does
+type savedMeanwhile struct {
+	repos.EventStore
+}
+
+func (s savedMeanwhile) Get(ctx context.Context, aggregateID string, fromVersion, toVersion int,
+	agg eventsourcing.Aggregate) error {
+	if err := s.EventStore.Get(ctx, aggregateID, fromVersion, toVersion, agg); err != nil {
+		return err
+	}
+	return s.EventStore.CreateSnapshot(ctx, agg)
+}
+
+type savedMeanwhileRepos struct {
+	repos.Repos
+}
+
+func (r savedMeanwhileRepos) EventStore() repos.EventStore {
+	return savedMeanwhile{r.Repos.EventStore()}
+}
+
+func TestSnapshotRegeneratorKeepsSnapshotWrittenMeanwhile(t *testing.T) {
+	ctx := context.Background()
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			r := open(t)
+			accounts := eventstore.NewRepository[*Account](eventstore.NewAggregateStore(r))
+			if _, err := accounts.Create(ctx, "acc-1", deposit(1)); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := accounts.Update(ctx, "acc-1", deposit(2)); err != nil {
+				t.Fatal(err)
+			}
+			writeStaleSnapshot(t, r.EventStore(), "acc-1")
+
+			n, err := eventstore.NewSnapshotRegenerator(savedMeanwhileRepos{r}, &Account{}).Run(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != 0 {
+				t.Fatalf("%d snapshots regenerated, want 0 as a save wrote one", n)
+			}
+			checkSnapshots(t, r.EventStore(), "acc-1", 2)
+		})
+	}
+}
@@ -0,0 +1,245 @@
+// Package stream appends and reads streams of events that are not the events of an aggregate, such as audit logs
+// or inboxes, in the same event store as the aggregates:
+//
+//	_ = eventsourcing.Register[LoginFailed](s, "audit.login_failed.v1")
+//	audit := stream.New(r, stream.WithType("AuditLog"))
+//	version, err := audit.AppendToStream(ctx, "audit-user-42", stream.Any, &LoginFailed{IP: ip})
+//	events, err := audit.ReadStream(ctx, "audit-user-42", stream.End, stream.Backward, 20)
+//
+// A stream is stored like an aggregate with its ID, so streams and aggregates share the same IDs, and its events
+// are part of the global stream. Their types are registered with eventsourcing.Register, as no aggregate
+// registers them.
+package stream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+const (
+	defaultType = "Stream"
+	// appendAttempts is how many times an append expecting Any or StreamExists runs when a concurrent append
+	// moves the version in between its read and its write
+	appendAttempts = 3
+)
+
+// The errors of the repos layer are re-exported so callers of Store don't need to import repos
+type ErrConcurrencyConflict = repos.ErrConcurrencyConflict
+
+// ErrStreamNotFound is returned by an append expecting StreamExists to a stream without events
+var ErrStreamNotFound = repos.ErrAggregateNotFound
+
+// ExpectedVersion is the version a stream must be at for an append to succeed: Any, NoStream, StreamExists
+// or an exact version given with Exact
+type ExpectedVersion int
+
+const (
+	// Any appends whatever the version of the stream
+	Any ExpectedVersion = -1
+	// NoStream appends to a stream without events only
+	NoStream ExpectedVersion = 0
+	// StreamExists appends to a stream with events only
+	StreamExists ExpectedVersion = -2
+)
+
+// Exact expects the stream to be at version, the version of its last event
+func Exact(version int) ExpectedVersion {
+	return ExpectedVersion(version)
+}
+
+// check returns the error of appending to the stream at version
+func (e ExpectedVersion) check(streamID string, version int) error {
+	switch {
+	case e == Any:
+		return nil
+	case e == StreamExists:
+		if version == 0 {
+			return fmt.Errorf("%w id=%s", ErrStreamNotFound, streamID)
+		}
+		return nil
+	case int(e) != version:
+		return &ErrConcurrencyConflict{AggregateID: streamID, Expected: int(e), Actual: version}
+	}
+	return nil
+}
+
+// Direction is the order ReadStream reads events in
+type Direction int
+
+const (
+	Forward Direction = iota
+	Backward
+)
+
+// End reads a stream backward from its last event
+const End = -1
+
+// Store appends and reads streams of one type
+type Store struct {
+	es         repos.EventStore
+	serializer eventsourcing.Serializer
+	typ        string
+}
+
+type Option func(*Store)
+
+// WithType sets the type the streams are stored with, the aggregate type their codec and upcasters are registered
+// for. Streams are of type Stream by default.
+func WithType(typ string) Option {
+	return func(s *Store) {
+		s.typ = typ
+	}
+}
+
+func New(r repos.Repos, opts ...Option) *Store {
+	s := &Store{
+		es:         r.EventStore(),
+		serializer: r.Serializer(),
+		typ:        defaultType,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// AppendToStream appends events, pointers to structs, to the stream if its version is the expected one and returns
+// the new version of the stream. The events are appended atomically and get their metadata from ctx like the
+// events of an aggregate, see eventsourcing.StampMetadata. A version other than the expected one fails with
+// ErrConcurrencyConflict, or ErrStreamNotFound for StreamExists.
+func (s *Store) AppendToStream(ctx context.Context, streamID string, expected ExpectedVersion, events ...interface{}) (int, error) {
+	if streamID == "" {
+		return 0, eventsourcing.ErrIDEmpty
+	}
+
+	retry := expected == Any || expected == StreamExists
+	var version int
+	var err error
+	for attempt := 1; ; attempt++ {
+		version, err = s.append(ctx, streamID, expected, events)
+		if err == nil || !retry || attempt == appendAttempts || !repos.IsConcurrencyConflict(err) {
+			break
+		}
+	}
+	if err != nil {
+		return 0, fmt.Errorf("append to stream id=%s err=%w", streamID, err)
+	}
+
+	return version, nil
+}
+
+func (s *Store) append(ctx context.Context, streamID string, expected ExpectedVersion, data []interface{}) (int, error) {
+	var version int
+	err := s.es.WithTransaction(ctx, func(tx repos.EventStore) error {
+		current, err := tx.AggregateVersion(ctx, streamID)
+		if err != nil && !errors.Is(err, repos.ErrAggregateNotFound) {
+			return err
+		}
+		if err := expected.check(streamID, current); err != nil {
+			return err
+		}
+		version = current
+		if len(data) == 0 {
+			return nil
+		}
+		if err := tx.CreateIfNotExist(ctx, streamID, s.typ); err != nil {
+			return err
+		}
+
+		// the events are built by a root at the current version, as ApplyChange builds the events of an aggregate
+		agg := &streamAggregate{}
+		agg.SetInternal(streamID, current, current)
+		for _, d := range data {
+			if err := agg.ApplyChange(agg, d); err != nil {
+				return err
+			}
+		}
+		events := agg.CloneEvents()
+		eventsourcing.StampMetadata(ctx, events)
+
+		if err := tx.CheckAndUpdateVersion(ctx, agg); err != nil {
+			return err
+		}
+		for _, e := range events {
+			e.AggregateType = s.typ
+			e.EventType = s.serializer.EventTypeName(e.Data)
+			if err := tx.Append(ctx, e); err != nil {
+				return err
+			}
+		}
+
+		version = agg.Version()
+		return nil
+	})
+	return version, err
+}
+
+// ReadStream returns up to limit events of the stream from the version from, from included, in direction.
+// Forward reads start at the first event for from 0 and Backward reads at the last one for End, a limit of 0 reads
+// to the end of the stream in direction. A stream without events has no event to read.
+func (s *Store) ReadStream(ctx context.Context, streamID string, from int, direction Direction, limit int) ([]eventsourcing.Event, error) {
+	if direction == Backward {
+		return s.readBackward(ctx, streamID, from, limit)
+	}
+
+	var result []eventsourcing.Event
+	for e, err := range s.es.Events(ctx, streamID, max(from, 1)-1) {
+		if err != nil {
+			return nil, fmt.Errorf("read stream id=%s err=%w", streamID, err)
+		}
+		result = append(result, e)
+		if len(result) == limit {
+			break
+		}
+	}
+	return result, nil
+}
+
+func (s *Store) readBackward(ctx context.Context, streamID string, from, limit int) ([]eventsourcing.Event, error) {
+	head, err := s.es.AggregateVersion(ctx, streamID)
+	if errors.Is(err, repos.ErrAggregateNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read stream id=%s err=%w", streamID, err)
+	}
+	if from == End || from > head {
+		from = head
+	}
+	after := 0
+	if limit > 0 {
+		after = max(from-limit, 0)
+	}
+
+	var result []eventsourcing.Event
+	for e, err := range s.es.Events(ctx, streamID, after) {
+		if err != nil {
+			return nil, fmt.Errorf("read stream id=%s err=%w", streamID, err)
+		}
+		if e.Version > from {
+			break
+		}
+		result = append(result, e)
+	}
+	slices.Reverse(result)
+	return result, nil
+}
+
+// streamAggregate builds the events appended to a stream and carries its versions to CheckAndUpdateVersion
+type streamAggregate struct {
+	eventsourcing.AggregateRoot
+}
+
+func (a *streamAggregate) RegisterEvents(eventsourcing.RegisterEventsFunc) error {
+	return nil
+}
+
+func (a *streamAggregate) Transition(eventsourcing.Event) error {
+	return nil
+}
@@ -0,0 +1,309 @@
+package stream_test
+
+import (
+	"context"
+	"errors"
+	"iter"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/eventstore/stream"
+	"event_sourcing_golang/pkg/eventsourcing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+type Noted struct{ Text string }
+
+type openFunc func(t *testing.T, s eventsourcing.Serializer, opts ...repos.Option) repos.Repos
+
+var stores = map[string]openFunc{
+	"InMemory": func(t *testing.T, s eventsourcing.Serializer, opts ...repos.Option) repos.Repos {
+		return repos.NewInMemory(s, opts...)
+	},
+	"SQLite": func(t *testing.T, s eventsourcing.Serializer, opts ...repos.Option) repos.Repos {
+		db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "es.db")), &gorm.Config{Logger: logger.Discard})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repos.Migrate(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+		return repos.New(db, s, opts...)
+	},
+}
+
+func newRepos(t *testing.T, open openFunc, opts ...repos.Option) repos.Repos {
+	t.Helper()
+	s := eventsourcing.NewSerializer()
+	if err := eventsourcing.Register[Noted](s, "audit.noted.v1"); err != nil {
+		t.Fatal(err)
+	}
+	return open(t, s, opts...)
+}
+
+// notes returns n notes, numbered from 1
+func notes(n int) []interface{} {
+	result := make([]interface{}, n)
+	for i := range result {
+		result[i] = &Noted{Text: string(rune('a' + i))}
+	}
+	return result
+}
+
+// versions returns the versions of events, checking they are notes
+func versions(t *testing.T, events []eventsourcing.Event) []int {
+	t.Helper()
+	result := make([]int, 0, len(events))
+	for _, e := range events {
+		if _, ok := e.Data.(*Noted); !ok || e.EventType != "audit.noted.v1" {
+			t.Fatalf("read event type=%s data=%+v, want a note stored as audit.noted.v1", e.EventType, e.Data)
+		}
+		result = append(result, e.Version)
+	}
+	return result
+}
+
+func TestExpectedVersion(t *testing.T) {
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := stream.New(newRepos(t, open))
+
+			if _, err := s.AppendToStream(ctx, "log-1", stream.StreamExists, notes(1)...); !errors.Is(err, stream.ErrStreamNotFound) {
+				t.Fatalf("StreamExists on a new stream err=%v, want %v", err, stream.ErrStreamNotFound)
+			}
+			if version, err := s.AppendToStream(ctx, "log-1", stream.NoStream, notes(2)...); err != nil || version != 2 {
+				t.Fatalf("NoStream on a new stream version=%d err=%v, want 2", version, err)
+			}
+			var conflict *stream.ErrConcurrencyConflict
+			if _, err := s.AppendToStream(ctx, "log-1", stream.NoStream, notes(1)...); !errors.As(err, &conflict) {
+				t.Fatalf("NoStream on an existing stream err=%v, want a concurrency conflict", err)
+			}
+			if version, err := s.AppendToStream(ctx, "log-1", stream.StreamExists, notes(1)...); err != nil || version != 3 {
+				t.Fatalf("StreamExists version=%d err=%v, want 3", version, err)
+			}
+
+			if _, err := s.AppendToStream(ctx, "log-1", stream.Exact(2), notes(1)...); !errors.As(err, &conflict) {
+				t.Fatalf("Exact(2) at version 3 err=%v, want a concurrency conflict", err)
+			}
+			if conflict.Expected != 2 || conflict.Actual != 3 {
+				t.Fatalf("conflict expected=%d actual=%d, want 2 and 3", conflict.Expected, conflict.Actual)
+			}
+			if version, err := s.AppendToStream(ctx, "log-1", stream.Exact(3), notes(1)...); err != nil || version != 4 {
+				t.Fatalf("Exact(3) version=%d err=%v, want 4", version, err)
+			}
+			if version, err := s.AppendToStream(ctx, "log-1", stream.Any, notes(2)...); err != nil || version != 6 {
+				t.Fatalf("Any version=%d err=%v, want 6", version, err)
+			}
+			if version, err := s.AppendToStream(ctx, "log-2", stream.Any, notes(1)...); err != nil || version != 1 {
+				t.Fatalf("Any on a new stream version=%d err=%v, want 1", version, err)
+			}
+
+			// the failed appends left nothing behind
+			events, err := s.ReadStream(ctx, "log-1", 0, stream.Forward, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := versions(t, events); !slices.Equal(got, []int{1, 2, 3, 4, 5, 6}) {
+				t.Fatalf("read versions %v, want 1 to 6", got)
+			}
+		})
+	}
+}
+
+// racingRepos fails the first conflicts version checks of its transactions, as when another writer appends to
+// the stream between the read of its version and the append
+type racingRepos struct {
+	repos.Repos
+	conflicts int
+	checks    int
+}
+
+func (r *racingRepos) EventStore() repos.EventStore {
+	return &racingStore{EventStore: r.Repos.EventStore(), r: r}
+}
+
+type racingStore struct {
+	repos.EventStore
+	r *racingRepos
+}
+
+func (s *racingStore) WithTransaction(ctx context.Context, fn func(repos.EventStore) error) error {
+	return s.EventStore.WithTransaction(ctx, func(tx repos.EventStore) error {
+		return fn(&racingStore{EventStore: tx, r: s.r})
+	})
+}
+
+func (s *racingStore) CheckAndUpdateVersion(ctx context.Context, agg eventsourcing.Aggregate) error {
+	s.r.checks++
+	if s.r.checks <= s.r.conflicts {
+		root := agg.Root()
+		return &repos.ErrConcurrencyConflict{
+			AggregateID: root.AggregateID(), Expected: root.BaseVersion(), Actual: root.BaseVersion() + 1,
+		}
+	}
+	return s.EventStore.CheckAndUpdateVersion(ctx, agg)
+}
+
+func TestAppendRetriedOnConflict(t *testing.T) {
+	cases := []struct {
+		name      string
+		expected  stream.ExpectedVersion
+		conflicts int
+		checks    int
+		ok        bool
+	}{
+		{"Any retries", stream.Any, 2, 3, true},
+		{"StreamExists retries", stream.StreamExists, 1, 2, true},
+		{"Any gives up", stream.Any, 3, 3, false},
+		{"Exact does not retry", stream.Exact(1), 1, 1, false},
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			for _, c := range cases {
+				t.Run(c.name, func(t *testing.T) {
+					ctx := context.Background()
+					r := &racingRepos{Repos: newRepos(t, open)}
+					if _, err := stream.New(r.Repos).AppendToStream(ctx, "log-1", stream.NoStream, notes(1)...); err != nil {
+						t.Fatal(err)
+					}
+
+					r.conflicts = c.conflicts
+					version, err := stream.New(r).AppendToStream(ctx, "log-1", c.expected, notes(1)...)
+					if c.ok && (err != nil || version != 2) {
+						t.Fatalf("version=%d err=%v, want 2", version, err)
+					}
+					if !c.ok && !repos.IsConcurrencyConflict(err) {
+						t.Fatalf("err=%v, want a concurrency conflict", err)
+					}
+					if r.checks != c.checks {
+						t.Fatalf("%d attempts, want %d", r.checks, c.checks)
+					}
+				})
+			}
+		})
+	}
+}
+
+func TestReadStream(t *testing.T) {
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			s := stream.New(newRepos(t, open))
+			if _, err := s.AppendToStream(ctx, "log-1", stream.NoStream, notes(5)...); err != nil {
+				t.Fatal(err)
+			}
+
+			cases := []struct {
+				name      string
+				from      int
+				direction stream.Direction
+				limit     int
+				want      []int
+			}{
+				{"forward from the start", 0, stream.Forward, 0, []int{1, 2, 3, 4, 5}},
+				{"forward with a limit", 2, stream.Forward, 2, []int{2, 3}},
+				{"forward after the end", 6, stream.Forward, 0, []int{}},
+				{"backward from the end", stream.End, stream.Backward, 0, []int{5, 4, 3, 2, 1}},
+				{"backward from the end with a limit", stream.End, stream.Backward, 2, []int{5, 4}},
+				{"backward from a version", 3, stream.Backward, 0, []int{3, 2, 1}},
+				{"backward with a limit past the start", 2, stream.Backward, 5, []int{2, 1}},
+				{"backward from after the end", 10, stream.Backward, 2, []int{5, 4}},
+			}
+			for _, c := range cases {
+				events, err := s.ReadStream(ctx, "log-1", c.from, c.direction, c.limit)
+				if err != nil {
+					t.Fatalf("%s err=%v", c.name, err)
+				}
+				if got := versions(t, events); !slices.Equal(got, c.want) {
+					t.Fatalf("%s read versions %v, want %v", c.name, got, c.want)
+				}
+			}
+
+			for _, direction := range []stream.Direction{stream.Forward, stream.Backward} {
+				if events, err := s.ReadStream(ctx, "log-2", stream.End, direction, 0); err != nil || len(events) != 0 {
+					t.Fatalf("read a stream without events=%v err=%v, want none", events, err)
+				}
+			}
+		})
+	}
+}
+
+// memArchive keeps the events the test archives
+type memArchive struct {
+	events []repos.StoredEvent
+}
+
+func (a *memArchive) ArchivedEvents(ctx context.Context, aggregateID string, fromVersion, toVersion int) iter.Seq2[repos.StoredEvent, error] {
+	return func(yield func(repos.StoredEvent, error) bool) {
+		for _, se := range a.events {
+			if se.AggregateID == aggregateID && se.Version > fromVersion && (toVersion == 0 || se.Version <= toVersion) {
+				if !yield(se, nil) {
+					return
+				}
+			}
+		}
+	}
+}
+
+func (a *memArchive) ArchivedVersionAt(ctx context.Context, aggregateID string, at time.Time) (int, error) {
+	version := 0
+	for _, se := range a.events {
+		if se.AggregateID == aggregateID && se.CreatedAt <= at.Unix() {
+			version = max(version, se.Version)
+		}
+	}
+	return version, nil
+}
+
+func TestReadArchivedEvents(t *testing.T) {
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			archive := &memArchive{}
+			r := newRepos(t, open, repos.WithArchive(archive))
+			s := stream.New(r)
+			if _, err := s.AppendToStream(ctx, "log-1", stream.NoStream, notes(5)...); err != nil {
+				t.Fatal(err)
+			}
+
+			stored, err := r.EventStore().StoredEvents(ctx, "log-1", 0, 3)
+			if err != nil {
+				t.Fatal(err)
+			}
+			archive.events = stored
+			if _, err := r.EventStore().DeleteEvents(ctx, "log-1", 3); err != nil {
+				t.Fatal(err)
+			}
+
+			cases := []struct {
+				name      string
+				from      int
+				direction stream.Direction
+				limit     int
+				want      []int
+			}{
+				{"forward", 0, stream.Forward, 0, []int{1, 2, 3, 4, 5}},
+				{"forward from an archived version", 2, stream.Forward, 2, []int{2, 3}},
+				{"backward from the end", stream.End, stream.Backward, 0, []int{5, 4, 3, 2, 1}},
+				{"backward across the archive", stream.End, stream.Backward, 3, []int{5, 4, 3}},
+				{"backward from an archived version", 2, stream.Backward, 0, []int{2, 1}},
+			}
+			for _, c := range cases {
+				events, err := s.ReadStream(ctx, "log-1", c.from, c.direction, c.limit)
+				if err != nil {
+					t.Fatalf("%s err=%v", c.name, err)
+				}
+				if got := versions(t, events); !slices.Equal(got, c.want) {
+					t.Fatalf("%s read versions %v, want %v", c.name, got, c.want)
+				}
+			}
+		})
+	}
+}
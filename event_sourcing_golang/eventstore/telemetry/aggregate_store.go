@@ -0,0 +1,89 @@
+package telemetry
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+)
+
+type aggregateStore struct {
+	eventstore.AggregateStore
+	inst *instruments
+}
+
+// WrapAggregateStore returns as emitting a span and a duration metric for every load and save
+func WrapAggregateStore(as eventstore.AggregateStore, opts ...Option) eventstore.AggregateStore {
+	return &aggregateStore{AggregateStore: as, inst: newInstruments(opts)}
+}
+
+func (s *aggregateStore) Get(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) error {
+	return s.load(ctx, "AggregateStore.Get", aggregateID, agg, func(ctx context.Context) error {
+		return s.AggregateStore.Get(ctx, aggregateID, agg)
+	})
+}
+
+func (s *aggregateStore) GetAtVersion(ctx context.Context, aggregateID string, version int, agg eventsourcing.Aggregate) error {
+	return s.load(ctx, "AggregateStore.GetAtVersion", aggregateID, agg, func(ctx context.Context) error {
+		return s.AggregateStore.GetAtVersion(ctx, aggregateID, version, agg)
+	})
+}
+
+func (s *aggregateStore) GetAsOf(ctx context.Context, aggregateID string, at time.Time, agg eventsourcing.Aggregate) error {
+	return s.load(ctx, "AggregateStore.GetAsOf", aggregateID, agg, func(ctx context.Context) error {
+		return s.AggregateStore.GetAsOf(ctx, aggregateID, at, agg)
+	})
+}
+
+func (s *aggregateStore) load(ctx context.Context, name, aggregateID string, agg eventsourcing.Aggregate,
+	fn func(context.Context) error) error {
+	aggType := aggregateType(agg)
+	ctx, span := s.inst.start(ctx, name, aggType, aggregateID)
+	start := time.Now()
+
+	err := fn(ctx)
+
+	s.inst.loadDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(AggregateTypeKey.String(aggType)))
+	span.SetAttributes(attribute.Int("eventstore.aggregate.version", agg.Root().Version()))
+	return finish(span, err)
+}
+
+func (s *aggregateStore) Save(ctx context.Context, agg eventsourcing.Aggregate) error {
+	return s.save(ctx, "AggregateStore.Save", []eventsourcing.Aggregate{agg}, func(ctx context.Context) error {
+		return s.AggregateStore.Save(ctx, agg)
+	})
+}
+
+func (s *aggregateStore) SaveAll(ctx context.Context, aggs ...eventsourcing.Aggregate) error {
+	return s.save(ctx, "AggregateStore.SaveAll", aggs, func(ctx context.Context) error {
+		return s.AggregateStore.SaveAll(ctx, aggs...)
+	})
+}
+
+// save measures fn, its aggregate type attribute lists the types of aggs when they are several
+func (s *aggregateStore) save(ctx context.Context, name string, aggs []eventsourcing.Aggregate,
+	fn func(context.Context) error) error {
+	var types, ids []string
+	for _, agg := range aggs {
+		types = append(types, aggregateType(agg))
+		ids = append(ids, agg.Root().AggregateID())
+	}
+	slices.Sort(types)
+	aggType := strings.Join(slices.Compact(types), ",")
+
+	ctx, span := s.inst.start(ctx, name, aggType, strings.Join(ids, ","))
+	start := time.Now()
+
+	err := fn(ctx)
+
+	s.inst.saveDuration.Record(ctx, time.Since(start).Seconds(), metric.WithAttributes(AggregateTypeKey.String(aggType)))
+	span.SetAttributes(attribute.Bool("eventstore.concurrency_conflict", repos.IsConcurrencyConflict(err)))
+	return finish(span, err)
+}
@@ -0,0 +1,138 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+type eventStore struct {
+	repos.EventStore
+	inst *instruments
+	// appended counts the events appended in the current transaction, nil outside of one
+	appended map[eventKey]int64
+}
+
+type eventKey struct {
+	aggType   string
+	eventType string
+}
+
+// WrapEventStore returns es emitting spans for its reads and transactions, and metrics of the events appended
+// and replayed, the snapshot reads and the concurrency conflicts
+func WrapEventStore(es repos.EventStore, opts ...Option) repos.EventStore {
+	return &eventStore{EventStore: es, inst: newInstruments(opts)}
+}
+
+type wrappedRepos struct {
+	repos.Repos
+	es repos.EventStore
+}
+
+// WrapRepos returns r with its event store decorated by WrapEventStore
+func WrapRepos(r repos.Repos, opts ...Option) repos.Repos {
+	return &wrappedRepos{Repos: r, es: WrapEventStore(r.EventStore(), opts...)}
+}
+
+func (r *wrappedRepos) EventStore() repos.EventStore {
+	return r.es
+}
+
+// WithTransaction counts the events appended by fn once they are committed
+func (s *eventStore) WithTransaction(ctx context.Context, fn func(repos.EventStore) error) error {
+	if s.appended != nil {
+		return s.EventStore.WithTransaction(ctx, func(txn repos.EventStore) error {
+			return fn(&eventStore{EventStore: txn, inst: s.inst, appended: s.appended})
+		})
+	}
+
+	ctx, span := s.inst.tracer.Start(ctx, "EventStore.WithTransaction")
+	appended := make(map[eventKey]int64)
+	err := s.EventStore.WithTransaction(ctx, func(txn repos.EventStore) error {
+		return fn(&eventStore{EventStore: txn, inst: s.inst, appended: appended})
+	})
+	if err == nil {
+		for k, n := range appended {
+			s.inst.appended.Add(ctx, n, metric.WithAttributes(AggregateTypeKey.String(k.aggType), EventTypeKey.String(k.eventType)))
+		}
+	}
+	return finish(span, err)
+}
+
+func (s *eventStore) Append(ctx context.Context, e eventsourcing.Event) error {
+	if err := s.EventStore.Append(ctx, e); err != nil {
+		return err
+	}
+
+	key := eventKey{aggType: e.AggregateType, eventType: e.EventType}
+	if s.appended != nil {
+		s.appended[key]++
+		return nil
+	}
+	s.inst.appended.Add(ctx, 1, metric.WithAttributes(AggregateTypeKey.String(key.aggType), EventTypeKey.String(key.eventType)))
+	return nil
+}
+
+func (s *eventStore) CheckAndUpdateVersion(ctx context.Context, agg eventsourcing.Aggregate) error {
+	err := s.EventStore.CheckAndUpdateVersion(ctx, agg)
+	if repos.IsConcurrencyConflict(err) {
+		s.inst.conflicts.Add(ctx, 1, metric.WithAttributes(AggregateTypeKey.String(aggregateType(agg))))
+	}
+	return err
+}
+
+// Get records the number of events replayed into agg
+func (s *eventStore) Get(ctx context.Context, aggregateID string, fromVersion, toVersion int, agg eventsourcing.Aggregate) error {
+	aggType := aggregateType(agg)
+	ctx, span := s.inst.start(ctx, "EventStore.Get", aggType, aggregateID)
+
+	before := agg.Root().Version()
+	err := s.EventStore.Get(ctx, aggregateID, fromVersion, toVersion, agg)
+	replayed := agg.Root().Version() - before
+
+	span.SetAttributes(attribute.Int("eventstore.events.replayed", replayed))
+	s.inst.replayed.Record(ctx, int64(replayed), metric.WithAttributes(AggregateTypeKey.String(aggType)))
+	return finish(span, err)
+}
+
+func (s *eventStore) ReadSnapshot(ctx context.Context, aggregateID string, version int, agg eventsourcing.Aggregate) error {
+	ctx, span := s.inst.start(ctx, "EventStore.ReadSnapshot", aggregateType(agg), aggregateID)
+	err := s.EventStore.ReadSnapshot(ctx, aggregateID, version, agg)
+	s.snapshotRead(ctx, span, agg, err)
+	return err
+}
+
+func (s *eventStore) ReadSnapshotAt(ctx context.Context, aggregateID string, maxVersion int, agg eventsourcing.Aggregate) error {
+	ctx, span := s.inst.start(ctx, "EventStore.ReadSnapshotAt", aggregateType(agg), aggregateID)
+	err := s.EventStore.ReadSnapshotAt(ctx, aggregateID, maxVersion, agg)
+	s.snapshotRead(ctx, span, agg, err)
+	return err
+}
+
+// snapshotRead counts a snapshot hit or miss and ends span, a miss is not an error of the span
+func (s *eventStore) snapshotRead(ctx context.Context, span trace.Span, agg eventsourcing.Aggregate, err error) {
+	miss := errors.Is(err, repos.ErrSnapshotNotFound)
+	if err == nil || miss {
+		s.inst.snapshots.Add(ctx, 1, metric.WithAttributes(AggregateTypeKey.String(aggregateType(agg)), SnapshotHitKey.Bool(!miss)))
+		err = nil
+	}
+	_ = finish(span, err)
+}
+
+func (s *eventStore) CreateSnapshot(ctx context.Context, agg eventsourcing.Aggregate) error {
+	ctx, span := s.inst.start(ctx, "EventStore.CreateSnapshot", aggregateType(agg), agg.Root().AggregateID())
+	return finish(span, s.EventStore.CreateSnapshot(ctx, agg))
+}
+
+func (s *eventStore) ReadAll(ctx context.Context, fromPosition int64, limit int) ([]eventsourcing.Event, error) {
+	ctx, span := s.inst.tracer.Start(ctx, "EventStore.ReadAll")
+	events, err := s.EventStore.ReadAll(ctx, fromPosition, limit)
+	span.SetAttributes(attribute.Int64("eventstore.position", fromPosition), attribute.Int("eventstore.events.read", len(events)))
+	return events, finish(span, err)
+}
@@ -0,0 +1,129 @@
+// Package telemetry decorates event stores and aggregate stores with OpenTelemetry spans and metrics.
+//
+// The aggregate store decorator measures loads and saves, the event store decorator counts what happens
+// underneath them: events appended and replayed, snapshot hits and concurrency conflicts. Both are used together
+// by building the aggregate store on decorated repos:
+//
+//	as := telemetry.WrapAggregateStore(eventstore.NewAggregateStore(telemetry.WrapRepos(r)))
+//
+// Spans and metrics go to the global providers unless WithTracerProvider and WithMeterProvider are given.
+package telemetry
+
+import (
+	"context"
+	"reflect"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/metric"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "event_sourcing_golang/eventstore/telemetry"
+
+// Attributes of the spans and metrics, the aggregate ID is only set on spans
+const (
+	AggregateTypeKey = attribute.Key("eventstore.aggregate.type")
+	AggregateIDKey   = attribute.Key("eventstore.aggregate.id")
+	EventTypeKey     = attribute.Key("eventstore.event.type")
+	SnapshotHitKey   = attribute.Key("eventstore.snapshot.hit")
+)
+
+type config struct {
+	tracerProvider trace.TracerProvider
+	meterProvider  metric.MeterProvider
+}
+
+type Option func(*config)
+
+func WithTracerProvider(tp trace.TracerProvider) Option {
+	return func(c *config) {
+		c.tracerProvider = tp
+	}
+}
+
+func WithMeterProvider(mp metric.MeterProvider) Option {
+	return func(c *config) {
+		c.meterProvider = mp
+	}
+}
+
+// instruments are the tracer and the metric instruments shared by the decorators
+type instruments struct {
+	tracer trace.Tracer
+
+	appended     metric.Int64Counter
+	replayed     metric.Int64Histogram
+	snapshots    metric.Int64Counter
+	conflicts    metric.Int64Counter
+	loadDuration metric.Float64Histogram
+	saveDuration metric.Float64Histogram
+}
+
+func newInstruments(opts []Option) *instruments {
+	cfg := &config{
+		tracerProvider: otel.GetTracerProvider(),
+		meterProvider:  otel.GetMeterProvider(),
+	}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	meter := cfg.meterProvider.Meter(instrumentationName)
+	inst := &instruments{tracer: cfg.tracerProvider.Tracer(instrumentationName)}
+
+	// a failed instrument is reported to the otel error handler and left a no-op
+	var err error
+	inst.appended, err = meter.Int64Counter("eventstore.events.appended",
+		metric.WithDescription("Events appended by committed writes"), metric.WithUnit("{event}"))
+	handle(err)
+	inst.replayed, err = meter.Int64Histogram("eventstore.events.replayed",
+		metric.WithDescription("Events replayed to load an aggregate"), metric.WithUnit("{event}"))
+	handle(err)
+	inst.snapshots, err = meter.Int64Counter("eventstore.snapshot.reads",
+		metric.WithDescription("Snapshot reads, eventstore.snapshot.hit tells if a snapshot was found"),
+		metric.WithUnit("{read}"))
+	handle(err)
+	inst.conflicts, err = meter.Int64Counter("eventstore.concurrency_conflicts",
+		metric.WithDescription("Writes rejected as the aggregate changed since it was loaded"), metric.WithUnit("{conflict}"))
+	handle(err)
+	inst.loadDuration, err = meter.Float64Histogram("eventstore.aggregate.load.duration",
+		metric.WithDescription("Time to hydrate an aggregate"), metric.WithUnit("s"))
+	handle(err)
+	inst.saveDuration, err = meter.Float64Histogram("eventstore.aggregate.save.duration",
+		metric.WithDescription("Time to save aggregates"), metric.WithUnit("s"))
+	handle(err)
+
+	return inst
+}
+
+func handle(err error) {
+	if err != nil {
+		otel.Handle(err)
+	}
+}
+
+// finish records err on span and ends it
+func finish(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+	return err
+}
+
+// aggregateType returns the type of agg, it is the name of its Go type until the aggregate store sets it
+func aggregateType(agg eventsourcing.Aggregate) string {
+	if typ := agg.Root().AggregateType(); typ != "" {
+		return typ
+	}
+	return reflect.TypeOf(agg).Elem().Name()
+}
+
+func (inst *instruments) start(ctx context.Context, name, aggType, aggregateID string) (context.Context, trace.Span) {
+	return inst.tracer.Start(ctx, name, trace.WithAttributes(AggregateTypeKey.String(aggType), AggregateIDKey.String(aggregateID)))
+}
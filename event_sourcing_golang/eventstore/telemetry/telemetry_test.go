@@ -0,0 +1,220 @@
+package telemetry_test
+
+import (
+	"context"
+	"testing"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/eventstore/telemetry"
+	"event_sourcing_golang/pkg/eventsourcing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+type Opened struct{}
+type Deposited struct{ Amount int }
+
+type Account struct {
+	eventsourcing.AggregateRoot
+	Balance int
+}
+
+func (a *Account) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&Opened{}, &Deposited{})
+}
+
+func (a *Account) Transition(e eventsourcing.Event) error {
+	if v, ok := e.Data.(*Deposited); ok {
+		a.Balance += v.Amount
+	}
+	return nil
+}
+
+type fixture struct {
+	reader *sdkmetric.ManualReader
+	spans  *tracetest.SpanRecorder
+	store  eventstore.AggregateStore
+}
+
+func newFixture(t *testing.T, opts ...eventstore.Option) *fixture {
+	t.Helper()
+	s := eventsourcing.NewSerializer()
+	if err := s.RegisterAggregate(&Account{}); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &fixture{reader: sdkmetric.NewManualReader(), spans: tracetest.NewSpanRecorder()}
+	telemetryOpts := []telemetry.Option{
+		telemetry.WithMeterProvider(sdkmetric.NewMeterProvider(sdkmetric.WithReader(f.reader))),
+		telemetry.WithTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(f.spans))),
+	}
+	r := telemetry.WrapRepos(repos.NewInMemory(s), telemetryOpts...)
+	f.store = telemetry.WrapAggregateStore(eventstore.NewAggregateStore(r, opts...), telemetryOpts...)
+	return f
+}
+
+// sum returns the sum of the counter name over the data points having every attribute of attrs
+func (f *fixture) sum(t *testing.T, name string, attrs ...attribute.KeyValue) int64 {
+	t.Helper()
+	var rm metricdata.ResourceMetrics
+	if err := f.reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+
+	var total int64
+	for _, sm := range rm.ScopeMetrics {
+		for _, m := range sm.Metrics {
+			if m.Name != name {
+				continue
+			}
+			for _, dp := range m.Data.(metricdata.Sum[int64]).DataPoints {
+				if hasAll(dp.Attributes, attrs) {
+					total += dp.Value
+				}
+			}
+		}
+	}
+	return total
+}
+
+func hasAll(set attribute.Set, attrs []attribute.KeyValue) bool {
+	for _, kv := range attrs {
+		if v, ok := set.Value(kv.Key); !ok || v != kv.Value {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *fixture) open(t *testing.T, id string, amounts ...int) *Account {
+	t.Helper()
+	a := &Account{}
+	if err := a.SetID(id); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.ApplyChange(a, &Opened{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, amount := range amounts {
+		if err := a.ApplyChange(a, &Deposited{Amount: amount}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.store.Save(context.Background(), a); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func (f *fixture) get(t *testing.T, id string) *Account {
+	t.Helper()
+	a := &Account{}
+	if err := f.store.Get(context.Background(), id, a); err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+var accountType = telemetry.AggregateTypeKey.String("Account")
+
+func TestAppendedCountedPerEventType(t *testing.T) {
+	f := newFixture(t)
+	f.open(t, "acc-1", 1, 2)
+	f.open(t, "acc-2", 3)
+
+	if got := f.sum(t, "eventstore.events.appended", accountType, telemetry.EventTypeKey.String("Opened")); got != 2 {
+		t.Fatalf("%d Opened appended, want 2", got)
+	}
+	if got := f.sum(t, "eventstore.events.appended", accountType, telemetry.EventTypeKey.String("Deposited")); got != 3 {
+		t.Fatalf("%d Deposited appended, want 3", got)
+	}
+}
+
+func TestOnlyCommittedEventsCounted(t *testing.T) {
+	ctx := context.Background()
+	f := newFixture(t)
+	f.open(t, "acc-1")
+	f.open(t, "acc-2")
+
+	// acc-2 is saved by another writer after it was loaded, saving both appends acc-1 then rolls back
+	acc1, stale := f.get(t, "acc-1"), f.get(t, "acc-2")
+	other := f.get(t, "acc-2")
+	_ = other.ApplyChange(other, &Deposited{Amount: 1})
+	if err := f.store.Save(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	_ = acc1.ApplyChange(acc1, &Deposited{Amount: 5})
+	_ = stale.ApplyChange(stale, &Deposited{Amount: 5})
+	if err := f.store.SaveAll(ctx, acc1, stale); !repos.IsConcurrencyConflict(err) {
+		t.Fatalf("err=%v, want a concurrency conflict", err)
+	}
+
+	if got := f.sum(t, "eventstore.events.appended", telemetry.EventTypeKey.String("Deposited")); got != 1 {
+		t.Fatalf("%d Deposited counted, want only the committed one", got)
+	}
+	if got := f.sum(t, "eventstore.concurrency_conflicts", accountType); got != 1 {
+		t.Fatalf("%d conflicts counted, want 1", got)
+	}
+
+	var save sdktrace.ReadOnlySpan
+	for _, span := range f.spans.Ended() {
+		if span.Name() == "AggregateStore.SaveAll" {
+			save = span
+		}
+	}
+	if save == nil {
+		t.Fatal("no AggregateStore.SaveAll span")
+	}
+	if save.Status().Code != codes.Error {
+		t.Fatalf("SaveAll span status=%v, want an error", save.Status())
+	}
+	conflict := false
+	for _, kv := range save.Attributes() {
+		if kv.Key == "eventstore.concurrency_conflict" {
+			conflict = kv.Value.AsBool()
+		}
+	}
+	if !conflict {
+		t.Fatal("SaveAll span is not marked as a concurrency conflict")
+	}
+}
+
+func TestSnapshotHitsAndMisses(t *testing.T) {
+	f := newFixture(t, eventstore.WithSnapshotPolicy(&Account{}, eventstore.EveryNEvents(3)))
+	f.open(t, "acc-1", 1)
+	f.get(t, "acc-1")
+
+	hit, miss := telemetry.SnapshotHitKey.Bool(true), telemetry.SnapshotHitKey.Bool(false)
+	if got := f.sum(t, "eventstore.snapshot.reads", accountType, miss); got != 1 {
+		t.Fatalf("%d snapshot misses, want 1", got)
+	}
+
+	// the third event takes a snapshot
+	acc := f.get(t, "acc-1")
+	_ = acc.ApplyChange(acc, &Deposited{Amount: 2})
+	if err := f.store.Save(context.Background(), acc); err != nil {
+		t.Fatal(err)
+	}
+	if got := f.get(t, "acc-1"); got.Balance != 3 {
+		t.Fatalf("balance=%d, want 3", got.Balance)
+	}
+	if got := f.sum(t, "eventstore.snapshot.reads", accountType, hit); got != 1 {
+		t.Fatalf("%d snapshot hits, want 1", got)
+	}
+	if got := f.sum(t, "eventstore.snapshot.reads", accountType, miss); got != 2 {
+		t.Fatalf("%d snapshot misses, want 2", got)
+	}
+
+	// a miss is not an error of its span
+	for _, span := range f.spans.Ended() {
+		if span.Name() == "EventStore.ReadSnapshot" && span.Status().Code == codes.Error {
+			t.Fatalf("snapshot read span status=%v", span.Status())
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package eventstore
+
+import (
+	"context"
+	"fmt"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// UnitOfWork tracks the aggregates changed by one business operation, such as a transfer debiting an account
+// and crediting another, and saves all of them in one transaction on Commit.
+// A UnitOfWork is used by a single goroutine and discarded after Commit.
+type UnitOfWork struct {
+	store AggregateStore
+	// aggregates keeps the tracked aggregates in tracking order, indexed by ID
+	aggregates []eventsourcing.Aggregate
+	index      map[string]eventsourcing.Aggregate
+}
+
+func NewUnitOfWork(store AggregateStore) *UnitOfWork {
+	return &UnitOfWork{
+		store: store,
+		index: make(map[string]eventsourcing.Aggregate),
+	}
+}
+
+// Get loads the aggregate into agg and tracks it, ErrAggregateNotFound if it has no event
+func (u *UnitOfWork) Get(ctx context.Context, aggregateID string, agg eventsourcing.Aggregate) error {
+	if _, ok := u.index[aggregateID]; ok {
+		return fmt.Errorf("aggregate id=%s is already tracked by the unit of work", aggregateID)
+	}
+	if err := u.store.Get(ctx, aggregateID, agg); err != nil {
+		return err
+	}
+
+	return u.Track(agg)
+}
+
+// Track adds aggregates to save on Commit, typically new ones, aggregates loaded with Get are already tracked
+func (u *UnitOfWork) Track(aggs ...eventsourcing.Aggregate) error {
+	for _, agg := range aggs {
+		id := agg.Root().AggregateID()
+		if id == "" {
+			return eventsourcing.ErrIDEmpty
+		}
+		if tracked, ok := u.index[id]; ok {
+			if tracked != agg {
+				return fmt.Errorf("another instance of aggregate id=%s is already tracked by the unit of work", id)
+			}
+			continue
+		}
+
+		u.index[id] = agg
+		u.aggregates = append(u.aggregates, agg)
+	}
+
+	return nil
+}
+
+// Commit saves the tracked aggregates atomically, on ErrConcurrencyConflict none of them is saved
+// and the operation must be retried with a new UnitOfWork. The version of unchanged aggregates is checked too,
+// so a decision based on their state fails if they changed meanwhile.
+func (u *UnitOfWork) Commit(ctx context.Context) error {
+	var aggs []eventsourcing.Aggregate
+	for _, agg := range u.aggregates {
+		// an aggregate that was never stored and has no change has nothing to check
+		if agg.Root().Version() > 0 {
+			aggs = append(aggs, agg)
+		}
+	}
+	if len(aggs) == 0 {
+		return nil
+	}
+
+	return u.store.SaveAll(ctx, aggs...)
+}
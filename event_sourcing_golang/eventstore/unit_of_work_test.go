@@ -0,0 +1,215 @@
+package eventstore_test
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+
+	"github.com/glebarez/sqlite"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+// backends opens a new store with Account registered for every store implementation
+var backends = map[string]func(t *testing.T, opts ...repos.Option) repos.Repos{
+	"InMemory": newRepos,
+	"SQLite": func(t *testing.T, opts ...repos.Option) repos.Repos {
+		t.Helper()
+		s := eventsourcing.NewSerializer()
+		if err := s.RegisterAggregate(&Account{}); err != nil {
+			t.Fatal(err)
+		}
+		db, err := gorm.Open(sqlite.Open(filepath.Join(t.TempDir(), "es.db")), &gorm.Config{Logger: logger.Discard})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := repos.Migrate(context.Background(), db); err != nil {
+			t.Fatal(err)
+		}
+		return repos.New(db, s, opts...)
+	},
+}
+
+func countEvents(t *testing.T, r repos.Repos) int {
+	t.Helper()
+	events, err := r.EventStore().ReadAll(context.Background(), 0, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(events)
+}
+
+// transfer moves amount from one account to the other in a unit of work
+func transfer(ctx context.Context, store eventstore.AggregateStore, from, to string, amount int) error {
+	uow := eventstore.NewUnitOfWork(store)
+	src, dst := &Account{}, &Account{}
+	if err := uow.Get(ctx, from, src); err != nil {
+		return err
+	}
+	if err := uow.Get(ctx, to, dst); err != nil {
+		return err
+	}
+	if err := deposit(-amount)(src); err != nil {
+		return err
+	}
+	if err := deposit(amount)(dst); err != nil {
+		return err
+	}
+	return uow.Commit(ctx)
+}
+
+func TestUnitOfWorkCommitsAllOrNothing(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			r := open(t)
+			store := eventstore.NewAggregateStore(r)
+			accounts := eventstore.NewRepository[*Account](store)
+			for _, id := range []string{"acc-1", "acc-2"} {
+				if _, err := accounts.Create(ctx, id, deposit(10)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if err := transfer(ctx, store, "acc-1", "acc-2", 3); err != nil {
+				t.Fatal(err)
+			}
+			if a, b := get(t, store, "acc-1"), get(t, store, "acc-2"); a.Balance != 7 || b.Balance != 13 {
+				t.Fatalf("balances=%d,%d after the transfer, want 7,13", a.Balance, b.Balance)
+			}
+
+			// acc-2 changes between the load and the commit, the withdrawal from acc-1 is rolled back too
+			uow := eventstore.NewUnitOfWork(store)
+			src, dst := &Account{}, &Account{}
+			if err := uow.Get(ctx, "acc-1", src); err != nil {
+				t.Fatal(err)
+			}
+			if err := uow.Get(ctx, "acc-2", dst); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := accounts.Update(ctx, "acc-2", deposit(1)); err != nil {
+				t.Fatal(err)
+			}
+			_ = deposit(-5)(src)
+			_ = deposit(5)(dst)
+			events := countEvents(t, r)
+			if err := uow.Commit(ctx); !repos.IsConcurrencyConflict(err) {
+				t.Fatalf("err=%v, want a concurrency conflict", err)
+			}
+			if n := countEvents(t, r); n != events {
+				t.Fatalf("%d events stored by the failed commit", n-events)
+			}
+			if a, b := get(t, store, "acc-1"), get(t, store, "acc-2"); a.Balance != 7 || a.Version() != 2 || b.Balance != 14 {
+				t.Fatalf("balances=%d,%d acc-1 version=%d after the rollback, want 7,14 at 2", a.Balance, b.Balance, a.Version())
+			}
+
+			// the transfer succeeds again with a new unit of work
+			if err := transfer(ctx, store, "acc-1", "acc-2", 5); err != nil {
+				t.Fatal(err)
+			}
+			if a, b := get(t, store, "acc-1"), get(t, store, "acc-2"); a.Balance != 2 || b.Balance != 19 {
+				t.Fatalf("balances=%d,%d after the retry, want 2,19", a.Balance, b.Balance)
+			}
+		})
+	}
+}
+
+func TestUnitOfWorkChecksUnchangedAggregates(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			r := open(t)
+			store := eventstore.NewAggregateStore(r)
+			accounts := eventstore.NewRepository[*Account](store)
+			for _, id := range []string{"acc-1", "acc-2"} {
+				if _, err := accounts.Create(ctx, id, deposit(10)); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// acc-2 is credited only if acc-1 holds enough, acc-1 itself is not changed
+			uow := eventstore.NewUnitOfWork(store)
+			guard, dst := &Account{}, &Account{}
+			if err := uow.Get(ctx, "acc-1", guard); err != nil {
+				t.Fatal(err)
+			}
+			if err := uow.Get(ctx, "acc-2", dst); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := accounts.Update(ctx, "acc-1", deposit(-10)); err != nil {
+				t.Fatal(err)
+			}
+			_ = deposit(guard.Balance)(dst)
+			if err := uow.Commit(ctx); !repos.IsConcurrencyConflict(err) {
+				t.Fatalf("err=%v, want a concurrency conflict", err)
+			}
+			if b := get(t, store, "acc-2"); b.Balance != 10 || b.Version() != 1 {
+				t.Fatalf("acc-2 balance=%d version=%d, want 10 at 1", b.Balance, b.Version())
+			}
+		})
+	}
+}
+
+func TestUnitOfWorkSavesNewAggregates(t *testing.T) {
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			store := eventstore.NewAggregateStore(open(t))
+			accounts := eventstore.NewRepository[*Account](store)
+			if _, err := accounts.Create(ctx, "acc-1", deposit(10)); err != nil {
+				t.Fatal(err)
+			}
+
+			// the new account already exists, the change of acc-1 is not saved either
+			uow := eventstore.NewUnitOfWork(store)
+			src := &Account{}
+			if err := uow.Get(ctx, "acc-1", src); err != nil {
+				t.Fatal(err)
+			}
+			dup := &Account{}
+			_ = dup.SetID("acc-1")
+			if err := uow.Track(dup); err == nil {
+				t.Fatal("another instance of acc-1 tracked")
+			}
+
+			if _, err := accounts.Create(ctx, "acc-2", deposit(1)); err != nil {
+				t.Fatal(err)
+			}
+			stale := &Account{}
+			_ = stale.SetID("acc-2")
+			_ = deposit(4)(stale)
+			_ = deposit(-4)(src)
+			if err := uow.Track(stale); err != nil {
+				t.Fatal(err)
+			}
+			if err := uow.Commit(ctx); !repos.IsConcurrencyConflict(err) {
+				t.Fatalf("err=%v, want a concurrency conflict", err)
+			}
+			if a := get(t, store, "acc-1"); a.Balance != 10 {
+				t.Fatalf("acc-1 balance=%d, want 10", a.Balance)
+			}
+
+			uow = eventstore.NewUnitOfWork(store)
+			src, created := &Account{}, &Account{}
+			if err := uow.Get(ctx, "acc-1", src); err != nil {
+				t.Fatal(err)
+			}
+			_ = created.SetID("acc-3")
+			_ = deposit(4)(created)
+			_ = deposit(-4)(src)
+			if err := uow.Track(created); err != nil {
+				t.Fatal(err)
+			}
+			if err := uow.Commit(ctx); err != nil {
+				t.Fatal(err)
+			}
+			if a, c := get(t, store, "acc-1"), get(t, store, "acc-3"); a.Balance != 6 || c.Balance != 4 {
+				t.Fatalf("balances=%d,%d, want 6,4", a.Balance, c.Balance)
+			}
+		})
+	}
+}
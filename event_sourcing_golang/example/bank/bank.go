@@ -0,0 +1,35 @@
+// Package bank is the demo domain shared by the demo program and esctl: a BankAccount aggregate, its events and
+// the Transfer process between accounts
+package bank
+
+import "event_sourcing_golang/pkg/eventsourcing"
+
+// Events
+// Owner is personal data, encrypted with the key of the account and shredded by forgetting the key
+type AccountOpened struct {
+	Owner string `pii:"data"`
+}
+type MoneyDeposited struct{ Amount int }
+type MoneyWithdrawn struct{ Amount int }
+
+type BankAccount struct {
+	eventsourcing.AggregateRoot
+	Owner   string `pii:"data"`
+	Balance int
+}
+
+func (a *BankAccount) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&AccountOpened{}, &MoneyDeposited{}, &MoneyWithdrawn{})
+}
+
+func (a *BankAccount) Transition(e eventsourcing.Event) error {
+	switch v := e.Data.(type) {
+	case *AccountOpened:
+		a.Owner = v.Owner
+	case *MoneyDeposited:
+		a.Balance += v.Amount
+	case *MoneyWithdrawn:
+		a.Balance -= v.Amount
+	}
+	return nil
+}
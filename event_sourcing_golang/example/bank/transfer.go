@@ -0,0 +1,108 @@
+package bank
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/process"
+	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// TransferTo is the metadata key of a withdrawal naming the account the money is transferred to
+const TransferTo = "transfer_to"
+
+// Events
+type TransferStarted struct {
+	From, To string
+	Amount   int
+}
+type TransferRefunded struct{}
+
+// Credit is the command depositing Amount on an account
+type Credit struct {
+	AccountID string
+	Amount    int
+}
+
+// Transfer is the process moving money between accounts: a withdrawal with TransferTo in its metadata starts it,
+// it credits the target account and completes once the deposit is saved. When the target account rejects the
+// credit it credits the source account back.
+type Transfer struct {
+	process.Saga
+	From, To string
+	Amount   int
+	Refunded bool
+}
+
+func (t *Transfer) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(append(process.SagaEvents(), &TransferStarted{}, &TransferRefunded{})...)
+}
+
+func (t *Transfer) Transition(e eventsourcing.Event) error {
+	if t.Saga.Transition(e) {
+		return nil
+	}
+	switch v := e.Data.(type) {
+	case *TransferStarted:
+		t.From, t.To, t.Amount = v.From, v.To, v.Amount
+	case *TransferRefunded:
+		t.Refunded = true
+	}
+	return nil
+}
+
+// NewTransferManager returns the manager of the transfers, it runs their Credit commands on the accounts of as.
+// Transfers are correlated by the correlation ID of the withdrawal.
+func NewTransferManager(es repos.EventStore, as eventstore.AggregateStore, checkpoints process.CheckpointStore,
+	opts ...process.ManagerOption) *process.Manager[*Transfer] {
+	accounts := eventstore.NewRepository[*BankAccount](as)
+	credit := process.DispatcherFunc(func(ctx context.Context, cmd process.Command) error {
+		var c Credit
+		if err := cmd.Decode(&c); err != nil {
+			return err
+		}
+		// the ctx carries the command ID, a credit delivered again is not deposited twice
+		_, err := accounts.Update(ctx, c.AccountID, func(a *BankAccount) error {
+			return a.ApplyChange(a, &MoneyDeposited{Amount: c.Amount})
+		})
+		if errors.Is(err, eventstore.ErrAggregateNotFound) {
+			return fmt.Errorf("%w id=%s err=%w", process.ErrCommandRejected, cmd.ID, err)
+		}
+		return err
+	})
+
+	return process.NewManager[*Transfer]("transfer", es, as, checkpoints, credit, opts...).
+		On(&MoneyWithdrawn{}, func(ctx context.Context, t *Transfer, e eventsourcing.Event) error {
+			to, _ := e.Metadata.Extra[TransferTo].(string)
+			if to == "" || t.Version() > 0 {
+				return nil
+			}
+			amount := e.Data.(*MoneyWithdrawn).Amount
+			if err := t.ApplyChange(t, &TransferStarted{From: e.AggregateID, To: to, Amount: amount}); err != nil {
+				return err
+			}
+			return t.Send("Credit", Credit{AccountID: to, Amount: amount})
+		}).
+		On(&MoneyDeposited{}, func(ctx context.Context, t *Transfer, e eventsourcing.Event) error {
+			if t.Version() == 0 || e.AggregateID != t.To {
+				return nil
+			}
+			return t.Complete()
+		}).
+		OnRejected("Credit", func(ctx context.Context, t *Transfer, cmd process.Command, err error) error {
+			// a rejected refund is left to the operators
+			if t.Refunded {
+				return nil
+			}
+			if err := t.Send("Credit", Credit{AccountID: t.From, Amount: t.Amount}); err != nil {
+				return err
+			}
+			if err := t.ApplyChange(t, &TransferRefunded{}); err != nil {
+				return err
+			}
+			return t.Complete()
+		})
+}
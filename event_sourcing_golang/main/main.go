@@ -2,61 +2,70 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"time"
 
 	"event_sourcing_golang/eventstore"
+	"event_sourcing_golang/eventstore/projection"
 	"event_sourcing_golang/eventstore/repos"
+	"event_sourcing_golang/example/bank"
 	"event_sourcing_golang/pkg/eventsourcing"
 )
 
-// Demo domain: BankAccount aggregate (no projections)
-// Events
-type AccountOpened struct{ Owner string }
-type MoneyDeposited struct{ Amount int }
-type MoneyWithdrawn struct{ Amount int }
-
-type BankAccount struct {
-	eventsourcing.AggregateRoot
-	Owner   string
-	Balance int
-}
-
-func (a *BankAccount) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
-	return reg(&AccountOpened{}, &MoneyDeposited{}, &MoneyWithdrawn{})
-}
-
-func (a *BankAccount) Transition(e eventsourcing.Event) error {
-	switch v := e.Data.(type) {
-	case *AccountOpened:
-		a.Owner = v.Owner
-	case *MoneyDeposited:
-		a.Balance += v.Amount
-	case *MoneyWithdrawn:
-		a.Balance -= v.Amount
+// balanceProjection keeps the balance per account in an in-memory table
+func balanceProjection(ps *projection.MemoryStore) *projection.Projection {
+	add := func(table, id string, amount int) {
+		ps.Table(table).Update(id, func(v interface{}, ok bool) interface{} {
+			if !ok {
+				return amount
+			}
+			return v.(int) + amount
+		})
 	}
-	return nil
+
+	return projection.New("balances", "balances").
+		On(&bank.AccountOpened{}, func(ctx context.Context, table string, e eventsourcing.Event) error {
+			ps.Table(table).Put(e.AggregateID, 0)
+			return nil
+		}).
+		On(&bank.MoneyDeposited{}, func(ctx context.Context, table string, e eventsourcing.Event) error {
+			add(table, e.AggregateID, e.Data.(*bank.MoneyDeposited).Amount)
+			return nil
+		}).
+		On(&bank.MoneyWithdrawn{}, func(ctx context.Context, table string, e eventsourcing.Event) error {
+			add(table, e.AggregateID, -e.Data.(*bank.MoneyWithdrawn).Amount)
+			return nil
+		})
 }
 
 func main() {
-	ctx := context.Background()
+	// Metadata carried by ctx is stamped on every saved event
+	ctx := eventsourcing.WithActorID(context.Background(), "teller-42")
 
 	// Serializer with aggregate registration
 	s := eventsourcing.NewSerializer()
-	_ = s.RegisterAggregate(&BankAccount{})
+	_ = s.RegisterAggregate(&bank.BankAccount{})
+	_ = s.RegisterAggregate(&bank.Transfer{})
+	keys := eventsourcing.NewInMemoryKeyStore()
+	s.UseKeyStore(keys)
 
 	// Use in-memory event store
 	r := repos.NewInMemory(s)
-	as := eventstore.NewAggregateStore(r)
+	as := eventstore.NewAggregateStore(r,
+		eventstore.WithSnapshotPolicy(&bank.BankAccount{}, eventstore.EveryNEvents(100)),
+		eventstore.WithCache(1000),
+	)
 
 	// Open a new account
-	acc := &BankAccount{}
+	acc := &bank.BankAccount{}
 	_ = acc.SetID("acc-1")
 
-	// Perform multiple transactions to trigger snapshots (every 10 events)
-	_ = acc.ApplyChange(acc, &AccountOpened{Owner: "Alice"})
+	// Perform multiple transactions to trigger a snapshot (every 100 events)
+	_ = acc.ApplyChange(acc, &bank.AccountOpened{Owner: "Alice"})
 	for i := 0; i < 1000; i++ {
-		_ = acc.ApplyChange(acc, &MoneyDeposited{Amount: 10})
-		_ = acc.ApplyChange(acc, &MoneyWithdrawn{Amount: 5})
+		_ = acc.ApplyChange(acc, &bank.MoneyDeposited{Amount: 10})
+		_ = acc.ApplyChange(acc, &bank.MoneyWithdrawn{Amount: 5})
 	}
 
 	// Persist events
@@ -65,34 +74,159 @@ func main() {
 	}
 
 	// Load fresh aggregate
-	loaded := &BankAccount{}
+	loaded := &bank.BankAccount{}
 	if err := as.Get(ctx, "acc-1", loaded); err != nil {
 		panic(err)
 	}
 
 	fmt.Printf("Owner=%s Balance=%d Version=%d\n", loaded.Owner, loaded.Balance, loaded.Root().Version())
 
-	// List and print all events
-	// Note: we need an instance with aggregate type set for deserialization
-	tmp := &BankAccount{}
-	_ = tmp.SetID("acc-1")
-	events, err := r.EventStore().List(ctx, "acc-1", tmp)
+	// Update through the typed repository, retried on concurrency conflicts
+	accounts := eventstore.NewRepository[*bank.BankAccount](as)
+	updated, err := accounts.Update(ctx, "acc-1", func(a *bank.BankAccount) error {
+		return a.ApplyChange(a, &bank.MoneyWithdrawn{Amount: 100})
+	})
 	if err != nil {
 		panic(err)
 	}
-	fmt.Printf("Total events: %d\n", len(events))
-	for _, e := range events[:5] { // print first few
-		fmt.Printf("v=%d type=%s data=%+v\n", e.Version, e.EventType, e.Data)
+	fmt.Printf("After withdrawal Balance=%d Version=%d\n", updated.Balance, updated.Root().Version())
+
+	// Transfer to a new account, the debit and the credit are saved in one transaction
+	uow := eventstore.NewUnitOfWork(as)
+	from, to := &bank.BankAccount{}, &bank.BankAccount{}
+	if err := uow.Get(ctx, "acc-1", from); err != nil {
+		panic(err)
+	}
+	_ = to.SetID("acc-2")
+	_ = to.ApplyChange(to, &bank.AccountOpened{Owner: "Bob"})
+	_ = from.ApplyChange(from, &bank.MoneyWithdrawn{Amount: 50})
+	_ = to.ApplyChange(to, &bank.MoneyDeposited{Amount: 50})
+	if err := uow.Track(to); err != nil {
+		panic(err)
+	}
+	if err := uow.Commit(ctx); err != nil {
+		panic(err)
+	}
+	fmt.Printf("Transferred 50: acc-1 Balance=%d acc-2 Balance=%d\n", from.Balance, to.Balance)
+
+	// A gateway retry of the same command is detected by its ID and not applied twice
+	cmdCtx := eventsourcing.WithCommandID(ctx, "deposit-7f3a")
+	for i := 0; i < 2; i++ {
+		acc2, err := accounts.Update(cmdCtx, "acc-2", func(a *bank.BankAccount) error {
+			return a.ApplyChange(a, &bank.MoneyDeposited{Amount: 25})
+		})
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Deposit attempt %d: acc-2 Balance=%d Version=%d\n", i+1, acc2.Balance, acc2.Root().Version())
+	}
+
+	// Loads after the first are served from the aggregate cache
+	for i := 0; i < 3; i++ {
+		if _, err := accounts.Load(ctx, "acc-1"); err != nil {
+			panic(err)
+		}
 	}
-	if len(events) > 5 {
-		last := events[len(events)-1]
+	stats := as.CacheStats()
+	fmt.Printf("Cache hits=%d misses=%d size=%d\n", stats.Hits, stats.Misses, stats.Size)
+
+	// Point-in-time state for audits, from the best snapshot at or below the version
+	past := &bank.BankAccount{}
+	if err := as.GetAtVersion(ctx, "acc-1", 1001, past); err != nil {
+		panic(err)
+	}
+	fmt.Printf("At version=%d Balance=%d\n", past.Root().Version(), past.Balance)
+
+	// Stream all events without loading the whole history in memory
+	total := 0
+	var last eventsourcing.Event
+	for e, err := range r.EventStore().Events(ctx, "acc-1", 0) {
+		if err != nil {
+			panic(err)
+		}
+		if total < 5 { // print first few
+			fmt.Printf("v=%d type=%s data=%+v\n", e.Version, e.EventType, e.Data)
+		}
+		total++
+		last = e
+	}
+	if total > 5 {
 		fmt.Printf("... last v=%d type=%s\n", last.Version, last.EventType)
 	}
+	fmt.Printf("Total events: %d\n", total)
+
+	// Read the global stream across all aggregates
+	head, err := r.EventStore().ReadAll(ctx, 0, 3)
+	if err != nil {
+		panic(err)
+	}
+	for _, e := range head {
+		fmt.Printf("position=%d aggregate=%s/%s type=%s actor=%s correlation=%s\n",
+			e.Position, e.AggregateType, e.AggregateID, e.EventType, e.Metadata.ActorID, e.Metadata.CorrelationID)
+	}
+
+	// Build the balance read model from the global stream
+	ps := projection.NewInMemoryStore()
+	runner := projection.NewRunner(r.EventStore(), ps, balanceProjection(ps))
+	if err := runner.Rebuild(ctx, "balances"); err != nil {
+		panic(err)
+	}
+	balance, _ := ps.Table("balances").Get("acc-1")
+	checkpoint, _ := ps.LoadCheckpoint(ctx, "balances")
+	fmt.Printf("Projected balance=%v checkpoint=%d\n", balance, checkpoint)
 
 	// Snapshot info
-	if ver, ok := r.EventStore().SnapshotVersion(ctx, "acc-1"); ok {
-		fmt.Printf("Snapshot exists at version=%d\n", ver)
-	} else {
+	ver, err := r.EventStore().SnapshotVersion(ctx, "acc-1")
+	switch {
+	case errors.Is(err, repos.ErrSnapshotNotFound):
 		fmt.Println("No snapshot yet")
+	case err != nil:
+		panic(err)
+	default:
+		fmt.Printf("Snapshot exists at version=%d\n", ver)
+	}
+
+	// Transfer through a process: the withdrawal starts it and the manager credits the target account
+	transfers := bank.NewTransferManager(r.EventStore(), as, projection.NewInMemoryStore())
+	runCtx, stop := context.WithCancel(ctx)
+	stopped := make(chan error, 1)
+	go func() { stopped <- transfers.Run(runCtx) }()
+
+	_, err = accounts.Update(eventsourcing.WithCorrelationID(ctx, "transfer-1"), "acc-1", func(a *bank.BankAccount) error {
+		return a.ApplyChangeWithMetadata(a, &bank.MoneyWithdrawn{Amount: 30}, map[string]interface{}{bank.TransferTo: "acc-2"})
+	})
+	if err != nil {
+		panic(err)
+	}
+	transfer := &bank.Transfer{}
+	for !transfer.Completed {
+		select {
+		case err := <-stopped:
+			panic(err)
+		case <-time.After(10 * time.Millisecond):
+		}
+		transfer = &bank.Transfer{}
+		err := as.Get(ctx, "transfer:transfer-1", transfer)
+		if err != nil && !errors.Is(err, eventstore.ErrAggregateNotFound) {
+			panic(err)
+		}
+	}
+	stop()
+	if err := <-stopped; err != nil {
+		panic(err)
+	}
+	acc1, _ := accounts.Load(ctx, "acc-1")
+	acc2, _ := accounts.Load(ctx, "acc-2")
+	fmt.Printf("Transfer completed version=%d: acc-1 Balance=%d acc-2 Balance=%d\n",
+		transfer.Root().Version(), acc1.Balance, acc2.Balance)
+
+	// Forget the account holder, the personal data of the stored events and snapshots can no longer be read
+	if err := keys.Forget("acc-1"); err != nil {
+		panic(err)
+	}
+	forgotten := &bank.BankAccount{}
+	if err := as.Get(ctx, "acc-1", forgotten); err != nil {
+		panic(err)
 	}
+	fmt.Printf("After forget Owner=%s Balance=%d\n", forgotten.Owner, forgotten.Balance)
 }
@@ -3,7 +3,6 @@ package eventsourcing
 import (
 	"errors"
 	"fmt"
-	"reflect"
 	"time"
 )
 
@@ -12,9 +11,16 @@ var (
 	ErrIDEmpty    = errors.New("aggregate id cant be empty")
 )
 
+// EventNamer gives the name events are stored under, see Serializer.EventTypeName
+type EventNamer interface {
+	EventTypeName(event interface{}) string
+}
+
 type AggregateRoot struct {
 	aggregateID   string
 	aggregateType string
+	// eventNamer names the applied events, the struct name is used without it
+	eventNamer EventNamer
 	// version mean the version not stored yet
 	version int
 	// baseVersion mean version has been stored in DB
@@ -39,6 +45,11 @@ func (ar *AggregateRoot) SetAggregateType(typ string) {
 	ar.aggregateType = typ
 }
 
+// SetEventNamer makes the events applied from now on named by n, the serializer the aggregate is stored with
+func (ar *AggregateRoot) SetEventNamer(n EventNamer) {
+	ar.eventNamer = n
+}
+
 func (ar *AggregateRoot) AggregateID() string {
 	return ar.aggregateID
 }
@@ -90,14 +101,19 @@ func (ar *AggregateRoot) ApplyChangeWithMetadata(agg Aggregate, data interface{}
 		return fmt.Errorf("missing aggregate_id, aggregate_type=%s", ar.aggregateType)
 	}
 
-	eventType := reflect.TypeOf(data).Elem().Name()
+	// events registered with Register are named by the serializer, they are also renamed when saved
+	eventType := structType(data).Name()
+	if ar.eventNamer != nil {
+		eventType = ar.eventNamer.EventTypeName(data)
+	}
 	event := Event{
-		AggregateID: ar.aggregateID,
-		Version:     ar.nextVersion(),
-		EventType:   eventType,
-		CreatedAt:   time.Now().Unix(),
-		Data:        data,
-		Metadata:    metadata,
+		AggregateID:   ar.aggregateID,
+		Version:       ar.nextVersion(),
+		EventType:     eventType,
+		SchemaVersion: schemaVersionOf(data),
+		CreatedAt:     time.Now().Unix(),
+		Data:          data,
+		Metadata:      Metadata{Extra: metadata},
 	}
 
 	ar.events = append(ar.events, event)
@@ -114,12 +130,13 @@ func (ar *AggregateRoot) LoadFromHistory(agg Aggregate, events []Event) {
 	}
 }
 
-// update update version
+// Update marks the applied events as stored, moving the version and the base version to the last one
 func (ar *AggregateRoot) Update() {
 	if len(ar.events) > 0 {
 		lastEvent := ar.events[len(ar.events)-1]
 		ar.version = lastEvent.Version
 		ar.baseVersion = lastEvent.Version
+		ar.events = []Event{}
 	}
 }
 
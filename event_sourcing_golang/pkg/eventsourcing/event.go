@@ -1,12 +1,31 @@
 package eventsourcing
 
 type Event struct {
-	ID          int64       `json:"id"`
-	AggregateID string      `json:"aggregate_id"`
-	Version     int         `json:"version"`
-	EventType   string      `json:"event_type"`
-	Data        interface{} `json:"data"`
-	Metadata    interface{} `json:"metadata"`
+	ID            int64  `json:"id"`
+	AggregateID   string `json:"aggregate_id"`
+	AggregateType string `json:"aggregate_type"`
+	Version       int    `json:"version"`
+	EventType     string `json:"event_type"`
+	// SchemaVersion is the version of the payload schema the event was written with
+	SchemaVersion int         `json:"schema_version"`
+	Data          interface{} `json:"data"`
+	Metadata      Metadata    `json:"metadata"`
+	// Position is the global, monotonically increasing position of the event across all aggregates
+	Position int64 `json:"position"`
 
 	CreatedAt int64 `json:"created_at"`
 }
+
+// SchemaVersioned is implemented by event payloads whose schema evolved over time.
+// Payloads not implementing it are at schema version 1.
+type SchemaVersioned interface {
+	SchemaVersion() int
+}
+
+func schemaVersionOf(data interface{}) int {
+	if v, ok := data.(SchemaVersioned); ok {
+		return v.SchemaVersion()
+	}
+
+	return 1
+}
@@ -0,0 +1,41 @@
+package eventsourcing
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+)
+
+// ErrDuplicateEventType is returned when two event types are registered under the same name,
+// or one event type under two names
+var ErrDuplicateEventType = errors.New("duplicate event type")
+
+// ErrEventTypeInUse is returned when an event type is given a name after an aggregate registered it
+var ErrEventTypeInUse = errors.New("event type already in use")
+
+// Register gives the event type E, a struct, the explicit name s stores its events under, such as
+// "account.opened.v1". Renaming E or declaring another struct of the same name then changes nothing in the store.
+// s reads events stored under name for any aggregate, and the events of E stored under its struct name for the
+// aggregates registering E. The name belongs to s only, E is registered before the aggregates registering it.
+func Register[E any](s Serializer, name string) error {
+	typ := reflect.TypeOf((*E)(nil)).Elem()
+	if typ.Kind() != reflect.Struct {
+		return fmt.Errorf("event type %s must be a struct", typ)
+	}
+	if name == "" {
+		return fmt.Errorf("event name of %s is missing", typ)
+	}
+
+	return s.RegisterEventType(name, func() interface{} {
+		return new(E)
+	})
+}
+
+// structType returns the struct type of event, a pointer to struct
+func structType(event interface{}) reflect.Type {
+	typ := reflect.TypeOf(event)
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ
+}
@@ -0,0 +1,146 @@
+package eventsourcing_test
+
+import (
+	"errors"
+	"testing"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+type Opened struct{ Owner string }
+type Closed struct{}
+
+// ledgerOpened names Opened where another struct shadows it
+type ledgerOpened = Opened
+
+type Ledger struct {
+	eventsourcing.AggregateRoot
+	Owner string
+}
+
+func (l *Ledger) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&Opened{}, &Closed{})
+}
+
+func (l *Ledger) Transition(e eventsourcing.Event) error {
+	if v, ok := e.Data.(*Opened); ok {
+		l.Owner = v.Owner
+	}
+	return nil
+}
+
+func decode(s eventsourcing.Serializer, aggType, eventType, data string) (eventsourcing.Event, error) {
+	e := eventsourcing.Event{AggregateID: "led-1", EventType: eventType}
+	err := s.UnmarshalEvent(aggType, &e, "json", []byte(data))
+	return e, err
+}
+
+func TestEventNamesBelongToTheirSerializer(t *testing.T) {
+	named, plain := eventsourcing.NewSerializer(), eventsourcing.NewSerializer()
+	if err := eventsourcing.Register[Opened](named, "ledger.opened.v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := eventsourcing.Register[Opened](plain, "ledger.opened.v2"); err != nil {
+		t.Fatalf("naming the event in another serializer err=%v", err)
+	}
+
+	if got := named.EventTypeName(&Opened{}); got != "ledger.opened.v1" {
+		t.Fatalf("name=%s, want ledger.opened.v1", got)
+	}
+	if got := eventsourcing.NewSerializer().EventTypeName(&Opened{}); got != "Opened" {
+		t.Fatalf("name in a new serializer=%s, want the struct name", got)
+	}
+}
+
+func TestReadEventsStoredUnderStructName(t *testing.T) {
+	s := eventsourcing.NewSerializer()
+	if err := eventsourcing.Register[Opened](s, "ledger.opened.v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterAggregate(&Ledger{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, stored := range []string{"Opened", "ledger.opened.v1"} {
+		e, err := decode(s, "Ledger", stored, `{"Owner":"ada"}`)
+		if err != nil {
+			t.Fatalf("decode %s err=%v", stored, err)
+		}
+		if v, ok := e.Data.(*Opened); !ok || v.Owner != "ada" || e.EventType != "ledger.opened.v1" {
+			t.Fatalf("decoded %s as type=%s data=%+v, want ledger.opened.v1", stored, e.EventType, e.Data)
+		}
+	}
+	// the name is readable for aggregates not registering the event too
+	if _, err := decode(s, "Other", "ledger.opened.v1", `{}`); err != nil {
+		t.Fatalf("decode for another aggregate err=%v", err)
+	}
+	if _, err := decode(s, "Other", "Opened", `{}`); !errors.Is(err, eventsourcing.ErrUnknownEventType) {
+		t.Fatalf("decode struct name for another aggregate err=%v, want %v", err, eventsourcing.ErrUnknownEventType)
+	}
+}
+
+func TestStructNameOfTwoNamedEventsIsAmbiguous(t *testing.T) {
+	// another Opened struct, as declared in another package
+	type Opened struct{ Amount int }
+
+	s := eventsourcing.NewSerializer()
+	if err := eventsourcing.Register[Opened](s, "loan.opened.v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := eventsourcing.Register[ledgerOpened](s, "ledger.opened.v1"); err != nil {
+		t.Fatal(err)
+	}
+	err := s.RegisterTypes(&Ledger{},
+		func() interface{} { return &Opened{} },
+		func() interface{} { return &ledgerOpened{} })
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := decode(s, "Ledger", "loan.opened.v1", `{"Amount":1}`); err != nil {
+		t.Fatalf("decode by name err=%v", err)
+	}
+	// a row stored as Opened could be either event
+	if _, err := decode(s, "Ledger", "Opened", `{}`); !errors.Is(err, eventsourcing.ErrUnknownEventType) {
+		t.Fatalf("decode ambiguous struct name err=%v, want %v", err, eventsourcing.ErrUnknownEventType)
+	}
+}
+
+func TestRegisterDuplicates(t *testing.T) {
+	s := eventsourcing.NewSerializer()
+	if err := eventsourcing.Register[Opened](s, "ledger.opened.v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := eventsourcing.Register[Opened](s, "ledger.opened.v1"); err != nil {
+		t.Fatalf("registering the same name again err=%v", err)
+	}
+
+	if err := eventsourcing.Register[Closed](s, "ledger.opened.v1"); !errors.Is(err, eventsourcing.ErrDuplicateEventType) {
+		t.Fatalf("second type under a name err=%v, want %v", err, eventsourcing.ErrDuplicateEventType)
+	}
+	if err := eventsourcing.Register[Opened](s, "ledger.created.v1"); !errors.Is(err, eventsourcing.ErrDuplicateEventType) {
+		t.Fatalf("second name of a type err=%v, want %v", err, eventsourcing.ErrDuplicateEventType)
+	}
+
+	// Closed is named like the struct name of Opened, both would be stored as Opened for the aggregate
+	clash := eventsourcing.NewSerializer()
+	if err := eventsourcing.Register[Closed](clash, "Opened"); err != nil {
+		t.Fatal(err)
+	}
+	if err := clash.RegisterAggregate(&Ledger{}); !errors.Is(err, eventsourcing.ErrDuplicateEventType) {
+		t.Fatalf("register aggregate err=%v, want %v", err, eventsourcing.ErrDuplicateEventType)
+	}
+}
+
+func TestRegisterAfterAggregateFails(t *testing.T) {
+	s := eventsourcing.NewSerializer()
+	if err := s.RegisterAggregate(&Ledger{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := eventsourcing.Register[Opened](s, "ledger.opened.v1"); !errors.Is(err, eventsourcing.ErrEventTypeInUse) {
+		t.Fatalf("register after the aggregate err=%v, want %v", err, eventsourcing.ErrEventTypeInUse)
+	}
+	if got := s.EventTypeName(&Opened{}); got != "Opened" {
+		t.Fatalf("name after the failed register=%s, want Opened", got)
+	}
+}
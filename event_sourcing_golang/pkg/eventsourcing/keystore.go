@@ -0,0 +1,212 @@
+package eventsourcing
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+var _ KeyStore = (*memoryKeyStore)(nil)
+var _ KeyStore = (*fileKeyStore)(nil)
+
+// ErrKeyNotFound is returned when a subject has no data key, because it was forgotten or never had one
+var ErrKeyNotFound = errors.New("data key not found")
+
+// dataKeySize is the size of the AES-256 data keys
+const dataKeySize = 32
+
+// KeyStore holds one data key per subject, the personal data of a subject is encrypted with its key
+type KeyStore interface {
+	// DataKey returns the key of subjectID, creating it on first use
+	DataKey(subjectID string) ([]byte, error)
+	// LookupKey returns the key of subjectID, ErrKeyNotFound if it has none
+	LookupKey(subjectID string) ([]byte, error)
+	// Forget destroys the key of subjectID, the data encrypted with it can never be read again.
+	// Data written for the subject afterwards is encrypted with a new key.
+	Forget(subjectID string) error
+}
+
+type memoryKeyStore struct {
+	mu   sync.RWMutex
+	keys map[string][]byte
+}
+
+// NewInMemoryKeyStore creates a KeyStore keeping the keys in memory, for tests and demos
+func NewInMemoryKeyStore() KeyStore {
+	return &memoryKeyStore{
+		keys: make(map[string][]byte),
+	}
+}
+
+func (s *memoryKeyStore) DataKey(subjectID string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if key, ok := s.keys[subjectID]; ok {
+		return key, nil
+	}
+	key, err := newDataKey()
+	if err != nil {
+		return nil, err
+	}
+	s.keys[subjectID] = key
+	return key, nil
+}
+
+func (s *memoryKeyStore) LookupKey(subjectID string) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.keys[subjectID]
+	if !ok {
+		return nil, fmt.Errorf("%w subject=%s", ErrKeyNotFound, subjectID)
+	}
+	return key, nil
+}
+
+func (s *memoryKeyStore) Forget(subjectID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, subjectID)
+	return nil
+}
+
+type fileKeyStore struct {
+	dir string
+
+	mu    sync.Mutex
+	cache map[string][]byte
+}
+
+// NewFileKeyStore creates a KeyStore keeping each key in its own file under dir, named by the hash of the subject.
+// Keys are cached in memory, a key forgotten by another process may still be read until this one restarts.
+func NewFileKeyStore(dir string) (KeyStore, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("create key dir=%s err=%w", dir, err)
+	}
+
+	return &fileKeyStore{
+		dir:   dir,
+		cache: make(map[string][]byte),
+	}, nil
+}
+
+func (s *fileKeyStore) DataKey(subjectID string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, err := s.lookup(subjectID)
+	if !errors.Is(err, ErrKeyNotFound) {
+		return key, err
+	}
+
+	key, err = newDataKey()
+	if err != nil {
+		return nil, err
+	}
+	// the key is written to a temporary file and linked in place, linking fails if another process created
+	// the key meanwhile, so a reader never sees a partially written key
+	f, err := os.CreateTemp(s.dir, "tmp-*.key")
+	if err != nil {
+		return nil, fmt.Errorf("create key subject=%s err=%w", subjectID, err)
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(key)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, fmt.Errorf("write key subject=%s err=%w", subjectID, err)
+	}
+
+	err = os.Link(f.Name(), s.path(subjectID))
+	if errors.Is(err, fs.ErrExist) {
+		return s.lookup(subjectID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("store key subject=%s err=%w", subjectID, err)
+	}
+
+	s.cache[subjectID] = key
+	return key, nil
+}
+
+func (s *fileKeyStore) LookupKey(subjectID string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lookup(subjectID)
+}
+
+func (s *fileKeyStore) lookup(subjectID string) ([]byte, error) {
+	if key, ok := s.cache[subjectID]; ok {
+		return key, nil
+	}
+
+	key, err := os.ReadFile(s.path(subjectID))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("%w subject=%s", ErrKeyNotFound, subjectID)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read key subject=%s err=%w", subjectID, err)
+	}
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("key of subject=%s is corrupted, size=%d", subjectID, len(key))
+	}
+
+	s.cache[subjectID] = key
+	return key, nil
+}
+
+// Forget overwrites the key file before removing it, so the key is not left in the freed blocks
+func (s *fileKeyStore) Forget(subjectID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.cache, subjectID)
+
+	path := s.path(subjectID)
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open key subject=%s err=%w", subjectID, err)
+	}
+	_, err = f.Write(make([]byte, dataKeySize))
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("overwrite key subject=%s err=%w", subjectID, err)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("remove key subject=%s err=%w", subjectID, err)
+	}
+
+	return nil
+}
+
+func (s *fileKeyStore) path(subjectID string) string {
+	sum := sha256.Sum256([]byte(subjectID))
+	return filepath.Join(s.dir, hex.EncodeToString(sum[:])+".key")
+}
+
+func newDataKey() ([]byte, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate data key err=%w", err)
+	}
+	return key, nil
+}
@@ -0,0 +1,218 @@
+package eventsourcing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Metadata is the envelope stored with every event to trace the chain of commands and events producing it.
+// AggregateStore.Save fills the empty fields from the context, see StampMetadata.
+type Metadata struct {
+	// EventID uniquely identifies the event, it is the causation ID of the events it triggers
+	EventID string `json:"event_id,omitempty"`
+	// CorrelationID is shared by every event of the same business transaction
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// CausationID is the ID of the command or event that caused this event
+	CausationID string `json:"causation_id,omitempty"`
+	// CommandID is the idempotency ID of the command producing the event, a command is saved only once
+	CommandID string `json:"command_id,omitempty"`
+	ActorID   string `json:"actor_id,omitempty"`
+	TenantID  string `json:"tenant_id,omitempty"`
+	// TraceParent and TraceState hold the W3C trace context the event was produced in
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
+
+	// Extra keeps any other metadata, such as the values given to ApplyChangeWithMetadata
+	Extra map[string]interface{} `json:"-"`
+}
+
+var metadataKeys = []string{"event_id", "correlation_id", "causation_id", "command_id", "actor_id", "tenant_id", "traceparent", "tracestate"}
+
+// MarshalJSON writes Extra next to the known fields, so the metadata column stays a flat JSON object
+func (m Metadata) MarshalJSON() ([]byte, error) {
+	type plain Metadata
+	known, err := json.Marshal(plain(m))
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Extra) == 0 {
+		return known, nil
+	}
+
+	flat := make(map[string]interface{}, len(m.Extra)+len(metadataKeys))
+	for k, v := range m.Extra {
+		flat[k] = v
+	}
+	if err := json.Unmarshal(known, &flat); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(flat)
+}
+
+// UnmarshalJSON reads the known fields and keeps every other key in Extra,
+// which also covers metadata written before the envelope existed
+func (m *Metadata) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	type plain Metadata
+	var known plain
+	if err := json.Unmarshal(data, &known); err != nil {
+		return err
+	}
+
+	var flat map[string]interface{}
+	if err := json.Unmarshal(data, &flat); err != nil {
+		return err
+	}
+	for _, k := range metadataKeys {
+		delete(flat, k)
+	}
+
+	*m = Metadata(known)
+	if len(flat) > 0 {
+		m.Extra = flat
+	}
+	return nil
+}
+
+type metadataKey struct{}
+
+// ContextWithMetadata returns a context carrying md, the events saved with it get md's fields
+func ContextWithMetadata(ctx context.Context, md Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// MetadataFromContext returns the metadata carried by ctx
+func MetadataFromContext(ctx context.Context) Metadata {
+	md, _ := ctx.Value(metadataKey{}).(Metadata)
+	return md
+}
+
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	md := MetadataFromContext(ctx)
+	md.CorrelationID = id
+	return ContextWithMetadata(ctx, md)
+}
+
+// WithCausationID sets the ID of the command or event causing the events saved with ctx
+func WithCausationID(ctx context.Context, id string) context.Context {
+	md := MetadataFromContext(ctx)
+	md.CausationID = id
+	return ContextWithMetadata(ctx, md)
+}
+
+// WithCommandID sets the idempotency ID of the command handled with ctx,
+// saving the events of a command ID that was already saved replays its original result
+func WithCommandID(ctx context.Context, id string) context.Context {
+	md := MetadataFromContext(ctx)
+	md.CommandID = id
+	return ContextWithMetadata(ctx, md)
+}
+
+func WithActorID(ctx context.Context, id string) context.Context {
+	md := MetadataFromContext(ctx)
+	md.ActorID = id
+	return ContextWithMetadata(ctx, md)
+}
+
+func WithTenantID(ctx context.Context, id string) context.Context {
+	md := MetadataFromContext(ctx)
+	md.TenantID = id
+	return ContextWithMetadata(ctx, md)
+}
+
+// WithTraceContext sets the W3C traceparent and tracestate headers of the current trace,
+// without them the events get the trace context of the OpenTelemetry span in ctx
+func WithTraceContext(ctx context.Context, traceParent, traceState string) context.Context {
+	md := MetadataFromContext(ctx)
+	md.TraceParent = traceParent
+	md.TraceState = traceState
+	return ContextWithMetadata(ctx, md)
+}
+
+// CausedBy returns the context to handle e with: events saved with it keep e's correlation ID,
+// have e as their cause and inherit e's actor, tenant and trace unless ctx sets them or holds a span
+func CausedBy(ctx context.Context, e Event) context.Context {
+	md := MetadataFromContext(ctx)
+	parent := e.Metadata
+
+	md.CorrelationID = parent.CorrelationID
+	if md.CorrelationID == "" {
+		md.CorrelationID = parent.EventID
+	}
+	md.CausationID = parent.EventID
+	if md.ActorID == "" {
+		md.ActorID = parent.ActorID
+	}
+	if md.TenantID == "" {
+		md.TenantID = parent.TenantID
+	}
+	if md.TraceParent == "" && !trace.SpanContextFromContext(ctx).IsValid() {
+		md.TraceParent = parent.TraceParent
+		md.TraceState = parent.TraceState
+	}
+
+	return ContextWithMetadata(ctx, md)
+}
+
+// StampMetadata fills the empty metadata fields of events from ctx and gives each event a new event ID.
+// Without a correlation ID in ctx, the events start a new chain correlated by the ID of the first one.
+func StampMetadata(ctx context.Context, events []Event) {
+	md := MetadataFromContext(ctx)
+	if md.TraceParent == "" {
+		md.TraceParent, md.TraceState = spanTraceContext(ctx)
+	}
+
+	for i := range events {
+		m := &events[i].Metadata
+		if m.EventID == "" {
+			m.EventID = NewID()
+		}
+		if md.CorrelationID == "" {
+			md.CorrelationID = m.EventID
+		}
+		if m.CorrelationID == "" {
+			m.CorrelationID = md.CorrelationID
+		}
+		if m.CausationID == "" {
+			m.CausationID = md.CausationID
+		}
+		if m.CommandID == "" {
+			m.CommandID = md.CommandID
+		}
+		if m.ActorID == "" {
+			m.ActorID = md.ActorID
+		}
+		if m.TenantID == "" {
+			m.TenantID = md.TenantID
+		}
+		if m.TraceParent == "" {
+			m.TraceParent = md.TraceParent
+			m.TraceState = md.TraceState
+		}
+	}
+}
+
+// spanTraceContext returns the W3C traceparent and tracestate of the span in ctx, empty without one
+func spanTraceContext(ctx context.Context) (string, string) {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+	return carrier.Get("traceparent"), carrier.Get("tracestate")
+}
+
+// NewID returns a random UUID v4
+func NewID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,151 @@
+package eventsourcing_test
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestMetadataJSON(t *testing.T) {
+	md := eventsourcing.Metadata{
+		EventID:       "evt-1",
+		CorrelationID: "corr-1",
+		// a key of a known field does not override it
+		Extra: map[string]interface{}{"transfer_to": "acc-2", "amount": float64(3), "event_id": "spoofed"},
+	}
+	data, err := json.Marshal(md)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var flat map[string]interface{}
+	if err := json.Unmarshal(data, &flat); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"event_id": "evt-1", "correlation_id": "corr-1", "transfer_to": "acc-2", "amount": float64(3),
+	}
+	if !reflect.DeepEqual(flat, want) {
+		t.Fatalf("metadata written as %s, want a flat object %v", data, want)
+	}
+
+	var got eventsourcing.Metadata
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	md.Extra = map[string]interface{}{"transfer_to": "acc-2", "amount": float64(3)}
+	if !reflect.DeepEqual(got, md) {
+		t.Fatalf("metadata read as %+v, want %+v", got, md)
+	}
+
+	// metadata written before the envelope existed only has extra keys
+	var legacy eventsourcing.Metadata
+	if err := json.Unmarshal([]byte(`{"transfer_to":"acc-2"}`), &legacy); err != nil {
+		t.Fatal(err)
+	}
+	if legacy.EventID != "" || legacy.Extra["transfer_to"] != "acc-2" {
+		t.Fatalf("legacy metadata read as %+v", legacy)
+	}
+	var empty eventsourcing.Metadata
+	if err := json.Unmarshal([]byte(`null`), &empty); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(empty, eventsourcing.Metadata{}) {
+		t.Fatalf("null metadata read as %+v", empty)
+	}
+}
+
+// withSpan returns ctx holding a sampled span with the tracestate k=v
+func withSpan(t *testing.T, ctx context.Context) (context.Context, string) {
+	t.Helper()
+	state, err := trace.ParseTraceState("k=v")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: trace.TraceID{
+			0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36,
+		},
+		SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		TraceFlags: trace.FlagsSampled,
+		TraceState: state,
+	})
+	return trace.ContextWithSpanContext(ctx, sc), "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+}
+
+func TestStampMetadata(t *testing.T) {
+	ctx := eventsourcing.WithActorID(context.Background(), "user-1")
+	events := []eventsourcing.Event{{}, {Metadata: eventsourcing.Metadata{ActorID: "system"}}}
+	eventsourcing.StampMetadata(ctx, events)
+
+	first, second := events[0].Metadata, events[1].Metadata
+	if first.EventID == "" || first.EventID == second.EventID {
+		t.Fatalf("event IDs %q and %q, want two new IDs", first.EventID, second.EventID)
+	}
+	// without a correlation ID the first event starts the chain
+	if first.CorrelationID != first.EventID || second.CorrelationID != first.EventID {
+		t.Fatalf("correlation IDs %q and %q, want %q", first.CorrelationID, second.CorrelationID, first.EventID)
+	}
+	if first.ActorID != "user-1" || second.ActorID != "system" {
+		t.Fatalf("actors %q and %q, want user-1 and the one already set", first.ActorID, second.ActorID)
+	}
+	if first.TraceParent != "" {
+		t.Fatalf("traceparent=%q without a trace", first.TraceParent)
+	}
+
+	spanCtx, traceParent := withSpan(t, eventsourcing.WithCorrelationID(context.Background(), "corr-1"))
+	for name, tc := range map[string]struct {
+		ctx                     context.Context
+		traceParent, traceState string
+	}{
+		"Span":         {spanCtx, traceParent, "k=v"},
+		"TraceContext": {eventsourcing.WithTraceContext(spanCtx, "00-set", "a=b"), "00-set", "a=b"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			events := []eventsourcing.Event{{}}
+			eventsourcing.StampMetadata(tc.ctx, events)
+			md := events[0].Metadata
+			if md.CorrelationID != "corr-1" {
+				t.Fatalf("correlation ID=%q, want corr-1", md.CorrelationID)
+			}
+			if md.TraceParent != tc.traceParent || md.TraceState != tc.traceState {
+				t.Fatalf("trace context %q %q, want %q %q", md.TraceParent, md.TraceState, tc.traceParent, tc.traceState)
+			}
+		})
+	}
+}
+
+func TestCausedBy(t *testing.T) {
+	parent := eventsourcing.Event{Metadata: eventsourcing.Metadata{
+		EventID: "evt-1", CorrelationID: "corr-1", ActorID: "user-1", TenantID: "tenant-1",
+		TraceParent: "00-parent", TraceState: "p=1",
+	}}
+
+	md := eventsourcing.MetadataFromContext(eventsourcing.CausedBy(context.Background(), parent))
+	want := eventsourcing.Metadata{
+		CorrelationID: "corr-1", CausationID: "evt-1", ActorID: "user-1", TenantID: "tenant-1",
+		TraceParent: "00-parent", TraceState: "p=1",
+	}
+	if !reflect.DeepEqual(md, want) {
+		t.Fatalf("metadata=%+v, want %+v", md, want)
+	}
+
+	// the context keeps its own actor and span, an event without correlation ID starts the chain
+	ctx, traceParent := withSpan(t, eventsourcing.WithActorID(context.Background(), "user-2"))
+	parent.Metadata.CorrelationID = ""
+	ctx = eventsourcing.CausedBy(ctx, parent)
+	md = eventsourcing.MetadataFromContext(ctx)
+	if md.CorrelationID != "evt-1" || md.ActorID != "user-2" || md.TraceParent != "" {
+		t.Fatalf("metadata=%+v, want correlation ID evt-1, actor user-2 and no inherited trace", md)
+	}
+	events := []eventsourcing.Event{{}}
+	eventsourcing.StampMetadata(ctx, events)
+	if got := events[0].Metadata.TraceParent; got != traceParent {
+		t.Fatalf("traceparent=%q, want the span's %q", got, traceParent)
+	}
+}
@@ -0,0 +1,266 @@
+package eventsourcing
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// Personal data is marked on event and aggregate structs with the pii tag:
+//
+//	type AccountOpened struct {
+//		CustomerID string `pii:"subject"`
+//		Owner      string `pii:"data"`
+//	}
+//
+// Fields tagged data must be strings, they are encrypted with the key of their subject before being stored.
+// The subject is the value of the field tagged subject, or the aggregate ID when there is none.
+// Every non-empty value is encrypted, also one that looks encrypted already. Once the key of a subject is forgotten
+// its fields are loaded as Redacted, also after data written for the subject later created a new key: every value
+// records the ID of the key it was encrypted with.
+const (
+	piiTag     = "pii"
+	piiData    = "data"
+	piiSubject = "subject"
+
+	// Redacted is the value of personal data whose subject was forgotten
+	Redacted = "[redacted]"
+
+	// encryptedV2 values are enc:v2:<key ID>:<sealed value>, values without it were stored before a key store was used
+	encryptedV2 = "enc:v2:"
+)
+
+// errStaleKey is returned when a value was encrypted with a key of the subject that was forgotten since
+var errStaleKey = errors.New("value encrypted with a forgotten key")
+
+type piiFields struct {
+	// subject is the index of the subject field, nil if the struct has none
+	subject []int
+	data    [][]int
+}
+
+// piiCache keeps the *piiFields of every struct type seen
+var piiCache sync.Map
+
+func piiFieldsOf(t reflect.Type) (*piiFields, error) {
+	if pf, ok := piiCache.Load(t); ok {
+		return pf.(*piiFields), nil
+	}
+
+	pf := &piiFields{}
+	if err := pf.collect(t, nil); err != nil {
+		return nil, err
+	}
+	piiCache.Store(t, pf)
+	return pf, nil
+}
+
+// collect walks the fields of t and of its nested structs, such as embedded ones
+func (pf *piiFields) collect(t reflect.Type, index []int) error {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		idx := append(append([]int{}, index...), i)
+
+		tag, ok := f.Tag.Lookup(piiTag)
+		if !ok {
+			if f.Type.Kind() == reflect.Struct {
+				if err := pf.collect(f.Type, idx); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if f.Type.Kind() != reflect.String {
+			return fmt.Errorf("pii field %s.%s must be a string", t.Name(), f.Name)
+		}
+		switch tag {
+		case piiData:
+			pf.data = append(pf.data, idx)
+		case piiSubject:
+			pf.subject = idx
+		default:
+			return fmt.Errorf("pii field %s.%s has unknown tag %q", t.Name(), f.Name, tag)
+		}
+	}
+
+	return nil
+}
+
+func (pf *piiFields) subjectOf(v reflect.Value, fallback string) string {
+	if pf.subject != nil {
+		if s := v.FieldByIndex(pf.subject).String(); s != "" {
+			return s
+		}
+	}
+	return fallback
+}
+
+// piiStruct returns the struct v points to and its personal data fields, ok is false when there is nothing to protect
+func piiStruct(v interface{}) (reflect.Value, *piiFields, bool, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return reflect.Value{}, nil, false, nil
+	}
+
+	pf, err := piiFieldsOf(rv.Elem().Type())
+	if err != nil {
+		return reflect.Value{}, nil, false, err
+	}
+	return rv.Elem(), pf, len(pf.data) > 0, nil
+}
+
+// protect returns a copy of v with its personal data encrypted, v itself is left untouched
+func (s *serializer) protect(subject string, v interface{}) (interface{}, error) {
+	if s.keys == nil {
+		return v, nil
+	}
+	sv, pf, ok, err := piiStruct(v)
+	if err != nil || !ok {
+		return v, err
+	}
+
+	cp := reflect.New(sv.Type()).Elem()
+	cp.Set(sv)
+	subject = pf.subjectOf(cp, subject)
+
+	key, err := s.keys.DataKey(subject)
+	if err != nil {
+		return nil, err
+	}
+	for _, idx := range pf.data {
+		f := cp.FieldByIndex(idx)
+		if f.String() == "" {
+			continue
+		}
+		enc, err := encryptField(key, subject, f.String())
+		if err != nil {
+			return nil, err
+		}
+		f.SetString(enc)
+	}
+
+	return cp.Addr().Interface(), nil
+}
+
+// reveal decrypts the personal data of v in place, the data of forgotten subjects is set to Redacted
+func (s *serializer) reveal(subject string, v interface{}) error {
+	if s.keys == nil {
+		return nil
+	}
+	sv, pf, ok, err := piiStruct(v)
+	if err != nil || !ok {
+		return err
+	}
+	subject = pf.subjectOf(sv, subject)
+
+	var key []byte
+	for _, idx := range pf.data {
+		f := sv.FieldByIndex(idx)
+		if !strings.HasPrefix(f.String(), encryptedV2) {
+			continue
+		}
+
+		if key == nil {
+			key, err = s.keys.LookupKey(subject)
+			if errors.Is(err, ErrKeyNotFound) {
+				redact(sv, pf)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		plain, err := decryptField(key, subject, f.String())
+		if errors.Is(err, errStaleKey) {
+			f.SetString(Redacted)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		f.SetString(plain)
+	}
+
+	return nil
+}
+
+func redact(v reflect.Value, pf *piiFields) {
+	for _, idx := range pf.data {
+		if f := v.FieldByIndex(idx); strings.HasPrefix(f.String(), encryptedV2) {
+			f.SetString(Redacted)
+		}
+	}
+}
+
+// encryptField seals value with AES-GCM, the subject is authenticated so a value can't be moved to another subject
+func encryptField(key []byte, subject, value string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("generate nonce err=%w", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(subject))
+
+	return encryptedV2 + keyID(key) + ":" + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptField opens value with key, errStaleKey if value was encrypted with another key of the subject
+func decryptField(key []byte, subject, value string) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(value, encryptedV2), ":")
+	if !ok {
+		return "", errors.New("encrypted field has no key ID")
+	}
+	if id != keyID(key) {
+		return "", fmt.Errorf("%w subject=%s key=%s", errStaleKey, subject, id)
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("decode encrypted field err=%w", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("encrypted field is too short")
+	}
+
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(subject))
+	if err != nil {
+		return "", fmt.Errorf("decrypt field of subject=%s err=%w", subject, err)
+	}
+	return string(plain), nil
+}
+
+// keyID identifies a data key in the values it encrypts without revealing it
+func keyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("create cipher err=%w", err)
+	}
+	return cipher.NewGCM(block)
+}
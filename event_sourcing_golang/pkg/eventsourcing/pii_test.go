@@ -0,0 +1,153 @@
+package eventsourcing_test
+
+import (
+	"strings"
+	"testing"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+type Registered struct {
+	Email string `pii:"data"`
+}
+
+type Customer struct {
+	eventsourcing.AggregateRoot
+	Email string `pii:"data"`
+}
+
+func (c *Customer) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&Registered{})
+}
+
+func (c *Customer) Transition(e eventsourcing.Event) error {
+	if v, ok := e.Data.(*Registered); ok {
+		c.Email = v.Email
+	}
+	return nil
+}
+
+func newPIISerializer(t *testing.T) (eventsourcing.Serializer, eventsourcing.KeyStore) {
+	t.Helper()
+	s := eventsourcing.NewSerializer()
+	if err := s.RegisterAggregate(&Customer{}); err != nil {
+		t.Fatal(err)
+	}
+	keys := eventsourcing.NewInMemoryKeyStore()
+	s.UseKeyStore(keys)
+	return s, keys
+}
+
+type stored struct {
+	codec string
+	data  []byte
+}
+
+func encodeRegistered(t *testing.T, s eventsourcing.Serializer, email string) stored {
+	t.Helper()
+	codec, data, err := s.EncodeEvent(eventsourcing.Event{
+		AggregateID: "cus-1", AggregateType: "Customer", EventType: "Registered", Data: &Registered{Email: email},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), email) {
+		t.Fatalf("stored event %s holds the email in clear", data)
+	}
+	return stored{codec, data}
+}
+
+func decodeRegistered(t *testing.T, s eventsourcing.Serializer, st stored) string {
+	t.Helper()
+	e := eventsourcing.Event{AggregateID: "cus-1", EventType: "Registered"}
+	if err := s.UnmarshalEvent("Customer", &e, st.codec, st.data); err != nil {
+		t.Fatal(err)
+	}
+	return e.Data.(*Registered).Email
+}
+
+func encodeCustomer(t *testing.T, s eventsourcing.Serializer, email string) stored {
+	t.Helper()
+	c := &Customer{Email: email}
+	c.SetInternal("cus-1", 1, 1)
+	codec, data, err := s.EncodeSnapshot(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return stored{codec, data}
+}
+
+func decodeCustomer(t *testing.T, s eventsourcing.Serializer, st stored) string {
+	t.Helper()
+	c := &Customer{}
+	if err := s.DecodeSnapshot("cus-1", st.codec, st.data, c); err != nil {
+		t.Fatal(err)
+	}
+	return c.Email
+}
+
+func TestForgetThenSaveAgain(t *testing.T) {
+	s, keys := newPIISerializer(t)
+	oldEvent := encodeRegistered(t, s, "ada@example.com")
+	oldSnapshot := encodeCustomer(t, s, "ada@example.com")
+	if got := decodeRegistered(t, s, oldEvent); got != "ada@example.com" {
+		t.Fatalf("email=%s before forget, want ada@example.com", got)
+	}
+
+	if err := keys.Forget("cus-1"); err != nil {
+		t.Fatal(err)
+	}
+	// saving for the subject again creates a new key, the data of the forgotten one stays unreadable
+	newEvent := encodeRegistered(t, s, "grace@example.com")
+	newSnapshot := encodeCustomer(t, s, "grace@example.com")
+
+	if got := decodeRegistered(t, s, oldEvent); got != eventsourcing.Redacted {
+		t.Fatalf("event email=%s after forget, want %s", got, eventsourcing.Redacted)
+	}
+	if got := decodeCustomer(t, s, oldSnapshot); got != eventsourcing.Redacted {
+		t.Fatalf("snapshot email=%s after forget, want %s", got, eventsourcing.Redacted)
+	}
+	if got := decodeRegistered(t, s, newEvent); got != "grace@example.com" {
+		t.Fatalf("new event email=%s, want grace@example.com", got)
+	}
+	if got := decodeCustomer(t, s, newSnapshot); got != "grace@example.com" {
+		t.Fatalf("new snapshot email=%s, want grace@example.com", got)
+	}
+}
+
+func TestValueLookingEncryptedIsEncrypted(t *testing.T) {
+	s, keys := newPIISerializer(t)
+	for _, email := range []string{"enc:hello", "enc:v2:0123456789abcdef:aGVsbG8"} {
+		st := encodeRegistered(t, s, email)
+		if got := decodeRegistered(t, s, st); got != email {
+			t.Fatalf("email=%s, want %s", got, email)
+		}
+	}
+
+	st := encodeRegistered(t, s, "enc:hello")
+	if err := keys.Forget("cus-1"); err != nil {
+		t.Fatal(err)
+	}
+	if got := decodeRegistered(t, s, st); got != eventsourcing.Redacted {
+		t.Fatalf("email=%s after forget, want %s", got, eventsourcing.Redacted)
+	}
+}
+
+func TestTamperedValueFails(t *testing.T) {
+	s, _ := newPIISerializer(t)
+	st := encodeRegistered(t, s, "ada@example.com")
+	// change a character of the authentication tag, the key ID still matches. The last character is left alone
+	// as some of its bits are not decoded.
+	i := strings.LastIndex(string(st.data), `"`) - 8
+	data := []byte(string(st.data))
+	if data[i] == 'A' {
+		data[i] = 'B'
+	} else {
+		data[i] = 'A'
+	}
+
+	e := eventsourcing.Event{AggregateID: "cus-1", EventType: "Registered"}
+	if err := s.UnmarshalEvent("Customer", &e, st.codec, data); err == nil {
+		t.Fatalf("tampered value decoded as %s", e.Data.(*Registered).Email)
+	}
+}
@@ -12,23 +12,83 @@ type RegisterEventsFunc = func(events ...interface{}) error
 
 var _ Serializer = (*serializer)(nil)
 
+// ErrUnknownEventType is returned when decoding an event whose type is not registered
+var ErrUnknownEventType = errors.New("unknown event type")
+
 type Serializer interface {
 	ToEventsFunc(events ...interface{}) []eventFunc
 	RegisterAggregate(agg BaseAggregate) error
 	Register(agg Aggregate, eventsFunc []eventFunc) error
 	RegisterTypes(agg Aggregate, eventsFunc ...eventFunc) error
+	// RegisterEventType makes the event created by f readable under name for any aggregate and stores its events
+	// under name, see Register
+	RegisterEventType(name string, f eventFunc) error
+	// EventTypeName returns the name the events of the type of event, a pointer to struct, are stored under:
+	// the name given with Register, else the name of the struct
+	EventTypeName(event interface{}) string
 	Type(typ, name string) (eventFunc, bool)
 	Marshal(v interface{}) ([]byte, error)
 	Unmarshal(data []byte, v interface{}) error
+
+	// RegisterUpcaster registers fn to upgrade events of eventType from schema version fromVersion to the next one.
+	// The event registered as eventType must declare a schema version above fromVersion, see SchemaVersioned.
+	RegisterUpcaster(aggType, eventType string, fromVersion int, fn UpcastFunc) error
+	Upcast(aggType string, raw RawEvent) (RawEvent, error)
+	// UnmarshalEvent upcasts the stored payload of evt to its latest schema and decodes it into evt.Data
+	UnmarshalEvent(aggType string, evt *Event, codec string, data []byte) error
+
+	// RegisterCodec makes c available to encode and decode payloads, JSON is always registered
+	RegisterCodec(c Codec) error
+	// UseCodec makes name the codec writing the payloads of aggTypes, or of every aggregate when none is given
+	UseCodec(name string, aggTypes ...string) error
+	Codec(name string) (Codec, bool)
+	// Encode encodes v with the codec configured for aggType and returns the codec name to store next to the data
+	Encode(aggType string, v interface{}) (string, []byte, error)
+	// Decode decodes data written by the named codec, an empty name means JSON
+	Decode(codec string, data []byte, v interface{}) error
+
+	// UseKeyStore enables the encryption of the fields tagged pii with the subject keys held by ks
+	UseKeyStore(ks KeyStore)
+	// EncodeEvent encodes e.Data like Encode, with its personal data encrypted
+	EncodeEvent(e Event) (string, []byte, error)
+	// EncodeSnapshot encodes agg like Encode, with its personal data encrypted
+	EncodeSnapshot(agg Aggregate) (string, []byte, error)
+	// DecodeSnapshot decodes the snapshot of aggregateID into agg and decrypts its personal data
+	DecodeSnapshot(aggregateID, codec string, data []byte, agg Aggregate) error
 }
 
 type serializer struct {
+	// eventRegister keeps the events per <aggregate type>_<event type>, aliases are the keys of struct names
+	// of events with an explicit name, nil when several events of the aggregate have that struct name
 	eventRegister map[string]eventFunc
+	aliases       map[string]bool
+	// namedEvents keeps the events registered with an explicit name, for any aggregate, and eventNames their names
+	namedEvents map[string]eventFunc
+	eventNames  map[reflect.Type]string
+	upcasters   map[string]UpcastFunc
+	// latestSchema keeps the schema version the upcasters of each <aggregate type>_<event type> lead to
+	latestSchema map[string]int
+
+	codecs map[string]Codec
+	// defaultCodec writes payloads of aggregate types without their own codec in aggregateCodecs
+	defaultCodec    string
+	aggregateCodecs map[string]string
+
+	// keys holds the data keys of personal data, nil when it is stored in clear
+	keys KeyStore
 }
 
 func NewSerializer() Serializer {
 	return &serializer{
-		eventRegister: make(map[string]func() interface{}),
+		eventRegister:   make(map[string]func() interface{}),
+		aliases:         make(map[string]bool),
+		namedEvents:     make(map[string]eventFunc),
+		eventNames:      make(map[reflect.Type]string),
+		upcasters:       make(map[string]UpcastFunc),
+		latestSchema:    make(map[string]int),
+		codecs:          map[string]Codec{CodecJSON: JSONCodec()},
+		defaultCodec:    CodecJSON,
+		aggregateCodecs: make(map[string]string),
 	}
 }
 
@@ -50,13 +110,9 @@ func (s *serializer) RegisterAggregate(agg BaseAggregate) error {
 	fu := func(events ...interface{}) error {
 		listF := s.ToEventsFunc(events...)
 		for _, f := range listF {
-			event := f()
-			eName := reflect.TypeOf(event).Elem().Name()
-			if eName == "" {
-				return errors.New("name of event is missing")
+			if err := s.registerEvent(typ, f); err != nil {
+				return err
 			}
-
-			s.eventRegister[typ+"_"+eName] = f
 		}
 
 		return nil
@@ -72,23 +128,95 @@ func (s *serializer) Register(agg Aggregate, eventsFunc []eventFunc) error {
 	}
 
 	for _, f := range eventsFunc {
-		event := f()
-		eName := reflect.TypeOf(event).Elem().Name()
-		if eName == "" {
-			return errors.New("event name is missing")
+		if err := s.registerEvent(typ, f); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// registerEvent registers the event created by f for the aggregate type typ under its event type name.
+// An event with an explicit name is also registered under its struct name, for the rows stored before it had one.
+func (s *serializer) registerEvent(typ string, f eventFunc) error {
+	event := f()
+	structName := reflect.TypeOf(event).Elem().Name()
+	if structName == "" {
+		return errors.New("event name is missing")
+	}
+
+	key := typ + "_" + s.EventTypeName(event)
+	if prev, ok := s.eventRegister[key]; ok && !s.aliases[key] && reflect.TypeOf(prev()) != reflect.TypeOf(event) {
+		return fmt.Errorf("%w %s: %T and %T", ErrDuplicateEventType, key, prev(), event)
+	}
+	if latest, ok := s.latestSchema[key]; ok {
+		if err := checkSchemaVersion(key, event, latest); err != nil {
+			return err
 		}
-		s.eventRegister[typ+"_"+eName] = f
+	}
+	s.eventRegister[key] = f
+	delete(s.aliases, key)
+
+	alias := typ + "_" + structName
+	if alias == key {
+		return nil
+	}
+	prev, ok := s.eventRegister[alias]
+	switch {
+	case !ok:
+		s.eventRegister[alias] = f
+		s.aliases[alias] = true
+	case s.aliases[alias] && prev != nil && reflect.TypeOf(prev()) != reflect.TypeOf(event):
+		// the stored rows could be either event
+		s.eventRegister[alias] = nil
 	}
 
 	return nil
 }
 
+// RegisterEventType fails when an aggregate already registered the event under another name, its events would be
+// keyed by that name
+func (s *serializer) RegisterEventType(name string, f eventFunc) error {
+	event := f()
+	typ := structType(event)
+	if prev, ok := s.namedEvents[name]; ok && reflect.TypeOf(prev()) != reflect.TypeOf(event) {
+		return fmt.Errorf("%w %s: %T and %T", ErrDuplicateEventType, name, prev(), event)
+	}
+	if prev, ok := s.eventNames[typ]; ok {
+		if prev != name {
+			return fmt.Errorf("%w %T: %s and %s", ErrDuplicateEventType, event, prev, name)
+		}
+		return nil
+	}
+	for key, registered := range s.eventRegister {
+		if registered != nil && !s.aliases[key] && structType(registered()) == typ {
+			return fmt.Errorf("%w %T: registered as %s before its name %s", ErrEventTypeInUse, event, key, name)
+		}
+	}
+
+	s.namedEvents[name] = f
+	s.eventNames[typ] = name
+	return nil
+}
+
+func (s *serializer) EventTypeName(event interface{}) string {
+	typ := structType(event)
+	if name, ok := s.eventNames[typ]; ok {
+		return name
+	}
+	return typ.Name()
+}
+
 func (s *serializer) RegisterTypes(agg Aggregate, eventsFunc ...eventFunc) error {
 	return s.Register(agg, eventsFunc)
 }
 
 func (s *serializer) Type(typ, name string) (eventFunc, bool) {
-	f, ok := s.eventRegister[typ+"_"+name]
+	if f, ok := s.eventRegister[typ+"_"+name]; ok {
+		return f, f != nil
+	}
+
+	f, ok := s.namedEvents[name]
 	return f, ok
 }
 
@@ -100,8 +228,139 @@ func (s *serializer) Unmarshal(data []byte, v interface{}) error {
 	return json.Unmarshal(data, v)
 }
 
+func (s *serializer) UnmarshalEvent(aggType string, evt *Event, codec string, data []byte) error {
+	raw, err := s.Upcast(aggType, RawEvent{EventType: evt.EventType, SchemaVersion: evt.SchemaVersion, Codec: codec, Data: data})
+	if err != nil {
+		return err
+	}
+
+	f, ok := s.Type(aggType, raw.EventType)
+	if !ok {
+		return fmt.Errorf("%w, cant serialize event with type: %s_%s", ErrUnknownEventType, aggType, raw.EventType)
+	}
+
+	eventData := f()
+	if err := s.Decode(raw.Codec, raw.Data, eventData); err != nil {
+		return fmt.Errorf("unmarshal event failed with err=%w", err)
+	}
+	if err := s.reveal(evt.AggregateID, eventData); err != nil {
+		return fmt.Errorf("decrypt event failed with err=%w", err)
+	}
+
+	// events stored under their struct name are read under their explicit name
+	evt.EventType = s.EventTypeName(eventData)
+	evt.SchemaVersion = raw.SchemaVersion
+	evt.Data = eventData
+	return nil
+}
+
+func (s *serializer) RegisterCodec(c Codec) error {
+	if c.Name() == "" {
+		return errors.New("codec name is missing")
+	}
+
+	s.codecs[c.Name()] = c
+	return nil
+}
+
+func (s *serializer) UseCodec(name string, aggTypes ...string) error {
+	if _, ok := s.codecs[name]; !ok {
+		return fmt.Errorf("codec %s is not registered", name)
+	}
+
+	if len(aggTypes) == 0 {
+		s.defaultCodec = name
+		return nil
+	}
+	for _, typ := range aggTypes {
+		s.aggregateCodecs[typ] = name
+	}
+
+	return nil
+}
+
+func (s *serializer) Codec(name string) (Codec, bool) {
+	if name == "" {
+		name = CodecJSON
+	}
+
+	c, ok := s.codecs[name]
+	return c, ok
+}
+
+func (s *serializer) Encode(aggType string, v interface{}) (string, []byte, error) {
+	name, ok := s.aggregateCodecs[aggType]
+	if !ok {
+		name = s.defaultCodec
+	}
+
+	c := s.codecs[name]
+	if tc, ok := c.(typedCodec); ok && !tc.Supports(v) {
+		c = s.codecs[CodecJSON]
+	}
+
+	data, err := c.Marshal(v)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return c.Name(), data, nil
+}
+
+func (s *serializer) Decode(codec string, data []byte, v interface{}) error {
+	c, ok := s.Codec(codec)
+	if !ok {
+		return fmt.Errorf("codec %s is not registered", codec)
+	}
+
+	return c.Unmarshal(data, v)
+}
+
+func (s *serializer) UseKeyStore(ks KeyStore) {
+	s.keys = ks
+}
+
+func (s *serializer) EncodeEvent(e Event) (string, []byte, error) {
+	data, err := s.protect(e.AggregateID, e.Data)
+	if err != nil {
+		return "", nil, fmt.Errorf("encrypt event err=%w", err)
+	}
+
+	return s.Encode(e.AggregateType, data)
+}
+
+func (s *serializer) EncodeSnapshot(agg Aggregate) (string, []byte, error) {
+	root := agg.Root()
+	data, err := s.protect(root.AggregateID(), agg)
+	if err != nil {
+		return "", nil, fmt.Errorf("encrypt snapshot err=%w", err)
+	}
+
+	return s.Encode(root.AggregateType(), data)
+}
+
+func (s *serializer) DecodeSnapshot(aggregateID, codec string, data []byte, agg Aggregate) error {
+	if err := s.Decode(codec, data, agg); err != nil {
+		return err
+	}
+	if err := s.reveal(aggregateID, agg); err != nil {
+		return fmt.Errorf("decrypt snapshot err=%w", err)
+	}
+
+	return nil
+}
+
+// eventToFunc returns a factory creating a fresh instance of e's type on every call,
+// so decoded events never share the same underlying struct
 func eventToFunc(e interface{}) eventFunc {
+	typ := reflect.TypeOf(e)
+	if typ.Kind() != reflect.Ptr {
+		return func() interface{} {
+			return e
+		}
+	}
+
 	return func() interface{} {
-		return e
+		return reflect.New(typ.Elem()).Interface()
 	}
 }
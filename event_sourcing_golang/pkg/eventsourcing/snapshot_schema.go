@@ -0,0 +1,83 @@
+package eventsourcing
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// SnapshotSchemaVersioner is implemented by aggregates declaring the version of their snapshot shape.
+// Bumping it discards the existing snapshots, without it they are discarded whenever the fields change.
+type SnapshotSchemaVersioner interface {
+	SnapshotSchemaVersion() int
+}
+
+// fingerprints caches the fingerprint per aggregate type
+var fingerprints sync.Map
+
+// SnapshotSchema returns the schema the snapshots of agg are written with: "v<N>" when agg declares its version,
+// else a fingerprint of its serialized fields, their names, tags and types. A snapshot is only read back into an
+// aggregate of the same schema.
+func SnapshotSchema(agg Aggregate) string {
+	if v, ok := agg.(SnapshotSchemaVersioner); ok {
+		return "v" + strconv.Itoa(v.SnapshotSchemaVersion())
+	}
+
+	typ := reflect.TypeOf(agg)
+	if fp, ok := fingerprints.Load(typ); ok {
+		return fp.(string)
+	}
+
+	var b strings.Builder
+	writeTypeShape(&b, typ, make(map[reflect.Type]bool))
+	sum := sha256.Sum256([]byte(b.String()))
+	fp := hex.EncodeToString(sum[:8])
+	fingerprints.Store(typ, fp)
+	return fp
+}
+
+// writeTypeShape writes what of typ affects its encoding. Unexported fields are left out as codecs skip them,
+// and named types only count for their shape so renaming a type keeps its snapshots.
+func writeTypeShape(b *strings.Builder, typ reflect.Type, visiting map[reflect.Type]bool) {
+	switch typ.Kind() {
+	case reflect.Ptr:
+		b.WriteString("*")
+		writeTypeShape(b, typ.Elem(), visiting)
+	case reflect.Slice:
+		b.WriteString("[]")
+		writeTypeShape(b, typ.Elem(), visiting)
+	case reflect.Array:
+		b.WriteString("[" + strconv.Itoa(typ.Len()) + "]")
+		writeTypeShape(b, typ.Elem(), visiting)
+	case reflect.Map:
+		b.WriteString("map[")
+		writeTypeShape(b, typ.Key(), visiting)
+		b.WriteString("]")
+		writeTypeShape(b, typ.Elem(), visiting)
+	case reflect.Struct:
+		// a recursive type refers to itself by name
+		if visiting[typ] {
+			b.WriteString(typ.String())
+			return
+		}
+		visiting[typ] = true
+		defer delete(visiting, typ)
+
+		b.WriteString("{")
+		for i := 0; i < typ.NumField(); i++ {
+			f := typ.Field(i)
+			if !f.IsExported() && !f.Anonymous {
+				continue
+			}
+			b.WriteString(f.Name + " " + strconv.Quote(string(f.Tag)) + " ")
+			writeTypeShape(b, f.Type, visiting)
+			b.WriteString(";")
+		}
+		b.WriteString("}")
+	default:
+		b.WriteString(typ.Kind().String())
+	}
+}
@@ -0,0 +1,110 @@
+package eventsourcing
+
+import "fmt"
+
+// RawEvent is a stored event payload before it is decoded into its Go type
+type RawEvent struct {
+	EventType     string
+	SchemaVersion int
+	// Codec is the name of the codec Data is encoded with
+	Codec string
+	Data  []byte
+}
+
+// UpcastFunc upgrades a raw event by one schema version. It may also rename the event type,
+// the returned event then continues through the upcasters registered for the new type.
+type UpcastFunc = func(RawEvent) (RawEvent, error)
+
+func upcasterKey(aggType, eventType string, fromVersion int) string {
+	return fmt.Sprintf("%s_%s_v%d", aggType, eventType, fromVersion)
+}
+
+// RegisterUpcaster fails when the event registered as eventType for aggType does not declare a schema version
+// above fromVersion, see SchemaVersioned: its new events would be written at a version the upcaster runs on.
+func (s *serializer) RegisterUpcaster(aggType, eventType string, fromVersion int, fn UpcastFunc) error {
+	key := upcasterKey(aggType, eventType, fromVersion)
+	if _, ok := s.upcasters[key]; ok {
+		return fmt.Errorf("upcaster already registered for %s", key)
+	}
+
+	typeKey := aggType + "_" + eventType
+	latest := max(s.latestSchema[typeKey], fromVersion+1)
+	if f, ok := s.eventRegister[typeKey]; ok && f != nil && !s.aliases[typeKey] {
+		if err := checkSchemaVersion(typeKey, f(), latest); err != nil {
+			return err
+		}
+	}
+
+	s.upcasters[key] = fn
+	s.latestSchema[typeKey] = latest
+	return nil
+}
+
+// checkSchemaVersion fails when event declares a schema version below latest, the version its upcasters lead to
+func checkSchemaVersion(typeKey string, event interface{}, latest int) error {
+	if v := schemaVersionOf(event); v < latest {
+		return fmt.Errorf("%T is written at schema version %d but upcasters of %s lead to version %d, "+
+			"its SchemaVersion method must return %d", event, v, typeKey, latest, latest)
+	}
+	return nil
+}
+
+// Upcast runs the chain of upcasters registered for the event until it reaches its latest schema
+func (s *serializer) Upcast(aggType string, raw RawEvent) (RawEvent, error) {
+	if raw.SchemaVersion == 0 {
+		// rows written before schema versioning existed
+		raw.SchemaVersion = 1
+	}
+
+	for {
+		fn, ok := s.upcasters[upcasterKey(aggType, raw.EventType, raw.SchemaVersion)]
+		if !ok {
+			return raw, nil
+		}
+
+		from := raw.SchemaVersion
+		next, err := fn(raw)
+		if err != nil {
+			return raw, fmt.Errorf("upcast %s_%s from v%d err=%w", aggType, raw.EventType, from, err)
+		}
+		if next.SchemaVersion <= from {
+			next.SchemaVersion = from + 1
+		}
+
+		raw = next
+	}
+}
+
+// StructUpcaster builds an UpcastFunc from a conversion between the old and the new payload struct.
+// The event type becomes the name of New, so it also covers renaming or replacing an event.
+// The payload is re-encoded with the codec it was stored with.
+func StructUpcaster[Old, New any](s Serializer, fn func(*Old) (*New, error)) UpcastFunc {
+	return func(raw RawEvent) (RawEvent, error) {
+		c, ok := s.Codec(raw.Codec)
+		if !ok {
+			return raw, fmt.Errorf("codec %s is not registered", raw.Codec)
+		}
+
+		old := new(Old)
+		if err := c.Unmarshal(raw.Data, old); err != nil {
+			return raw, err
+		}
+
+		upgraded, err := fn(old)
+		if err != nil {
+			return raw, err
+		}
+
+		data, err := c.Marshal(upgraded)
+		if err != nil {
+			return raw, err
+		}
+
+		return RawEvent{
+			EventType:     s.EventTypeName(upgraded),
+			SchemaVersion: raw.SchemaVersion + 1,
+			Codec:         c.Name(),
+			Data:          data,
+		}, nil
+	}
+}
@@ -0,0 +1,136 @@
+package eventsourcing_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"event_sourcing_golang/pkg/eventsourcing"
+)
+
+// Renamed is at schema version 1 with Name and version 2 with First and Last
+type Renamed struct {
+	First string
+	Last  string
+}
+
+func (Renamed) SchemaVersion() int { return 2 }
+
+type renamedV1 struct{ Name string }
+
+// Unversioned forgot to declare its schema version after its upcaster was added
+type Unversioned struct {
+	First string
+	Last  string
+}
+
+type Person struct {
+	eventsourcing.AggregateRoot
+	First string
+}
+
+func (p *Person) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&Renamed{})
+}
+
+func (p *Person) Transition(e eventsourcing.Event) error {
+	if v, ok := e.Data.(*Renamed); ok {
+		p.First = v.First
+	}
+	return nil
+}
+
+type Forgetful struct {
+	eventsourcing.AggregateRoot
+}
+
+func (f *Forgetful) RegisterEvents(reg eventsourcing.RegisterEventsFunc) error {
+	return reg(&Unversioned{})
+}
+
+func (f *Forgetful) Transition(eventsourcing.Event) error { return nil }
+
+func splitName(s eventsourcing.Serializer) eventsourcing.UpcastFunc {
+	return eventsourcing.StructUpcaster(s, func(old *renamedV1) (*Renamed, error) {
+		first, last, _ := strings.Cut(old.Name, " ")
+		return &Renamed{First: first, Last: last}, nil
+	})
+}
+
+func TestUpcasterRunsOnOldEventsOnly(t *testing.T) {
+	s := eventsourcing.NewSerializer()
+	if err := s.RegisterAggregate(&Person{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterUpcaster("Person", "Renamed", 1, splitName(s)); err != nil {
+		t.Fatal(err)
+	}
+
+	old := eventsourcing.Event{AggregateID: "p-1", EventType: "Renamed", SchemaVersion: 1}
+	if err := s.UnmarshalEvent("Person", &old, "json", []byte(`{"Name":"Ada Lovelace"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := old.Data.(*Renamed); got.First != "Ada" || got.Last != "Lovelace" || old.SchemaVersion != 2 {
+		t.Fatalf("upcast event=%+v schema=%d, want Ada Lovelace at 2", got, old.SchemaVersion)
+	}
+
+	// a new event is written at version 2 and read as is
+	p := &Person{}
+	_ = p.SetID("p-1")
+	if err := p.ApplyChange(p, &Renamed{First: "Grace", Last: "Hopper"}); err != nil {
+		t.Fatal(err)
+	}
+	e := p.Events()[0]
+	e.AggregateType = "Person"
+	codec, data, err := s.EncodeEvent(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := eventsourcing.Event{AggregateID: "p-1", EventType: e.EventType, SchemaVersion: e.SchemaVersion}
+	if err := s.UnmarshalEvent("Person", &stored, codec, data); err != nil {
+		t.Fatal(err)
+	}
+	if got := stored.Data.(*Renamed); got.First != "Grace" || got.Last != "Hopper" {
+		t.Fatalf("new event read as %+v, want Grace Hopper", got)
+	}
+}
+
+func TestUpcasterRequiresSchemaVersion(t *testing.T) {
+	upcaster := func(raw eventsourcing.RawEvent) (eventsourcing.RawEvent, error) {
+		var v renamedV1
+		if err := json.Unmarshal(raw.Data, &v); err != nil {
+			return raw, err
+		}
+		raw.Data, _ = json.Marshal(Unversioned{First: v.Name})
+		return raw, nil
+	}
+
+	s := eventsourcing.NewSerializer()
+	if err := s.RegisterAggregate(&Forgetful{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterUpcaster("Forgetful", "Unversioned", 1, upcaster); err == nil {
+		t.Fatal("upcaster from v1 registered for an event written at v1")
+	}
+
+	// the upcaster registered first, the aggregate registering the event fails
+	s = eventsourcing.NewSerializer()
+	if err := s.RegisterUpcaster("Forgetful", "Unversioned", 1, upcaster); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterAggregate(&Forgetful{}); err == nil {
+		t.Fatal("event written at v1 registered after an upcaster from v1")
+	}
+
+	// the whole chain counts, an event at v2 does not cover an upcaster from v2
+	s = eventsourcing.NewSerializer()
+	if err := s.RegisterAggregate(&Person{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterUpcaster("Person", "Renamed", 1, splitName(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterUpcaster("Person", "Renamed", 2, upcaster); err == nil {
+		t.Fatal("upcaster from v2 registered for an event written at v2")
+	}
+}